@@ -23,16 +23,15 @@ func main() {
 	req.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2, 3.3.3.3, 192.168.1.1")
 	req.RemoteAddr = "192.168.1.2:8888"
 
-	clientIP := strat.ClientIP(req.Header, req.RemoteAddr)
-	if clientIP == "" {
-		// This should probably result in the request being denied
-		log.Fatal("strat.ClientIP found no IP")
+	// An IPv6 client typically controls a whole /64, so we limit by network prefix
+	// rather than by exact IP. (This also discards any zone.)
+	limitKey, err := realclientip.LimiterKeyPrefix(strat, req.Header, req.RemoteAddr, 0, 0)
+	if err != nil {
+		// If no IP was found, this should probably result in the request being denied
+		log.Fatal("realclientip.LimiterKeyPrefix failed: ", err)
 	}
 
-	// We don't want to include the zone in our limiter key
-	clientIP, _ = realclientip.SplitHostZone(clientIP)
-
-	if httpErr := tollbooth.LimitByKeys(lmt, []string{clientIP}); httpErr != nil {
+	if httpErr := tollbooth.LimitByKeys(lmt, []string{limitKey}); httpErr != nil {
 		fmt.Println("We got limited!?!", httpErr)
 	} else {
 		fmt.Println("Request allowed")
@@ -0,0 +1,896 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// StrategyFromString creates a strategy from a compact string description, which is
+// useful when the strategy is configured via an environment variable or command-line
+// flag. The format is the strategy name, followed by its colon-separated arguments:
+//
+//	remote-addr
+//	single-header:<header>
+//	single-headers:<header>,<header>,...
+//	google-frontend
+//	heroku
+//	gcp-external-lb
+//	fly
+//	leftmost-non-private:<header>
+//	rightmost-non-private:<header>
+//	leftmost:<header>
+//	rightmost:<header>
+//	leftmost-trusted-count:<header>:<count>
+//	rightmost-trusted-count:<header>:<count>
+//	rightmost-trusted-range:<header>:<range>,<range>,...
+//	proxy-protocol:<header>
+//	chain:<strategy>|<strategy>|...
+//
+// For example: "rightmost-trusted-count:Forwarded:2" or
+// "chain:leftmost-non-private:X-Forwarded-For|remote-addr".
+// Strategy names are case-insensitive. Ranges are in any form accepted by
+// AddressesAndRangesToIPNets. Chains cannot be nested.
+// The arguments are validated in the same way as by the strategy constructors.
+func StrategyFromString(s string) (Strategy, error) {
+	name, args, _ := strings.Cut(strings.TrimSpace(s), ":")
+	if strings.EqualFold(name, "chain") {
+		if args == "" {
+			return nil, fmt.Errorf("StrategyFromString: chain must have at least one strategy")
+		}
+
+		var strategies []Strategy
+		for _, sub := range strings.Split(args, "|") {
+			subName, _, _ := strings.Cut(strings.TrimSpace(sub), ":")
+			if strings.EqualFold(subName, "chain") {
+				return nil, fmt.Errorf("StrategyFromString: chains cannot be nested")
+			}
+
+			strat, err := StrategyFromString(sub)
+			if err != nil {
+				return nil, err
+			}
+			strategies = append(strategies, strat)
+		}
+		return NewChainStrategy(strategies...), nil
+	}
+
+	strat, err := strategyFromNameAndArgs(strings.ToLower(name), args)
+	if err != nil {
+		return nil, fmt.Errorf("StrategyFromString: %q: %w", s, err)
+	}
+	return strat, nil
+}
+
+// strategyFromNameAndArgs creates the non-chain strategy described by name (which must
+// be lowercase) and its colon-separated args.
+func strategyFromNameAndArgs(name, args string) (Strategy, error) {
+	switch name {
+	case "remote-addr":
+		if args != "" {
+			return nil, fmt.Errorf("remote-addr does not take arguments")
+		}
+		return RemoteAddrStrategy{}, nil
+
+	case "google-frontend":
+		if args != "" {
+			return nil, fmt.Errorf("google-frontend does not take arguments")
+		}
+		return NewGoogleFrontendStrategy(), nil
+
+	case "heroku":
+		if args != "" {
+			return nil, fmt.Errorf("heroku does not take arguments")
+		}
+		return NewHerokuStrategy(), nil
+
+	case "gcp-external-lb":
+		if args != "" {
+			return nil, fmt.Errorf("gcp-external-lb does not take arguments")
+		}
+		return NewGCPExternalLBStrategy(), nil
+
+	case "fly":
+		if args != "" {
+			return nil, fmt.Errorf("fly does not take arguments")
+		}
+		return NewFlyClientIPStrategy(), nil
+
+	case "single-header":
+		return NewSingleIPHeaderStrategy(args)
+
+	case "single-headers":
+		return NewSingleIPHeadersStrategy(strings.Split(args, ",")...)
+
+	case "leftmost-non-private":
+		return NewLeftmostNonPrivateStrategy(args)
+
+	case "rightmost-non-private":
+		return NewRightmostNonPrivateStrategy(args)
+
+	case "leftmost":
+		return NewLeftmostStrategy(args)
+
+	case "rightmost":
+		return NewRightmostStrategy(args)
+
+	case "leftmost-trusted-count", "rightmost-trusted-count":
+		headerName, countStr, found := strings.Cut(args, ":")
+		if !found {
+			return nil, fmt.Errorf("%s requires a header and a count", name)
+		}
+
+		count, err := strconv.Atoi(countStr)
+		if err != nil {
+			return nil, fmt.Errorf("bad count %q: %w", countStr, err)
+		}
+
+		if name == "leftmost-trusted-count" {
+			return NewLeftmostTrustedCountStrategy(headerName, count)
+		}
+		return NewRightmostTrustedCountStrategy(headerName, count)
+
+	case "rightmost-trusted-range":
+		// The ranges may contain colons (IPv6), so only split off the header
+		headerName, rangesStr, found := strings.Cut(args, ":")
+		if !found || rangesStr == "" {
+			return nil, fmt.Errorf("rightmost-trusted-range requires a header and ranges")
+		}
+
+		trustedRanges, err := AddressesAndRangesToIPNets(strings.Split(rangesStr, ",")...)
+		if err != nil {
+			return nil, err
+		}
+		return NewRightmostTrustedRangeStrategy(headerName, trustedRanges)
+
+	case "proxy-protocol":
+		return NewProxyProtocolStrategy(args)
+	}
+
+	return nil, fmt.Errorf("unknown strategy %q", name)
+}
+
+// strategyConfigJSON is the JSON representation of a strategy's configuration. The Type
+// values are the same as the strategy names used by StrategyFromString.
+type strategyConfigJSON struct {
+	Type                  string            `json:"type"`
+	Header                string            `json:"header,omitempty"`
+	Headers               []string          `json:"headers,omitempty"`
+	Count                 int               `json:"count,omitempty"`
+	Ranges                []string          `json:"ranges,omitempty"`
+	PrivateRanges         *[]string         `json:"privateRanges,omitempty"`
+	RequireHTTPS          bool              `json:"requireHTTPS,omitempty"`
+	Recursive             *bool             `json:"recursive,omitempty"`
+	ContiguousTrust       bool              `json:"contiguousTrust,omitempty"`
+	PrivateRangesTrusted  bool              `json:"privateRangesTrusted,omitempty"`
+	Zone                  *bool             `json:"zone,omitempty"`
+	MappedIPv6            bool              `json:"mappedIPv6,omitempty"`
+	RejectReserved        bool              `json:"rejectReserved,omitempty"`
+	Family                string            `json:"family,omitempty"`
+	RejectMultipleHeaders bool              `json:"rejectMultipleHeaders,omitempty"`
+	Unspecified           bool              `json:"unspecified,omitempty"`
+	StrictForwarded       bool              `json:"strictForwarded,omitempty"`
+	LenientSeparators     bool              `json:"lenientSeparators,omitempty"`
+	Syntax                string            `json:"syntax,omitempty"`
+	Strategies            []json.RawMessage `json:"strategies,omitempty"`
+	Strategy              json.RawMessage   `json:"strategy,omitempty"`
+}
+
+// jsonConfigurer is implemented by the strategies that can be marshalled to JSON.
+type jsonConfigurer interface {
+	configJSON() (strategyConfigJSON, error)
+}
+
+// StrategyConfig wraps a Strategy so that it can be marshalled to and unmarshalled from
+// JSON, without knowing the concrete strategy type in advance. It is intended to be
+// embedded in an application's configuration. The JSON is an object with a "type" field
+// that determines the strategy, and the strategy's parameters. For example:
+//
+//	{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8"]}
+//
+// The types are the same as the strategy names accepted by StrategyFromString, plus
+// "trusted-peer" (TrustedPeerStrategy), "blocklist" (BlocklistStrategy), "max-hops"
+// (MaxHopsStrategy), "consensus" (ConsensusStrategy), and "require-all"
+// (RequireAllStrategy). The other fields are:
+//
+//	header        string  The header name, for strategies that use one header.
+//	headers       array   The header names, for single-headers.
+//	count         number  The trusted count, for the trusted-count strategies, or the
+//	                      maximum number of hops, for max-hops.
+//	ranges        array   The trusted ranges, for rightmost-trusted-range, in any form
+//	                      accepted by AddressesAndRangesToIPNets. Required (and must
+//	                      not be empty) unless privateRangesTrusted is true, as a
+//	                      configuration with no trusted ranges is almost certainly
+//	                      a mistake.
+//	privateRanges array   Optional private ranges for the non-private strategies, as
+//	                      with NewLeftmostNonPrivateStrategyWithRanges. If absent,
+//	                      the default ranges are used; an empty array means that no
+//	                      ranges are private.
+//	requireHTTPS  bool    For rightmost-trusted-range; see WithRequireHTTPS.
+//	recursive     bool    For rightmost-trusted-range; see WithRecursive. Defaults to
+//	                      true.
+//	contiguousTrust
+//	              bool    For rightmost-trusted-range; see WithContiguousTrust.
+//	privateRangesTrusted
+//	              bool    For rightmost-trusted-range; see WithPrivateRangesTrusted.
+//	                      The private ranges are included in the marshalled ranges,
+//	                      so this is never marshalled.
+//	zone          bool    For the strategies that derive the IP from a header (other
+//	                      than heroku, gcp-external-lb, and single-headers); see
+//	                      WithZone.
+//	                      Defaults to true.
+//	mappedIPv6    bool    For the same strategies as zone; see WithMappedIPv6.
+//	rejectReserved
+//	              bool    For the same strategies as zone; see WithRejectReserved.
+//	family        string  For leftmost-non-private and leftmost; "ipv4", "ipv6", or
+//	                      "any" (the default). See WithFamily.
+//	rejectMultipleHeaders
+//	              bool    For single-header, google-frontend, and fly; see
+//	                      WithRejectMultipleHeaders.
+//	unspecified   bool    For single-header, google-frontend, and fly; see
+//	                      WithUnspecified.
+//	strictForwarded
+//	              bool    For the strategies that take a list header, with the Forwarded
+//	                      header; see WithStrictForwarded.
+//	lenientSeparators
+//	              bool    For the strategies that take a list header, with the
+//	                      X-Forwarded-For header; see WithLenientSeparators.
+//	syntax        string  For the strategies that take a list header; "xff",
+//	                      "forwarded", or "auto" (the default). See WithHeaderSyntax.
+//	strategies    array   The sub-strategy objects, for chain, consensus, and
+//	                      require-all.
+//	strategy      object  The inner strategy object, for trusted-peer, blocklist, and
+//	                      max-hops (the first two also use "ranges", for the trusted
+//	                      proxy ranges or the blocked ranges).
+//
+// Unmarshalling performs the same validation as the strategy constructors, plus that of
+// the strategy's Validate method, and returns their errors.
+// The concrete strategy types can also be marshalled and unmarshalled directly (except
+// ReloadableTrustedRangeStrategy, as its ranges are expected to come from elsewhere).
+type StrategyConfig struct {
+	Strategy
+}
+
+// MarshalJSON implements json.Marshaler.
+func (c StrategyConfig) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(c.Strategy)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *StrategyConfig) UnmarshalJSON(b []byte) error {
+	strat, err := strategyFromJSON(b)
+	if err != nil {
+		return err
+	}
+	c.Strategy = strat
+	return nil
+}
+
+// marshalStrategyJSON marshals strat, which must be one of the strategies in this package.
+func marshalStrategyJSON(strat Strategy) ([]byte, error) {
+	cfg, err := strategyConfig(strat)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cfg)
+}
+
+// strategyConfig returns the JSON configuration of strat, which must be one of the
+// strategies in this package.
+func strategyConfig(strat Strategy) (strategyConfigJSON, error) {
+	configurer, ok := strat.(jsonConfigurer)
+	if !ok {
+		return strategyConfigJSON{}, fmt.Errorf("strategy of type %T cannot be marshalled to JSON", strat)
+	}
+	return configurer.configJSON()
+}
+
+// unmarshalStrategyJSON unmarshals b into strat, which must be of the concrete strategy
+// type described by b.
+func unmarshalStrategyJSON[T Strategy](b []byte, strat *T) error {
+	parsed, err := strategyFromJSON(b)
+	if err != nil {
+		return err
+	}
+
+	typed, ok := parsed.(T)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T from JSON into %T", parsed, *strat)
+	}
+	*strat = typed
+	return nil
+}
+
+// strategyFromJSON creates the strategy described by the JSON in b.
+func strategyFromJSON(b []byte) (Strategy, error) {
+	var cfg strategyConfigJSON
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Type == "chain" || cfg.Type == "consensus" || cfg.Type == "require-all" {
+		var strategies []Strategy
+		for _, sub := range cfg.Strategies {
+			strat, err := strategyFromJSON(sub)
+			if err != nil {
+				return nil, err
+			}
+			strategies = append(strategies, strat)
+		}
+		if len(strategies) == 0 {
+			return nil, fmt.Errorf("%s must have at least one strategy", cfg.Type)
+		}
+		switch cfg.Type {
+		case "consensus":
+			return NewConsensusStrategy(strategies...), nil
+		case "require-all":
+			return NewRequireAllStrategy(strategies...), nil
+		}
+		return NewChainStrategy(strategies...), nil
+	}
+
+	var trustedRanges, privateRanges []net.IPNet
+	var err error
+	if cfg.Ranges != nil {
+		if trustedRanges, err = AddressesAndRangesToIPNets(cfg.Ranges...); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PrivateRanges != nil {
+		if privateRanges, err = AddressesAndRangesToIPNets(*cfg.PrivateRanges...); err != nil {
+			return nil, err
+		}
+		if privateRanges == nil {
+			// An explicitly empty list means that nothing is private, whereas nil means
+			// the default ranges
+			privateRanges = []net.IPNet{}
+		}
+	}
+
+	var opts []Option
+	if cfg.Zone != nil {
+		opts = append(opts, WithZone(*cfg.Zone))
+	}
+	if cfg.MappedIPv6 {
+		opts = append(opts, WithMappedIPv6(true))
+	}
+	if cfg.RejectReserved {
+		opts = append(opts, WithRejectReserved(true))
+	}
+	if cfg.Family != "" {
+		family, err := parseFamily(cfg.Family)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithFamily(family))
+	}
+	if cfg.StrictForwarded {
+		opts = append(opts, WithStrictForwarded(true))
+	}
+	if cfg.LenientSeparators {
+		opts = append(opts, WithLenientSeparators(true))
+	}
+	if cfg.Syntax != "" {
+		syntax, err := parseHeaderSyntax(cfg.Syntax)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithHeaderSyntax(syntax))
+	}
+
+	var strat Strategy
+	switch cfg.Type {
+	case "remote-addr":
+		strat = RemoteAddrStrategy{}
+	case "google-frontend":
+		opts = append(opts, WithRejectMultipleHeaders(cfg.RejectMultipleHeaders), WithUnspecified(cfg.Unspecified))
+		strat = NewGoogleFrontendStrategy(opts...)
+	case "heroku":
+		strat = NewHerokuStrategy()
+	case "gcp-external-lb":
+		strat = NewGCPExternalLBStrategy()
+	case "fly":
+		opts = append(opts, WithRejectMultipleHeaders(cfg.RejectMultipleHeaders), WithUnspecified(cfg.Unspecified))
+		strat = NewFlyClientIPStrategy(opts...)
+	case "single-header":
+		opts = append(opts, WithRejectMultipleHeaders(cfg.RejectMultipleHeaders), WithUnspecified(cfg.Unspecified))
+		strat, err = NewSingleIPHeaderStrategy(cfg.Header, opts...)
+	case "single-headers":
+		strat, err = NewSingleIPHeadersStrategy(cfg.Headers...)
+	case "leftmost-non-private":
+		strat, err = NewLeftmostNonPrivateStrategyWithRanges(cfg.Header, privateRanges, opts...)
+	case "rightmost-non-private":
+		strat, err = NewRightmostNonPrivateStrategyWithRanges(cfg.Header, privateRanges, opts...)
+	case "leftmost":
+		strat, err = NewLeftmostStrategy(cfg.Header, opts...)
+	case "rightmost":
+		strat, err = NewRightmostStrategy(cfg.Header, opts...)
+	case "leftmost-trusted-count":
+		strat, err = NewLeftmostTrustedCountStrategy(cfg.Header, cfg.Count, opts...)
+	case "rightmost-trusted-count":
+		strat, err = NewRightmostTrustedCountStrategy(cfg.Header, cfg.Count, opts...)
+	case "rightmost-trusted-range":
+		opts = append(opts, WithRequireHTTPS(cfg.RequireHTTPS), WithContiguousTrust(cfg.ContiguousTrust),
+			WithPrivateRangesTrusted(cfg.PrivateRangesTrusted))
+		if cfg.Recursive != nil {
+			opts = append(opts, WithRecursive(*cfg.Recursive))
+		}
+		if len(trustedRanges) == 0 && !cfg.PrivateRangesTrusted {
+			return nil, fmt.Errorf("rightmost-trusted-range requires ranges")
+		}
+		strat, err = NewRightmostTrustedRangeStrategy(cfg.Header, trustedRanges, opts...)
+	case "proxy-protocol":
+		strat, err = NewProxyProtocolStrategy(cfg.Header, opts...)
+	case "trusted-peer":
+		if cfg.Strategy == nil {
+			return nil, fmt.Errorf("trusted-peer requires a strategy")
+		}
+		var inner Strategy
+		if inner, err = strategyFromJSON(cfg.Strategy); err != nil {
+			return nil, err
+		}
+		strat, err = NewTrustedPeerStrategy(inner, trustedRanges)
+	case "blocklist":
+		if cfg.Strategy == nil {
+			return nil, fmt.Errorf("blocklist requires a strategy")
+		}
+		var inner Strategy
+		if inner, err = strategyFromJSON(cfg.Strategy); err != nil {
+			return nil, err
+		}
+		strat, err = NewBlocklistStrategy(inner, trustedRanges)
+	case "max-hops":
+		if cfg.Strategy == nil {
+			return nil, fmt.Errorf("max-hops requires a strategy")
+		}
+		var inner Strategy
+		if inner, err = strategyFromJSON(cfg.Strategy); err != nil {
+			return nil, err
+		}
+		strat, err = NewMaxHopsStrategy(inner, cfg.Header, cfg.Count)
+	default:
+		return nil, fmt.Errorf("unknown strategy type %q", cfg.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A backstop: Validate re-checks the invariants that the constructors enforce
+	if err := strat.Validate(); err != nil {
+		return nil, err
+	}
+	return strat, nil
+}
+
+// ipNetStrings converts ipNets to their string representations, for marshalling.
+func ipNetStrings(ipNets []net.IPNet) []string {
+	if ipNets == nil {
+		return nil
+	}
+
+	result := make([]string, len(ipNets))
+	for i := range ipNets {
+		result[i] = ipNets[i].String()
+	}
+	return result
+}
+
+// privateRangesJSON returns the JSON representation of a non-private strategy's
+// privateRanges. nil (the default ranges) is omitted, but an empty list is kept, as it
+// means that nothing is private.
+func privateRangesJSON(privateRanges []net.IPNet) *[]string {
+	if privateRanges == nil {
+		return nil
+	}
+	strs := ipNetStrings(privateRanges)
+	return &strs
+}
+
+// parseFamily parses the JSON representation of a Family, which is case-insensitive.
+func parseFamily(s string) (Family, error) {
+	for _, family := range []Family{FamilyAny, FamilyIPv4, FamilyIPv6} {
+		if strings.EqualFold(s, family.String()) {
+			return family, nil
+		}
+	}
+	return FamilyAny, fmt.Errorf("unknown family %q", s)
+}
+
+// familyJSON returns the Family config value for a strategy's family setting. It is
+// empty for the default, so that it's omitted.
+func familyJSON(family Family) string {
+	if family == FamilyAny {
+		return ""
+	}
+	return strings.ToLower(family.String())
+}
+
+// parseHeaderSyntax parses the JSON representation of a HeaderSyntax, which is
+// case-insensitive.
+func parseHeaderSyntax(s string) (HeaderSyntax, error) {
+	for _, syntax := range []HeaderSyntax{HeaderSyntaxAuto, HeaderSyntaxXFF, HeaderSyntaxForwarded} {
+		if strings.EqualFold(s, syntax.String()) {
+			return syntax, nil
+		}
+	}
+	return HeaderSyntaxAuto, fmt.Errorf("unknown header syntax %q", s)
+}
+
+// syntaxJSON returns the Syntax config value for a strategy's syntax setting. It is
+// empty for the default, so that it's omitted.
+func syntaxJSON(syntax HeaderSyntax) string {
+	if syntax == HeaderSyntaxAuto {
+		return ""
+	}
+	return syntax.String()
+}
+
+// zoneJSON returns the Zone config value for a strategy's stripZone setting. It is nil
+// for the default, so that it's omitted.
+func zoneJSON(stripZone bool) *bool {
+	if !stripZone {
+		return nil
+	}
+	keep := false
+	return &keep
+}
+
+// setConfigJSON sets the config values for lo's settings in cfg.
+func (lo listOptions) setConfigJSON(cfg *strategyConfigJSON) {
+	cfg.Zone = zoneJSON(lo.stripZone)
+	cfg.MappedIPv6 = lo.keepMapped
+	cfg.RejectReserved = lo.rejectReserved
+	cfg.StrictForwarded = lo.strictForwarded
+	cfg.LenientSeparators = lo.lenientSeparators
+	cfg.Syntax = syntaxJSON(lo.syntax)
+}
+
+// marshalStrategiesJSON marshals the sub-strategies of a chain, consensus, or
+// require-all.
+func marshalStrategiesJSON(strategies []Strategy) ([]json.RawMessage, error) {
+	var result []json.RawMessage
+	for _, sub := range strategies {
+		b, err := marshalStrategyJSON(sub)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+func (strat ChainStrategy) configJSON() (strategyConfigJSON, error) {
+	strategies, err := marshalStrategiesJSON(strat.strategies)
+	if err != nil {
+		return strategyConfigJSON{}, err
+	}
+	return strategyConfigJSON{Type: "chain", Strategies: strategies}, nil
+}
+
+func (strat ConsensusStrategy) configJSON() (strategyConfigJSON, error) {
+	strategies, err := marshalStrategiesJSON(strat.strategies)
+	if err != nil {
+		return strategyConfigJSON{}, err
+	}
+	return strategyConfigJSON{Type: "consensus", Strategies: strategies}, nil
+}
+
+func (strat RequireAllStrategy) configJSON() (strategyConfigJSON, error) {
+	strategies, err := marshalStrategiesJSON(strat.strategies)
+	if err != nil {
+		return strategyConfigJSON{}, err
+	}
+	return strategyConfigJSON{Type: "require-all", Strategies: strategies}, nil
+}
+
+func (strat RemoteAddrStrategy) configJSON() (strategyConfigJSON, error) {
+	return strategyConfigJSON{Type: "remote-addr"}, nil
+}
+
+func (strat SingleIPHeaderStrategy) configJSON() (strategyConfigJSON, error) {
+	return strategyConfigJSON{
+		Type:                  "single-header",
+		Header:                strat.headerName,
+		Zone:                  zoneJSON(strat.stripZone),
+		MappedIPv6:            strat.keepMapped,
+		RejectReserved:        strat.rejectReserved,
+		RejectMultipleHeaders: strat.rejectMultipleHeaders,
+		Unspecified:           strat.allowUnspecified,
+	}, nil
+}
+
+func (strat SingleIPHeadersStrategy) configJSON() (strategyConfigJSON, error) {
+	return strategyConfigJSON{Type: "single-headers", Headers: strat.headerNames}, nil
+}
+
+func (strat LeftmostNonPrivateStrategy) configJSON() (strategyConfigJSON, error) {
+	cfg := strategyConfigJSON{
+		Type:          "leftmost-non-private",
+		Header:        strat.headerName,
+		PrivateRanges: privateRangesJSON(strat.privateRanges),
+		Family:        familyJSON(strat.family),
+	}
+	strat.listOptions.setConfigJSON(&cfg)
+	return cfg, nil
+}
+
+func (strat RightmostNonPrivateStrategy) configJSON() (strategyConfigJSON, error) {
+	cfg := strategyConfigJSON{
+		Type:          "rightmost-non-private",
+		Header:        strat.headerName,
+		PrivateRanges: privateRangesJSON(strat.privateRanges),
+	}
+	strat.listOptions.setConfigJSON(&cfg)
+	return cfg, nil
+}
+
+func (strat LeftmostStrategy) configJSON() (strategyConfigJSON, error) {
+	cfg := strategyConfigJSON{
+		Type:   "leftmost",
+		Header: strat.headerName,
+		Family: familyJSON(strat.family),
+	}
+	strat.listOptions.setConfigJSON(&cfg)
+	return cfg, nil
+}
+
+func (strat RightmostStrategy) configJSON() (strategyConfigJSON, error) {
+	cfg := strategyConfigJSON{
+		Type:   "rightmost",
+		Header: strat.headerName,
+	}
+	strat.listOptions.setConfigJSON(&cfg)
+	return cfg, nil
+}
+
+func (strat LeftmostTrustedCountStrategy) configJSON() (strategyConfigJSON, error) {
+	cfg := strategyConfigJSON{
+		Type:   "leftmost-trusted-count",
+		Header: strat.headerName,
+		Count:  strat.trustedCount,
+	}
+	strat.listOptions.setConfigJSON(&cfg)
+	return cfg, nil
+}
+
+func (strat RightmostTrustedCountStrategy) configJSON() (strategyConfigJSON, error) {
+	cfg := strategyConfigJSON{
+		Type:   "rightmost-trusted-count",
+		Header: strat.headerName,
+		Count:  strat.trustedCount,
+	}
+	strat.listOptions.setConfigJSON(&cfg)
+	return cfg, nil
+}
+
+func (strat RightmostTrustedRangeStrategy) configJSON() (strategyConfigJSON, error) {
+	cfg := strategyConfigJSON{
+		Type:            "rightmost-trusted-range",
+		Header:          strat.headerName,
+		Ranges:          ipNetStrings(strat.ranges()),
+		RequireHTTPS:    strat.requireHTTPS,
+		ContiguousTrust: strat.contiguousTrust,
+	}
+	strat.listOptions.setConfigJSON(&cfg)
+	if strat.nonRecursive {
+		recursive := false
+		cfg.Recursive = &recursive
+	}
+	return cfg, nil
+}
+
+func (strat ProxyProtocolStrategy) configJSON() (strategyConfigJSON, error) {
+	return strategyConfigJSON{Type: "proxy-protocol", Header: strat.headerName, Zone: zoneJSON(strat.stripZone), MappedIPv6: strat.keepMapped}, nil
+}
+
+func (strat TrustedPeerStrategy) configJSON() (strategyConfigJSON, error) {
+	inner, err := marshalStrategyJSON(strat.inner)
+	if err != nil {
+		return strategyConfigJSON{}, err
+	}
+	return strategyConfigJSON{
+		Type:     "trusted-peer",
+		Ranges:   ipNetStrings(strat.trustedProxyRanges),
+		Strategy: inner,
+	}, nil
+}
+
+func (strat BlocklistStrategy) configJSON() (strategyConfigJSON, error) {
+	inner, err := marshalStrategyJSON(strat.inner)
+	if err != nil {
+		return strategyConfigJSON{}, err
+	}
+	return strategyConfigJSON{
+		Type:     "blocklist",
+		Ranges:   ipNetStrings(strat.blockedRanges),
+		Strategy: inner,
+	}, nil
+}
+
+func (strat MaxHopsStrategy) configJSON() (strategyConfigJSON, error) {
+	inner, err := marshalStrategyJSON(strat.inner)
+	if err != nil {
+		return strategyConfigJSON{}, err
+	}
+	return strategyConfigJSON{
+		Type:     "max-hops",
+		Header:   strat.headerName,
+		Count:    strat.maxHops,
+		Strategy: inner,
+	}, nil
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat ChainStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *ChainStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat ConsensusStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *ConsensusStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat RequireAllStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *RequireAllStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat RemoteAddrStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *RemoteAddrStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat SingleIPHeaderStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *SingleIPHeaderStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat SingleIPHeadersStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *SingleIPHeadersStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat LeftmostNonPrivateStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *LeftmostNonPrivateStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat RightmostNonPrivateStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *RightmostNonPrivateStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat LeftmostStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *LeftmostStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat RightmostStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *RightmostStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat LeftmostTrustedCountStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *LeftmostTrustedCountStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat RightmostTrustedCountStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *RightmostTrustedCountStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat RightmostTrustedRangeStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *RightmostTrustedRangeStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat ProxyProtocolStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *ProxyProtocolStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat TrustedPeerStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *TrustedPeerStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat BlocklistStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *BlocklistStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
+
+// MarshalJSON implements json.Marshaler. See StrategyConfig for the format.
+func (strat MaxHopsStrategy) MarshalJSON() ([]byte, error) {
+	return marshalStrategyJSON(strat)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. See StrategyConfig for the format.
+func (strat *MaxHopsStrategy) UnmarshalJSON(b []byte) error {
+	return unmarshalStrategyJSON(b, strat)
+}
@@ -0,0 +1,648 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestStrategyFromString(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Strategy
+		wantErr bool
+	}{
+		{
+			name: "remote-addr",
+			s:    "remote-addr",
+			want: RemoteAddrStrategy{},
+		},
+		{
+			name: "google-frontend",
+			s:    "google-frontend",
+			want: NewGoogleFrontendStrategy(),
+		},
+		{
+			name: "heroku",
+			s:    "Heroku",
+			want: NewHerokuStrategy(),
+		},
+		{
+			name: "fly",
+			s:    "Fly",
+			want: NewFlyClientIPStrategy(),
+		},
+		{
+			name:    "Error: fly with arguments",
+			s:       "fly:Fly-Client-IP",
+			wantErr: true,
+		},
+		{
+			name:    "Error: heroku with arguments",
+			s:       "heroku:X-Forwarded-For",
+			wantErr: true,
+		},
+		{
+			name: "gcp-external-lb",
+			s:    "gcp-external-lb",
+			want: NewGCPExternalLBStrategy(),
+		},
+		{
+			name:    "Error: gcp-external-lb with arguments",
+			s:       "gcp-external-lb:2",
+			wantErr: true,
+		},
+		{
+			name: "single-header",
+			s:    "single-header:CF-Connecting-IP",
+			want: Must(NewSingleIPHeaderStrategy("Cf-Connecting-Ip")),
+		},
+		{
+			name: "single-headers",
+			s:    "single-headers:X-Real-IP,True-Client-IP",
+			want: Must(NewSingleIPHeadersStrategy("X-Real-IP", "True-Client-IP")),
+		},
+		{
+			name: "leftmost-non-private",
+			s:    "leftmost-non-private:X-Forwarded-For",
+			want: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+		},
+		{
+			name: "rightmost-non-private, mixed case name",
+			s:    " Rightmost-Non-Private:forwarded ",
+			want: Must(NewRightmostNonPrivateStrategy("Forwarded")),
+		},
+		{
+			name: "leftmost",
+			s:    "leftmost:X-Forwarded-For",
+			want: Must(NewLeftmostStrategy("X-Forwarded-For")),
+		},
+		{
+			name: "rightmost",
+			s:    "rightmost:Forwarded",
+			want: Must(NewRightmostStrategy("Forwarded")),
+		},
+		{
+			name: "leftmost-trusted-count",
+			s:    "leftmost-trusted-count:X-Forwarded-For:1",
+			want: Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1)),
+		},
+		{
+			name: "rightmost-trusted-count",
+			s:    "rightmost-trusted-count:Forwarded:2",
+			want: Must(NewRightmostTrustedCountStrategy("Forwarded", 2)),
+		},
+		{
+			name: "rightmost-trusted-range",
+			s:    "rightmost-trusted-range:X-Forwarded-For:10.0.0.0/8,2001:db8::/32,192.0.2.1",
+			want: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", mustAddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::/32", "192.0.2.1"))),
+		},
+		{
+			name: "proxy-protocol",
+			s:    "proxy-protocol:X-Proxy-Protocol",
+			want: Must(NewProxyProtocolStrategy("X-Proxy-Protocol")),
+		},
+		{
+			name: "chain",
+			s:    "chain:leftmost-non-private:X-Forwarded-For|remote-addr",
+			want: NewChainStrategy(
+				Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+				RemoteAddrStrategy{}),
+		},
+		{
+			name:    "Error: empty",
+			s:       "",
+			wantErr: true,
+		},
+		{
+			name:    "Error: unknown strategy",
+			s:       "nope:X-Forwarded-For",
+			wantErr: true,
+		},
+		{
+			name:    "Error: remote-addr with arguments",
+			s:       "remote-addr:X-Forwarded-For",
+			wantErr: true,
+		},
+		{
+			name:    "Error: google-frontend with arguments",
+			s:       "google-frontend:X-Forwarded-For",
+			wantErr: true,
+		},
+		{
+			name:    "Error: single-header missing header",
+			s:       "single-header",
+			wantErr: true,
+		},
+		{
+			name:    "Error: single-headers bad header",
+			s:       "single-headers:X-Real-IP,X-Forwarded-For",
+			wantErr: true,
+		},
+		{
+			name:    "Error: non-private bad header",
+			s:       "leftmost-non-private:X-Real-IP",
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted count missing count",
+			s:       "rightmost-trusted-count:Forwarded",
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted count bad count",
+			s:       "rightmost-trusted-count:Forwarded:two",
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted count zero",
+			s:       "leftmost-trusted-count:Forwarded:0",
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted range missing ranges",
+			s:       "rightmost-trusted-range:X-Forwarded-For",
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted range bad range",
+			s:       "rightmost-trusted-range:X-Forwarded-For:nope",
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted range bad header",
+			s:       "rightmost-trusted-range:X-Real-IP:10.0.0.0/8",
+			wantErr: true,
+		},
+		{
+			name:    "Error: empty chain",
+			s:       "chain",
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad chain member",
+			s:       "chain:remote-addr|nope",
+			wantErr: true,
+		},
+		{
+			name:    "Error: nested chain",
+			s:       "chain:remote-addr|chain:remote-addr",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StrategyFromString(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StrategyFromString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				if got != nil {
+					t.Fatalf("StrategyFromString() returned non-nil strategy with error")
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("StrategyFromString() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustAddressesAndRangesToIPNets(ranges ...string) []net.IPNet {
+	ipNets, err := AddressesAndRangesToIPNets(ranges...)
+	if err != nil {
+		panic(err)
+	}
+	return ipNets
+}
+
+func TestStrategyConfig_JSON(t *testing.T) {
+	// WithPrivateRangesTrusted merges the private ranges into the trusted ranges
+	privateTrusted := append(mustAddressesAndRangesToIPNets("1.1.1.1"), PrivateAndLocalRanges()...)
+	privateTrustedJSON, _ := json.Marshal(ipNetStrings(privateTrusted))
+
+	tests := []struct {
+		name     string
+		json     string
+		want     Strategy
+		wantJSON string // if empty, same as json
+		wantErr  bool
+	}{
+		{
+			name: "remote-addr",
+			json: `{"type":"remote-addr"}`,
+			want: RemoteAddrStrategy{},
+		},
+		{
+			name:     "single-header",
+			json:     `{"type":"single-header","header":"cf-connecting-ip"}`,
+			want:     Must(NewSingleIPHeaderStrategy("CF-Connecting-IP")),
+			wantJSON: `{"type":"single-header","header":"Cf-Connecting-Ip"}`,
+		},
+		{
+			name:     "google-frontend",
+			json:     `{"type":"google-frontend"}`,
+			want:     NewGoogleFrontendStrategy(),
+			wantJSON: `{"type":"single-header","header":"X-Proxyuser-Ip"}`,
+		},
+		{
+			name:     "heroku",
+			json:     `{"type":"heroku"}`,
+			want:     NewHerokuStrategy(),
+			wantJSON: `{"type":"rightmost-trusted-count","header":"X-Forwarded-For","count":1}`,
+		},
+		{
+			name:     "fly",
+			json:     `{"type":"fly"}`,
+			want:     NewFlyClientIPStrategy(),
+			wantJSON: `{"type":"single-header","header":"Fly-Client-Ip"}`,
+		},
+		{
+			name:     "fly without zone",
+			json:     `{"type":"fly","zone":false,"rejectMultipleHeaders":true}`,
+			want:     NewFlyClientIPStrategy(WithZone(false), WithRejectMultipleHeaders(true)),
+			wantJSON: `{"type":"single-header","header":"Fly-Client-Ip","zone":false,"rejectMultipleHeaders":true}`,
+		},
+		{
+			name:     "gcp-external-lb",
+			json:     `{"type":"gcp-external-lb"}`,
+			want:     NewGCPExternalLBStrategy(),
+			wantJSON: `{"type":"rightmost-trusted-count","header":"X-Forwarded-For","count":2}`,
+		},
+		{
+			name: "single-headers",
+			json: `{"type":"single-headers","headers":["X-Real-Ip","True-Client-Ip"]}`,
+			want: Must(NewSingleIPHeadersStrategy("X-Real-IP", "True-Client-IP")),
+		},
+		{
+			name: "leftmost-non-private",
+			json: `{"type":"leftmost-non-private","header":"X-Forwarded-For"}`,
+			want: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+		},
+		{
+			name: "rightmost-non-private with private ranges",
+			json: `{"type":"rightmost-non-private","header":"Forwarded","privateRanges":["10.0.0.0/8"]}`,
+			want: Must(NewRightmostNonPrivateStrategyWithRanges("Forwarded", mustAddressesAndRangesToIPNets("10.0.0.0/8"))),
+		},
+		{
+			name: "leftmost-non-private with no private ranges",
+			json: `{"type":"leftmost-non-private","header":"X-Forwarded-For","privateRanges":[]}`,
+			want: Must(NewLeftmostNonPrivateStrategyWithRanges("X-Forwarded-For", []net.IPNet{})),
+		},
+		{
+			name: "consensus",
+			json: `{"type":"consensus","strategies":[{"type":"rightmost-trusted-count","header":"Forwarded","count":1},{"type":"rightmost-trusted-count","header":"X-Forwarded-For","count":1}]}`,
+			want: NewConsensusStrategy(Must(NewRightmostTrustedCountStrategy("Forwarded", 1)), Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))),
+		},
+		{
+			name:    "Error: empty consensus",
+			json:    `{"type":"consensus","strategies":[]}`,
+			wantErr: true,
+		},
+		{
+			name: "require-all",
+			json: `{"type":"require-all","strategies":[{"type":"remote-addr"},{"type":"rightmost-trusted-count","header":"X-Forwarded-For","count":1}]}`,
+			want: NewRequireAllStrategy(RemoteAddrStrategy{}, Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))),
+		},
+		{
+			name:    "Error: empty require-all",
+			json:    `{"type":"require-all","strategies":[]}`,
+			wantErr: true,
+		},
+		{
+			name: "leftmost",
+			json: `{"type":"leftmost","header":"X-Forwarded-For"}`,
+			want: Must(NewLeftmostStrategy("X-Forwarded-For")),
+		},
+		{
+			name:     "leftmost IPv6",
+			json:     `{"type":"leftmost","header":"X-Forwarded-For","family":"IPv6"}`,
+			want:     Must(NewLeftmostStrategy("X-Forwarded-For", WithFamily(FamilyIPv6))),
+			wantJSON: `{"type":"leftmost","header":"X-Forwarded-For","family":"ipv6"}`,
+		},
+		{
+			name: "leftmost-non-private IPv4",
+			json: `{"type":"leftmost-non-private","header":"X-Forwarded-For","family":"ipv4"}`,
+			want: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyIPv4))),
+		},
+		{
+			name:    "Error: unknown family",
+			json:    `{"type":"leftmost","header":"X-Forwarded-For","family":"ipx"}`,
+			wantErr: true,
+		},
+		{
+			name: "rightmost without zone",
+			json: `{"type":"rightmost","header":"Forwarded","zone":false}`,
+			want: Must(NewRightmostStrategy("Forwarded", WithZone(false))),
+		},
+		{
+			name: "rightmost-trusted-count with rejectReserved",
+			json: `{"type":"rightmost-trusted-count","header":"X-Forwarded-For","count":1,"rejectReserved":true}`,
+			want: Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, WithRejectReserved(true))),
+		},
+		{
+			name: "single-header with mapped IPv6",
+			json: `{"type":"single-header","header":"X-Real-Ip","mappedIPv6":true}`,
+			want: Must(NewSingleIPHeaderStrategy("X-Real-IP", WithMappedIPv6(true))),
+		},
+		{
+			name: "leftmost-trusted-count",
+			json: `{"type":"leftmost-trusted-count","header":"X-Forwarded-For","count":1}`,
+			want: Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1)),
+		},
+		{
+			name: "rightmost-trusted-count",
+			json: `{"type":"rightmost-trusted-count","header":"Forwarded","count":2}`,
+			want: Must(NewRightmostTrustedCountStrategy("Forwarded", 2)),
+		},
+		{
+			name:     "rightmost-trusted-range",
+			json:     `{"type":"rightmost-trusted-range","header":"Forwarded","ranges":["10.0.0.0/8","192.0.2.1"],"requireHTTPS":true}`,
+			want:     Must(NewRightmostTrustedRangeStrategy("Forwarded", mustAddressesAndRangesToIPNets("10.0.0.0/8", "192.0.2.1"), WithRequireHTTPS(true))),
+			wantJSON: `{"type":"rightmost-trusted-range","header":"Forwarded","ranges":["10.0.0.0/8","192.0.2.1/32"],"requireHTTPS":true}`,
+		},
+		{
+			name: "rightmost-trusted-range non-recursive",
+			json: `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8"],"recursive":false}`,
+			want: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", mustAddressesAndRangesToIPNets("10.0.0.0/8"), WithRecursive(false))),
+		},
+		{
+			name:     "rightmost-trusted-range explicitly recursive",
+			json:     `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8"],"recursive":true}`,
+			want:     Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", mustAddressesAndRangesToIPNets("10.0.0.0/8"))),
+			wantJSON: `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8"]}`,
+		},
+		{
+			name: "rightmost-non-private without zone",
+			json: `{"type":"rightmost-non-private","header":"X-Forwarded-For","zone":false}`,
+			want: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithZone(false))),
+		},
+		{
+			name: "single-header rejecting multiple headers",
+			json: `{"type":"single-header","header":"X-Real-Ip","rejectMultipleHeaders":true}`,
+			want: Must(NewSingleIPHeaderStrategy("X-Real-IP", WithRejectMultipleHeaders(true))),
+		},
+		{
+			name: "rightmost-trusted-range strict Forwarded",
+			json: `{"type":"rightmost-trusted-range","header":"Forwarded","ranges":["10.0.0.0/8"],"strictForwarded":true}`,
+			want: Must(NewRightmostTrustedRangeStrategy("Forwarded", mustAddressesAndRangesToIPNets("10.0.0.0/8"), WithStrictForwarded(true))),
+		},
+		{
+			name: "rightmost lenient separators",
+			json: `{"type":"rightmost","header":"X-Forwarded-For","lenientSeparators":true}`,
+			want: Must(NewRightmostStrategy("X-Forwarded-For", WithLenientSeparators(true))),
+		},
+		{
+			name: "rightmost-trusted-count with XFF syntax",
+			json: `{"type":"rightmost-trusted-count","header":"X-Cdn-Client-Chain","count":2,"syntax":"xff"}`,
+			want: Must(NewRightmostTrustedCountStrategy("X-CDN-Client-Chain", 2, WithHeaderSyntax(HeaderSyntaxXFF))),
+		},
+		{
+			name:     "leftmost with Forwarded syntax, mixed case",
+			json:     `{"type":"leftmost","header":"X-Cdn-Forwarded","syntax":"Forwarded"}`,
+			want:     Must(NewLeftmostStrategy("X-CDN-Forwarded", WithHeaderSyntax(HeaderSyntaxForwarded))),
+			wantJSON: `{"type":"leftmost","header":"X-Cdn-Forwarded","syntax":"forwarded"}`,
+		},
+		{
+			name:    "Error: unknown syntax",
+			json:    `{"type":"leftmost","header":"X-Cdn-Forwarded","syntax":"csv"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: unknown header without syntax",
+			json:    `{"type":"leftmost","header":"X-Cdn-Forwarded"}`,
+			wantErr: true,
+		},
+		{
+			name: "rightmost-trusted-range with contiguous trust",
+			json: `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8"],"contiguousTrust":true}`,
+			want: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", mustAddressesAndRangesToIPNets("10.0.0.0/8"), WithContiguousTrust(true))),
+		},
+		{
+			name:     "rightmost-trusted-range with private ranges trusted",
+			json:     `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["1.1.1.1"],"privateRangesTrusted":true}`,
+			want:     Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", privateTrusted)),
+			wantJSON: `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":` + string(privateTrustedJSON) + `}`,
+		},
+		{
+			name:    "Error: contiguous trust without recursion",
+			json:    `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8"],"recursive":false,"contiguousTrust":true}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: strict X-Forwarded-For",
+			json:    `{"type":"leftmost","header":"X-Forwarded-For","strictForwarded":true}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: lenient separators with Forwarded",
+			json:    `{"type":"leftmost","header":"Forwarded","lenientSeparators":true}`,
+			wantErr: true,
+		},
+		{
+			name: "single-header allowing unspecified",
+			json: `{"type":"single-header","header":"X-Real-Ip","unspecified":true}`,
+			want: Must(NewSingleIPHeaderStrategy("X-Real-IP", WithUnspecified(true))),
+		},
+		{
+			name:     "single-header explicitly with zone",
+			json:     `{"type":"single-header","header":"X-Real-IP","zone":true}`,
+			want:     Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			wantJSON: `{"type":"single-header","header":"X-Real-Ip"}`,
+		},
+		{
+			name: "proxy-protocol",
+			json: `{"type":"proxy-protocol","header":"X-Proxy-Protocol"}`,
+			want: Must(NewProxyProtocolStrategy("X-Proxy-Protocol")),
+		},
+		{
+			name: "chain",
+			json: `{"type":"chain","strategies":[{"type":"leftmost-non-private","header":"X-Forwarded-For"},{"type":"remote-addr"}]}`,
+			want: NewChainStrategy(Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")), RemoteAddrStrategy{}),
+		},
+		{
+			name: "trusted-peer",
+			json: `{"type":"trusted-peer","ranges":["10.0.0.0/8"],"strategy":{"type":"rightmost-non-private","header":"X-Forwarded-For"}}`,
+			want: Must(NewTrustedPeerStrategy(Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")), mustAddressesAndRangesToIPNets("10.0.0.0/8"))),
+		},
+		{
+			name:    "Error: trusted-peer without strategy",
+			json:    `{"type":"trusted-peer","ranges":["10.0.0.0/8"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted-peer with bad strategy",
+			json:    `{"type":"trusted-peer","ranges":["10.0.0.0/8"],"strategy":{"type":"nope"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: trusted-peer without ranges",
+			json:    `{"type":"trusted-peer","strategy":{"type":"remote-addr"}}`,
+			wantErr: true,
+		},
+		{
+			name: "blocklist",
+			json: `{"type":"blocklist","ranges":["3.3.3.0/24"],"strategy":{"type":"remote-addr"}}`,
+			want: Must(NewBlocklistStrategy(RemoteAddrStrategy{}, mustAddressesAndRangesToIPNets("3.3.3.0/24"))),
+		},
+		{
+			name: "max-hops",
+			json: `{"type":"max-hops","header":"X-Forwarded-For","count":2,"strategy":{"type":"rightmost-trusted-count","header":"X-Forwarded-For","count":2}}`,
+			want: Must(NewMaxHopsStrategy(Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)), "X-Forwarded-For", 2)),
+		},
+		{
+			name:    "Error: max-hops without strategy",
+			json:    `{"type":"max-hops","header":"X-Forwarded-For","count":2}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: max-hops without count",
+			json:    `{"type":"max-hops","header":"X-Forwarded-For","strategy":{"type":"remote-addr"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: blocklist without strategy",
+			json:    `{"type":"blocklist","ranges":["3.3.3.0/24"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad JSON",
+			json:    `{"type":`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: unknown type",
+			json:    `{"type":"nope"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: missing header",
+			json:    `{"type":"single-header"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad header",
+			json:    `{"type":"rightmost-non-private","header":"X-Real-IP"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad count",
+			json:    `{"type":"rightmost-trusted-count","header":"Forwarded","count":0}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad range",
+			json:    `{"type":"rightmost-trusted-range","header":"Forwarded","ranges":["nope"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: missing ranges",
+			json:    `{"type":"rightmost-trusted-range","header":"Forwarded"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad private range",
+			json:    `{"type":"leftmost-non-private","header":"Forwarded","privateRanges":["nope"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: requireHTTPS with X-Forwarded-For",
+			json:    `{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8"],"requireHTTPS":true}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: empty chain",
+			json:    `{"type":"chain"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad chain member",
+			json:    `{"type":"chain","strategies":[{"type":"nope"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg StrategyConfig
+			err := json.Unmarshal([]byte(tt.json), &cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("json.Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(cfg.Strategy, tt.want) {
+				t.Fatalf("json.Unmarshal() = %#v, want %#v", cfg.Strategy, tt.want)
+			}
+
+			wantJSON := tt.wantJSON
+			if wantJSON == "" {
+				wantJSON = tt.json
+			}
+
+			b, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if string(b) != wantJSON {
+				t.Fatalf("json.Marshal() = %s, want %s", b, wantJSON)
+			}
+
+			// The concrete type should marshal the same way
+			b, err = json.Marshal(tt.want)
+			if err != nil {
+				t.Fatalf("json.Marshal() of concrete type error = %v", err)
+			}
+			if string(b) != wantJSON {
+				t.Fatalf("json.Marshal() of concrete type = %s, want %s", b, wantJSON)
+			}
+		})
+	}
+}
+
+func TestStrategyConfig_concreteTypes(t *testing.T) {
+	// A concrete type can be unmarshalled directly, such as when it's a field in a
+	// configuration struct.
+	var cfg struct {
+		ClientIP RightmostTrustedCountStrategy `json:"clientIP"`
+	}
+	err := json.Unmarshal([]byte(`{"clientIP":{"type":"rightmost-trusted-count","header":"x-forwarded-for","count":2}}`), &cfg)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if want := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)); !reflect.DeepEqual(cfg.ClientIP, want) {
+		t.Fatalf("json.Unmarshal() = %#v, want %#v", cfg.ClientIP, want)
+	}
+
+	// But not from a different type
+	var leftmost LeftmostNonPrivateStrategy
+	if err := json.Unmarshal([]byte(`{"type":"remote-addr"}`), &leftmost); err == nil {
+		t.Fatalf("json.Unmarshal() into mismatched type did not return error")
+	}
+
+	// Validation errors are surfaced
+	var single SingleIPHeaderStrategy
+	if err := json.Unmarshal([]byte(`{"type":"single-header","header":"Forwarded"}`), &single); err == nil {
+		t.Fatalf("json.Unmarshal() of invalid config did not return error")
+	}
+
+	// Strategies from outside this package can't be marshalled, even in a chain
+	if _, err := json.Marshal(StrategyConfig{customStrategy{}}); err == nil {
+		t.Fatalf("json.Marshal() of foreign strategy did not return error")
+	}
+	if _, err := json.Marshal(NewChainStrategy(RemoteAddrStrategy{}, customStrategy{})); err == nil {
+		t.Fatalf("json.Marshal() of chain with foreign strategy did not return error")
+	}
+	if _, err := json.Marshal(Must(NewTrustedPeerStrategy(customStrategy{}, mustAddressesAndRangesToIPNets("10.0.0.0/8")))); err == nil {
+		t.Fatalf("json.Marshal() of trusted-peer with foreign strategy did not return error")
+	}
+}
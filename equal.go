@@ -0,0 +1,187 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net"
+	"reflect"
+)
+
+// StrategiesEqual reports whether a and b are the same type of strategy with the same
+// configuration, and so will derive the same client IP from any request. Header names,
+// counts, and options are compared directly; IP ranges are compared after merging (see
+// MergeIPNets), so ranges given in a different order or split differently are equal; and
+// the members of ChainStrategy, ConsensusStrategy, and RequireAllStrategy (and the inner
+// strategies of wrappers like TrustedPeerStrategy) are compared recursively, in order.
+// This is more reliable than comparing String output. It is useful, for example, to
+// avoid replacing a live strategy when a reloaded configuration hasn't changed.
+//
+// Functions can't be compared, so a strategy with an Observer (from WithObserver or
+// WithLogger), or created by WithResultCallback, is never equal to another strategy
+// (except the same *ReloadableTrustedRangeStrategy). Strategies of types not in this
+// package are compared with ==, if they are comparable.
+func StrategiesEqual(a, b Strategy) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	switch a := a.(type) {
+	case ChainStrategy:
+		b, ok := b.(ChainStrategy)
+		return ok && strategyListsEqual(a.strategies, b.strategies)
+	case ConsensusStrategy:
+		b, ok := b.(ConsensusStrategy)
+		return ok && strategyListsEqual(a.strategies, b.strategies)
+	case RequireAllStrategy:
+		b, ok := b.(RequireAllStrategy)
+		return ok && strategyListsEqual(a.strategies, b.strategies)
+	case resultCallbackStrategy:
+		return false
+	case RemoteAddrStrategy:
+		_, ok := b.(RemoteAddrStrategy)
+		return ok
+	case TrustedPeerStrategy:
+		b, ok := b.(TrustedPeerStrategy)
+		return ok &&
+			rangesEqual(a.trustedProxyRanges, b.trustedProxyRanges) &&
+			StrategiesEqual(a.inner, b.inner)
+	case BlocklistStrategy:
+		b, ok := b.(BlocklistStrategy)
+		return ok &&
+			rangesEqual(a.blockedRanges, b.blockedRanges) &&
+			StrategiesEqual(a.inner, b.inner)
+	case MaxHopsStrategy:
+		b, ok := b.(MaxHopsStrategy)
+		return ok &&
+			a.headerName == b.headerName &&
+			a.maxHops == b.maxHops &&
+			StrategiesEqual(a.inner, b.inner)
+	case SingleIPHeaderStrategy:
+		b, ok := b.(SingleIPHeaderStrategy)
+		return ok && a.observer == nil && b.observer == nil &&
+			a.headerName == b.headerName &&
+			a.stripZone == b.stripZone &&
+			a.keepMapped == b.keepMapped &&
+			a.rejectReserved == b.rejectReserved &&
+			a.rejectMultipleHeaders == b.rejectMultipleHeaders &&
+			a.allowUnspecified == b.allowUnspecified
+	case SingleIPHeadersStrategy:
+		b, ok := b.(SingleIPHeadersStrategy)
+		return ok && reflect.DeepEqual(a.headerNames, b.headerNames)
+	case LeftmostNonPrivateStrategy:
+		b, ok := b.(LeftmostNonPrivateStrategy)
+		return ok &&
+			a.headerName == b.headerName &&
+			privateRangesEqual(a.privateRanges, b.privateRanges) &&
+			a.family == b.family &&
+			a.listOptions.equal(b.listOptions)
+	case RightmostNonPrivateStrategy:
+		b, ok := b.(RightmostNonPrivateStrategy)
+		return ok &&
+			a.headerName == b.headerName &&
+			privateRangesEqual(a.privateRanges, b.privateRanges) &&
+			a.listOptions.equal(b.listOptions)
+	case LeftmostStrategy:
+		b, ok := b.(LeftmostStrategy)
+		return ok &&
+			a.headerName == b.headerName &&
+			a.family == b.family &&
+			a.listOptions.equal(b.listOptions)
+	case RightmostStrategy:
+		b, ok := b.(RightmostStrategy)
+		return ok &&
+			a.headerName == b.headerName &&
+			a.listOptions.equal(b.listOptions)
+	case RightmostTrustedCountStrategy:
+		b, ok := b.(RightmostTrustedCountStrategy)
+		return ok &&
+			a.headerName == b.headerName &&
+			a.trustedCount == b.trustedCount &&
+			a.listOptions.equal(b.listOptions)
+	case LeftmostTrustedCountStrategy:
+		b, ok := b.(LeftmostTrustedCountStrategy)
+		return ok &&
+			a.headerName == b.headerName &&
+			a.trustedCount == b.trustedCount &&
+			a.listOptions.equal(b.listOptions)
+	case RightmostTrustedRangeStrategy:
+		b, ok := b.(RightmostTrustedRangeStrategy)
+		return ok && trustedRangeStrategiesEqual(a, b)
+	case *ReloadableTrustedRangeStrategy:
+		b, ok := b.(*ReloadableTrustedRangeStrategy)
+		if !ok || a == nil || b == nil {
+			return ok && a == b
+		}
+		if a == b {
+			return true
+		}
+		aCurrent, bCurrent := a.base, b.base
+		aCurrent.trustedRanges, bCurrent.trustedRanges = a.TrustedRanges(), b.TrustedRanges()
+		return trustedRangeStrategiesEqual(aCurrent, bCurrent)
+	case ProxyProtocolStrategy:
+		b, ok := b.(ProxyProtocolStrategy)
+		return ok && a.observer == nil && b.observer == nil &&
+			a.headerName == b.headerName &&
+			a.stripZone == b.stripZone &&
+			a.keepMapped == b.keepMapped
+	}
+
+	// A strategy type we don't know about
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// strategyListsEqual reports whether a and b have the same length and their strategies
+// are pairwise equal, per StrategiesEqual.
+func strategyListsEqual(a, b []Strategy) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !StrategiesEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// trustedRangeStrategiesEqual is the StrategiesEqual comparison for
+// RightmostTrustedRangeStrategy. The trusted ranges are compared whether they are held
+// as a []net.IPNet or as a RangeSet.
+func trustedRangeStrategiesEqual(a, b RightmostTrustedRangeStrategy) bool {
+	return a.headerName == b.headerName &&
+		rangesEqual(a.ranges(), b.ranges()) &&
+		a.requireHTTPS == b.requireHTTPS &&
+		a.nonRecursive == b.nonRecursive &&
+		a.contiguousTrust == b.contiguousTrust &&
+		a.listOptions.equal(b.listOptions)
+}
+
+// privateRangesEqual is rangesEqual for the privateRanges of LeftmostNonPrivateStrategy
+// and RightmostNonPrivateStrategy. A nil privateRanges means the default ranges, not "no
+// ranges", so it's expanded before comparing.
+func privateRangesEqual(a, b []net.IPNet) bool {
+	if a == nil {
+		a = privateAndLocalRanges
+	}
+	if b == nil {
+		b = privateAndLocalRanges
+	}
+	return rangesEqual(a, b)
+}
+
+// rangesEqual reports whether a and b cover exactly the same addresses.
+func rangesEqual(a, b []net.IPNet) bool {
+	aMerged, bMerged := MergeIPNets(a), MergeIPNets(b)
+	if len(aMerged) != len(bMerged) {
+		return false
+	}
+	for i := range aMerged {
+		if aMerged[i].String() != bMerged[i].String() {
+			return false
+		}
+	}
+	return true
+}
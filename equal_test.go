@@ -0,0 +1,274 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestStrategiesEqual(t *testing.T) {
+	ranges1 := mustAddressesAndRangesToIPNets("10.0.0.0/9", "10.128.0.0/9", "192.0.2.1")
+	ranges2 := mustAddressesAndRangesToIPNets("192.0.2.1/32", "10.0.0.0/8", "10.1.0.0/16")
+	ranges3 := mustAddressesAndRangesToIPNets("10.0.0.0/8")
+	set, _ := NewRangeSet(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.1/32"))
+	reloadable := Must(NewReloadableTrustedRangeStrategy("X-Forwarded-For", ranges1))
+	obs := func(string, Reason, string) {}
+
+	type customStrategy struct{ Strategy }
+
+	tests := []struct {
+		name string
+		a, b Strategy
+		want bool
+	}{
+		{
+			name: "Both nil",
+			a:    nil,
+			b:    nil,
+			want: true,
+		},
+		{
+			name: "One nil",
+			a:    RemoteAddrStrategy{},
+			b:    nil,
+			want: false,
+		},
+		{
+			name: "RemoteAddr",
+			a:    RemoteAddrStrategy{},
+			b:    RemoteAddrStrategy{},
+			want: true,
+		},
+		{
+			name: "Different types",
+			a:    Must(NewLeftmostStrategy("X-Forwarded-For")),
+			b:    Must(NewRightmostStrategy("X-Forwarded-For")),
+			want: false,
+		},
+		{
+			name: "Canonicalized header names",
+			a:    Must(NewSingleIPHeaderStrategy("x-real-ip")),
+			b:    Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			want: true,
+		},
+		{
+			name: "Different header names",
+			a:    Must(NewRightmostStrategy("X-Forwarded-For")),
+			b:    Must(NewRightmostStrategy("Forwarded")),
+			want: false,
+		},
+		{
+			name: "Same options",
+			a:    Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithZone(false), WithFamily(FamilyIPv4))),
+			b:    Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyIPv4), WithZone(false))),
+			want: true,
+		},
+		{
+			name: "Different options",
+			a:    Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithZone(false))),
+			b:    Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+			want: false,
+		},
+		{
+			name: "Default private ranges and no private ranges",
+			a:    Must(NewLeftmostNonPrivateStrategyWithRanges("X-Forwarded-For", nil)),
+			b:    Must(NewLeftmostNonPrivateStrategyWithRanges("X-Forwarded-For", []net.IPNet{})),
+			want: false,
+		},
+		{
+			name: "Default private ranges and no private ranges, rightmost",
+			a:    Must(NewRightmostNonPrivateStrategyWithRanges("X-Forwarded-For", []net.IPNet{})),
+			b:    Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			want: false,
+		},
+		{
+			name: "Default private ranges given explicitly",
+			a:    Must(NewRightmostNonPrivateStrategyWithRanges("X-Forwarded-For", PrivateAndLocalRanges())),
+			b:    Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			want: true,
+		},
+		{
+			name: "Default option given explicitly",
+			a:    Must(NewRightmostTrustedCountStrategy("Forwarded", 2, WithStrictForwarded(false))),
+			b:    Must(NewRightmostTrustedCountStrategy("Forwarded", 2)),
+			want: true,
+		},
+		{
+			name: "Different counts",
+			a:    Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1)),
+			b:    Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 2)),
+			want: false,
+		},
+		{
+			name: "Ranges normalized",
+			a:    Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges1)),
+			b:    Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges2)),
+			want: true,
+		},
+		{
+			name: "Ranges as a RangeSet",
+			a:    Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges1)),
+			b:    Must(NewRightmostTrustedRangeStrategyFromSet("X-Forwarded-For", set)),
+			want: true,
+		},
+		{
+			name: "Different ranges",
+			a:    Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges1)),
+			b:    Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges3)),
+			want: false,
+		},
+		{
+			name: "Reloadable, same",
+			a:    reloadable,
+			b:    reloadable,
+			want: true,
+		},
+		{
+			name: "Reloadable, same ranges",
+			a:    reloadable,
+			b:    Must(NewReloadableTrustedRangeStrategy("X-Forwarded-For", ranges2)),
+			want: true,
+		},
+		{
+			name: "Reloadable, different ranges",
+			a:    reloadable,
+			b:    Must(NewReloadableTrustedRangeStrategy("X-Forwarded-For", ranges3)),
+			want: false,
+		},
+		{
+			name: "Reloadable and non-reloadable",
+			a:    reloadable,
+			b:    Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges1)),
+			want: false,
+		},
+		{
+			name: "Chain",
+			a:    NewChainStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges1)), RemoteAddrStrategy{}),
+			b:    NewChainStrategy(Must(NewSingleIPHeaderStrategy("cf-connecting-ip")), Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges2)), RemoteAddrStrategy{}),
+			want: true,
+		},
+		{
+			name: "Chain, different member",
+			a:    NewChainStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), RemoteAddrStrategy{}),
+			b:    NewChainStrategy(Must(NewSingleIPHeaderStrategy("True-Client-IP")), RemoteAddrStrategy{}),
+			want: false,
+		},
+		{
+			name: "Chain, different order",
+			a:    NewChainStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), RemoteAddrStrategy{}),
+			b:    NewChainStrategy(RemoteAddrStrategy{}, Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP"))),
+			want: false,
+		},
+		{
+			name: "Chain, different length",
+			a:    NewChainStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), RemoteAddrStrategy{}),
+			b:    NewChainStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP"))),
+			want: false,
+		},
+		{
+			name: "Chain and consensus",
+			a:    NewChainStrategy(RemoteAddrStrategy{}),
+			b:    NewConsensusStrategy(RemoteAddrStrategy{}),
+			want: false,
+		},
+		{
+			name: "Nested composites",
+			a:    NewConsensusStrategy(NewRequireAllStrategy(Must(NewRightmostStrategy("X-Forwarded-For"))), Must(NewLeftmostStrategy("Forwarded"))),
+			b:    NewConsensusStrategy(NewRequireAllStrategy(Must(NewRightmostStrategy("X-Forwarded-For"))), Must(NewLeftmostStrategy("Forwarded"))),
+			want: true,
+		},
+		{
+			name: "Trusted peer",
+			a:    Must(NewTrustedPeerStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), ranges1)),
+			b:    Must(NewTrustedPeerStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), ranges2)),
+			want: true,
+		},
+		{
+			name: "Trusted peer, different inner",
+			a:    Must(NewTrustedPeerStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), ranges1)),
+			b:    Must(NewTrustedPeerStrategy(Must(NewSingleIPHeaderStrategy("X-Real-IP")), ranges1)),
+			want: false,
+		},
+		{
+			name: "Blocklist, different ranges",
+			a:    Must(NewBlocklistStrategy(RemoteAddrStrategy{}, ranges1)),
+			b:    Must(NewBlocklistStrategy(RemoteAddrStrategy{}, ranges3)),
+			want: false,
+		},
+		{
+			name: "Max hops",
+			a:    Must(NewMaxHopsStrategy(RemoteAddrStrategy{}, "X-Forwarded-For", 3)),
+			b:    Must(NewMaxHopsStrategy(RemoteAddrStrategy{}, "x-forwarded-for", 3)),
+			want: true,
+		},
+		{
+			name: "Max hops, different count",
+			a:    Must(NewMaxHopsStrategy(RemoteAddrStrategy{}, "X-Forwarded-For", 3)),
+			b:    Must(NewMaxHopsStrategy(RemoteAddrStrategy{}, "X-Forwarded-For", 4)),
+			want: false,
+		},
+		{
+			name: "Single IP headers",
+			a:    Must(NewSingleIPHeadersStrategy("Cf-Connecting-IP", "X-Real-IP")),
+			b:    Must(NewSingleIPHeadersStrategy("Cf-Connecting-IP", "X-Real-IP")),
+			want: true,
+		},
+		{
+			name: "Single IP headers, different order",
+			a:    Must(NewSingleIPHeadersStrategy("Cf-Connecting-IP", "X-Real-IP")),
+			b:    Must(NewSingleIPHeadersStrategy("X-Real-IP", "Cf-Connecting-IP")),
+			want: false,
+		},
+		{
+			name: "Proxy protocol",
+			a:    Must(NewProxyProtocolStrategy("X-Proxy-Protocol", WithMappedIPv6(true))),
+			b:    Must(NewProxyProtocolStrategy("X-Proxy-Protocol", WithMappedIPv6(true))),
+			want: true,
+		},
+		{
+			name: "Observer",
+			a:    Must(NewRightmostStrategy("X-Forwarded-For", WithObserver(obs))),
+			b:    Must(NewRightmostStrategy("X-Forwarded-For", WithObserver(obs))),
+			want: false,
+		},
+		{
+			name: "Result callback",
+			a:    WithResultCallback(RemoteAddrStrategy{}, nil),
+			b:    WithResultCallback(RemoteAddrStrategy{}, nil),
+			want: false,
+		},
+		{
+			name: "Custom comparable strategy",
+			a:    customStrategy{RemoteAddrStrategy{}},
+			b:    customStrategy{RemoteAddrStrategy{}},
+			want: true,
+		},
+		{
+			name: "Custom strategy, different",
+			a:    customStrategy{RemoteAddrStrategy{}},
+			b:    customStrategy{Must(NewRightmostStrategy("X-Forwarded-For"))},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StrategiesEqual(tt.a, tt.b); got != tt.want {
+				t.Fatalf("StrategiesEqual(a, b) = %v, want %v", got, tt.want)
+			}
+			if got := StrategiesEqual(tt.b, tt.a); got != tt.want {
+				t.Fatalf("StrategiesEqual(b, a) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Strategies parsed from equivalent configs are equal
+	var cfg1, cfg2 StrategyConfig
+	_ = json.Unmarshal([]byte(`{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["10.0.0.0/8","192.0.2.1"]}`), &cfg1)
+	_ = json.Unmarshal([]byte(`{"type":"rightmost-trusted-range","header":"x-forwarded-for","ranges":["192.0.2.1/32","10.0.0.0/8"]}`), &cfg2)
+	if cfg1.Strategy == nil || !StrategiesEqual(cfg1.Strategy, cfg2.Strategy) {
+		t.Fatalf("StrategiesEqual(%v, %v) = false, want true", cfg1.Strategy, cfg2.Strategy)
+	}
+}
@@ -1,7 +1,6 @@
 package realclientip_test
 
 import (
-	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -18,8 +17,10 @@ func Example_middleware() {
 		log.Fatal("realclientip.NewRightmostNonPrivateStrategy returned error (bad input)")
 	}
 
-	// Place our middleware before the handler
-	handlerWithMiddleware := clientIPMiddleware(strat, http.HandlerFunc(handler))
+	// Place the middleware before the handler. If the client IP couldn't be derived, the
+	// request will be rejected with a 400 Bad Request.
+	mw := realclientip.Middleware(strat, realclientip.WithRejectMissingIP(true))
+	handlerWithMiddleware := mw(http.HandlerFunc(handler))
 	httpServer := httptest.NewServer(handlerWithMiddleware)
 	defer httpServer.Close()
 
@@ -42,28 +43,7 @@ func Example_middleware() {
 	//  your IP: 3.3.3.3
 }
 
-type clientIPCtxKey struct{}
-
-// Adds the "real" client IP to the request context under the clientIPCtxKey{} key.
-// If the client IP couldn't be obtained, the value will be an empty string.
-// We could use the RightmostNonPrivateStrategy concrete type, but instead we'll pass
-// around the Strategy interface, in case we decide to change our strategy in the future.
-func clientIPMiddleware(strat realclientip.Strategy, next http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		clientIP := strat.ClientIP(r.Header, r.RemoteAddr)
-		if clientIP == "" {
-			// Write error log. Consider aborting the request depending on use.
-			log.Fatal("Failed to find client IP")
-		}
-
-		r = r.WithContext(context.WithValue(r.Context(), clientIPCtxKey{}, clientIP))
-		next.ServeHTTP(w, r)
-	}
-
-	return http.HandlerFunc(fn)
-}
-
 func handler(w http.ResponseWriter, r *http.Request) {
-	clientIP := r.Context().Value(clientIPCtxKey{})
+	clientIP, _ := realclientip.ClientIPFromContext(r.Context())
 	fmt.Fprintln(w, "your IP:", clientIP)
 }
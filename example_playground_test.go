@@ -58,16 +58,16 @@ func Example_playground() {
 	// realclientip.SingleIPHeaderStrategy: {headerName:X-Real-Ip}
 	// 4.4.4.4
 	//
-	// realclientip.LeftmostNonPrivateStrategy: {headerName:Forwarded}
+	// realclientip.LeftmostNonPrivateStrategy: {headerName:Forwarded privateRanges:default}
 	// 188.0.2.128
 	//
-	// realclientip.RightmostNonPrivateStrategy: {headerName:X-Forwarded-For}
+	// realclientip.RightmostNonPrivateStrategy: {headerName:X-Forwarded-For privateRanges:default}
 	// 3.3.3.3
 	//
 	// realclientip.RightmostTrustedCountStrategy: {headerName:Forwarded trustedCount:2}
 	// 2001:db8:cafe::17
 	//
-	// realclientip.RightmostTrustedRangeStrategy: {headerName:X-Forwarded-For trustedRanges:[192.168.0.0/16 3.3.3.3/32]
+	// realclientip.RightmostTrustedRangeStrategy: {headerName:X-Forwarded-For trustedRanges:[192.168.0.0/16 3.3.3.3/32]}
 	// 2001:db8:cafe::99%eth0
 	// 2001:db8:cafe::99
 	//
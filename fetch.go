@@ -0,0 +1,80 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// maxFetchBodyBytes limits how much of a response FetchIPRanges will read; a larger
+// response is an error. Published range lists are much smaller than this (AWS's
+// ip-ranges.json, one of the largest, is a couple of megabytes).
+const maxFetchBodyBytes = 16 << 20
+
+// FetchIPRanges retrieves a list of IP addresses and ranges from url and converts them to
+// IPNets, suitable for use with RightmostTrustedRangeStrategy or
+// ReloadableTrustedRangeStrategy.
+//
+// parse extracts the addresses and ranges from the response body, which lets the caller
+// adapt to the provider's format (such as the JSON of AWS's ip-ranges.json). If parse is
+// nil, the body is treated as one address or range per line, as with
+// ParseIPNetsFromReader; this is the format of Cloudflare's /ips-v4 and /ips-v6 endpoints.
+//
+// If client is nil, http.DefaultClient will be used. The request is bound to ctx, so its
+// deadline or cancellation will abort the fetch. A non-200 response results in an error,
+// as does a response body larger than 16 MiB.
+func FetchIPRanges(ctx context.Context, client *http.Client, url string, parse func([]byte) ([]string, error)) ([]net.IPNet, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("FetchIPRanges: creating request failed: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("FetchIPRanges: request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("FetchIPRanges: unexpected response status from %q: %s", url, resp.Status)
+	}
+
+	// Read one byte more than the limit, so that we can tell if the body was too large.
+	// Silently truncating it isn't safe: the last range could be cut short and still parse,
+	// as a much wider range (like "10.0.0.0/24" becoming "10.0.0.0/2").
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBodyBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("FetchIPRanges: reading response failed: %w", err)
+	}
+	if len(body) > maxFetchBodyBytes {
+		return nil, fmt.Errorf("FetchIPRanges: response from %q is larger than %d bytes", url, maxFetchBodyBytes)
+	}
+
+	if parse == nil {
+		ipNets, err := ParseIPNetsFromReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("FetchIPRanges: %w", err)
+		}
+		return ipNets, nil
+	}
+
+	rangeStrings, err := parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("FetchIPRanges: parsing response failed: %w", err)
+	}
+
+	ipNets, err := AddressesAndRangesToIPNets(rangeStrings...)
+	if err != nil {
+		return nil, fmt.Errorf("FetchIPRanges: %w", err)
+	}
+	return ipNets, nil
+}
@@ -0,0 +1,153 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchIPRanges(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ips-v4", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("173.245.48.0/20\n103.21.244.0/22\n"))
+	})
+	mux.HandleFunc("/ip-ranges.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"prefixes":[{"ip_prefix":"3.2.34.0/26"},{"ip_prefix":"13.32.0.0/15"}]}`))
+	})
+	mux.HandleFunc("/bad", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("nope\n"))
+	})
+	mux.HandleFunc("/huge", func(w http.ResponseWriter, r *http.Request) {
+		// One byte too many; truncated, the last range would be "10.0.0.0/2"
+		line := []byte("10.0.0.0/24")
+		body := bytes.Repeat([]byte("\n"), maxFetchBodyBytes-len(line)+1)
+		_, _ = w.Write(append(body, line...))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	awsParse := func(body []byte) ([]string, error) {
+		var doc struct {
+			Prefixes []struct {
+				IPPrefix string `json:"ip_prefix"`
+			} `json:"prefixes"`
+		}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, err
+		}
+		var res []string
+		for _, p := range doc.Prefixes {
+			res = append(res, p.IPPrefix)
+		}
+		return res, nil
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		parse   func([]byte) ([]string, error)
+		timeout time.Duration
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Line list",
+			path: "/ips-v4",
+			want: []string{"173.245.48.0/20", "103.21.244.0/22"},
+		},
+		{
+			name:  "Custom parser",
+			path:  "/ip-ranges.json",
+			parse: awsParse,
+			want:  []string{"3.2.34.0/26", "13.32.0.0/15"},
+		},
+		{
+			name:    "Error: parser failure",
+			path:    "/ips-v4",
+			parse:   func([]byte) ([]string, error) { return nil, errors.New("nope") },
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad range",
+			path:    "/bad",
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad range from parser",
+			path:    "/bad",
+			parse:   func([]byte) ([]string, error) { return []string{"nope"}, nil },
+			wantErr: true,
+		},
+		{
+			name:    "Error: body too large",
+			path:    "/huge",
+			wantErr: true,
+		},
+		{
+			name:    "Error: non-200",
+			path:    "/missing",
+			wantErr: true,
+		},
+		{
+			name:    "Error: context deadline",
+			path:    "/slow",
+			timeout: 50 * time.Millisecond,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			got, err := FetchIPRanges(ctx, srv.Client(), srv.URL+tt.path, tt.parse)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FetchIPRanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("len mismatch: %d != %d", len(got), len(tt.want))
+			}
+
+			for i := 0; i < len(got); i++ {
+				if got[i].String() != tt.want[i] {
+					t.Fatalf("got does not equal want; %d: %q != %q", i, got[i].String(), tt.want[i])
+				}
+			}
+		})
+	}
+
+	// A nil client falls back to http.DefaultClient
+	if _, err := FetchIPRanges(context.Background(), nil, srv.URL+"/ips-v4", nil); err != nil {
+		t.Fatalf("FetchIPRanges with nil client error: %v", err)
+	}
+
+	// A malformed URL fails before any request is made
+	if _, err := FetchIPRanges(context.Background(), nil, "://nope", nil); err == nil {
+		t.Fatalf("FetchIPRanges did not return error for bad URL")
+	}
+}
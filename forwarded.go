@@ -0,0 +1,567 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ForwardedElement holds the directives of a single element (comma-separated list item)
+// of a Forwarded header. See RFC 7239 for the meaning of each directive.
+type ForwardedElement struct {
+	// For is the "for" directive: the client that made the request to the proxy. It is
+	// nil if the directive is absent or is not a valid IP (such as "unknown" or an
+	// obfuscated identifier like "_hidden").
+	For *net.IPAddr
+	// ForObfuscated is set if the "for" directive is not an IP, but one of the node names
+	// that RFC 7239 (section 6) allows instead: "unknown" or an obfuscated identifier
+	// (like "_hidden"). Any port is not included. This allows a hop that deliberately
+	// hides its client to be told apart from one that is malformed. It is empty
+	// otherwise.
+	ForObfuscated string
+	// ForPort is the port of the "for" directive, if it has one and For or
+	// ForObfuscated is set. RFC 7239 allows either a number or an obfuscated identifier
+	// (like "_abc"), so it is a string. It is empty otherwise.
+	ForPort string
+	// By is the "by" directive: the interface where the request came in to the proxy.
+	// It is nil if the directive is absent or is not a valid IP.
+	By *net.IPAddr
+	// ByObfuscated is like ForObfuscated, but for the "by" directive.
+	ByObfuscated string
+	// ByPort is like ForPort, but for the "by" directive.
+	ByPort string
+	// Host is the "host" directive: the Host request header as received by the proxy.
+	Host string
+	// Proto is the "proto" directive: the protocol used to make the request to the
+	// proxy, like "http" or "https".
+	Proto string
+	// Extensions holds any other directives, keyed by lowercased name. It is nil if
+	// there are none.
+	Extensions map[string]string
+}
+
+// ParseForwarded parses the value of a Forwarded header into its elements, in order.
+// If there are multiple Forwarded headers, each should be parsed and the results
+// concatenated.
+// Parsing is as tolerant as that used by the strategies in this package: directive names
+// are case-insensitive, whitespace around separators is trimmed (except before an
+// equal sign, as a directive name can't contain a space), quotes around values are
+// removed (and backslash-escaped characters within them are unescaped), and quoted values
+// may contain commas and semicolons. Directives that are malformed are ignored, as are
+// repeats of a directive within an element (the first one is used). Empty elements are
+// skipped.
+// Note that the values are not validated beyond the parsing of For and By; in
+// particular, Host and Proto are exactly as provided by the proxy (or the client).
+func ParseForwarded(headerValue string) []ForwardedElement {
+	var result []ForwardedElement
+	for _, rawElement := range splitQuoted(headerValue, ',') {
+		rawElement = strings.TrimSpace(rawElement)
+		if rawElement == "" {
+			continue
+		}
+		result = append(result, parseForwardedElement(rawElement))
+	}
+	return result
+}
+
+// parseForwardedElement parses a single Forwarded header list item.
+func parseForwardedElement(fwd string) ForwardedElement {
+	var elem ForwardedElement
+	seen := map[string]bool{}
+
+	for _, fp := range splitQuoted(fwd, ';') {
+		// This is the same splitting as is done by the strategies (in forwardedDirective)
+		fpName, value, ok := splitForwardedDirective(fp)
+		if !ok {
+			continue
+		}
+
+		name := strings.ToLower(fpName)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if unquoted := trimMatchedEnds(value, `"`); unquoted != value {
+			value = unescapeQuotedPairs(unquoted)
+		}
+
+		switch name {
+		case "for":
+			if elem.For = goodIPAddr(value); elem.For == nil {
+				elem.ForObfuscated = obfuscatedNode(value)
+			}
+			if elem.For != nil || elem.ForObfuscated != "" {
+				elem.ForPort = forwardedNodePort(value)
+			}
+		case "by":
+			if elem.By = goodIPAddr(value); elem.By == nil {
+				elem.ByObfuscated = obfuscatedNode(value)
+			}
+			if elem.By != nil || elem.ByObfuscated != "" {
+				elem.ByPort = forwardedNodePort(value)
+			}
+		case "host":
+			elem.Host = value
+		case "proto":
+			elem.Proto = value
+		default:
+			if elem.Extensions == nil {
+				elem.Extensions = map[string]string{}
+			}
+			elem.Extensions[name] = value
+		}
+	}
+
+	return elem
+}
+
+// obfuscatedNode returns the node name in value (a "for" or "by" directive value, without
+// quotes) if it is "unknown" or an obfuscated identifier, optionally followed by a valid
+// port. "unknown" is returned in lowercase. Otherwise, it returns empty string.
+func obfuscatedNode(value string) string {
+	name, port, hasPort := strings.Cut(value, ":")
+	if hasPort && !isForwardedNodePort(port) {
+		return ""
+	}
+
+	if strings.EqualFold(name, "unknown") {
+		return "unknown"
+	}
+	if isObfuscatedIdentifier(name) {
+		return name
+	}
+	return ""
+}
+
+// forwardedNodePort returns the port of value (a "for" or "by" directive value, without
+// quotes), or empty string if it doesn't have a valid one. An IPv6 address only has a
+// port if it is bracketed (like "[2001:db8::1]:443").
+func forwardedNodePort(value string) string {
+	var port string
+	if strings.HasPrefix(value, "[") {
+		end := strings.IndexByte(value, ']')
+		if end < 0 || !strings.HasPrefix(value[end+1:], ":") {
+			return ""
+		}
+		port = value[end+2:]
+	} else if strings.Count(value, ":") == 1 {
+		_, port, _ = strings.Cut(value, ":")
+	}
+
+	if !isForwardedNodePort(port) {
+		return ""
+	}
+	return port
+}
+
+// unescapeQuotedPairs removes the backslashes from the quoted-pairs in the content of a
+// quoted string (RFC 7230, section 3.2.6).
+func unescapeQuotedPairs(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// FormatForwarded creates a Forwarded header list item from el. It is the inverse of
+// ParseForwarded, and is useful when acting as a reverse proxy and adding an element for
+// the next hop.
+// Directive names are lowercase and are emitted in the order: for, by, host, proto,
+// then the extensions sorted by name. Absent (nil or empty) directives are omitted. If
+// For is nil, ForObfuscated is used for the "for" directive (and likewise for By). If
+// ForPort is set, it is appended to the "for" node (and likewise for ByPort).
+// Values are quoted when RFC 7239 requires it (when they are not tokens); in particular,
+// IPv6 addresses are bracketed and quoted (like `for="[2001:db8::1]:443"`), with any
+// zone preserved.
+// To append to an existing Forwarded header, join the values with ", ".
+func FormatForwarded(el ForwardedElement) string {
+	var parts []string
+
+	if el.For != nil {
+		parts = append(parts, "for="+forwardedValue(withForwardedPort(forwardedNode(*el.For), el.ForPort)))
+	} else if el.ForObfuscated != "" {
+		parts = append(parts, "for="+forwardedValue(withForwardedPort(el.ForObfuscated, el.ForPort)))
+	}
+	if el.By != nil {
+		parts = append(parts, "by="+forwardedValue(withForwardedPort(forwardedNode(*el.By), el.ByPort)))
+	} else if el.ByObfuscated != "" {
+		parts = append(parts, "by="+forwardedValue(withForwardedPort(el.ByObfuscated, el.ByPort)))
+	}
+	if el.Host != "" {
+		parts = append(parts, "host="+forwardedValue(el.Host))
+	}
+	if el.Proto != "" {
+		parts = append(parts, "proto="+forwardedValue(el.Proto))
+	}
+
+	names := make([]string, 0, len(el.Extensions))
+	for name := range el.Extensions {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+	for _, name := range names {
+		parts = append(parts, strings.ToLower(name)+"="+forwardedValue(el.Extensions[name]))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// withForwardedPort appends port to the node name, if port isn't empty.
+func withForwardedPort(node, port string) string {
+	if port == "" {
+		return node
+	}
+	return node + ":" + port
+}
+
+// forwardedNode returns the RFC 7239 node name for ipAddr: IPv4 addresses are as-is,
+// IPv6 addresses are bracketed.
+func forwardedNode(ipAddr net.IPAddr) string {
+	if ipAddr.IP.To4() != nil {
+		return ipAddr.String()
+	}
+	return "[" + ipAddr.String() + "]"
+}
+
+// forwardedValue returns value as a token if it is one, otherwise as a quoted string.
+func forwardedValue(value string) string {
+	if isToken(value) {
+		return value
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(value[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isToken returns true if s is a non-empty token, per RFC 7230, section 3.2.6.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// AppendXForwardedFor appends clientIP to existing, which is the value of an
+// X-Forwarded-For header (possibly empty), and returns the new value. This is useful when
+// acting as a reverse proxy.
+// Items are separated by ", ". Trailing commas and whitespace in existing are removed
+// first, so that sloppy incoming values don't result in empty items. IPv6 addresses are
+// not bracketed, as there is no port, and any zone is retained.
+// If there are multiple X-Forwarded-For headers, they should be joined with ", " before
+// calling this, or the result should replace only the last of them.
+func AppendXForwardedFor(existing string, clientIP net.IPAddr) string {
+	existing = strings.TrimRight(existing, ", \t")
+	if existing == "" {
+		return clientIP.String()
+	}
+	return existing + ", " + clientIP.String()
+}
+
+// SanitizeXFF returns value, which is the value of an X-Forwarded-For header, with only
+// its valid IP items, in their original order. This is useful when acting as a reverse
+// proxy, to pass a clean header on (see also AppendXForwardedFor).
+// Items are split and parsed as they are by the strategies, so items that the strategies
+// would treat as invalid (like "unknown", "0.0.0.0", or garbage) are dropped, as are
+// empty items. The remaining IPs are normalized, like "2001:db8::1%eth0" (ports and
+// brackets are removed, and any zone is retained), and separated by ", ".
+// Empty string is returned if no valid IPs remain, or if value has more than
+// MaxListItems items or MaxHeaderBytes bytes (as the strategies will not parse it at
+// all).
+// Note that this doesn't make the IPs trustworthy: a spoofed item that is a valid IP is
+// kept.
+func SanitizeXFF(value string) string {
+	headers := http.Header{xForwardedForHdr: []string{value}}
+	items, ok := getListItems(headers, xForwardedForHdr, false, false, false)
+	if !ok {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, item := range items {
+		if item.ipAddr == nil {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(item.ipAddr.String())
+	}
+	return b.String()
+}
+
+// These errors are wrapped by the XFFItemErrors returned by ValidateXFF, and can be
+// checked for with errors.Is.
+var (
+	// ErrNotIP indicates that an item is not a valid IP address (or IP:port).
+	ErrNotIP = errors.New("not a valid IP address")
+	// ErrUnspecifiedIP indicates that an item is the zero or unspecified address (like
+	// "0.0.0.0" or "::"), which the strategies treat as invalid.
+	ErrUnspecifiedIP = errors.New("unspecified IP address")
+	// ErrPrivateIP indicates that an item is a private or local IP address (see
+	// IsPrivateOrLocal), which the non-private strategies skip.
+	ErrPrivateIP = errors.New("private or local IP address")
+)
+
+// XFFItemError describes a problem with an item of an X-Forwarded-For header. See
+// ValidateXFF.
+type XFFItemError struct {
+	// Index is the 0-based index of the item. Empty items are not counted, matching the
+	// positions used by the strategies (see ClientIPWithPosition).
+	Index int
+	// Item is the item, with surrounding whitespace removed.
+	Item string
+	// Err is the problem: ErrNotIP, ErrUnspecifiedIP, or ErrPrivateIP.
+	Err error
+}
+
+func (e *XFFItemError) Error() string {
+	return fmt.Sprintf("X-Forwarded-For item %d (%q): %v", e.Index, e.Item, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *XFFItemError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateXFF checks each item of value, which is the value of an X-Forwarded-For
+// header, and returns an error for each one that is not a valid IP address, is
+// unspecified, or is private or local. Each error is an *XFFItemError. Items are split
+// and parsed as they are by the strategies (so "unknown" is not a valid IP, and empty
+// items are ignored), but rather than being silently skipped, the problems are reported.
+// This is useful for monitoring proxies for malformed headers. Note that a private IP
+// is not necessarily a problem, depending on your network; use errors.Is to tell the
+// kinds of problems apart.
+// If value has more than MaxListItems items or MaxHeaderBytes bytes, a single error (not
+// an *XFFItemError) is returned, as the strategies will not parse it at all. If there
+// are no problems, nil is returned.
+func ValidateXFF(value string) []error {
+	headers := http.Header{xForwardedForHdr: []string{value}}
+	items, ok := getListItems(headers, xForwardedForHdr, false, false, false)
+	if !ok && listHeaderTooLarge(headers, xForwardedForHdr) {
+		return []error{fmt.Errorf("X-Forwarded-For is longer than MaxHeaderBytes (%d)", MaxHeaderBytes)}
+	}
+	if !ok {
+		return []error{fmt.Errorf("X-Forwarded-For has more than MaxListItems (%d) items", MaxListItems)}
+	}
+
+	var errs []error
+	for _, item := range items {
+		var problem error
+		switch {
+		case item.ipAddr != nil:
+			if isPrivate(item.ipAddr.IP, nil) {
+				problem = ErrPrivateIP
+			}
+		case unspecifiedIPAddr(item.raw) != nil:
+			problem = ErrUnspecifiedIP
+		default:
+			problem = ErrNotIP
+		}
+
+		if problem != nil {
+			errs = append(errs, &XFFItemError{Index: item.index, Item: item.raw, Err: problem})
+		}
+	}
+	return errs
+}
+
+// ForwardedProto returns the protocol, "http" or "https", that the client used to make
+// the request to the nearest reverse proxy. It is taken from the X-Forwarded-Proto
+// header, or, if that is absent, from the "proto" directive of the Forwarded header.
+// If a header has multiple values (because each proxy added one), the last (rightmost)
+// value is used, as it was added by the proxy closest to this server, just like the IP
+// used by RightmostTrustedCountStrategy with a count of 1. The value is lowercased.
+// Empty string is returned if there is no value, or if it isn't "http" or "https".
+// As with the client IP headers, you must ensure that the headers are set (or
+// sanitized) by your own reverse proxy, and that you are using the same one that you
+// use for the client IP, otherwise they can be trivially spoofed.
+func ForwardedProto(headers http.Header) string {
+	var proto string
+	if values := headers.Values(xForwardedProtoHdr); len(values) > 0 {
+		proto = lastListValue(values, false)
+	} else if elem, ok := lastForwardedElement(headers); ok {
+		proto = elem.Proto
+	}
+
+	proto = strings.ToLower(proto)
+	if proto != "http" && proto != "https" {
+		return ""
+	}
+	return proto
+}
+
+// ForwardedHost returns the host, optionally with a port (like "example.com" or
+// "example.com:8443"), that the client made the request to. It is taken from the
+// X-Forwarded-Host header, or, if that is absent, from the "host" directive of the
+// Forwarded header. As with ForwardedProto, the last (rightmost) value is used, as it was
+// added by the proxy closest to this server, and the headers are only trustworthy if
+// they're set by your own reverse proxy.
+// Empty string is returned if there is no value, or if it isn't a plausible host: it
+// must not contain whitespace or control characters, an IPv6 literal must be in brackets,
+// and a port must be numeric. No other validation is done, so the host may not be one
+// that your server is configured to handle.
+// Use ForwardedHostname to get the host without the port.
+func ForwardedHost(headers http.Header) string {
+	var host string
+	if values := headers.Values(xForwardedHostHdr); len(values) > 0 {
+		host = lastListValue(values, false)
+	} else if elem, ok := lastForwardedElement(headers); ok {
+		host = elem.Host
+	}
+
+	if _, _, ok := splitForwardedHost(host); !ok {
+		return ""
+	}
+	return host
+}
+
+// ForwardedHostname is like ForwardedHost, but with any port removed. As with
+// url.URL.Hostname, square brackets are removed from an IPv6 literal.
+func ForwardedHostname(headers http.Header) string {
+	hostname, _, _ := splitForwardedHost(ForwardedHost(headers))
+	return hostname
+}
+
+// RequestInfo holds the attributes of a request as the client made it, before it passed
+// through any reverse proxies. See DeriveRequestInfo.
+type RequestInfo struct {
+	// ClientIP is the client IP, as returned by the strategy. It is empty if there is no
+	// derivable IP.
+	ClientIP string
+	// Proto is the protocol, "http" or "https", as returned by ForwardedProto.
+	Proto string
+	// Host is the host without the port, as returned by ForwardedHostname.
+	Host string
+	// Port is the port from the host returned by ForwardedHost. If the host has no port,
+	// it is the default port for Proto ("80" or "443"), or empty if Proto is also empty.
+	Port string
+}
+
+// DeriveRequestInfo derives the client IP using strat, and the protocol and host using
+// ForwardedProto and ForwardedHost. Any of the fields of the result may be empty.
+// The strategy and the headers must correspond to your own reverse proxy
+// configuration; see the caveats for the strategies and for ForwardedProto and
+// ForwardedHost.
+func DeriveRequestInfo(strat Strategy, headers http.Header, remoteAddr string) RequestInfo {
+	info := RequestInfo{
+		ClientIP: strat.ClientIP(headers, remoteAddr),
+		Proto:    ForwardedProto(headers),
+	}
+	info.Host, info.Port, _ = splitForwardedHost(ForwardedHost(headers))
+
+	if info.Port == "" {
+		switch info.Proto {
+		case "http":
+			info.Port = "80"
+		case "https":
+			info.Port = "443"
+		}
+	}
+	return info
+}
+
+// splitForwardedHost splits host into its hostname (without brackets) and port (which may
+// be empty). ok is false if host is empty or fails the validation described in
+// ForwardedHost.
+func splitForwardedHost(host string) (hostname, port string, ok bool) {
+	for i := 0; i < len(host); i++ {
+		if host[i] <= ' ' || host[i] == 0x7F {
+			return "", "", false
+		}
+	}
+
+	rest := ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return "", "", false
+		}
+		hostname, rest = host[1:end], host[end+1:]
+		if !strings.Contains(hostname, ":") {
+			// Brackets are only for IPv6 literals
+			return "", "", false
+		}
+	} else {
+		// An unbracketed IPv6 address ends up with a non-numeric port, and so fails
+		hostname, rest = host, ""
+		if i := strings.IndexByte(host, ':'); i >= 0 {
+			hostname, rest = host[:i], host[i:]
+		}
+	}
+
+	if hostname == "" || strings.ContainsAny(hostname, "[]") {
+		return "", "", false
+	}
+	if rest != "" {
+		port = strings.TrimPrefix(rest, ":")
+		if port == rest || port == "" || strings.Trim(port, "0123456789") != "" {
+			return "", "", false
+		}
+	}
+	return hostname, port, true
+}
+
+// lastListValue returns the last non-empty, trimmed item in the comma-separated list
+// header values, or empty string if there isn't one. If quoted is true, commas within
+// quoted strings do not separate items (as in the Forwarded header).
+func lastListValue(values []string, quoted bool) string {
+	for i := len(values) - 1; i >= 0; i-- {
+		var items []string
+		if quoted {
+			items = splitQuoted(values[i], ',')
+		} else {
+			items = strings.Split(values[i], ",")
+		}
+
+		for j := len(items) - 1; j >= 0; j-- {
+			if item := strings.TrimSpace(items[j]); item != "" {
+				return item
+			}
+		}
+	}
+	return ""
+}
+
+// lastForwardedElement parses the last (rightmost) element of the Forwarded headers. ok
+// is false if there is none.
+func lastForwardedElement(headers http.Header) (elem ForwardedElement, ok bool) {
+	last := lastListValue(headers.Values(forwardedHdr), true)
+	if last == "" {
+		return ForwardedElement{}, false
+	}
+	return parseForwardedElement(last), true
+}
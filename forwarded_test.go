@@ -0,0 +1,619 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	tests := []struct {
+		name        string
+		headerValue string
+		want        []ForwardedElement
+	}{
+		{
+			name:        "Empty",
+			headerValue: "",
+			want:        nil,
+		},
+		{
+			name:        "All directives",
+			headerValue: `for=192.0.2.60;proto=http;by=203.0.113.43;host=example.com`,
+			want: []ForwardedElement{
+				{
+					For:   mustParseIPAddrPtr("192.0.2.60"),
+					By:    mustParseIPAddrPtr("203.0.113.43"),
+					Host:  "example.com",
+					Proto: "http",
+				},
+			},
+		},
+		{
+			name:        "Multiple elements with quoting and mixed case",
+			headerValue: `For="[2001:db8:cafe::17%zone]:4711";Proto=HTTPS, for=198.51.100.17 ; host="example.com:8080"`,
+			want: []ForwardedElement{
+				{
+					For:     mustParseIPAddrPtr("2001:db8:cafe::17%zone"),
+					ForPort: "4711",
+					Proto:   "HTTPS",
+				},
+				{
+					For:  mustParseIPAddrPtr("198.51.100.17"),
+					Host: "example.com:8080",
+				},
+			},
+		},
+		{
+			name:        "Obfuscated and unknown identifiers",
+			headerValue: `for=unknown;by="_hidden", for="_a,b";proto=https, For=UNKNOWN, for="_gazonk:_port";by="unknown:4711"`,
+			want: []ForwardedElement{
+				{ForObfuscated: "unknown", ByObfuscated: "_hidden"},
+				{Proto: "https"},
+				{ForObfuscated: "unknown"},
+				{ForObfuscated: "_gazonk", ForPort: "_port", ByObfuscated: "unknown", ByPort: "4711"},
+			},
+		},
+		{
+			name:        "Invalid obfuscated identifiers",
+			headerValue: `for=_, for="_a!", for=unknowns, for="_a:b", for="unknown:123456", for=hidden`,
+			want:        []ForwardedElement{{}, {}, {}, {}, {}, {}},
+		},
+		{
+			name:        "Extensions",
+			headerValue: `for=1.1.1.1;Ext="x,y;z";other=token`,
+			want: []ForwardedElement{
+				{
+					For:        mustParseIPAddrPtr("1.1.1.1"),
+					Extensions: map[string]string{"ext": "x,y;z", "other": "token"},
+				},
+			},
+		},
+		{
+			name:        "Escaped characters in quoted values",
+			headerValue: `for=1.1.1.1;host="a\"b\\c";ext="\x"`,
+			want: []ForwardedElement{
+				{
+					For:        mustParseIPAddrPtr("1.1.1.1"),
+					Host:       `a"b\c`,
+					Extensions: map[string]string{"ext": "x"},
+				},
+			},
+		},
+		{
+			name:        "Values containing equal signs",
+			headerValue: `for="x=y";host="a=b";ext=abc==;proto=https, for=1.1.1.1;by=_abc==;Other==x`,
+			want: []ForwardedElement{
+				{
+					Host:       "a=b",
+					Proto:      "https",
+					Extensions: map[string]string{"ext": "abc=="},
+				},
+				{
+					// Padding isn't allowed in an obfuscated identifier, but the other
+					// directives are still parsed
+					For:        mustParseIPAddrPtr("1.1.1.1"),
+					Extensions: map[string]string{"other": "=x"},
+				},
+			},
+		},
+		{
+			name:        "Malformed directives, repeats, and empty elements",
+			headerValue: `, for=1.1.1.1;for=2.2.2.2;proto;=x,, by=3.3.3.3,`,
+			want: []ForwardedElement{
+				{For: mustParseIPAddrPtr("1.1.1.1")},
+				{By: mustParseIPAddrPtr("3.3.3.3")},
+			},
+		},
+		{
+			// As with the strategies, a space is tolerated after the equal sign, but not
+			// before it
+			name:        "Equal sign spaces",
+			headerValue: `For =1.1.1.1, For= 3.3.3.3;proto =https`,
+			want: []ForwardedElement{
+				{},
+				{For: mustParseIPAddrPtr("3.3.3.3")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseForwarded(tt.headerValue)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseForwarded() = %+v, want %+v", got, tt.want)
+			}
+
+			// The strategies must find the same "for" IPs
+			strat := Must(NewLeftmostStrategy("Forwarded"))
+			var items []string
+			for _, item := range splitQuoted(tt.headerValue, ',') {
+				if strings.TrimSpace(item) != "" {
+					items = append(items, item)
+				}
+			}
+			for i, el := range got {
+				want := ""
+				if el.For != nil {
+					want = el.For.String()
+				}
+				if ip := strat.ClientIP(http.Header{"Forwarded": []string{items[i]}}, ""); ip != want {
+					t.Fatalf("strategy ClientIP(%q) = %q, ParseForwarded For = %q", items[i], ip, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatForwarded(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	tests := []struct {
+		name string
+		el   ForwardedElement
+		want string
+	}{
+		{
+			name: "Empty",
+			el:   ForwardedElement{},
+			want: ``,
+		},
+		{
+			name: "IPv4",
+			el:   ForwardedElement{For: mustParseIPAddrPtr("192.0.2.60")},
+			want: `for=192.0.2.60`,
+		},
+		{
+			name: "IPv4-mapped IPv6",
+			el:   ForwardedElement{For: mustParseIPAddrPtr("::ffff:192.0.2.60")},
+			want: `for=192.0.2.60`,
+		},
+		{
+			name: "IPv6 with zone",
+			el:   ForwardedElement{For: mustParseIPAddrPtr("fe80::1%eth0")},
+			want: `for="[fe80::1%eth0]"`,
+		},
+		{
+			name: "Obfuscated identifiers",
+			el:   ForwardedElement{ForObfuscated: "_hidden", ByObfuscated: "unknown"},
+			want: `for=_hidden;by=unknown`,
+		},
+		{
+			name: "Ports",
+			el: ForwardedElement{
+				For:          mustParseIPAddrPtr("2001:db8::1"),
+				ForPort:      "443",
+				ByObfuscated: "_proxy",
+				ByPort:       "_port",
+			},
+			want: `for="[2001:db8::1]:443";by="_proxy:_port"`,
+		},
+		{
+			name: "IPv4 with port",
+			el:   ForwardedElement{For: mustParseIPAddrPtr("192.0.2.60"), ForPort: "8080"},
+			want: `for="192.0.2.60:8080"`,
+		},
+		{
+			name: "IP takes precedence over obfuscated identifier",
+			el:   ForwardedElement{For: mustParseIPAddrPtr("192.0.2.60"), ForObfuscated: "_hidden"},
+			want: `for=192.0.2.60`,
+		},
+		{
+			name: "All directives",
+			el: ForwardedElement{
+				For:        mustParseIPAddrPtr("2001:db8::1"),
+				By:         mustParseIPAddrPtr("203.0.113.43"),
+				Host:       "example.com:8080",
+				Proto:      "https",
+				Extensions: map[string]string{"Zext": "token", "aext": `needs "quoting"`},
+			},
+			want: `for="[2001:db8::1]";by=203.0.113.43;host="example.com:8080";proto=https;aext="needs \"quoting\"";zext=token`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FormatForwarded(tt.el)
+			if got != tt.want {
+				t.Fatalf("FormatForwarded() = %q, want %q", got, tt.want)
+			}
+
+			// Make sure it round-trips
+			if got == "" {
+				return
+			}
+			parsed := ParseForwarded(got)
+			if len(parsed) != 1 || FormatForwarded(parsed[0]) != got {
+				t.Fatalf("FormatForwarded round-trip failed: %q -> %+v", got, parsed)
+			}
+		})
+	}
+}
+
+func TestAppendXForwardedFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		clientIP string
+		want     string
+	}{
+		{
+			name:     "Empty existing",
+			existing: "",
+			clientIP: "1.1.1.1",
+			want:     "1.1.1.1",
+		},
+		{
+			name:     "Whitespace-only existing",
+			existing: " \t",
+			clientIP: "1.1.1.1",
+			want:     "1.1.1.1",
+		},
+		{
+			name:     "Append",
+			existing: "1.1.1.1, 2.2.2.2",
+			clientIP: "3.3.3.3",
+			want:     "1.1.1.1, 2.2.2.2, 3.3.3.3",
+		},
+		{
+			name:     "Trailing comma",
+			existing: "1.1.1.1, 2.2.2.2 , ,",
+			clientIP: "3.3.3.3",
+			want:     "1.1.1.1, 2.2.2.2, 3.3.3.3",
+		},
+		{
+			name:     "IPv6 with zone",
+			existing: "1.1.1.1",
+			clientIP: "fe80::1%eth0",
+			want:     "1.1.1.1, fe80::1%eth0",
+		},
+		{
+			name:     "IPv4-mapped IPv6",
+			existing: "",
+			clientIP: "::ffff:1.1.1.1",
+			want:     "1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientIP := MustParseIPAddr(tt.clientIP)
+			got := AppendXForwardedFor(tt.existing, clientIP)
+			if got != tt.want {
+				t.Fatalf("AppendXForwardedFor() = %q, want %q", got, tt.want)
+			}
+
+			// The result should be parsed correctly by the strategies
+			strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))
+			if ip := strat.ClientIP(http.Header{"X-Forwarded-For": []string{got}}, ""); ip != clientIP.String() {
+				t.Fatalf("appended IP not derived; got %q", ip)
+			}
+		})
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    string
+	}{
+		{
+			name:    "No headers",
+			headers: http.Header{},
+			want:    "",
+		},
+		{
+			name:    "X-Forwarded-Proto",
+			headers: http.Header{"X-Forwarded-Proto": []string{"https"}},
+			want:    "https",
+		},
+		{
+			name:    "Last X-Forwarded-Proto value, lowercased",
+			headers: http.Header{"X-Forwarded-Proto": []string{"http", "http, HTTPS , "}},
+			want:    "https",
+		},
+		{
+			name: "X-Forwarded-Proto takes precedence",
+			headers: http.Header{
+				"X-Forwarded-Proto": []string{"http"},
+				"Forwarded":         []string{"for=1.1.1.1;proto=https"},
+			},
+			want: "http",
+		},
+		{
+			name:    "Forwarded",
+			headers: http.Header{"Forwarded": []string{`for=1.1.1.1;proto=http, for=2.2.2.2;proto="HTTPS";host="a,b"`}},
+			want:    "https",
+		},
+		{
+			name:    "Fail: last Forwarded element has no proto",
+			headers: http.Header{"Forwarded": []string{"for=1.1.1.1;proto=https", "for=2.2.2.2"}},
+			want:    "",
+		},
+		{
+			name: "Fail: invalid X-Forwarded-Proto doesn't fall back",
+			headers: http.Header{
+				"X-Forwarded-Proto": []string{"wss"},
+				"Forwarded":         []string{"for=1.1.1.1;proto=https"},
+			},
+			want: "",
+		},
+		{
+			name:    "Fail: empty X-Forwarded-Proto",
+			headers: http.Header{"X-Forwarded-Proto": []string{" , "}},
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ForwardedProto(tt.headers); got != tt.want {
+				t.Fatalf("ForwardedProto() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedHost(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      http.Header
+		want         string
+		wantHostname string
+	}{
+		{
+			name:    "No headers",
+			headers: http.Header{},
+		},
+		{
+			name:         "X-Forwarded-Host",
+			headers:      http.Header{"X-Forwarded-Host": []string{"example.com"}},
+			want:         "example.com",
+			wantHostname: "example.com",
+		},
+		{
+			name:         "Last X-Forwarded-Host value, with port",
+			headers:      http.Header{"X-Forwarded-Host": []string{"a.example.com", "b.example.com, c.example.com:8443 , "}},
+			want:         "c.example.com:8443",
+			wantHostname: "c.example.com",
+		},
+		{
+			name:         "IPv6 with port",
+			headers:      http.Header{"X-Forwarded-Host": []string{"[2001:db8::1]:8443"}},
+			want:         "[2001:db8::1]:8443",
+			wantHostname: "2001:db8::1",
+		},
+		{
+			name:         "IPv6 without port",
+			headers:      http.Header{"X-Forwarded-Host": []string{"[2001:db8::1]"}},
+			want:         "[2001:db8::1]",
+			wantHostname: "2001:db8::1",
+		},
+		{
+			name: "X-Forwarded-Host takes precedence",
+			headers: http.Header{
+				"X-Forwarded-Host": []string{"a.example.com"},
+				"Forwarded":        []string{"for=1.1.1.1;host=b.example.com"},
+			},
+			want:         "a.example.com",
+			wantHostname: "a.example.com",
+		},
+		{
+			name:         "Forwarded",
+			headers:      http.Header{"Forwarded": []string{`for=1.1.1.1;host=a.example.com, for=2.2.2.2;host="b.example.com:8080"`}},
+			want:         "b.example.com:8080",
+			wantHostname: "b.example.com",
+		},
+		{
+			name:    "Fail: last Forwarded element has no host",
+			headers: http.Header{"Forwarded": []string{"for=1.1.1.1;host=a.example.com", "for=2.2.2.2"}},
+		},
+		{
+			name:    "Fail: control character",
+			headers: http.Header{"X-Forwarded-Host": []string{"example.com\x00evil"}},
+		},
+		{
+			name:    "Fail: whitespace",
+			headers: http.Header{"Forwarded": []string{`host="example.com evil"`}},
+		},
+		{
+			name:    "Fail: bad port",
+			headers: http.Header{"X-Forwarded-Host": []string{"example.com:http"}},
+		},
+		{
+			name:    "Fail: empty port",
+			headers: http.Header{"X-Forwarded-Host": []string{"example.com:"}},
+		},
+		{
+			name:    "Fail: unbracketed IPv6",
+			headers: http.Header{"X-Forwarded-Host": []string{"2001:db8::1"}},
+		},
+		{
+			name:    "Fail: unclosed bracket",
+			headers: http.Header{"X-Forwarded-Host": []string{"[2001:db8::1:8443"}},
+		},
+		{
+			name:    "Fail: bracketed non-IPv6",
+			headers: http.Header{"X-Forwarded-Host": []string{"[example.com]"}},
+		},
+		{
+			name:    "Fail: junk after bracket",
+			headers: http.Header{"X-Forwarded-Host": []string{"[2001:db8::1]8443"}},
+		},
+		{
+			name:    "Fail: no hostname",
+			headers: http.Header{"X-Forwarded-Host": []string{":8443"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ForwardedHost(tt.headers); got != tt.want {
+				t.Fatalf("ForwardedHost() = %q, want %q", got, tt.want)
+			}
+			if got := ForwardedHostname(tt.headers); got != tt.wantHostname {
+				t.Fatalf("ForwardedHostname() = %q, want %q", got, tt.wantHostname)
+			}
+		})
+	}
+}
+
+func TestDeriveRequestInfo(t *testing.T) {
+	strat := Must(NewRightmostTrustedCountStrategy("Forwarded", 1))
+
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    RequestInfo
+	}{
+		{
+			name:    "No headers",
+			headers: http.Header{},
+			want:    RequestInfo{},
+		},
+		{
+			name:    "Forwarded",
+			headers: http.Header{"Forwarded": []string{`for=1.1.1.1;proto=https;host=example.com`}},
+			want:    RequestInfo{ClientIP: "1.1.1.1", Proto: "https", Host: "example.com", Port: "443"},
+		},
+		{
+			name: "X-Forwarded headers, with port",
+			headers: http.Header{
+				"Forwarded":         []string{`for="[2600:1f18::99]"`},
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"[2001:db8::1]:8080"},
+			},
+			want: RequestInfo{ClientIP: "2600:1f18::99", Proto: "http", Host: "2001:db8::1", Port: "8080"},
+		},
+		{
+			name:    "No proto",
+			headers: http.Header{"X-Forwarded-Host": []string{"example.com"}},
+			want:    RequestInfo{Host: "example.com"},
+		},
+		{
+			name: "Invalid host",
+			headers: http.Header{
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"example.com:bad"},
+			},
+			want: RequestInfo{Proto: "http", Port: "80"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DeriveRequestInfo(strat, tt.headers, "9.9.9.9:1234"); got != tt.want {
+				t.Fatalf("DeriveRequestInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateXFF(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{
+			name:  "Empty",
+			value: "",
+			want:  nil,
+		},
+		{
+			name:  "All good",
+			value: "1.1.1.1, [2600:1f18::99%eth0]:4711, 3.3.3.3:80",
+			want:  nil,
+		},
+		{
+			name:  "Problems",
+			value: "nope, , 0.0.0.0, 10.0.0.1, 1.1.1.1, unknown,[::]:80, fe80::1%eth0",
+			want: []string{
+				`X-Forwarded-For item 0 ("nope"): not a valid IP address`,
+				`X-Forwarded-For item 1 ("0.0.0.0"): unspecified IP address`,
+				`X-Forwarded-For item 2 ("10.0.0.1"): private or local IP address`,
+				`X-Forwarded-For item 4 ("unknown"): not a valid IP address`,
+				`X-Forwarded-For item 5 ("[::]:80"): unspecified IP address`,
+				`X-Forwarded-For item 6 ("fe80::1%eth0"): private or local IP address`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range ValidateXFF(tt.value) {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ValidateXFF() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	errs := ValidateXFF("1.1.1.1, 192.168.1.1, nope")
+	if len(errs) != 2 || !errors.Is(errs[0], ErrPrivateIP) || !errors.Is(errs[1], ErrNotIP) {
+		t.Fatalf("ValidateXFF() = %v, want ErrPrivateIP and ErrNotIP", errs)
+	}
+	var itemErr *XFFItemError
+	if !errors.As(errs[1], &itemErr) || itemErr.Index != 2 || itemErr.Item != "nope" {
+		t.Fatalf("ValidateXFF() error = %#v, want index 2, item nope", errs[1])
+	}
+
+	if errs := ValidateXFF(strings.Repeat("1.1.1.1,", MaxListItems+1)); len(errs) != 1 || errors.As(errs[0], &itemErr) {
+		t.Fatalf("ValidateXFF() = %v, want a single too-many-items error", errs)
+	}
+}
+
+func TestSanitizeXFF(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "Empty",
+			value: "",
+			want:  "",
+		},
+		{
+			name:  "Already clean",
+			value: "1.1.1.1, 2001:db8::1",
+			want:  "1.1.1.1, 2001:db8::1",
+		},
+		{
+			name:  "Normalized",
+			value: "1.1.1.1:1234,[2001:DB8::1]:4711,  [fe80::1%eth0]  ,::ffff:3.3.3.3",
+			want:  "1.1.1.1, 2001:db8::1, fe80::1%eth0, 3.3.3.3",
+		},
+		{
+			name:  "Invalid and empty items dropped",
+			value: "nope, , 1.1.1.1, unknown, 0.0.0.0, [::]:80,, 10.0.0.1, ",
+			want:  "1.1.1.1, 10.0.0.1",
+		},
+		{
+			name:  "Nothing valid",
+			value: "nope, unknown, ,",
+			want:  "",
+		},
+		{
+			name:  "Too many items",
+			value: strings.Repeat("1.1.1.1,", MaxListItems+1),
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeXFF(tt.value); got != tt.want {
+				t.Fatalf("SanitizeXFF() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
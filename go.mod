@@ -1,3 +1,3 @@
 module github.com/realclientip/realclientip-go
 
-go 1.13
+go 1.19
@@ -0,0 +1,44 @@
+// SPDX: 0BSD
+
+//go:build go1.21
+
+package realclientip
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger makes a strategy log each derivation to logger, at debug level: the header
+// value that was considered, and the resulting IP and reason. This is useful when
+// setting up a new proxy or CDN, to check that the header, counts, or ranges are right.
+// Derivations are never logged at info level or higher, so they won't flood the logs if
+// debug logging is disabled. If logger is nil (the default), nothing is logged and there is no
+// overhead. It can be used together with WithObserver, and is supported by the same
+// strategies.
+// Constructors that can warn about their configuration (like NewSingleIPHeaderStrategy,
+// for a commonly spoofable header) also log the warnings to logger, at warn level.
+// It is only available with Go 1.21 or later, as it uses log/slog.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logObserver = nil
+		o.logWarning = nil
+		if logger == nil {
+			return
+		}
+
+		o.logWarning = func(w Warning) {
+			logger.LogAttrs(context.Background(), slog.LevelWarn, "realclientip strategy configuration warning",
+				slog.String("header", w.Header), slog.String("warning", w.Message))
+		}
+
+		o.logObserver = func(result string, reason Reason, header string) {
+			ctx := context.Background()
+			if !logger.Enabled(ctx, slog.LevelDebug) {
+				return
+			}
+			logger.LogAttrs(ctx, slog.LevelDebug, "realclientip derived client IP",
+				slog.String("ip", result), slog.String("reason", reason.String()), slog.String("header", header))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// SPDX: 0BSD
+
+//go:build go1.21
+
+package realclientip
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var observed []string
+	strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, WithLogger(logger),
+		WithObserver(func(result string, reason Reason, header string) { observed = append(observed, result) })))
+
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2"}}
+	if got := strat.ClientIP(headers, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+	strat.ClientIP(http.Header{}, "")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2: %q", len(lines), buf.String())
+	}
+	for i, want := range []string{`level=DEBUG msg="realclientip derived client IP" ip=2.2.2.2 reason=found header="1.1.1.1, 2.2.2.2"`,
+		`level=DEBUG msg="realclientip derived client IP" ip="" reason="header missing" header=""`} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Fatalf("log line %d = %q, want suffix %q", i, lines[i], want)
+		}
+	}
+
+	// The observer is still called
+	if len(observed) != 2 || observed[0] != "2.2.2.2" {
+		t.Fatalf("observed = %q", observed)
+	}
+
+	// Nothing is logged above debug level
+	buf.Reset()
+	logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	Must(NewSingleIPHeaderStrategy("X-Real-IP", WithLogger(logger))).ClientIP(http.Header{"X-Real-Ip": []string{"1.1.1.1"}}, "")
+	if buf.Len() != 0 {
+		t.Fatalf("logged at info level: %q", buf.String())
+	}
+
+	// A nil logger removes the logging
+	buf.Reset()
+	strat = Must(NewSingleIPHeaderStrategy("X-Real-IP", WithLogger(logger), WithLogger(nil)))
+	if s := strat.(SingleIPHeaderStrategy); s.observer != nil {
+		t.Fatalf("observer set for nil logger")
+	}
+}
+
+func TestWithLogger_warnings(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	Must(NewSingleIPHeaderStrategy("x-client-ip", WithLogger(logger)))
+	want := `level=WARN msg="realclientip strategy configuration warning" header=X-Client-Ip warning=`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("log = %q, want %q", buf.String(), want)
+	}
+
+	// No warning for a header that isn't known to be spoofable
+	buf.Reset()
+	Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP", WithLogger(logger)))
+	if buf.Len() != 0 {
+		t.Fatalf("logged warning: %q", buf.String())
+	}
+}
@@ -0,0 +1,108 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// clientIPCtxKey is the context key under which Middleware stores the client IP.
+type clientIPCtxKey struct{}
+
+// MiddlewareOption configures the behaviour of Middleware.
+type MiddlewareOption func(*middlewareOptions)
+
+// middlewareOptions holds the values set by MiddlewareOption functions.
+type middlewareOptions struct {
+	rejectMissingIP bool
+}
+
+// WithRejectMissingIP makes Middleware respond with 400 Bad Request, rather than calling
+// the next handler, if no client IP can be derived. By default, the request is passed
+// through, and ClientIPFromContext will report that there is no IP.
+// Remember that a failure to derive the client IP usually indicates a misconfiguration
+// (see the "Strategy failures" section of the README), so it should be logged either way.
+func WithRejectMissingIP(reject bool) MiddlewareOption {
+	return func(o *middlewareOptions) {
+		o.rejectMissingIP = reject
+	}
+}
+
+// Middleware returns an HTTP middleware that derives the client IP using strat and stores
+// it in the request context, from where it can be retrieved with ClientIPFromContext.
+// It has the standard signature, so it can be used with the stdlib, chi, and other
+// routers. For example:
+//
+//	handler = realclientip.Middleware(strat)(handler)
+//
+// The supported option is WithRejectMissingIP.
+func Middleware(strat Strategy, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	var o middlewareOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := strat.ClientIP(r.Header, r.RemoteAddr)
+			if clientIP == "" {
+				if o.rejectMissingIP {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), clientIPCtxKey{}, clientIP))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RewriteRemoteAddrMiddleware returns an HTTP middleware that derives the client IP using
+// strat and overwrites the request's RemoteAddr with it, for code that reads RemoteAddr
+// directly and can't be changed (like some loggers and other middlewares). The port of
+// the original RemoteAddr is kept, or "0" is used if it has none; it is the port of the
+// connecting peer, not of the client, so it shouldn't be relied upon. If no client IP can
+// be derived, RemoteAddr is left untouched.
+// The next handler gets a shallow copy of the request, so the original is not modified.
+//
+// Security note: after this middleware, RemoteAddr is only as trustworthy as strat, and
+// the socket IP is no longer available to the handlers after it. In particular, it must
+// not be followed by anything (including another instance of this middleware, or a
+// strategy using RemoteAddrStrategy or TrustedPeerStrategy) that assumes RemoteAddr is
+// the connecting peer, as a spoofed header could then appear to come from a trusted
+// proxy. If you can change the code that needs the client IP, prefer Middleware.
+func RewriteRemoteAddrMiddleware(strat Strategy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := strat.ClientIP(r.Header, r.RemoteAddr)
+			if clientIP == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			port := "0"
+			if _, p, err := net.SplitHostPort(r.RemoteAddr); err == nil && p != "" {
+				port = p
+			}
+
+			// Handlers must not modify the request they are given, so make a shallow copy.
+			// (WithContext is the cheapest way to do that, as Clone also copies the headers.)
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = net.JoinHostPort(clientIP, port)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIPFromContext returns the client IP stored in ctx by Middleware. ok is false if
+// there is none, either because Middleware was not used or because no client IP could
+// be derived.
+func ClientIPFromContext(ctx context.Context) (clientIP string, ok bool) {
+	clientIP, ok = ctx.Value(clientIPCtxKey{}).(string)
+	return clientIP, ok
+}
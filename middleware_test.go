@@ -0,0 +1,146 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	var gotIP string
+	var gotOK, called bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		gotIP, gotOK = ClientIPFromContext(r.Context())
+	})
+
+	tests := []struct {
+		name       string
+		opts       []MiddlewareOption
+		xff        string
+		wantCalled bool
+		wantIP     string
+		wantOK     bool
+		wantStatus int
+	}{
+		{
+			name:       "Found",
+			xff:        "1.1.1.1, 2.2.2.2, 192.168.1.1",
+			wantCalled: true,
+			wantIP:     "2.2.2.2",
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Not found, pass through",
+			xff:        "192.168.1.1",
+			wantCalled: true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Found, reject option",
+			opts:       []MiddlewareOption{WithRejectMissingIP(true)},
+			xff:        "2.2.2.2",
+			wantCalled: true,
+			wantIP:     "2.2.2.2",
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Not found, reject",
+			opts:       []MiddlewareOption{WithRejectMissingIP(true)},
+			xff:        "nope",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIP, gotOK, called = "", false, false
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			rec := httptest.NewRecorder()
+
+			Middleware(strat, tt.opts...)(handler).ServeHTTP(rec, req)
+
+			if called != tt.wantCalled {
+				t.Fatalf("handler called = %v, want %v", called, tt.wantCalled)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if gotIP != tt.wantIP || gotOK != tt.wantOK {
+				t.Fatalf("ClientIPFromContext = (%q, %v), want (%q, %v)", gotIP, gotOK, tt.wantIP, tt.wantOK)
+			}
+		})
+	}
+
+	// A context that didn't go through the middleware
+	if ip, ok := ClientIPFromContext(context.Background()); ip != "" || ok {
+		t.Fatalf("ClientIPFromContext without middleware = (%q, %v)", ip, ok)
+	}
+}
+
+func TestRewriteRemoteAddrMiddleware(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	var gotRemoteAddr string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRemoteAddr = r.RemoteAddr
+	})
+
+	tests := []struct {
+		name       string
+		xff        string
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "Port kept",
+			xff:        "1.1.1.1, 2.2.2.2, 192.168.1.1",
+			remoteAddr: "192.168.1.2:1234",
+			want:       "2.2.2.2:1234",
+		},
+		{
+			name:       "IPv6 with zone",
+			xff:        "[2600:1f18::99%eth0]:4321",
+			remoteAddr: "192.168.1.2:1234",
+			want:       "[2600:1f18::99%eth0]:1234",
+		},
+		{
+			name:       "No port",
+			xff:        "2.2.2.2",
+			remoteAddr: "192.168.1.2",
+			want:       "2.2.2.2:0",
+		},
+		{
+			name:       "Not found, untouched",
+			xff:        "192.168.1.1",
+			remoteAddr: "192.168.1.2:1234",
+			want:       "192.168.1.2:1234",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotRemoteAddr = ""
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			req.RemoteAddr = tt.remoteAddr
+
+			RewriteRemoteAddrMiddleware(strat)(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+			if gotRemoteAddr != tt.want {
+				t.Fatalf("RemoteAddr = %q, want %q", gotRemoteAddr, tt.want)
+			}
+			if req.RemoteAddr != tt.remoteAddr {
+				t.Fatalf("original request modified: RemoteAddr = %q", req.RemoteAddr)
+			}
+		})
+	}
+}
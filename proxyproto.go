@@ -0,0 +1,194 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrProxyProtocolUnknown is returned by ParseProxyProtocolV1 when the PROXY line has the
+// UNKNOWN protocol. In that case the connection's addresses are not known (for example,
+// it may be a health check from the proxy itself), and the receiver must use the real
+// connection addresses instead.
+var ErrProxyProtocolUnknown = errors.New("PROXY protocol connection is UNKNOWN")
+
+// proxyProtocolV1MaxLen is the maximum length of a PROXY protocol v1 line, including
+// the CRLF, per the spec.
+const proxyProtocolV1MaxLen = 107
+
+// ParseProxyProtocolV1 parses a PROXY protocol version 1 line (as sent by HAProxy, AWS
+// NLB, and others) and returns the source (client) IP and port. The line looks like:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+//	PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n
+//	PROXY UNKNOWN\r\n
+//
+// The trailing CRLF is optional. If the protocol is UNKNOWN, ErrProxyProtocolUnknown is
+// returned. Otherwise an error is returned if the line is malformed, if an address
+// doesn't match the protocol family, or if the source IP is not valid.
+// The addresses must be bare IPs: brackets and ports are errors. The spec doesn't allow
+// zones in TCP6 addresses either, but they are tolerated; they are errors for TCP4.
+// See: https://www.haproxy.org/download/2.6/doc/proxy-protocol.txt
+func ParseProxyProtocolV1(line string) (srcIP net.IPAddr, srcPort int, err error) {
+	if len(line) > proxyProtocolV1MaxLen {
+		return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol line is too long: %d bytes", len(line))
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	// The fields are separated by exactly one space, so we don't use strings.Fields
+	fields := strings.Split(line, " ")
+
+	if fields[0] != "PROXY" {
+		return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol line does not start with PROXY: %q", line)
+	}
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The rest of the line, if any, must be ignored
+		return net.IPAddr{}, 0, ErrProxyProtocolUnknown
+	}
+
+	if len(fields) != 6 {
+		return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol line has wrong number of fields: %q", line)
+	}
+
+	proto, srcStr, dstStr, srcPortStr, dstPortStr := fields[1], fields[2], fields[3], fields[4], fields[5]
+
+	var wantIPv6 bool
+	switch proto {
+	case "TCP4":
+		wantIPv6 = false
+	case "TCP6":
+		wantIPv6 = true
+	default:
+		return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol line has unsupported protocol: %q", proto)
+	}
+
+	// We only need the source IP, but the destination must also be sane
+	for _, addr := range []string{srcStr, dstStr} {
+		// An IPv6 address, even an IPv4-mapped one, must contain a colon
+		if strings.Contains(addr, ":") != wantIPv6 {
+			return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol address %q does not match protocol %s", addr, proto)
+		}
+
+		// ParseIPAddr would accept brackets and strip a port, but neither is allowed here.
+		// The ports are in their own fields, so an address with one is malformed.
+		host, zone := SplitHostZone(addr)
+		if net.ParseIP(host) == nil {
+			return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol address is invalid: %q", addr)
+		}
+
+		// IPv4 addresses can't have zones, even where they are tolerated for TCP6
+		if zone != "" && !wantIPv6 {
+			return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol address %q must not have a zone for protocol %s", addr, proto)
+		}
+	}
+
+	ipAddr := goodIPAddr(srcStr)
+	if ipAddr == nil {
+		return net.IPAddr{}, 0, fmt.Errorf("PROXY protocol source address is invalid: %q", srcStr)
+	}
+
+	srcPort, err = parseProxyProtocolPort(srcPortStr)
+	if err != nil {
+		return net.IPAddr{}, 0, err
+	}
+
+	if _, err = parseProxyProtocolPort(dstPortStr); err != nil {
+		return net.IPAddr{}, 0, err
+	}
+
+	return *ipAddr, srcPort, nil
+}
+
+// parseProxyProtocolPort parses a PROXY protocol v1 port, which must be a decimal
+// number in the range 0-65535.
+func parseProxyProtocolPort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("PROXY protocol port is invalid: %q", s)
+	}
+	return int(port), nil
+}
+
+// ProxyProtocolStrategy derives the client IP from a PROXY protocol version 1 line that
+// has been placed in a request header. The PROXY protocol is used by HAProxy, AWS NLB,
+// and others to convey the client IP at the connection level, rather than in an HTTP
+// header. A server (or a connection wrapper in front of it) that accepts the PROXY
+// protocol can populate a header with the received line so that this strategy can
+// derive the client IP from it.
+// You must ensure that the header can only be set by your own code, and that any
+// client-supplied instance of it is removed. Otherwise it can be trivially spoofed.
+type ProxyProtocolStrategy struct {
+	headerName string
+	stripZone  bool
+	keepMapped bool
+	observer   Observer
+}
+
+// NewProxyProtocolStrategy creates a ProxyProtocolStrategy that uses the headerName
+// request header to get the PROXY protocol line.
+// The supported options are WithZone, WithMappedIPv6, and WithObserver.
+func NewProxyProtocolStrategy(headerName string, opts ...Option) (ProxyProtocolStrategy, error) {
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll canonicalize here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	if err := validateSingleIPHeaderName("ProxyProtocolStrategy", headerName); err != nil {
+		return ProxyProtocolStrategy{}, err
+	}
+
+	o := applyOptions(opts)
+
+	return ProxyProtocolStrategy{headerName: headerName, stripZone: o.stripZone, keepMapped: o.keepMapped, observer: o.observer}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned. This includes the case
+// where the PROXY protocol line has the UNKNOWN protocol.
+func (strat ProxyProtocolStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat ProxyProtocolStrategy) Validate() error {
+	return validateSingleIPHeaderName("ProxyProtocolStrategy", strat.headerName)
+}
+
+func (strat ProxyProtocolStrategy) String() string {
+	return fmt.Sprintf("{headerName:%v%s%s}", strat.headerName, zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped))
+}
+
+func (strat ProxyProtocolStrategy) derive(headers HeaderGetter, _ string) result {
+	return strat.observer.observe(strat.deriveHeader(headers), headers, strat.headerName)
+}
+
+// deriveHeader derives the client IP from the header, without notifying the observer.
+func (strat ProxyProtocolStrategy) deriveHeader(headers HeaderGetter) result {
+	line := lastHeader(headers, strat.headerName)
+	if line == "" {
+		return result{reason: ReasonHeaderMissing}
+	}
+
+	srcIP, _, err := ParseProxyProtocolV1(line)
+	if err != nil {
+		return result{reason: ReasonNoValidIP}
+	}
+
+	// The source address is the third field, like "PROXY TCP6 ::ffff:192.0.2.1 ..."
+	mapped := false
+	if fields := strings.Fields(line); strat.keepMapped && len(fields) > 2 {
+		mapped = isMappedIPv6Notation(fields[2])
+	}
+
+	return result{ipAddr: &srcIP, raw: line, reason: ReasonFound, mapped: mapped}.withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+}
@@ -0,0 +1,253 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseProxyProtocolV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantIP   net.IPAddr
+		wantPort int
+		wantErr  error
+		anyErr   bool
+	}{
+		{
+			name:     "TCP4 with CRLF",
+			line:     "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			wantIP:   MustParseIPAddr("192.0.2.1"),
+			wantPort: 56324,
+		},
+		{
+			name:     "TCP4 without CRLF",
+			line:     "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222",
+			wantIP:   MustParseIPAddr("1.2.3.4"),
+			wantPort: 1111,
+		},
+		{
+			name:     "TCP4 with LF only",
+			line:     "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\n",
+			wantIP:   MustParseIPAddr("1.2.3.4"),
+			wantPort: 1111,
+		},
+		{
+			name:     "TCP6",
+			line:     "PROXY TCP6 2001:db8::1 2001:db8::2 65535 443\r\n",
+			wantIP:   MustParseIPAddr("2001:db8::1"),
+			wantPort: 65535,
+		},
+		{
+			name:     "TCP6 with zone",
+			line:     "PROXY TCP6 fe80::1%eth0 fe80::2%eth0 0 443\r\n",
+			wantIP:   MustParseIPAddr("fe80::1%eth0"),
+			wantPort: 0,
+		},
+		{
+			name:     "TCP6 with IPv4-mapped address",
+			line:     "PROXY TCP6 ::ffff:1.2.3.4 ::ffff:5.6.7.8 1111 2222\r\n",
+			wantIP:   MustParseIPAddr("1.2.3.4"),
+			wantPort: 1111,
+		},
+		{
+			name:    "UNKNOWN",
+			line:    "PROXY UNKNOWN\r\n",
+			wantErr: ErrProxyProtocolUnknown,
+		},
+		{
+			name:    "UNKNOWN with addresses",
+			line:    "PROXY UNKNOWN 1.2.3.4 5.6.7.8 1111 2222\r\n",
+			wantErr: ErrProxyProtocolUnknown,
+		},
+		{
+			name:   "Error: not PROXY",
+			line:   "GET / HTTP/1.1\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: empty",
+			line:   "",
+			anyErr: true,
+		},
+		{
+			name:   "Error: too few fields",
+			line:   "PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: double space",
+			line:   "PROXY TCP4  1.2.3.4 5.6.7.8 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bad protocol",
+			line:   "PROXY UDP4 1.2.3.4 5.6.7.8 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: IPv6 with TCP4",
+			line:   "PROXY TCP4 2001:db8::1 5.6.7.8 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: IPv4 with TCP6",
+			line:   "PROXY TCP6 1.2.3.4 2001:db8::2 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bad source IP",
+			line:   "PROXY TCP4 1.2.3.999 5.6.7.8 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: unspecified source IP",
+			line:   "PROXY TCP4 0.0.0.0 5.6.7.8 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bad destination IP",
+			line:   "PROXY TCP4 1.2.3.4 nope 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bracketed source IP",
+			line:   "PROXY TCP6 [2001:db8::1] 2001:db8::2 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bracketed source IP with port",
+			line:   "PROXY TCP6 [2001:db8::1]:80 2001:db8::2 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bracketed destination IP with zone",
+			line:   "PROXY TCP6 fe80::1%eth0 [fe80::2%eth0] 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: IPv4 source IP with port",
+			line:   "PROXY TCP4 1.2.3.4:80 5.6.7.8 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: IPv4 source IP with zone",
+			line:   "PROXY TCP4 1.2.3.4%eth0 5.6.7.8 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: IPv4 destination IP with zone",
+			line:   "PROXY TCP4 1.2.3.4 5.6.7.8%eth0 1111 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bad source port",
+			line:   "PROXY TCP4 1.2.3.4 5.6.7.8 65536 2222\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: bad destination port",
+			line:   "PROXY TCP4 1.2.3.4 5.6.7.8 1111 -1\r\n",
+			anyErr: true,
+		},
+		{
+			name:   "Error: too long",
+			line:   "PROXY TCP6 2001:db8:1111:2222:3333:4444:5555:6666 2001:db8:1111:2222:3333:4444:5555:7777 65535 65535 extra\r\n",
+			anyErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIP, gotPort, err := ParseProxyProtocolV1(tt.line)
+			if tt.wantErr != nil || tt.anyErr {
+				if err == nil {
+					t.Fatalf("ParseProxyProtocolV1 did not return error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ParseProxyProtocolV1 error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseProxyProtocolV1 error = %v", err)
+			}
+
+			if !ipAddrsEqual(gotIP, tt.wantIP) || gotPort != tt.wantPort {
+				t.Fatalf("ParseProxyProtocolV1 = (%v, %d), want (%v, %d)", gotIP, gotPort, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = ProxyProtocolStrategy{}
+
+	tests := []struct {
+		name       string
+		headerName string
+		headers    http.Header
+		want       string
+		wantReason Reason
+		wantErr    bool
+	}{
+		{
+			name:       "Valid line",
+			headerName: "x-proxy-protocol",
+			headers:    http.Header{"X-Proxy-Protocol": []string{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n"}},
+			want:       "1.2.3.4",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Fail: UNKNOWN",
+			headerName: "X-Proxy-Protocol",
+			headers:    http.Header{"X-Proxy-Protocol": []string{"PROXY UNKNOWN\r\n"}},
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Fail: missing header",
+			headerName: "X-Proxy-Protocol",
+			headers:    http.Header{"X-Real-Ip": []string{"1.2.3.4"}},
+			want:       "",
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Error: empty header name",
+			headerName: "",
+			wantErr:    true,
+		},
+		{
+			name:       "Error: X-Forwarded-For header",
+			headerName: "X-Forwarded-For",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewProxyProtocolStrategy(tt.headerName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewProxyProtocolStrategy error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got, reason := ClientIPDetail(strat, tt.headers, "")
+			if got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+
+			if got := strat.ClientIP(tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -140,3 +140,7 @@ var CloudFront = []string{
 	"44.234.108.128/25",
 	"44.234.90.252/30",
 }
+
+// AWSCloudFrontIPRanges is the same list as CloudFront, under the name that matches
+// FastlyIPRanges and GCPLoadBalancerIPRanges.
+var AWSCloudFrontIPRanges = CloudFront
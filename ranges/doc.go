@@ -0,0 +1,12 @@
+// Package ranges contains copies of the IP ranges published by some common CDN and cloud
+// providers. They are suitable for passing to realclientip.AddressesAndRangesToIPNets to
+// build the trusted ranges for realclientip.RightmostTrustedRangeStrategy.
+//
+// These lists are snapshots and will become stale. Each is documented with its source, so
+// that it can be refreshed; when possible, prefer retrieving the ranges from the provider
+// at runtime.
+//
+// Akamai is deliberately not included: its edge ranges are not published as a single
+// list, and the ranges that connect to an origin are specific to each customer's Site
+// Shield map. Those should be obtained from Akamai and configured directly.
+package ranges
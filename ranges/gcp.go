@@ -0,0 +1,11 @@
+package ranges
+
+// The IP ranges that Google Cloud's external Application Load Balancers (and their health
+// checks) connect from.
+// Taken from https://cloud.google.com/load-balancing/docs/firewall-rules, retrieved 2026-10.
+// Note that these are the ranges the load balancer proxies use to connect to backends,
+// so they are the ranges to trust when the load balancer appends to X-Forwarded-For.
+var GCPLoadBalancerIPRanges = []string{
+	"35.191.0.0/16",
+	"130.211.0.0/22",
+}
@@ -0,0 +1,149 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// RangeSet is an immutable set of IP ranges that can be checked for containment in
+// O(log n) time. It is an alternative to the []net.IPNet used by
+// RightmostTrustedRangeStrategy, for when there are many ranges (for example, AWS
+// publishes hundreds), as checking a []net.IPNet requires a linear scan.
+// A RangeSet is safe for concurrent use.
+type RangeSet struct {
+	// v4 and v6 are sorted, non-overlapping, masked prefixes
+	v4, v6 []netip.Prefix
+}
+
+// NewRangeSet creates a RangeSet containing the given prefixes. Overlapping prefixes are
+// merged, so the prefixes in the set may differ from those given (see Prefixes).
+// IPv4-mapped IPv6 prefixes (like "::ffff:188.0.2.0/120") are converted to the
+// equivalent IPv4 prefix (like "188.0.2.0/24"), for consistency with
+// AddressesAndRangesToIPNets. (A mapped prefix shorter than /96 covers more than the
+// mapped range, so it is left as IPv6.)
+// An error is returned if any of the prefixes is invalid.
+func NewRangeSet(prefixes ...netip.Prefix) (*RangeSet, error) {
+	set := &RangeSet{}
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			return nil, fmt.Errorf("invalid prefix %q", p)
+		}
+
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		p = p.Masked()
+
+		if p.Addr().Is4() {
+			set.v4 = append(set.v4, p)
+		} else {
+			set.v6 = append(set.v6, p)
+		}
+	}
+
+	set.v4 = mergePrefixes(set.v4)
+	set.v6 = mergePrefixes(set.v6)
+	return set, nil
+}
+
+// mergePrefixes sorts prefixes (which must all be of the same family and masked) and
+// removes any that are contained in another.
+func mergePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Addr() != prefixes[j].Addr() {
+			return prefixes[i].Addr().Less(prefixes[j].Addr())
+		}
+		// Larger ranges first, so that the ranges within them are dropped
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+
+	// CIDR ranges either nest or don't overlap at all. As the prefixes are sorted, any
+	// prefix that's contained in a previous one is contained in the last one we kept.
+	var merged []netip.Prefix
+	for _, p := range prefixes {
+		if len(merged) > 0 && merged[len(merged)-1].Contains(p.Addr()) {
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// aggregatePrefixes combines sibling prefixes (the two halves of a larger prefix) into
+// their parent, repeatedly. The prefixes must be as returned by mergePrefixes.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, p := range prefixes {
+		result = append(result, p)
+
+		// As the prefixes are sorted and don't overlap, a prefix can only be combined with
+		// the one before it. The combined prefix may in turn combine with the one before.
+		for len(result) >= 2 {
+			a, b := result[len(result)-2], result[len(result)-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				break
+			}
+			result = append(result[:len(result)-2], parent)
+		}
+	}
+	return result
+}
+
+// Contains returns true if addr is in one of the set's ranges. IPv4-mapped IPv6
+// addresses are checked as the IPv4 address they represent, and any zone is ignored.
+func (set *RangeSet) Contains(addr netip.Addr) bool {
+	if set == nil {
+		return false
+	}
+
+	addr = addr.Unmap().WithZone("")
+	prefixes := set.v6
+	if addr.Is4() {
+		prefixes = set.v4
+	}
+
+	// Find the last prefix that starts at or before addr. As the prefixes don't overlap,
+	// it's the only one that can contain addr.
+	i := sort.Search(len(prefixes), func(i int) bool {
+		return addr.Less(prefixes[i].Addr())
+	})
+	return i > 0 && prefixes[i-1].Contains(addr)
+}
+
+// Len returns the number of (merged) ranges in the set.
+func (set *RangeSet) Len() int {
+	if set == nil {
+		return 0
+	}
+	return len(set.v4) + len(set.v6)
+}
+
+// Prefixes returns the (merged) ranges in the set, IPv4 first, in ascending order.
+func (set *RangeSet) Prefixes() []netip.Prefix {
+	if set == nil {
+		return nil
+	}
+
+	prefixes := make([]netip.Prefix, 0, set.Len())
+	prefixes = append(prefixes, set.v4...)
+	return append(prefixes, set.v6...)
+}
+
+// ipNets returns the set's ranges as IPNets, for String and JSON marshalling.
+func (set *RangeSet) ipNets() []net.IPNet {
+	return PrefixesToIPNets(set.Prefixes()...)
+}
+
+// containsIP is like Contains, but for a net.IP.
+func (set *RangeSet) containsIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && set.Contains(addr)
+}
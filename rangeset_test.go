@@ -0,0 +1,213 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/realclientip/realclientip-go/ranges"
+)
+
+func TestNewRangeSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		want     []string
+	}{
+		{
+			name:     "Empty",
+			prefixes: nil,
+			want:     []string{},
+		},
+		{
+			name:     "Sorted and masked",
+			prefixes: []string{"2001:db8::1/32", "10.1.2.3/8", "192.168.0.0/16", "1.1.1.1/32"},
+			want:     []string{"1.1.1.1/32", "10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"},
+		},
+		{
+			name:     "Nested ranges are merged",
+			prefixes: []string{"10.1.0.0/16", "10.0.0.0/8", "10.0.0.0/24", "11.0.0.0/8", "2001:db8:cafe::/48", "2001:db8::/32"},
+			want:     []string{"10.0.0.0/8", "11.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			name:     "Duplicates are merged",
+			prefixes: []string{"10.0.0.0/8", "10.0.0.0/8"},
+			want:     []string{"10.0.0.0/8"},
+		},
+		{
+			name:     "IPv4-mapped",
+			prefixes: []string{"::ffff:188.0.2.128/120", "::ffff:0:0/96", "::ffff:0:0/80"},
+			want:     []string{"0.0.0.0/0", "::/80"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prefixes []netip.Prefix
+			for _, p := range tt.prefixes {
+				prefixes = append(prefixes, netip.MustParsePrefix(p))
+			}
+
+			set, err := NewRangeSet(prefixes...)
+			if err != nil {
+				t.Fatalf("NewRangeSet() error = %v", err)
+			}
+
+			got := []string{}
+			for _, p := range set.Prefixes() {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Prefixes() = %v, want %v", got, tt.want)
+			}
+			if set.Len() != len(tt.want) {
+				t.Fatalf("Len() = %d, want %d", set.Len(), len(tt.want))
+			}
+		})
+	}
+
+	if _, err := NewRangeSet(netip.Prefix{}); err == nil {
+		t.Fatalf("NewRangeSet() expected error for invalid prefix")
+	}
+}
+
+func TestRangeSet_Contains(t *testing.T) {
+	var prefixes []netip.Prefix
+	for _, p := range []string{"10.0.0.0/8", "188.0.2.0/24", "192.168.1.1/32", "2001:db8::/32", "fe80::/10"} {
+		prefixes = append(prefixes, netip.MustParsePrefix(p))
+	}
+	set, _ := NewRangeSet(prefixes...)
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"9.255.255.255", false},
+		{"1.1.1.1", false},
+		{"188.0.2.128", true},
+		{"188.0.3.0", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"255.255.255.255", false},
+		{"::ffff:188.0.2.128", true},
+		{"::ffff:188.0.3.0", false},
+		{"2001:db8:cafe::99", true},
+		{"2001:db9::", false},
+		{"fe80::1%eth0", true},
+		{"::1", false},
+		{"ffff::", false},
+	}
+	for _, tt := range tests {
+		if got := set.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Fatalf("Contains(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// A nil or empty set contains nothing
+	var nilSet *RangeSet
+	if nilSet.Contains(netip.MustParseAddr("10.0.0.1")) || nilSet.Len() != 0 || nilSet.Prefixes() != nil {
+		t.Fatalf("nil RangeSet is not empty")
+	}
+	emptySet, _ := NewRangeSet()
+	if emptySet.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatalf("empty RangeSet contains an address")
+	}
+}
+
+func TestNewRightmostTrustedRangeStrategyFromSet(t *testing.T) {
+	ipNets, _ := AddressesAndRangesToIPNets(ranges.CloudFront...)
+	set, _ := NewRangeSet(mustParsePrefixes(ranges.CloudFront...)...)
+
+	linear, _ := NewRightmostTrustedRangeStrategy("X-Forwarded-For", ipNets)
+	fromSet, _ := NewRightmostTrustedRangeStrategyFromSet("X-Forwarded-For", set)
+
+	xffs := []string{
+		`1.1.1.1`,
+		`1.1.1.1, 13.32.0.1`,
+		`1.1.1.1, 2.2.2.2, 54.192.0.1, 13.32.0.1`,
+		`1.1.1.1, 2600:9000:1000::1`,
+		`1.1.1.1, [2600:9000:1000::1%eth0]`,
+		`1.1.1.1, ::ffff:13.32.0.1`,
+		`13.32.0.1, 54.192.0.1`,
+		`1.1.1.1, nope, 13.32.0.1`,
+	}
+	for _, xff := range xffs {
+		headers := http.Header{"X-Forwarded-For": []string{xff}}
+		wantIP, wantReason := ClientIPDetail(linear, headers, "")
+		gotIP, gotReason := ClientIPDetail(fromSet, headers, "")
+		if gotIP != wantIP || gotReason != wantReason {
+			t.Fatalf("%q: got (%q, %v), want (%q, %v)", xff, gotIP, gotReason, wantIP, wantReason)
+		}
+	}
+
+	if err := fromSet.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	// As with NewRightmostTrustedRangeStrategy, no ranges is allowed
+	emptySet, _ := NewRangeSet()
+	emptyStrat, err := NewRightmostTrustedRangeStrategyFromSet("X-Forwarded-For", emptySet)
+	if err != nil {
+		t.Fatalf("NewRightmostTrustedRangeStrategyFromSet() with empty set error = %v", err)
+	}
+	if err := emptyStrat.Validate(); err != nil {
+		t.Fatalf("Validate() with empty set error = %v", err)
+	}
+
+	if _, err := NewRightmostTrustedRangeStrategyFromSet("X-Real-IP", set); err == nil {
+		t.Fatalf("NewRightmostTrustedRangeStrategyFromSet() expected error for bad header")
+	}
+
+	small, _ := NewRangeSet(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::1/128"))
+	want := `{headerName:X-Forwarded-For trustedRanges:[10.0.0.0/8 2001:db8::1/128]}`
+	smallStrat, _ := NewRightmostTrustedRangeStrategyFromSet("X-Forwarded-For", small)
+	if got := smallStrat.String(); got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+}
+
+// mustParsePrefixes parses the given CIDR strings, panicking on failure.
+func mustParsePrefixes(strs ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(strs))
+	for i, s := range strs {
+		prefixes[i] = netip.MustParsePrefix(s)
+	}
+	return prefixes
+}
+
+// benchmarkRanges returns a large number of ranges, like those published by AWS.
+func benchmarkRanges() []string {
+	var strs []string
+	for i := 0; i < 500; i++ {
+		strs = append(strs, fmt.Sprintf("%d.%d.0.0/16", 20+i/256, i%256))
+		strs = append(strs, fmt.Sprintf("2600:%x::/32", i))
+	}
+	return strs
+}
+
+func BenchmarkRightmostTrustedRangeStrategy(b *testing.B) {
+	ipNets, _ := AddressesAndRangesToIPNets(benchmarkRanges()...)
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ipNets))
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2600:1f3::1, 21.243.0.1`}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		strat.ClientIP(headers, "")
+	}
+}
+
+func BenchmarkRightmostTrustedRangeStrategyFromSet(b *testing.B) {
+	set, _ := NewRangeSet(mustParsePrefixes(benchmarkRanges()...)...)
+	strat := Must(NewRightmostTrustedRangeStrategyFromSet("X-Forwarded-For", set))
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2600:1f3::1, 21.243.0.1`}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		strat.ClientIP(headers, "")
+	}
+}
@@ -0,0 +1,118 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/realclientip/realclientip-go/ranges"
+)
+
+// RangeSource provides IP ranges to BuildTrustedRanges. Use one of RangesFromStrings,
+// RangesFromFile, RangesFromReader, or RangesFromProvider to create one.
+type RangeSource func() ([]net.IPNet, error)
+
+// providerRanges maps the names accepted by RangesFromProvider to their ranges.
+var providerRanges = map[string]func() []string{
+	"cloudflare":        func() []string { return ranges.Cloudflare },
+	"cloudfront":        func() []string { return ranges.CloudFront },
+	"fastly":            func() []string { return ranges.FastlyIPRanges },
+	"gcp-load-balancer": func() []string { return ranges.GCPLoadBalancerIPRanges },
+}
+
+// RangesFromStrings returns a RangeSource for the given IP addresses and ranges, in any
+// form accepted by AddressesAndRangesToIPNets.
+func RangesFromStrings(ipRanges ...string) RangeSource {
+	return func() ([]net.IPNet, error) {
+		return AddressesAndRangesToIPNets(ipRanges...)
+	}
+}
+
+// RangesFromFile returns a RangeSource for the IP addresses and ranges in the file at
+// path, in the format read by ParseIPNetsFromReader (one per line, with '#' comments).
+// The file is read when BuildTrustedRanges is called.
+func RangesFromFile(path string) RangeSource {
+	return func() ([]net.IPNet, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		ipNets, err := ParseIPNetsFromReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("file %q: %w", path, err)
+		}
+		return ipNets, nil
+	}
+}
+
+// RangesFromReader returns a RangeSource for the IP addresses and ranges read from r,
+// in the format read by ParseIPNetsFromReader. r is read when BuildTrustedRanges is
+// called, so the RangeSource can only be used once.
+func RangesFromReader(r io.Reader) RangeSource {
+	return func() ([]net.IPNet, error) {
+		return ParseIPNetsFromReader(r)
+	}
+}
+
+// RangesFromProvider returns a RangeSource for the known ranges of the named provider:
+// "cloudflare" (ranges.Cloudflare), "cloudfront" (ranges.CloudFront), "fastly"
+// (ranges.FastlyIPRanges), or "gcp-load-balancer" (ranges.GCPLoadBalancerIPRanges).
+// "private" is also accepted, for PrivateAndLocalRanges. Names are case-insensitive. An
+// unknown name results in an error from BuildTrustedRanges.
+func RangesFromProvider(name string) RangeSource {
+	return func() ([]net.IPNet, error) {
+		lowerName := strings.ToLower(name)
+		if lowerName == "private" {
+			return PrivateAndLocalRanges(), nil
+		}
+
+		getRanges, ok := providerRanges[lowerName]
+		if !ok {
+			names := []string{"private"}
+			for n := range providerRanges {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown provider %q; must be one of %s", name, strings.Join(names, ", "))
+		}
+		return AddressesAndRangesToIPNets(getRanges()...)
+	}
+}
+
+// BuildTrustedRanges combines the ranges from all of the given sources, such as the
+// private ranges, a provider's ranges, and the ranges of your own proxies from a file.
+// For example:
+//
+//	trustedRanges, err := realclientip.BuildTrustedRanges(
+//		realclientip.RangesFromProvider("private"),
+//		realclientip.RangesFromProvider("cloudflare"),
+//		realclientip.RangesFromFile("/etc/myapp/proxies.txt"))
+//	...
+//	strat, err := realclientip.NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)
+//
+// The combined ranges are merged with MergeIPNets, so the result has no duplicates. If
+// any source fails (for example, if a file can't be read or contains an invalid range),
+// an error is returned that indicates which source it was, and no ranges are returned.
+func BuildTrustedRanges(sources ...RangeSource) ([]net.IPNet, error) {
+	var all []net.IPNet
+	for i, source := range sources {
+		if source == nil {
+			return nil, fmt.Errorf("BuildTrustedRanges: source %d must not be nil", i)
+		}
+
+		ipNets, err := source()
+		if err != nil {
+			return nil, fmt.Errorf("BuildTrustedRanges: source %d: %w", i, err)
+		}
+		all = append(all, ipNets...)
+	}
+
+	return MergeIPNets(all), nil
+}
@@ -0,0 +1,117 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/realclientip/realclientip-go/ranges"
+)
+
+func TestBuildTrustedRanges(t *testing.T) {
+	dir := t.TempDir()
+	goodFile := filepath.Join(dir, "good.txt")
+	if err := os.WriteFile(goodFile, []byte("# proxies\n192.0.2.0/25\n192.0.2.128/25\n2001:db8::1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	badFile := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(badFile, []byte("192.0.2.0/24\nnope\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sources []RangeSource
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "No sources",
+			sources: nil,
+			want:    []string{},
+		},
+		{
+			name: "Strings, file, and reader, merged",
+			sources: []RangeSource{
+				RangesFromStrings("10.0.0.0/8", "192.0.2.7"),
+				RangesFromFile(goodFile),
+				RangesFromReader(strings.NewReader("10.1.0.0/16\n2001:db8::1\n")),
+			},
+			want: []string{"10.0.0.0/8", "192.0.2.0/24", "2001:db8::1/128"},
+		},
+		{
+			name:    "Provider",
+			sources: []RangeSource{RangesFromProvider("Fastly"), RangesFromProvider("fastly")},
+			want:    ipNetStrings(MergeIPNets(mustAddressesAndRangesToIPNets(ranges.FastlyIPRanges...))),
+		},
+		{
+			name:    "Private",
+			sources: []RangeSource{RangesFromProvider("private"), RangesFromStrings("10.1.0.0/16")},
+			want:    ipNetStrings(MergeIPNets(PrivateAndLocalRanges())),
+		},
+		{
+			name:    "Error: bad string",
+			sources: []RangeSource{RangesFromStrings("10.0.0.0/8"), RangesFromStrings("nope")},
+			wantErr: "source 1:",
+		},
+		{
+			name:    "Error: missing file",
+			sources: []RangeSource{RangesFromFile(filepath.Join(dir, "missing.txt"))},
+			wantErr: "source 0:",
+		},
+		{
+			name:    "Error: bad file",
+			sources: []RangeSource{RangesFromFile(badFile)},
+			wantErr: "line 2:",
+		},
+		{
+			name:    "Error: bad reader",
+			sources: []RangeSource{RangesFromReader(strings.NewReader("nope"))},
+			wantErr: "source 0: line 1:",
+		},
+		{
+			name:    "Error: unknown provider",
+			sources: []RangeSource{RangesFromProvider("akamai")},
+			wantErr: `unknown provider "akamai"`,
+		},
+		{
+			name:    "Error: nil source",
+			sources: []RangeSource{nil},
+			wantErr: "source 0 must not be nil",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildTrustedRanges(tt.sources...)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("BuildTrustedRanges() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %q does not contain %q", err, tt.wantErr)
+				}
+				if got != nil {
+					t.Fatalf("BuildTrustedRanges() = %v, want nil on error", got)
+				}
+				return
+			}
+
+			if gotStrs := ipNetStrings(got); !reflect.DeepEqual(gotStrs, tt.want) {
+				t.Fatalf("BuildTrustedRanges() = %v, want %v", gotStrs, tt.want)
+			}
+		})
+	}
+
+	// The result can be used directly with the strategy
+	trustedRanges, _ := BuildTrustedRanges(RangesFromProvider("private"), RangesFromStrings("192.0.2.0/24"))
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges))
+	headers := http.Header{"X-Forwarded-For": []string{"2600:1f18::99, 192.0.2.1, 10.0.0.1"}}
+	if got := strat.ClientIP(headers, ""); got != "2600:1f18::99" {
+		t.Fatalf("ClientIP() = %q, want %q", got, "2600:1f18::99")
+	}
+}
@@ -4,10 +4,20 @@
 package realclientip
 
 import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
 )
 
 // Strategy is satisfied by all of the specific strategies in this package. It can be used
@@ -19,470 +29,3668 @@ type Strategy interface {
 	// get an untrustworthy or optional value.
 	// All implementations of this method must be threadsafe.
 	ClientIP(headers http.Header, remoteAddr string) string
+
+	// Validate returns an error if the strategy is misconfigured. The strategies in this
+	// package are validated by their constructors, so this is mostly useful for
+	// checking strategies that were created from dynamic configuration, or for failing
+	// fast at startup. It should be called before the strategy is used.
+	Validate() error
+}
+
+// HeaderGetter provides access to request headers. It allows the strategies in this
+// package to be used with headers that are not stored in an http.Header, such as those
+// of fasthttp or gRPC metadata, without copying them (see ClientIPFromHeaders).
+// http.Header satisfies this interface.
+type HeaderGetter interface {
+	// Values returns all of the values of the header with the given name, in order, or
+	// nil if there are none. The name passed by the strategies is canonicalized (as
+	// with http.CanonicalHeaderKey); implementations should match it case-insensitively
+	// if their header names are not.
+	Values(name string) []string
+}
+
+const (
+	// Pre-canonicalized constants to avoid typos later on
+	xForwardedForHdr         = "X-Forwarded-For"
+	xOriginalForwardedForHdr = "X-Original-Forwarded-For"
+	forwardedHdr             = "Forwarded"
+	xForwardedProtoHdr       = "X-Forwarded-Proto"
+	xForwardedHostHdr        = "X-Forwarded-Host"
+	xProxyUserIPHdr          = "X-Proxyuser-Ip"
+	xEnvoyExternalAddressHdr = "X-Envoy-External-Address"
+	flyClientIPHdr           = "Fly-Client-Ip"
+)
+
+// MaxListItems is the maximum number of items that will be parsed from the
+// X-Forwarded-For or Forwarded headers of a request (across all instances of the header).
+// A header with more items than this is treated as malformed, and the strategies using
+// it will not derive an IP (with reason ReasonTooManyItems). This prevents an attacker
+// from forcing large amounts of parsing and allocation by sending a huge list.
+// Legitimate proxy chains are far shorter than the default. Setting this to zero or less
+// disables the limit. It should only be changed during initialization, before any
+// strategies are used, as it is not safe to modify concurrently.
+var MaxListItems = 50
+
+// MaxHeaderBytes is the maximum total length, in bytes, of the X-Forwarded-For or
+// Forwarded headers of a request (across all instances of the header) that will be
+// parsed. Like MaxListItems, a longer header is treated as malformed, and the strategies
+// using it will not derive an IP (with reason ReasonHeaderTooLarge). This is checked
+// before anything else is done with the header, so an oversized header costs no more
+// than summing the lengths of its values. The default allows MaxListItems long Forwarded
+// items, with room to spare. Setting this to zero or less disables the limit. It should
+// only be changed during initialization, before any strategies are used, as it is not
+// safe to modify concurrently.
+var MaxHeaderBytes = 8192
+
+// These errors are returned (wrapped) by the strategy constructors and Validate methods,
+// and by AddressesAndRangesToIPNets, so that callers can check for them with errors.Is.
+var (
+	// ErrEmptyHeaderName indicates that a header name was empty.
+	ErrEmptyHeaderName = errors.New("header must not be empty")
+	// ErrHeaderNotList indicates that a strategy that requires the X-Forwarded-For,
+	// X-Original-Forwarded-For, or Forwarded header was given a different header.
+	ErrHeaderNotList = errors.New("header must be " + xForwardedForHdr + ", " + xOriginalForwardedForHdr + ", or " + forwardedHdr)
+	// ErrNonPositiveCount indicates that a trusted count was zero or negative.
+	ErrNonPositiveCount = errors.New("count must be greater than zero")
+	// ErrZoneNotAllowed indicates that an address or range had a zone.
+	ErrZoneNotAllowed = errors.New("zones are not allowed")
+)
+
+// ErrNoClientIP is matched (with errors.Is) by the errors returned by ClientIPErr when no
+// client IP can be derived. The error is a *NoClientIPError, which has the reason.
+var ErrNoClientIP = errors.New("no client IP could be derived")
+
+// NoClientIPError is the error returned by ClientIPErr when no client IP can be derived.
+type NoClientIPError struct {
+	// Reason is the reason that no IP was derived; it is never ReasonFound.
+	Reason Reason
+}
+
+func (e *NoClientIPError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrNoClientIP, e.Reason)
+}
+
+// Is makes the error match ErrNoClientIP.
+func (e *NoClientIPError) Is(target error) bool {
+	return target == ErrNoClientIP
+}
+
+// Option configures optional behaviour of a strategy. Options are passed to strategy
+// constructors. Each constructor documents the options it supports; options that don't
+// apply to a strategy are ignored.
+type Option func(*options)
+
+// options holds the values set by Option functions.
+type options struct {
+	requireHTTPS bool
+	// nonRecursive is inverted so that the zero value is the default
+	nonRecursive         bool
+	contiguousTrust      bool
+	privateRangesTrusted bool
+	// stripZone is inverted so that the zero value is the default
+	stripZone             bool
+	keepMapped            bool
+	rejectReserved        bool
+	family                Family
+	rejectMultipleHeaders bool
+	allowUnspecified      bool
+	strictForwarded       bool
+	lenientSeparators     bool
+	syntax                HeaderSyntax
+	observer              Observer
+	// logObserver is set by WithLogger, and is called after observer
+	logObserver Observer
+	// logWarning is set by WithLogger, and is called by constructors with any warnings
+	// about the strategy's configuration
+	logWarning func(Warning)
+}
+
+// applyOptions applies opts to the default options.
+func applyOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// The strategies only have a single observer, so combine them
+	if o.logObserver != nil {
+		obs, logObs := o.observer, o.logObserver
+		o.observer = logObs
+		if obs != nil {
+			o.observer = func(result string, reason Reason, header string) {
+				obs(result, reason, header)
+				logObs(result, reason, header)
+			}
+		}
+	}
+	return o
+}
+
+// WithRequireHTTPS makes RightmostTrustedRangeStrategy only treat a Forwarded header hop
+// as trusted if, in addition to being in the trusted ranges, its list item has
+// "proto=https". A hop from within the trusted ranges that was forwarded over plain HTTP
+// is then treated as untrusted, and will be returned as the client IP. This supports
+// policies that require end-to-end TLS through the proxy chain. It may only be used with
+// the Forwarded header, as X-Forwarded-For carries no per-hop protocol information.
+func WithRequireHTTPS(require bool) Option {
+	return func(o *options) {
+		o.requireHTTPS = require
+	}
+}
+
+// WithRecursive controls whether RightmostTrustedRangeStrategy skips over all trusted
+// IPs from the right of the header (recursive, the default), or only the proxy that
+// connected to us (non-recursive). These correspond to nginx's "real_ip_recursive on"
+// and "off". When non-recursive, the rightmost IP in the header is returned, regardless
+// of the trusted ranges; combine the strategy with TrustedPeerStrategy (using the same
+// ranges) to check that the connecting peer is trusted first, as nginx does.
+// Note that, with multiple trusted proxies, non-recursive mode returns the IP of a proxy
+// rather than that of the client.
+func WithRecursive(recursive bool) Option {
+	return func(o *options) {
+		o.nonRecursive = !recursive
+	}
+}
+
+// WithContiguousTrust makes RightmostTrustedRangeStrategy verify the whole proxy chain:
+// as usual, the IPs to the right of the client must all be in the trusted ranges, but
+// additionally, none of the IPs to the left of the client may be. A trusted IP to the
+// left of an untrusted one means the chain isn't what it should be (for example, the
+// client is spoofing a proxy's IP, or a proxy outside of the trusted ranges has been
+// inserted into the path), so no IP is derived and the reason is ReasonTrustGap. This
+// is stricter than the default, which simply returns the first untrusted IP from the
+// right. Note that clients on networks in the trusted ranges (like a private network
+// behind a forward proxy that adds to the header) will also be rejected.
+// It can't be combined with WithRecursive(false).
+func WithContiguousTrust(require bool) Option {
+	return func(o *options) {
+		o.contiguousTrust = require
+	}
+}
+
+// WithPrivateRangesTrusted makes RightmostTrustedRangeStrategy trust the private and
+// local ranges (see PrivateAndLocalRanges) in addition to the given trusted ranges. This
+// is useful when the reverse proxies closest to the server are on a private network,
+// behind an external CDN or load balancer: only the external ranges need to be given.
+// The ranges are merged when the strategy is created, so they're included in its String
+// and JSON output. Note that this trusts all private and local addresses, not just those
+// of your own network.
+func WithPrivateRangesTrusted(trust bool) Option {
+	return func(o *options) {
+		o.privateRangesTrusted = trust
+	}
+}
+
+// Observer is a function that is notified of each derivation by a strategy created with
+// WithObserver. result is the IP, as returned by ClientIP (empty if no IP was derived),
+// reason is the reason for the result, and header is the value of the header that was
+// considered (with multiple instances of the header joined with ", ", as they would be
+// combined into a single header).
+type Observer func(result string, reason Reason, header string)
+
+// observe calls obs, if it isn't nil, with res and the values of headerName, and returns
+// res.
+func (obs Observer) observe(res result, headers HeaderGetter, headerName string) result {
+	if obs != nil {
+		obs(res.String(), res.reason, strings.Join(headers.Values(headerName), ", "))
+	}
+	return res
+}
+
+// WithObserver makes a strategy call obs whenever it derives (or fails to derive) an IP,
+// whether it is called directly or as part of another strategy (like ChainStrategy, in
+// which case the observer of each strategy that is tried is called). This is useful for
+// sampling and logging the decisions made, such as when debugging a misbehaving proxy.
+// obs runs synchronously on the calling goroutine, so it must be fast, and it must be
+// threadsafe if the strategy is used concurrently. It must not modify anything it is
+// given. If obs is nil (the default), there is no observer and no overhead. Observers
+// are not included in a strategy's String or JSON representation.
+// It is supported by the constructors of the strategies that derive the IP from a
+// header, other than NewSingleIPHeadersStrategy, NewHerokuStrategy, and
+// NewGCPExternalLBStrategy, which take no options.
+func WithObserver(obs Observer) Option {
+	return func(o *options) {
+		o.observer = obs
+	}
+}
+
+// WithZone controls whether a strategy keeps the IPv6 zone identifier (like "%eth0") in
+// the IP it returns (the default), or strips it. Stripping the zone is useful when the
+// IP is used as a key, such as for rate limiting, where "fe80::1%eth0" and "fe80::1"
+// should be treated the same. (See the "IPv6 zones" section of the README for more
+// discussion.) It is supported by the same constructors as WithObserver.
+func WithZone(keep bool) Option {
+	return func(o *options) {
+		o.stripZone = !keep
+	}
+}
+
+// WithMappedIPv6 controls whether a strategy returns an IPv4-mapped IPv6 address (like
+// "::ffff:192.0.2.1") in the IPv6 notation it had in the header, or in IPv4 notation
+// (like "192.0.2.1"; the default). The two forms are the same address, and IPv4
+// notation is what net.IP produces, but some downstream systems distinguish them.
+// Addresses that were written in IPv4 notation are always returned in IPv4 notation.
+// Only the string IP is affected; ClientNetIPAddr and ClientAddr return the IPv4 address
+// either way. It is supported by the same constructors as WithObserver.
+// (RemoteAddrStrategy has no options, so it always uses IPv4 notation.)
+func WithMappedIPv6(keep bool) Option {
+	return func(o *options) {
+		o.keepMapped = keep
+	}
+}
+
+// WithRejectMultipleHeaders makes SingleIPHeaderStrategy fail (with reason
+// ReasonMultipleHeaders) if its header appears more than once in the request, rather than
+// using the last instance (the default). A single-IP header is not allowed to be repeated
+// (RFC 7230, section 3.2.2), so if your proxy only ever sets one instance, multiple
+// instances indicate tampering.
+func WithRejectMultipleHeaders(reject bool) Option {
+	return func(o *options) {
+		o.rejectMultipleHeaders = reject
+	}
+}
+
+// WithUnspecified makes SingleIPHeaderStrategy accept the unspecified addresses "0.0.0.0"
+// and "::" (which are rejected by default, as they are not useful client IPs). This is an
+// escape hatch for upstreams that legitimately set the header to an unspecified address
+// (such as for health checks), so that it can be distinguished from a missing or invalid
+// header.
+func WithUnspecified(allow bool) Option {
+	return func(o *options) {
+		o.allowUnspecified = allow
+	}
+}
+
+// WithRejectReserved makes a strategy treat IPs in the reserved ranges (see
+// ReservedRanges: multicast, benchmarking, documentation, and the like) as invalid, as
+// it does the unspecified addresses. None of them can be a real client IP, so one in a
+// header can only be a bogus or spoofed value. This applies regardless of whether the
+// strategy checks for private IPs: the non-private strategies already skip most of these
+// ranges, but the strategies that allow private IPs (like RightmostStrategy and the
+// trusted-count strategies) otherwise accept them. A list item with a reserved IP keeps
+// its position in the list, so the trusted-count strategies fail (with ReasonNoValidIP)
+// if it's the one selected, rather than counting past it. Likewise,
+// RightmostTrustedRangeStrategy stops at a reserved IP even if it is in the trusted
+// ranges.
+func WithRejectReserved(reject bool) Option {
+	return func(o *options) {
+		o.rejectReserved = reject
+	}
+}
+
+// WithStrictForwarded makes a strategy using the Forwarded header require each list
+// item's "for" value to conform to RFC 7239: IPv6 addresses must be in square brackets,
+// and a value containing a colon or brackets (like an IPv6 address or an IP with a port)
+// must be quoted. The port, if any, must be numeric or an obfuscated port (like "_abc").
+// Zones are not allowed. An item that does not conform is treated as invalid, just like
+// an item with no valid IP. By default, such deviations are tolerated (see the README).
+// This is useful for interop testing and for detecting misbehaving proxies. It is
+// supported by the strategies that take a list header, and requires the Forwarded
+// header.
+func WithStrictForwarded(strict bool) Option {
+	return func(o *options) {
+		o.strictForwarded = strict
+	}
+}
+
+// WithLenientSeparators makes the strategies that take a list header also treat runs of
+// whitespace as item separators, so that "1.1.1.1 2.2.2.2" (as sent by some buggy
+// proxies) is parsed as two items, like "1.1.1.1, 2.2.2.2". This does not conform to
+// the X-Forwarded-For syntax, but may be useful for extracting IPs for logging. By
+// default, only commas separate items, and such a value is a single invalid item.
+// It requires the X-Forwarded-For header syntax; the Forwarded header can contain
+// whitespace within its elements.
+func WithLenientSeparators(lenient bool) Option {
+	return func(o *options) {
+		o.lenientSeparators = lenient
+	}
+}
+
+// HeaderSyntax is the syntax of a list header, which determines how it is parsed.
+type HeaderSyntax int
+
+const (
+	// HeaderSyntaxAuto determines the syntax from the header name, which must be one of
+	// the known list headers (X-Forwarded-For, X-Original-Forwarded-For, or Forwarded).
+	// It is the default.
+	HeaderSyntaxAuto HeaderSyntax = iota
+	// HeaderSyntaxXFF is the X-Forwarded-For syntax: a comma-separated list of IPs,
+	// optionally with ports.
+	HeaderSyntaxXFF
+	// HeaderSyntaxForwarded is the Forwarded (RFC 7239) syntax: a comma-separated list
+	// of elements, from which the "for" parameter is used.
+	HeaderSyntaxForwarded
+)
+
+// String returns the name of the syntax.
+func (syntax HeaderSyntax) String() string {
+	switch syntax {
+	case HeaderSyntaxAuto:
+		return "auto"
+	case HeaderSyntaxXFF:
+		return "xff"
+	case HeaderSyntaxForwarded:
+		return "forwarded"
+	}
+	return fmt.Sprintf("HeaderSyntax(%d)", int(syntax))
+}
+
+// isForwarded returns true if headerName is to be parsed with the Forwarded syntax.
+func (syntax HeaderSyntax) isForwarded(headerName string) bool {
+	if syntax == HeaderSyntaxAuto {
+		return headerName == forwardedHdr
+	}
+	return syntax == HeaderSyntaxForwarded
+}
+
+// WithHeaderSyntax makes a strategy that takes a list header parse it with the given
+// syntax. This allows any header name to be used, rather than only the known list
+// headers, so that headers like a CDN's own X-Forwarded-For equivalent can be used. As
+// the header name is no longer enough to know its grammar, the syntax must be given
+// explicitly. The known list headers can't be given the syntax of the other kind (for
+// example, Forwarded with HeaderSyntaxXFF). Note that WithRequireHTTPS and
+// WithStrictForwarded require the Forwarded syntax.
+func WithHeaderSyntax(syntax HeaderSyntax) Option {
+	return func(o *options) {
+		o.syntax = syntax
+	}
+}
+
+// syntaxString returns the String() suffix for a strategy that has the syntax setting.
+func syntaxString(syntax HeaderSyntax) string {
+	if syntax == HeaderSyntaxAuto {
+		return ""
+	}
+	return " syntax:" + syntax.String()
+}
+
+// Family is an IP address family, used to restrict the IPs that a strategy returns.
+// IPv4-mapped IPv6 addresses are considered IPv4, as they are equivalent to (and
+// stringify as) the plain IPv4 address.
+type Family int
+
+const (
+	// FamilyAny allows both IPv4 and IPv6 addresses. It is the default.
+	FamilyAny Family = iota
+	// FamilyIPv4 allows only IPv4 addresses.
+	FamilyIPv4
+	// FamilyIPv6 allows only IPv6 addresses.
+	FamilyIPv6
+)
+
+// String returns the name of the family.
+func (f Family) String() string {
+	switch f {
+	case FamilyAny:
+		return "any"
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("Family(%d)", int(f))
+}
+
+// matches returns true if ip is of this family.
+func (f Family) matches(ip net.IP) bool {
+	switch f {
+	case FamilyIPv4:
+		return ip.To4() != nil
+	case FamilyIPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// WithFamily makes LeftmostNonPrivateStrategy or LeftmostStrategy skip IPs that are not
+// of the given family while scanning the header. For example, if a downstream system
+// only accepts IPv4, FamilyIPv4 will return the leftmost (non-private) IPv4 address, even
+// if there is an IPv6 address to its left.
+// It is not supported by the rightmost-ish strategies: skipping the IP that they would
+// otherwise return (which is the one added by a trusted proxy) would mean returning an
+// IP that the client could have spoofed. (The leftmost-ish strategies are already
+// spoofable, so no protection is lost.)
+func WithFamily(family Family) Option {
+	return func(o *options) {
+		o.family = family
+	}
+}
+
+// validateFamily returns an error if family is not one of the defined values.
+func validateFamily(stratName string, family Family) error {
+	if family < FamilyAny || family > FamilyIPv6 {
+		return fmt.Errorf("%s has unknown family %v", stratName, family)
+	}
+	return nil
+}
+
+// familyString returns the String() suffix for a strategy that has the family setting.
+func familyString(family Family) string {
+	if family == FamilyAny {
+		return ""
+	}
+	return " family:" + family.String()
+}
+
+// zoneString returns the String() suffix for a strategy that has the stripZone setting.
+func zoneString(stripZone bool) string {
+	if stripZone {
+		return " zone:false"
+	}
+	return ""
+}
+
+// mappedIPv6String returns the String() suffix for a strategy that has the keepMapped
+// setting.
+func mappedIPv6String(keepMapped bool) string {
+	if keepMapped {
+		return " mappedIPv6:true"
+	}
+	return ""
+}
+
+// rejectReservedString returns the String() suffix for a strategy that has the
+// rejectReserved setting.
+func rejectReservedString(rejectReserved bool) string {
+	if rejectReserved {
+		return " rejectReserved:true"
+	}
+	return ""
+}
+
+// strictForwardedString returns the String() suffix for a strategy that has the
+// strictForwarded setting.
+func strictForwardedString(strictForwarded bool) string {
+	if strictForwarded {
+		return " strictForwarded:true"
+	}
+	return ""
+}
+
+// validateStrictForwarded returns an error if WithStrictForwarded is used with a header
+// that doesn't have the Forwarded syntax.
+func validateStrictForwarded(stratName, headerName string, syntax HeaderSyntax, strictForwarded bool) error {
+	if strictForwarded && !syntax.isForwarded(headerName) {
+		return fmt.Errorf("%s WithStrictForwarded requires the %s header syntax", stratName, forwardedHdr)
+	}
+	return nil
+}
+
+// lenientSeparatorsString returns the String() suffix for a strategy that has the
+// lenientSeparators setting.
+func lenientSeparatorsString(lenientSeparators bool) string {
+	if lenientSeparators {
+		return " lenientSeparators:true"
+	}
+	return ""
+}
+
+// validateLenientSeparators returns an error if WithLenientSeparators is used with a
+// header that has the Forwarded syntax.
+func validateLenientSeparators(stratName, headerName string, syntax HeaderSyntax, lenientSeparators bool) error {
+	if lenientSeparators && syntax.isForwarded(headerName) {
+		return fmt.Errorf("%s WithLenientSeparators requires the %s header syntax", stratName, xForwardedForHdr)
+	}
+	return nil
+}
+
+// listOptions holds the settings that are shared by the strategies that derive the IP
+// from a list header (like LeftmostNonPrivateStrategy). It is embedded in them.
+type listOptions struct {
+	// stripZone is inverted so that the zero value is the default
+	stripZone         bool
+	keepMapped        bool
+	rejectReserved    bool
+	strictForwarded   bool
+	lenientSeparators bool
+	syntax            HeaderSyntax
+	observer          Observer
+}
+
+func newListOptions(o options) listOptions {
+	return listOptions{
+		stripZone:         o.stripZone,
+		keepMapped:        o.keepMapped,
+		rejectReserved:    o.rejectReserved,
+		strictForwarded:   o.strictForwarded,
+		lenientSeparators: o.lenientSeparators,
+		syntax:            o.syntax,
+		observer:          o.observer,
+	}
+}
+
+// validate returns an error if headerName can't be used with these settings. stratName
+// is used in the error message.
+func (lo listOptions) validate(stratName, headerName string) error {
+	if err := validateListHeaderName(stratName, headerName, lo.syntax); err != nil {
+		return err
+	}
+	if err := validateStrictForwarded(stratName, headerName, lo.syntax, lo.strictForwarded); err != nil {
+		return err
+	}
+	return validateLenientSeparators(stratName, headerName, lo.syntax, lo.lenientSeparators)
+}
+
+// equal reports whether lo and other are the same settings. An Observer can't be
+// compared, so settings with one are never equal (see StrategiesEqual).
+func (lo listOptions) equal(other listOptions) bool {
+	return lo.observer == nil && other.observer == nil &&
+		lo.stripZone == other.stripZone &&
+		lo.keepMapped == other.keepMapped &&
+		lo.rejectReserved == other.rejectReserved &&
+		lo.strictForwarded == other.strictForwarded &&
+		lo.lenientSeparators == other.lenientSeparators &&
+		lo.syntax == other.syntax
+}
+
+// Must panics if err is not nil. This can be used to make sure the strategy-making
+// functions do not return an error. It can also facilitate calling NewChainStrategy().
+// It can be called like Must(NewSingleIPHeaderStrategy("X-Real-IP")).
+func Must(strat Strategy, err error) Strategy {
+	if err != nil {
+		panic(fmt.Sprintf("err is not nil: %v", err))
+	}
+	return strat
+}
+
+// Reason describes the outcome of a client IP derivation. It is mostly useful for
+// logging and for debugging misconfigured strategies or proxy chains.
+type Reason int
+
+const (
+	// ReasonFound indicates that a valid client IP was derived.
+	ReasonFound Reason = iota
+	// ReasonHeaderMissing indicates that the header used by the strategy is not present.
+	ReasonHeaderMissing
+	// ReasonNoValidIP indicates that the value that should contain the client IP is not
+	// a valid IP address. For example, the single-IP header is garbage, or the list
+	// item selected by a trusted-count strategy is invalid.
+	ReasonNoValidIP
+	// ReasonAllPrivate indicates that all of the valid IPs in the header are private
+	// or local, so a non-private strategy found no candidate.
+	ReasonAllPrivate
+	// ReasonCountTooLarge indicates that a trusted-count strategy's header has fewer
+	// entries than the trusted count.
+	ReasonCountTooLarge
+	// ReasonAllTrusted indicates that all of the IPs in the header are in the trusted
+	// ranges, so there is no untrusted client IP.
+	ReasonAllTrusted
+	// ReasonTooManyItems indicates that the header has more than MaxListItems entries,
+	// so it was treated as malformed and not parsed.
+	ReasonTooManyItems
+	// ReasonMismatch indicates that the strategies of a ConsensusStrategy derived
+	// different IPs.
+	ReasonMismatch
+	// ReasonBlocked indicates that a BlocklistStrategy's inner strategy derived an IP,
+	// but it is in the blocked ranges.
+	ReasonBlocked
+	// ReasonMultipleHeaders indicates that a single-IP header appeared more than once,
+	// and the strategy was created with WithRejectMultipleHeaders(true).
+	ReasonMultipleHeaders
+	// ReasonTrustGap indicates that a trusted IP was found to the left of the client IP,
+	// and the strategy was created with WithContiguousTrust(true).
+	ReasonTrustGap
+	// ReasonTooManyHops indicates that a MaxHopsStrategy's header has more items than
+	// the maximum number of hops.
+	ReasonTooManyHops
+	// ReasonHeaderTooLarge indicates that the header is longer than MaxHeaderBytes, so it
+	// was treated as malformed and not parsed.
+	ReasonHeaderTooLarge
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonFound:
+		return "found"
+	case ReasonHeaderMissing:
+		return "header missing"
+	case ReasonNoValidIP:
+		return "no valid IP"
+	case ReasonAllPrivate:
+		return "all private"
+	case ReasonCountTooLarge:
+		return "count too large"
+	case ReasonAllTrusted:
+		return "all trusted"
+	case ReasonTooManyItems:
+		return "too many items"
+	case ReasonMismatch:
+		return "mismatch"
+	case ReasonBlocked:
+		return "blocked"
+	case ReasonMultipleHeaders:
+		return "multiple headers"
+	case ReasonTrustGap:
+		return "trust gap"
+	case ReasonTooManyHops:
+		return "too many hops"
+	case ReasonHeaderTooLarge:
+		return "header too large"
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+// result is the outcome of deriving the client IP with a strategy.
+type result struct {
+	// ipAddr is the derived IP; it is nil if no IP could be derived
+	ipAddr *net.IPAddr
+	// raw is the unparsed value that ipAddr was derived from, such as a header value or
+	// list item, or remoteAddr; it is empty if no IP could be derived
+	raw    string
+	reason Reason
+	// position is the 1-based position, from the left, of the list item that ipAddr was
+	// derived from, and total is the number of items in the list. They are zero if the
+	// result wasn't derived from a list header (or, for position, if there's no IP).
+	position, total int
+	// mapped is true if ipAddr is an IPv4 address that was written in IPv4-mapped IPv6
+	// notation, and keepMapped is true if String should use that notation (see
+	// WithMappedIPv6)
+	mapped, keepMapped bool
+}
+
+// String returns the normalized client IP, or empty string if there is none.
+func (res result) String() string {
+	if res.ipAddr == nil {
+		return ""
+	}
+	if res.mapped && res.keepMapped {
+		if ip4 := res.ipAddr.IP.To4(); ip4 != nil {
+			return JoinHostZone("::ffff:"+ip4.String(), res.ipAddr.Zone)
+		}
+	}
+	return res.ipAddr.String()
+}
+
+// withMappedIPv6 returns res with its keepMapped set to keep.
+func (res result) withMappedIPv6(keep bool) result {
+	res.keepMapped = keep
+	return res
+}
+
+// withoutZone returns res with the zone removed from its IP, if strip is true. The raw
+// value is left as it is.
+func (res result) withoutZone(strip bool) result {
+	if !strip || res.ipAddr == nil || res.ipAddr.Zone == "" {
+		return res
+	}
+	res.ipAddr = &net.IPAddr{IP: res.ipAddr.IP}
+	return res
+}
+
+// deriver is implemented by all of the strategies in this package. It provides more
+// information about the derivation than Strategy.ClientIP.
+type deriver interface {
+	derive(headers HeaderGetter, remoteAddr string) result
+}
+
+// deriveResult derives the client IP using strat. If strat is not one of the strategies
+// in this package, its ClientIP method is used and the returned IP is re-parsed. In that
+// case, if headers is not an http.Header, nil headers are passed to ClientIP, as there is
+// no way to convert them.
+func deriveResult(strat Strategy, headers HeaderGetter, remoteAddr string) result {
+	if d, ok := strat.(deriver); ok {
+		return d.derive(headers, remoteAddr)
+	}
+
+	httpHeaders, _ := headers.(http.Header)
+	ipStr := strat.ClientIP(httpHeaders, remoteAddr)
+	ipAddr, err := ParseIPAddr(ipStr)
+	if err != nil {
+		return result{reason: ReasonNoValidIP}
+	}
+	return result{ipAddr: &ipAddr, raw: ipStr, reason: ReasonFound}
+}
+
+// ClientIPFromRequest derives the client IP from r using strat. It is shorthand for
+// strat.ClientIP(r.Header, r.RemoteAddr). If r is nil, empty string is returned.
+func ClientIPFromRequest(strat Strategy, r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return strat.ClientIP(r.Header, r.RemoteAddr)
+}
+
+// ClientIPFromHeaders is like strat.ClientIP, but gets the request headers from getter.
+// This allows adapters for other HTTP frameworks (or gRPC metadata, etc.) to be written
+// without allocating an http.Header for every request.
+// Strategies that are not from this package only have the http.Header interface, so
+// they are passed the headers only if getter is an http.Header; otherwise they are
+// passed nil headers (and only remoteAddr is available to them). getter must not be nil.
+func ClientIPFromHeaders(strat Strategy, getter HeaderGetter, remoteAddr string) string {
+	return deriveResult(strat, getter, remoteAddr).String()
+}
+
+// ClientIPFromMetadata derives the client IP from gRPC metadata (like metadata.MD, which
+// has the same underlying type as md) using strat. peerAddr is the address of the
+// connecting peer (like peer.Peer.Addr.String()), and takes the place of remoteAddr.
+// gRPC metadata keys are lowercase, rather than canonicalized like http.Header keys, so
+// md can't simply be converted to an http.Header; the header names used by strat are
+// lowercased to look them up instead. Note that proxies and gateways may use a different
+// name for a header in metadata (grpc-gateway, for example, adds a "grpcgateway-" prefix
+// to most headers), so check which name is the right one for your configuration.
+func ClientIPFromMetadata(strat Strategy, md map[string][]string, peerAddr string) string {
+	return ClientIPFromHeaders(strat, metadataHeaders(md), peerAddr)
+}
+
+// metadataHeaders is a HeaderGetter for gRPC metadata.
+type metadataHeaders map[string][]string
+
+// Values implements HeaderGetter.
+func (md metadataHeaders) Values(name string) []string {
+	return md[strings.ToLower(name)]
+}
+
+// ClientAddr derives the client IP using strat and returns it as a netip.Addr. The zone,
+// if any, is preserved. IPv4 (including IPv4-mapped IPv6) addresses are returned in
+// their 4-byte form, consistent with the string returned by ClientIP.
+// This avoids the need to re-parse the string returned by ClientIP. ok is false if no
+// IP can be derived.
+func ClientAddr(strat Strategy, headers http.Header, remoteAddr string) (addr netip.Addr, ok bool) {
+	res := deriveResult(strat, headers, remoteAddr)
+	if res.ipAddr == nil {
+		return netip.Addr{}, false
+	}
+	return ipAddrToAddr(*res.ipAddr)
+}
+
+// ClientIPDetail is like strat.ClientIP, but also returns the reason for the result. This
+// is useful for logging and for debugging misconfigured strategies or proxy chains.
+// Strategies that are not from this package can only report ReasonFound or
+// ReasonNoValidIP.
+func ClientIPDetail(strat Strategy, headers http.Header, remoteAddr string) (ip string, reason Reason) {
+	res := deriveResult(strat, headers, remoteAddr)
+	return res.String(), res.reason
+}
+
+// ClientNetIPAddr is like ClientAddr, but returns the IP as a *net.IPAddr (including any
+// zone). It returns nil if no IP can be derived.
+func ClientNetIPAddr(strat Strategy, headers http.Header, remoteAddr string) *net.IPAddr {
+	return deriveResult(strat, headers, remoteAddr).ipAddr
+}
+
+// ClientIPWithPosition is like strat.ClientIP, but also returns the 0-based index, from
+// the left, of the header list item that the IP was derived from, and the total number
+// of items (across all instances of the header). For example, if the IP was the 3rd of
+// 5 items, indexFromLeft is 2 and total is 5. This can be used for auditing the proxy
+// chain, such as to check over time that a trusted count is still correct.
+// If no IP is derived, or it was not derived from a list header (as with
+// RemoteAddrStrategy, the single-IP header strategies, and strategies that are not from
+// this package), indexFromLeft is -1. total is 0 if no list header was read, or if it
+// has more than MaxListItems items.
+func ClientIPWithPosition(strat Strategy, headers http.Header, remoteAddr string) (ip string, indexFromLeft, total int) {
+	res := deriveResult(strat, headers, remoteAddr)
+	return res.String(), res.position - 1, res.total
+}
+
+// ClientIPErr is like strat.ClientIP, but returns an error instead of an empty string if
+// no client IP can be derived. The error matches ErrNoClientIP, and errors.As can be
+// used to get the *NoClientIPError, which has the reason. This is convenient for code
+// that logs and denies the request when there is no client IP.
+func ClientIPErr(strat Strategy, headers http.Header, remoteAddr string) (string, error) {
+	res := deriveResult(strat, headers, remoteAddr)
+	if res.ipAddr == nil {
+		return "", &NoClientIPError{Reason: res.reason}
+	}
+	return res.String(), nil
+}
+
+// ipAddrToAddr converts a net.IPAddr into a netip.Addr, preserving the zone. IPv4-mapped
+// IPv6 addresses are unmapped, to be consistent with net.IP's string form.
+func ipAddrToAddr(ipAddr net.IPAddr) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ipAddr.IP)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(ipAddr.Zone), true
+}
+
+// WithResultCallback wraps strat so that cb is invoked once for every call to ClientIP.
+// cb receives the normalized IP (as returned by ClientIP), the raw value the IP was
+// derived from (such as the header list item or remoteAddr, before normalization), and
+// the reason for the result. cb is called even when no IP is found, in which case
+// normalized and raw are empty.
+// cb runs synchronously on the calling goroutine, so it must be fast, and it must be
+// threadsafe if the returned strategy is used concurrently.
+func WithResultCallback(strat Strategy, cb func(normalized, raw string, reason Reason)) Strategy {
+	return resultCallbackStrategy{strat: strat, cb: cb}
+}
+
+// resultCallbackStrategy is the strategy returned by WithResultCallback.
+type resultCallbackStrategy struct {
+	strat Strategy
+	cb    func(normalized, raw string, reason Reason)
+}
+
+// ClientIP derives the client IP using the wrapped strategy and passes the result to
+// the callback before returning it.
+func (strat resultCallbackStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat resultCallbackStrategy) Validate() error {
+	if strat.strat == nil {
+		return fmt.Errorf("WithResultCallback strategy must not be nil")
+	}
+	if strat.cb == nil {
+		return fmt.Errorf("WithResultCallback callback must not be nil")
+	}
+	return strat.strat.Validate()
+}
+
+func (strat resultCallbackStrategy) String() string {
+	return fmt.Sprintf("{strategy:%T%v}", strat.strat, strat.strat)
+}
+
+func (strat resultCallbackStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	res := deriveResult(strat.strat, headers, remoteAddr)
+	strat.cb(res.String(), res.raw, res.reason)
+	return res
+}
+
+// ClientIPHash derives the client IP using strat and returns it along with a
+// hex-encoded HMAC-SHA256 of it, keyed with salt. This can be used for
+// privacy-preserving analytics, where a stable per-client identifier is needed but raw
+// IPs must not be stored.
+// The hash is computed over the binary form of the derived IP, so the same client will
+// hash identically regardless of how its IP was represented in the request (with or
+// without port, IPv4-mapped IPv6, zero-collapsed IPv6, etc.) or whether WithMappedIPv6
+// was used. Any zone is not included in the hash.
+// salt MUST be kept secret -- the IPv4 address space is small enough that an unkeyed or
+// known-key hash can be reversed by brute force. It must also be kept stable, or the
+// hashes for the same client will change.
+// If no IP can be derived, both return values will be empty strings.
+func ClientIPHash(strat Strategy, headers http.Header, remoteAddr string, salt []byte) (ip, hash string) {
+	res := deriveResult(strat, headers, remoteAddr)
+	if res.ipAddr == nil {
+		return "", ""
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(res.ipAddr.IP.To16())
+	return res.String(), hex.EncodeToString(mac.Sum(nil))
+}
+
+// LimiterKey derives the client IP using strat and returns it, without any zone, for use
+// as a rate-limiting key (or similar). ok is false if no IP can be derived, in which case
+// the request should probably be denied rather than limited under an empty key.
+// IPv4-mapped IPv6 addresses are always keyed as IPv4, even with WithMappedIPv6, so that a
+// client can't get a fresh key by changing how its IP is written.
+// As a single IPv6 client typically controls a whole /64, limiting by exact IPv6 address
+// is easily bypassed; use LimiterKeyPrefix to limit by network instead.
+func LimiterKey(strat Strategy, headers http.Header, remoteAddr string) (key string, ok bool) {
+	res := deriveResult(strat, headers, remoteAddr)
+	if res.ipAddr == nil {
+		return "", false
+	}
+	return res.ipAddr.IP.String(), true
+}
+
+// LimiterKeyPrefix is like LimiterKey, but the key is the network prefix containing the
+// client IP, as returned by NetworkPrefix with v4Bits and v6Bits (zero for the defaults
+// of 32 and 64).
+// An error is returned if v4Bits or v6Bits is not a valid prefix length, whether or not
+// an IP can be derived, so that a misconfiguration isn't mistaken for a request without
+// a client IP. Otherwise, if no IP can be derived, the error matches ErrNoClientIP (as
+// with ClientIPErr), in which case the request should probably be denied.
+func LimiterKeyPrefix(strat Strategy, headers http.Header, remoteAddr string, v4Bits, v6Bits int) (string, error) {
+	v4Bits, v6Bits = defaultBits(v4Bits, 32), defaultBits(v6Bits, 64)
+	if err := validatePrefixBits(v4Bits, v6Bits); err != nil {
+		return "", err
+	}
+
+	res := deriveResult(strat, headers, remoteAddr)
+	if res.ipAddr == nil {
+		return "", &NoClientIPError{Reason: res.reason}
+	}
+
+	ipNet, err := maskNetIP(res.ipAddr.IP, v4Bits, v6Bits)
+	if err != nil {
+		return "", err
+	}
+	return ipNet.String(), nil
+}
+
+// NetworkPrefix returns the network prefix containing ip, in CIDR form (like
+// "2001:db8::/64"). v4Bits and v6Bits are the prefix lengths to use for IPv4 and IPv6
+// addresses, respectively; if zero, the defaults of 32 for IPv4 and 64 for IPv6 are used.
+// This is useful as a rate-limiting key: a single IPv6 client typically controls at
+// least a whole /64, so limiting by exact IPv6 address is easily bypassed.
+// ip is parsed with ParseIPAddr, so it may have a port, and any zone is discarded.
+// IPv4-mapped IPv6 addresses are treated as IPv4.
+func NetworkPrefix(ip string, v4Bits, v6Bits int) (string, error) {
+	ipNet, err := maskIP(ip, defaultBits(v4Bits, 32), defaultBits(v6Bits, 64))
+	if err != nil {
+		return "", err
+	}
+	return ipNet.String(), nil
+}
+
+// defaultBits returns bits, or def if bits is zero.
+func defaultBits(bits, def int) int {
+	if bits == 0 {
+		return def
+	}
+	return bits
+}
+
+// Anonymize zeroes the host portion of ip, in the style of Google Analytics IP
+// anonymization, so that it can be logged or stored under privacy regulations like the
+// GDPR. IPv4 addresses are masked to /24 (the last octet is zeroed) and IPv6 addresses
+// are masked to /48 (the last 80 bits are zeroed). For example, "188.0.2.128" becomes
+// "188.0.2.0". Use AnonymizeWithBits for different prefix lengths.
+// ip is parsed with ParseIPAddr, so it may have a port, and any zone is discarded. The
+// address family is preserved, except that IPv4-mapped IPv6 addresses are treated, and
+// returned, as IPv4 (as they are by the rest of this library).
+func Anonymize(ip string) (string, error) {
+	return AnonymizeWithBits(ip, 24, 48)
+}
+
+// AnonymizeWithBits is like Anonymize, but keeps the first v4Bits bits of IPv4 addresses
+// and the first v6Bits bits of IPv6 addresses.
+func AnonymizeWithBits(ip string, v4Bits, v6Bits int) (string, error) {
+	ipNet, err := maskIP(ip, v4Bits, v6Bits)
+	if err != nil {
+		return "", err
+	}
+	return ipNet.IP.String(), nil
+}
+
+// maskIP parses ip and masks it to the given prefix length for its family.
+func maskIP(ip string, v4Bits, v6Bits int) (net.IPNet, error) {
+	ipAddr, err := ParseIPAddr(ip)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	return maskNetIP(ipAddr.IP, v4Bits, v6Bits)
+}
+
+// validatePrefixBits returns an error if v4Bits or v6Bits is not a valid prefix length
+// for its family.
+func validatePrefixBits(v4Bits, v6Bits int) error {
+	if err := validateV4Bits(v4Bits); err != nil {
+		return err
+	}
+	return validateV6Bits(v6Bits)
+}
+
+func validateV4Bits(v4Bits int) error {
+	if v4Bits < 0 || v4Bits > 8*net.IPv4len {
+		return fmt.Errorf("IPv4 prefix length %d is out of range", v4Bits)
+	}
+	return nil
+}
+
+func validateV6Bits(v6Bits int) error {
+	if v6Bits < 0 || v6Bits > 8*net.IPv6len {
+		return fmt.Errorf("IPv6 prefix length %d is out of range", v6Bits)
+	}
+	return nil
+}
+
+// maskNetIP masks ip to the given prefix length for its family. IPv4-mapped IPv6
+// addresses are treated as IPv4.
+func maskNetIP(ip net.IP, v4Bits, v6Bits int) (net.IPNet, error) {
+	var ipNet net.IPNet
+	if ip4 := ip.To4(); ip4 != nil {
+		if err := validateV4Bits(v4Bits); err != nil {
+			return net.IPNet{}, err
+		}
+		ipNet.Mask = net.CIDRMask(v4Bits, 8*net.IPv4len)
+		ipNet.IP = ip4.Mask(ipNet.Mask)
+	} else {
+		if err := validateV6Bits(v6Bits); err != nil {
+			return net.IPNet{}, err
+		}
+		ipNet.Mask = net.CIDRMask(v6Bits, 8*net.IPv6len)
+		ipNet.IP = ip.Mask(ipNet.Mask)
+	}
+
+	return ipNet, nil
+}
+
+// ChainStrategy attempts to use the given strategies in order. If the first one returns
+// an empty string, the second one is tried, and so on, until a good IP is found or the
+// strategies are exhausted.
+// A common use for this is if a server is both directly connected to the internet and
+// expecting a header to check. It might be called like:
+//   NewChainStrategy(Must(LeftmostNonPrivateStrategy("X-Forwarded-For")), RemoteAddrStrategy)
+type ChainStrategy struct {
+	strategies []Strategy
+}
+
+// NewChainStrategy creates a ChainStrategy that attempts to use the given strategies to
+// derive the client IP, stopping when the first one succeeds.
+func NewChainStrategy(strategies ...Strategy) ChainStrategy {
+	return ChainStrategy{strategies: strategies}
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If all chained strategies fail to derive a valid IP, an empty string is returned.
+func (strat ChainStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat ChainStrategy) Validate() error {
+	if len(strat.strategies) == 0 {
+		return fmt.Errorf("ChainStrategy must have at least one strategy")
+	}
+	for i, subStrat := range strat.strategies {
+		if subStrat == nil {
+			return fmt.Errorf("ChainStrategy strategy %d must not be nil", i)
+		}
+		if err := subStrat.Validate(); err != nil {
+			return fmt.Errorf("ChainStrategy strategy %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// ClientIPWithSource is like ClientIP, but also returns the zero-based index of the
+// chained strategy that produced the IP, or -1 if none did. This is useful for diagnosing
+// proxy misconfiguration; the strategy itself can be obtained (and logged) with
+// Strategies.
+func (strat ChainStrategy) ClientIPWithSource(headers http.Header, remoteAddr string) (ip string, index int) {
+	res, index := strat.deriveWithSource(headers, remoteAddr)
+	return res.String(), index
+}
+
+// Strategies returns the chained strategies, in order. The returned slice is a copy.
+func (strat ChainStrategy) Strategies() []Strategy {
+	return append([]Strategy(nil), strat.strategies...)
+}
+
+func (strat ChainStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	res, _ := strat.deriveWithSource(headers, remoteAddr)
+	return res
+}
+
+// deriveWithSource derives the result, and also returns the index of the strategy that
+// produced it (or -1).
+func (strat ChainStrategy) deriveWithSource(headers HeaderGetter, remoteAddr string) (result, int) {
+	// If all of the strategies fail, we'll report the reason from the last one
+	res := result{reason: ReasonNoValidIP}
+	for i, subStrat := range strat.strategies {
+		res = deriveResult(subStrat, headers, remoteAddr)
+		if res.ipAddr != nil {
+			return res, i
+		}
+	}
+	return res, -1
+}
+
+func (strat ChainStrategy) String() string {
+	return strategiesString(strat.strategies)
+}
+
+// ConsensusStrategy derives the client IP with all of the given strategies, and only
+// succeeds if they all derive the same IP. This is useful for high-security endpoints,
+// where the client IP can be derived by two independent methods (for example, from the
+// Forwarded header with RightmostTrustedRangeStrategy and from the X-Forwarded-For header
+// with RightmostTrustedCountStrategy). If they disagree, one of the headers has been
+// spoofed or the proxies are misconfigured -- which a ChainStrategy would mask.
+type ConsensusStrategy struct {
+	strategies []Strategy
+}
+
+// NewConsensusStrategy creates a ConsensusStrategy that requires all of the given
+// strategies to derive the same client IP.
+func NewConsensusStrategy(strategies ...Strategy) ConsensusStrategy {
+	return ConsensusStrategy{strategies: strategies}
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// IPs are compared without their zones, but the returned IP (which is the one derived
+// by the first strategy) may contain a zone identifier.
+// If any of the strategies fails to derive a valid IP, or they derive different IPs, an
+// empty string is returned. In the latter case, ClientIPDetail reports ReasonMismatch.
+func (strat ConsensusStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat ConsensusStrategy) Validate() error {
+	if len(strat.strategies) == 0 {
+		return fmt.Errorf("ConsensusStrategy must have at least one strategy")
+	}
+	for i, subStrat := range strat.strategies {
+		if subStrat == nil {
+			return fmt.Errorf("ConsensusStrategy strategy %d must not be nil", i)
+		}
+		if err := subStrat.Validate(); err != nil {
+			return fmt.Errorf("ConsensusStrategy strategy %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Strategies returns the strategies, in order. The returned slice is a copy.
+func (strat ConsensusStrategy) Strategies() []Strategy {
+	return append([]Strategy(nil), strat.strategies...)
+}
+
+func (strat ConsensusStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	// A consensus of nobody is not a consensus
+	consensus := result{reason: ReasonNoValidIP}
+	for i, subStrat := range strat.strategies {
+		res := deriveResult(subStrat, headers, remoteAddr)
+		if res.ipAddr == nil {
+			// If any strategy fails, we fail with its reason
+			return res
+		}
+
+		if i == 0 {
+			consensus = res
+			continue
+		}
+
+		// The IPs have been normalized by parsing, but the IPv4 ones may be in either 4-
+		// or 16-byte form, so we use IP.Equal. Zones are ignored, as different proxies may
+		// or may not include them.
+		if !res.ipAddr.IP.Equal(consensus.ipAddr.IP) {
+			return result{reason: ReasonMismatch}
+		}
+	}
+	return consensus
+}
+
+func (strat ConsensusStrategy) String() string {
+	return strategiesString(strat.strategies)
+}
+
+// RequireAllStrategy derives the client IP with all of the given strategies, and only
+// succeeds if every one of them derives an IP, in which case the IP derived by the last
+// one is returned. Unlike ConsensusStrategy, the IPs don't have to agree. This is useful
+// for checking that the request arrived through the expected topology. For example,
+// requiring RemoteAddrStrategy to succeed (so the connection is real, not an in-process
+// request) along with a header strategy, and returning the header's result:
+//
+//	NewRequireAllStrategy(RemoteAddrStrategy{}, Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1)))
+type RequireAllStrategy struct {
+	strategies []Strategy
+}
+
+// NewRequireAllStrategy creates a RequireAllStrategy that requires all of the given
+// strategies to derive a client IP, and returns the last one.
+func NewRequireAllStrategy(strategies ...Strategy) RequireAllStrategy {
+	return RequireAllStrategy{strategies: strategies}
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If any of the strategies fails to derive a valid IP, an empty string is returned, and
+// ClientIPDetail reports the reason that strategy gave.
+func (strat RequireAllStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat RequireAllStrategy) Validate() error {
+	if len(strat.strategies) == 0 {
+		return fmt.Errorf("RequireAllStrategy must have at least one strategy")
+	}
+	for i, subStrat := range strat.strategies {
+		if subStrat == nil {
+			return fmt.Errorf("RequireAllStrategy strategy %d must not be nil", i)
+		}
+		if err := subStrat.Validate(); err != nil {
+			return fmt.Errorf("RequireAllStrategy strategy %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Strategies returns the strategies, in order. The returned slice is a copy.
+func (strat RequireAllStrategy) Strategies() []Strategy {
+	return append([]Strategy(nil), strat.strategies...)
+}
+
+func (strat RequireAllStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	// With no strategies, there is nothing to return
+	res := result{reason: ReasonNoValidIP}
+	for _, subStrat := range strat.strategies {
+		res = deriveResult(subStrat, headers, remoteAddr)
+		if res.ipAddr == nil {
+			// If any strategy fails, we fail with its reason
+			return res
+		}
+	}
+	return res
+}
+
+func (strat RequireAllStrategy) String() string {
+	return strategiesString(strat.strategies)
+}
+
+// strategiesString returns the String() result for a strategy made of sub-strategies.
+func strategiesString(strategies []Strategy) string {
+	var b strings.Builder
+	b.WriteString("{strategies:[")
+	for i, s := range strategies {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(fmt.Sprintf("%T%+v", s, s))
+	}
+	b.WriteString("]}")
+	return b.String()
+}
+
+// RemoteAddrStrategy returns the client socket IP, stripped of port.
+// This strategy should be used if the server accept direct connections, rather than
+// through a reverse proxy.
+type RemoteAddrStrategy struct{}
+
+// ClientIP derives the client IP using this strategy.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned. This should only happen
+// if remoteAddr has been modified to something illegal, or if the server is accepting
+// connections on a Unix domain socket (in which case RemoteAddr is "@").
+func (strat RemoteAddrStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat RemoteAddrStrategy) Validate() error {
+	// There's nothing to configure
+	return nil
+}
+
+func (strat RemoteAddrStrategy) String() string {
+	return "{}"
+}
+
+func (strat RemoteAddrStrategy) derive(_ HeaderGetter, remoteAddr string) result {
+	ipAddr := goodIPAddr(remoteAddr)
+	if ipAddr == nil {
+		return result{reason: ReasonNoValidIP}
+	}
+
+	return result{ipAddr: ipAddr, raw: remoteAddr, reason: ReasonFound}
+}
+
+// TrustedPeerStrategy only consults another strategy (typically one using the
+// X-Forwarded-For or Forwarded header) if the immediate peer -- the remoteAddr -- is a
+// trusted reverse proxy. Otherwise, the peer is the client, and its IP is returned.
+// This is the "only trust proxies you know" model (like nginx's set_real_ip_from): a
+// client that connects directly, bypassing the proxies, can't spoof its IP with headers.
+// It is useful when a server can be reached both directly and via reverse proxies.
+type TrustedPeerStrategy struct {
+	inner              Strategy
+	trustedProxyRanges []net.IPNet
+}
+
+// NewTrustedPeerStrategy creates a TrustedPeerStrategy. If remoteAddr is in
+// trustedProxyRanges, the client IP will be derived using inner; otherwise the remoteAddr
+// IP is used. inner must not be nil and trustedProxyRanges must not be empty.
+func NewTrustedPeerStrategy(inner Strategy, trustedProxyRanges []net.IPNet) (TrustedPeerStrategy, error) {
+	strat := TrustedPeerStrategy{inner: inner, trustedProxyRanges: trustedProxyRanges}
+	if err := strat.Validate(); err != nil {
+		return TrustedPeerStrategy{}, err
+	}
+	return strat, nil
+}
+
+// NewCDNOrDirectStrategy creates a strategy for the common setup of a server that is
+// reached through a CDN (or other reverse proxy) that puts the client IP in a single-IP
+// header (like Cloudflare's CF-Connecting-IP), but that can also be reached directly.
+// The cdnHeader header is only trusted if the request came from the CDN, which is
+// determined by remoteAddr being in cdnRanges (like ranges.Cloudflare); otherwise the
+// remoteAddr IP is used. This prevents a client that connects directly from spoofing
+// its IP with the header, which is the easy mistake to make when chaining a
+// SingleIPHeaderStrategy with a RemoteAddrStrategy.
+// Note that if the request came from the CDN but the header is missing or invalid, no IP
+// is derived (as that indicates a misconfiguration), rather than falling back to
+// remoteAddr, which would be the CDN's IP.
+// The result is a TrustedPeerStrategy wrapping a SingleIPHeaderStrategy, so cdnHeader
+// must not be a list header, and cdnRanges must not be empty. opts are passed to
+// NewSingleIPHeaderStrategy.
+func NewCDNOrDirectStrategy(cdnHeader string, cdnRanges []net.IPNet, opts ...Option) (TrustedPeerStrategy, error) {
+	inner, err := NewSingleIPHeaderStrategy(cdnHeader, opts...)
+	if err != nil {
+		return TrustedPeerStrategy{}, err
+	}
+	return NewTrustedPeerStrategy(inner, cdnRanges)
+}
+
+// NewEnvoyExternalAddressStrategy creates a strategy for a server behind the Envoy proxy,
+// and is the recommended Envoy integration. Envoy determines the client IP itself
+// (according to its xff_num_trusted_hops or original IP detection settings) and puts it
+// in the X-Envoy-External-Address header, so there's no need to parse X-Forwarded-For.
+// The header is only used if the request came from Envoy, which is determined by
+// remoteAddr being in trustedEnvoyRanges; otherwise the remoteAddr IP is used, so a
+// client that connects directly can't spoof its IP with the header. Envoy removes the
+// x-envoy-* headers it receives from external clients, unless configured not to.
+// Note that Envoy only sets the header for requests it considers external, so a request
+// from Envoy for an internal client (as configured in Envoy) derives no IP, with
+// ReasonHeaderMissing; chain the strategy with another if such requests are expected.
+// The result is a TrustedPeerStrategy wrapping a SingleIPHeaderStrategy, and
+// trustedEnvoyRanges must not be empty. opts are passed to NewSingleIPHeaderStrategy.
+func NewEnvoyExternalAddressStrategy(trustedEnvoyRanges []net.IPNet, opts ...Option) (TrustedPeerStrategy, error) {
+	return NewCDNOrDirectStrategy(xEnvoyExternalAddressHdr, trustedEnvoyRanges, opts...)
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned. This will happen if
+// remoteAddr is not a valid IP, or if it is trusted and inner fails.
+func (strat TrustedPeerStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat TrustedPeerStrategy) Validate() error {
+	if strat.inner == nil {
+		return fmt.Errorf("TrustedPeerStrategy inner strategy must not be nil")
+	}
+	if len(strat.trustedProxyRanges) == 0 {
+		return fmt.Errorf("TrustedPeerStrategy must have at least one trusted proxy range")
+	}
+	if err := strat.inner.Validate(); err != nil {
+		return fmt.Errorf("TrustedPeerStrategy inner strategy: %w", err)
+	}
+	return nil
+}
+
+func (strat TrustedPeerStrategy) String() string {
+	return fmt.Sprintf("{inner:%T%v trustedProxyRanges:%v}", strat.inner, strat.inner, ipNetsString(strat.trustedProxyRanges))
+}
+
+func (strat TrustedPeerStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	peer := RemoteAddrStrategy{}.derive(headers, remoteAddr)
+	if peer.ipAddr == nil {
+		return peer
+	}
+
+	if !IPInRanges(peer.ipAddr.IP, strat.trustedProxyRanges) {
+		// The peer isn't one of our proxies, so it's the client
+		return peer
+	}
+
+	return deriveResult(strat.inner, headers, remoteAddr)
+}
+
+// BlocklistStrategy wraps another strategy and suppresses its result if the derived IP
+// is in one of the blocked ranges. This can be used to refuse to accept (for example)
+// known-bad ranges or the addresses of your own infrastructure as the client IP.
+// Note that a blocked result is a failure like any other: if it is used in a
+// ChainStrategy, the next strategy will be tried.
+type BlocklistStrategy struct {
+	inner         Strategy
+	blockedRanges []net.IPNet
+}
+
+// NewBlocklistStrategy creates a BlocklistStrategy. The client IP is derived using inner,
+// and is discarded if it is in blockedRanges. inner must not be nil. blockedRanges may
+// be created with AddressesAndRangesToIPNets; it may be empty, in which case nothing is
+// blocked.
+func NewBlocklistStrategy(inner Strategy, blockedRanges []net.IPNet) (BlocklistStrategy, error) {
+	strat := BlocklistStrategy{inner: inner, blockedRanges: blockedRanges}
+	if err := strat.Validate(); err != nil {
+		return BlocklistStrategy{}, err
+	}
+	return strat, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned. This will happen if
+// inner fails, or if the IP it derives is blocked (which ClientIPDetail reports as
+// ReasonBlocked).
+func (strat BlocklistStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat BlocklistStrategy) Validate() error {
+	if strat.inner == nil {
+		return fmt.Errorf("BlocklistStrategy inner strategy must not be nil")
+	}
+	if err := strat.inner.Validate(); err != nil {
+		return fmt.Errorf("BlocklistStrategy inner strategy: %w", err)
+	}
+	return nil
+}
+
+func (strat BlocklistStrategy) String() string {
+	return fmt.Sprintf("{inner:%T%v blockedRanges:%v}", strat.inner, strat.inner, ipNetsString(strat.blockedRanges))
+}
+
+func (strat BlocklistStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	res := deriveResult(strat.inner, headers, remoteAddr)
+	if res.ipAddr == nil {
+		return res
+	}
+
+	if IPInRanges(res.ipAddr.IP, strat.blockedRanges) {
+		return result{reason: ReasonBlocked}
+	}
+	return res
+}
+
+// MaxHopsStrategy wraps another strategy and fails if the X-Forwarded-For or Forwarded
+// header has more items than there are proxies in front of the server. With a fixed
+// proxy topology, the proxies add a known number of items, so any more than that were
+// supplied by the client (who may be trying to spoof their IP). Such requests can then
+// be flagged or denied.
+// Note that a too-long header is a failure like any other: if it is used in a
+// ChainStrategy, the next strategy will be tried.
+type MaxHopsStrategy struct {
+	inner      Strategy
+	headerName string
+	maxHops    int
+}
+
+// NewMaxHopsStrategy creates a MaxHopsStrategy. If the headerName header has more than
+// maxHops items (as counted by HopCount), no IP is derived; otherwise, the client IP is
+// derived using inner. headerName must be "X-Forwarded-For", "X-Original-Forwarded-For",
+// or "Forwarded", and is typically the same header used by inner. inner must not be nil,
+// and maxHops must be greater than zero (it will usually be the number of proxies, as
+// each adds one item).
+func NewMaxHopsStrategy(inner Strategy, headerName string, maxHops int) (MaxHopsStrategy, error) {
+	strat := MaxHopsStrategy{inner: inner, headerName: http.CanonicalHeaderKey(headerName), maxHops: maxHops}
+	if err := strat.Validate(); err != nil {
+		return MaxHopsStrategy{}, err
+	}
+	return strat, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned. This will happen if
+// the header has too many items (which ClientIPDetail reports as ReasonTooManyHops), or
+// if inner fails.
+func (strat MaxHopsStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat MaxHopsStrategy) Validate() error {
+	if strat.inner == nil {
+		return fmt.Errorf("MaxHopsStrategy inner strategy must not be nil")
+	}
+	if err := strat.inner.Validate(); err != nil {
+		return fmt.Errorf("MaxHopsStrategy inner strategy: %w", err)
+	}
+	if !isListHeader(strat.headerName) {
+		return fmt.Errorf("MaxHopsStrategy %w", ErrHeaderNotList)
+	}
+	if strat.maxHops <= 0 {
+		return fmt.Errorf("MaxHopsStrategy maxHops %w", ErrNonPositiveCount)
+	}
+	return nil
+}
+
+func (strat MaxHopsStrategy) String() string {
+	return fmt.Sprintf("{inner:%T%v headerName:%s maxHops:%d}", strat.inner, strat.inner, strat.headerName, strat.maxHops)
+}
+
+func (strat MaxHopsStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	if hopCount(headers, strat.headerName) > strat.maxHops {
+		return result{reason: ReasonTooManyHops}
+	}
+	return deriveResult(strat.inner, headers, remoteAddr)
+}
+
+// Warning describes a possible problem with a strategy's configuration that doesn't
+// prevent it from being created, such as the use of a header that is often spoofable.
+// Whether it is really a problem depends on your network configuration.
+type Warning struct {
+	// Header is the (canonicalized) header name the warning is about
+	Header string
+	// Message describes the possible problem
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Header + ": " + w.Message
+}
+
+// spoofableHeaders maps the canonicalized names of single-IP headers that are commonly
+// spoofable (because some proxies pass a client-supplied value through) to a note
+// explaining when. Keep it in sync with the single-IP wiki page.
+var spoofableHeaders = map[string]string{
+	"X-Client-Ip":         "not set by most proxies, so a client-supplied value is often passed through; make sure your proxy overwrites it",
+	"X-Cluster-Client-Ip": "set by some load balancers but passed through by others, so a client-supplied value may reach the server; make sure your proxy overwrites it",
+	"True-Client-Ip":      "Akamai passes a client-supplied value through unless configured to overwrite it (Cloudflare Enterprise always overwrites it)",
+	"Fastly-Client-Ip":    "Fastly passes a client-supplied value through unless the service configuration overwrites it",
+	"X-Azure-Clientip":    "Azure Front Door passes a client-supplied value through; consider X-Azure-SocketIP instead",
+}
+
+// singleIPHeaderWarnings returns a Warning for each of headerNames (which must be
+// canonicalized) that is commonly spoofable.
+func singleIPHeaderWarnings(headerNames ...string) []Warning {
+	var warnings []Warning
+	for _, headerName := range headerNames {
+		if msg, ok := spoofableHeaders[headerName]; ok {
+			warnings = append(warnings, Warning{Header: headerName, Message: msg})
+		}
+	}
+	return warnings
+}
+
+// SingleIPHeaderStrategy derives an IP address from a single-IP header.
+// A non-exhaustive list of such single-IP headers is:
+// X-Real-IP, CF-Connecting-IP, True-Client-IP, Fastly-Client-IP, X-Azure-ClientIP, X-Azure-SocketIP,
+// X-ProxyUser-Ip, X-Client-IP, X-Cluster-Client-IP.
+// This strategy should be used when the given header is added by a trusted reverse proxy.
+// You must ensure that this header is not spoofable (as is possible with Akamai's use of
+// True-Client-IP, Fastly's default use of Fastly-Client-IP, and Azure's X-Azure-ClientIP,
+// and with X-Client-IP and X-Cluster-Client-IP if your proxy doesn't overwrite them).
+// The Warnings method reports if the header is one of these.
+// See the single-IP wiki page for more info: https://github.com/realclientip/realclientip-go/wiki/Single-IP-Headers
+type SingleIPHeaderStrategy struct {
+	headerName            string
+	stripZone             bool
+	keepMapped            bool
+	rejectReserved        bool
+	rejectMultipleHeaders bool
+	allowUnspecified      bool
+	observer              Observer
+}
+
+// NewSingleIPHeaderStrategy creates a SingleIPHeaderStrategy that uses the headerName
+// request header to get the client IP.
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved,
+// WithRejectMultipleHeaders, WithUnspecified, WithObserver, and WithLogger. With WithLogger, any Warnings are
+// logged at warn level.
+func NewSingleIPHeaderStrategy(headerName string, opts ...Option) (SingleIPHeaderStrategy, error) {
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll canonicalize here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	if err := validateSingleIPHeaderName("SingleIPHeaderStrategy", headerName); err != nil {
+		return SingleIPHeaderStrategy{}, err
+	}
+
+	o := applyOptions(opts)
+
+	if o.logWarning != nil {
+		for _, w := range singleIPHeaderWarnings(headerName) {
+			o.logWarning(w)
+		}
+	}
+
+	return SingleIPHeaderStrategy{
+		headerName:            headerName,
+		stripZone:             o.stripZone,
+		keepMapped:            o.keepMapped,
+		rejectReserved:        o.rejectReserved,
+		rejectMultipleHeaders: o.rejectMultipleHeaders,
+		allowUnspecified:      o.allowUnspecified,
+		observer:              o.observer,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat SingleIPHeaderStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat SingleIPHeaderStrategy) Validate() error {
+	return validateSingleIPHeaderName("SingleIPHeaderStrategy", strat.headerName)
+}
+
+// Warnings returns a Warning if the strategy's header is one that is commonly
+// spoofable. It doesn't mean the strategy is wrong for your network, only that you
+// should check that your reverse proxy overwrites the header.
+func (strat SingleIPHeaderStrategy) Warnings() []Warning {
+	return singleIPHeaderWarnings(strat.headerName)
+}
+
+func (strat SingleIPHeaderStrategy) String() string {
+	var flags string
+	if strat.rejectMultipleHeaders {
+		flags += " rejectMultipleHeaders:true"
+	}
+	if strat.allowUnspecified {
+		flags += " unspecified:true"
+	}
+	return fmt.Sprintf("{headerName:%v%s%s%s%s}", strat.headerName, zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped), rejectReservedString(strat.rejectReserved), flags)
+}
+
+func (strat SingleIPHeaderStrategy) derive(headers HeaderGetter, _ string) result {
+	return strat.observer.observe(strat.deriveHeader(headers), headers, strat.headerName)
+}
+
+// deriveHeader derives the client IP from the header, without notifying the observer.
+func (strat SingleIPHeaderStrategy) deriveHeader(headers HeaderGetter) result {
+	// RFC 2616 does not allow multiple instances of single-IP headers (or any non-list header).
+	// It is debatable whether it is better to treat multiple such headers as an error
+	// (more correct) or simply pick one of them (more flexible). As we've already
+	// told the user tom make sure the header is not spoofable, by default we're going to
+	// use the last header instance if there are multiple. (Using the last is arbitrary,
+	// but in theory it should be the newest value.) The user can opt into the stricter
+	// behaviour with WithRejectMultipleHeaders.
+	if strat.rejectMultipleHeaders && len(headers.Values(strat.headerName)) > 1 {
+		return result{reason: ReasonMultipleHeaders}
+	}
+
+	ipStr := lastHeader(headers, strat.headerName)
+	if ipStr == "" {
+		// There is no header
+		return result{reason: ReasonHeaderMissing}
+	}
+
+	ipAddr := goodIPAddr(ipStr)
+	if ipAddr == nil && strat.allowUnspecified {
+		ipAddr = unspecifiedIPAddr(ipStr)
+	}
+	if ipAddr != nil && strat.rejectReserved && isReserved(ipAddr.IP) {
+		ipAddr = nil
+	}
+	if ipAddr == nil {
+		// The header value is invalid
+		return result{reason: ReasonNoValidIP}
+	}
+
+	return result{ipAddr: ipAddr, raw: ipStr, reason: ReasonFound, mapped: strat.keepMapped && isMappedIPv6Notation(ipStr)}.withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+}
+
+// SingleIPHeadersStrategy derives an IP address from the first of an ordered list of
+// single-IP headers that contains a valid IP. This is useful if the real client IP
+// arrives in different headers depending on the path the request took (for example,
+// different CDNs in different regions).
+// All of the caveats of SingleIPHeaderStrategy apply, for _every_ header in the list. In
+// particular, you must ensure that none of the headers is spoofable, as an attacker
+// could otherwise supply an earlier header in the list.
+type SingleIPHeadersStrategy struct {
+	headerNames []string
+}
+
+// NewSingleIPHeadersStrategy creates a SingleIPHeadersStrategy that checks the
+// headerNames request headers, in order, to get the client IP. At least one header name
+// must be provided, and each is subject to the same restrictions as in
+// NewSingleIPHeaderStrategy. It takes no options.
+func NewSingleIPHeadersStrategy(headerNames ...string) (SingleIPHeadersStrategy, error) {
+	if len(headerNames) == 0 {
+		return SingleIPHeadersStrategy{}, fmt.Errorf("SingleIPHeadersStrategy requires at least one header")
+	}
+
+	canonicalNames := make([]string, len(headerNames))
+	for i, headerName := range headerNames {
+		// We will be using the headerName for lookups in the http.Header map, which is keyed
+		// by canonicalized header name. We'll canonicalize here so we only have to do it once.
+		headerName = http.CanonicalHeaderKey(headerName)
+
+		if err := validateSingleIPHeaderName("SingleIPHeadersStrategy", headerName); err != nil {
+			return SingleIPHeadersStrategy{}, err
+		}
+
+		canonicalNames[i] = headerName
+	}
+
+	return SingleIPHeadersStrategy{headerNames: canonicalNames}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat SingleIPHeadersStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat SingleIPHeadersStrategy) Validate() error {
+	if len(strat.headerNames) == 0 {
+		return fmt.Errorf("SingleIPHeadersStrategy requires at least one header")
+	}
+	for _, headerName := range strat.headerNames {
+		if err := validateSingleIPHeaderName("SingleIPHeadersStrategy", headerName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Warnings is like SingleIPHeaderStrategy.Warnings, with a Warning for each commonly
+// spoofable header.
+func (strat SingleIPHeadersStrategy) Warnings() []Warning {
+	return singleIPHeaderWarnings(strat.headerNames...)
+}
+
+func (strat SingleIPHeadersStrategy) String() string {
+	return fmt.Sprintf("{headerNames:%v}", strat.headerNames)
+}
+
+func (strat SingleIPHeadersStrategy) derive(headers HeaderGetter, _ string) result {
+	reason := ReasonHeaderMissing
+	for _, headerName := range strat.headerNames {
+		// See SingleIPHeaderStrategy for why we use the last header instance
+		ipStr := lastHeader(headers, headerName)
+		if ipStr == "" {
+			// There is no header; try the next
+			continue
+		}
+
+		ipAddr := goodIPAddr(ipStr)
+		if ipAddr == nil {
+			// The header value is invalid; try the next
+			reason = ReasonNoValidIP
+			continue
+		}
+
+		return result{ipAddr: ipAddr, raw: ipStr, reason: ReasonFound}
+	}
+
+	return result{reason: reason}
+}
+
+// NewGoogleFrontendStrategy creates a SingleIPHeaderStrategy that uses the X-ProxyUser-Ip
+// header, which is set by Google Front End (GFE) and some Google APIs.
+// As with any single-IP header, you must ensure that requests can only reach your server
+// through Google's infrastructure; otherwise the header can be trivially spoofed.
+// The supported options are the same as for NewSingleIPHeaderStrategy.
+func NewGoogleFrontendStrategy(opts ...Option) SingleIPHeaderStrategy {
+	// The header name is valid, so this can't fail
+	strat, _ := NewSingleIPHeaderStrategy(xProxyUserIPHdr, opts...)
+	return strat
+}
+
+// NewFlyClientIPStrategy creates a SingleIPHeaderStrategy that uses the Fly-Client-IP
+// header, which Fly.io's proxy sets to the IP of the client that connected to it.
+// This must only be used if the app can only be reached through Fly's proxy (that is,
+// through its public services, not a directly-exposed port or other route). A client
+// that connects directly can set the header to anything. If the app can also be reached
+// directly, use NewCDNOrDirectStrategy with the ranges of Fly's proxies instead.
+// The supported options are the same as for NewSingleIPHeaderStrategy.
+func NewFlyClientIPStrategy(opts ...Option) SingleIPHeaderStrategy {
+	// The header name is valid, so this can't fail
+	strat, _ := NewSingleIPHeaderStrategy(flyClientIPHdr, opts...)
+	return strat
+}
+
+// LeftmostNonPrivateStrategy derives the client IP from the leftmost valid and
+// non-private IP address in the X-Fowarded-For for Forwarded header. This
+// strategy should be used when a valid, non-private IP closest to the client is desired.
+// Note that this MUST NOT BE USED FOR SECURITY PURPOSES. This IP can be TRIVIALLY
+// SPOOFED.
+type LeftmostNonPrivateStrategy struct {
+	headerName    string
+	privateRanges []net.IPNet
+	family        Family
+	listOptions
+}
+
+// NewLeftmostNonPrivateStrategy creates a LeftmostNonPrivateStrategy. headerName must be
+// "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded".
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved, WithFamily,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewLeftmostNonPrivateStrategy(headerName string, opts ...Option) (LeftmostNonPrivateStrategy, error) {
+	return NewLeftmostNonPrivateStrategyWithRanges(headerName, nil, opts...)
+}
+
+// NewLeftmostNonPrivateStrategyWithRanges creates a LeftmostNonPrivateStrategy that uses privateRanges, rather
+// than the default private and local ranges, to determine which IPs are undesirable.
+// This allows, for example, treating carrier-grade NAT addresses (100.64.0.0/10) as
+// valid client IPs, or treating an additional internal supernet as private. If
+// privateRanges is nil, the default ranges (see PrivateAndLocalRanges) are used; if it
+// is empty, no IPs are considered private.
+// headerName must be "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded".
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved, WithFamily,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewLeftmostNonPrivateStrategyWithRanges(headerName string, privateRanges []net.IPNet, opts ...Option) (LeftmostNonPrivateStrategy, error) {
+	if headerName == "" {
+		return LeftmostNonPrivateStrategy{}, fmt.Errorf("LeftmostNonPrivateStrategy %w", ErrEmptyHeaderName)
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	o := applyOptions(opts)
+	lo := newListOptions(o)
+	if err := lo.validate("LeftmostNonPrivateStrategy", headerName); err != nil {
+		return LeftmostNonPrivateStrategy{}, err
+	}
+	if err := validateFamily("LeftmostNonPrivateStrategy", o.family); err != nil {
+		return LeftmostNonPrivateStrategy{}, err
+	}
+
+	return LeftmostNonPrivateStrategy{
+		headerName:    headerName,
+		privateRanges: copyPrivateRanges(privateRanges),
+		family:        o.family,
+		listOptions:   lo,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat LeftmostNonPrivateStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat LeftmostNonPrivateStrategy) Validate() error {
+	if err := validateFamily("LeftmostNonPrivateStrategy", strat.family); err != nil {
+		return err
+	}
+	return strat.listOptions.validate("LeftmostNonPrivateStrategy", strat.headerName)
+}
+
+func (strat LeftmostNonPrivateStrategy) String() string {
+	return fmt.Sprintf("{headerName:%v privateRanges:%v%s%s%s%s%s%s%s}",
+		strat.headerName, privateRangesString(strat.privateRanges), familyString(strat.family), zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped), rejectReservedString(strat.rejectReserved),
+		strictForwardedString(strat.strictForwarded), lenientSeparatorsString(strat.lenientSeparators), syntaxString(strat.syntax))
+}
+
+func (strat LeftmostNonPrivateStrategy) derive(headers HeaderGetter, _ string) result {
+	res := withListItems(headers, strat.headerName, strat.syntax, strat.strictForwarded, strat.lenientSeparators, func(items []listItem) result {
+		rejectReservedItems(items, strat.rejectReserved)
+		for _, item := range items {
+			if item.ipAddr != nil && strat.family.matches(item.ipAddr.IP) && !isPrivate(item.ipAddr.IP, strat.privateRanges) {
+				// This is the leftmost valid, non-private IP (of the right family)
+				return item.result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+			}
+		}
+
+		// We failed to find any valid, non-private IP
+		return result{reason: nonPrivateFailureReason(items, strat.family)}
+	})
+	return strat.observer.observe(res, headers, strat.headerName)
+}
+
+// RightmostNonPrivateStrategy derives the client IP from the rightmost valid,
+// non-private/non-internal IP address in the X-Fowarded-For for Forwarded header. This
+// strategy should be used when all reverse proxies between the internet and the
+// server have private-space IP addresses.
+type RightmostNonPrivateStrategy struct {
+	headerName    string
+	privateRanges []net.IPNet
+	listOptions
+}
+
+// NewRightmostNonPrivateStrategy creates a RightmostNonPrivateStrategy. headerName must
+// be "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded".
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewRightmostNonPrivateStrategy(headerName string, opts ...Option) (RightmostNonPrivateStrategy, error) {
+	return NewRightmostNonPrivateStrategyWithRanges(headerName, nil, opts...)
+}
+
+// NewRightmostNonPrivateStrategyWithRanges creates a RightmostNonPrivateStrategy that uses privateRanges, rather
+// than the default private and local ranges, to determine which IPs are undesirable.
+// This allows, for example, treating carrier-grade NAT addresses (100.64.0.0/10) as
+// valid client IPs, or treating an additional internal supernet as private. If
+// privateRanges is nil, the default ranges (see PrivateAndLocalRanges) are used; if it
+// is empty, no IPs are considered private.
+// headerName must be "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded".
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewRightmostNonPrivateStrategyWithRanges(headerName string, privateRanges []net.IPNet, opts ...Option) (RightmostNonPrivateStrategy, error) {
+	if headerName == "" {
+		return RightmostNonPrivateStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy %w", ErrEmptyHeaderName)
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	o := applyOptions(opts)
+	lo := newListOptions(o)
+	if err := lo.validate("RightmostNonPrivateStrategy", headerName); err != nil {
+		return RightmostNonPrivateStrategy{}, err
+	}
+
+	return RightmostNonPrivateStrategy{
+		headerName:    headerName,
+		privateRanges: copyPrivateRanges(privateRanges),
+		listOptions:   lo,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat RightmostNonPrivateStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat RightmostNonPrivateStrategy) Validate() error {
+	return strat.listOptions.validate("RightmostNonPrivateStrategy", strat.headerName)
+}
+
+func (strat RightmostNonPrivateStrategy) String() string {
+	return fmt.Sprintf("{headerName:%v privateRanges:%v%s%s%s%s%s%s}",
+		strat.headerName, privateRangesString(strat.privateRanges), zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped), rejectReservedString(strat.rejectReserved),
+		strictForwardedString(strat.strictForwarded), lenientSeparatorsString(strat.lenientSeparators), syntaxString(strat.syntax))
+}
+
+func (strat RightmostNonPrivateStrategy) derive(headers HeaderGetter, _ string) result {
+	res := withListItems(headers, strat.headerName, strat.syntax, strat.strictForwarded, strat.lenientSeparators, func(items []listItem) result {
+		rejectReservedItems(items, strat.rejectReserved)
+		// Look backwards through the list of IP addresses
+		for i := len(items) - 1; i >= 0; i-- {
+			if items[i].ipAddr != nil && !isPrivate(items[i].ipAddr.IP, strat.privateRanges) {
+				// This is the rightmost non-private IP
+				return items[i].result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+			}
+		}
+
+		// We failed to find any valid, non-private IP
+		return result{reason: nonPrivateFailureReason(items, FamilyAny)}
+	})
+	return strat.observer.observe(res, headers, strat.headerName)
+}
+
+// LeftmostStrategy derives the client IP from the leftmost valid IP address in the
+// X-Forwarded-For or Forwarded header, without regard to whether it is private. Only
+// unparseable IPs, and the zero and unspecified addresses, are skipped.
+// This strategy should be used when all of the network between the client and the server
+// is trusted, such as for an intranet application, where the client IP is legitimately
+// private. Note that this MUST NOT BE USED FOR SECURITY PURPOSES if the header can come
+// from outside of that network, as this IP can be TRIVIALLY SPOOFED.
+type LeftmostStrategy struct {
+	headerName string
+	family     Family
+	listOptions
+}
+
+// NewLeftmostStrategy creates a LeftmostStrategy. headerName must be "X-Forwarded-For",
+// "X-Original-Forwarded-For", or "Forwarded".
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved, WithFamily,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewLeftmostStrategy(headerName string, opts ...Option) (LeftmostStrategy, error) {
+	if headerName == "" {
+		return LeftmostStrategy{}, fmt.Errorf("LeftmostStrategy %w", ErrEmptyHeaderName)
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	o := applyOptions(opts)
+	lo := newListOptions(o)
+	if err := lo.validate("LeftmostStrategy", headerName); err != nil {
+		return LeftmostStrategy{}, err
+	}
+	if err := validateFamily("LeftmostStrategy", o.family); err != nil {
+		return LeftmostStrategy{}, err
+	}
+
+	return LeftmostStrategy{
+		headerName:  headerName,
+		family:      o.family,
+		listOptions: lo,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat LeftmostStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat LeftmostStrategy) Validate() error {
+	if err := validateFamily("LeftmostStrategy", strat.family); err != nil {
+		return err
+	}
+	return strat.listOptions.validate("LeftmostStrategy", strat.headerName)
+}
+
+func (strat LeftmostStrategy) String() string {
+	return fmt.Sprintf("{headerName:%v%s%s%s%s%s%s%s}",
+		strat.headerName, familyString(strat.family), zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped), rejectReservedString(strat.rejectReserved),
+		strictForwardedString(strat.strictForwarded), lenientSeparatorsString(strat.lenientSeparators), syntaxString(strat.syntax))
+}
+
+func (strat LeftmostStrategy) derive(headers HeaderGetter, _ string) result {
+	res := withListItems(headers, strat.headerName, strat.syntax, strat.strictForwarded, strat.lenientSeparators, func(items []listItem) result {
+		rejectReservedItems(items, strat.rejectReserved)
+		for _, item := range items {
+			if item.ipAddr != nil && strat.family.matches(item.ipAddr.IP) {
+				// This is the leftmost valid IP (of the right family)
+				return item.result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+			}
+		}
+
+		// We failed to find any valid IP
+		if len(items) == 0 {
+			return result{reason: ReasonHeaderMissing}
+		}
+		return result{reason: ReasonNoValidIP}
+	})
+	return strat.observer.observe(res, headers, strat.headerName)
+}
+
+// NewLeftmostPublicOrPrivateStrategy creates a strategy that derives the client IP from
+// the leftmost non-private IP address in the X-Forwarded-For or Forwarded header, or, if
+// there is none, from the leftmost valid IP address, even if it is private. This is for
+// uses like analytics, where the best available identifier is wanted, rather than for
+// anything security-related (for which the caveats of the leftmost strategies apply).
+// It differs from LeftmostNonPrivateStrategy, which fails if all of the IPs are private,
+// and from LeftmostStrategy, which doesn't prefer non-private IPs.
+// The result is a ChainStrategy of a LeftmostNonPrivateStrategy and a LeftmostStrategy,
+// both created with headerName and opts. See NewLeftmostStrategy for the supported
+// options. (If WithObserver is used, the observer may be called by both.)
+func NewLeftmostPublicOrPrivateStrategy(headerName string, opts ...Option) (ChainStrategy, error) {
+	nonPrivate, err := NewLeftmostNonPrivateStrategy(headerName, opts...)
+	if err != nil {
+		return ChainStrategy{}, err
+	}
+	leftmost, err := NewLeftmostStrategy(headerName, opts...)
+	if err != nil {
+		return ChainStrategy{}, err
+	}
+	return NewChainStrategy(nonPrivate, leftmost), nil
+}
+
+// RightmostStrategy derives the client IP from the rightmost valid IP address in the
+// X-Forwarded-For or Forwarded header, without regard to whether it is private. Only
+// unparseable IPs, and the zero and unspecified addresses, are skipped.
+// This strategy should be used when all of the reverse proxies between the client and the
+// server are trusted, and the client IP may legitimately be private, such as for an
+// intranet application behind an internal reverse proxy. If the header can come from
+// outside of that network, use RightmostTrustedCountStrategy or
+// RightmostTrustedRangeStrategy instead.
+type RightmostStrategy struct {
+	headerName string
+	listOptions
+}
+
+// NewRightmostStrategy creates a RightmostStrategy. headerName must be "X-Forwarded-For",
+// "X-Original-Forwarded-For", or "Forwarded".
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewRightmostStrategy(headerName string, opts ...Option) (RightmostStrategy, error) {
+	if headerName == "" {
+		return RightmostStrategy{}, fmt.Errorf("RightmostStrategy %w", ErrEmptyHeaderName)
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	o := applyOptions(opts)
+	lo := newListOptions(o)
+	if err := lo.validate("RightmostStrategy", headerName); err != nil {
+		return RightmostStrategy{}, err
+	}
+
+	return RightmostStrategy{
+		headerName:  headerName,
+		listOptions: lo,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat RightmostStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat RightmostStrategy) Validate() error {
+	return strat.listOptions.validate("RightmostStrategy", strat.headerName)
+}
+
+func (strat RightmostStrategy) String() string {
+	return fmt.Sprintf("{headerName:%v%s%s%s%s%s%s}",
+		strat.headerName, zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped), rejectReservedString(strat.rejectReserved), strictForwardedString(strat.strictForwarded), lenientSeparatorsString(strat.lenientSeparators), syntaxString(strat.syntax))
+}
+
+func (strat RightmostStrategy) derive(headers HeaderGetter, _ string) result {
+	res := withListItems(headers, strat.headerName, strat.syntax, strat.strictForwarded, strat.lenientSeparators, func(items []listItem) result {
+		rejectReservedItems(items, strat.rejectReserved)
+		// Look backwards through the list of IP addresses
+		for i := len(items) - 1; i >= 0; i-- {
+			if items[i].ipAddr != nil {
+				// This is the rightmost valid IP
+				return items[i].result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+			}
+		}
+
+		// We failed to find any valid IP
+		if len(items) == 0 {
+			return result{reason: ReasonHeaderMissing}
+		}
+		return result{reason: ReasonNoValidIP}
+	})
+	return strat.observer.observe(res, headers, strat.headerName)
+}
+
+// NewHerokuStrategy creates a RightmostTrustedCountStrategy for apps running on Heroku.
+// Heroku's router appends the IP of the client that connected to it to the
+// X-Forwarded-For header, so the rightmost IP is the client IP (the same as
+// NewRightmostTrustedCountStrategy("X-Forwarded-For", 1)).
+// This assumes that the Heroku router is the only proxy in front of the app. If there is
+// another proxy in front of Heroku, like a CDN, the rightmost IP is that proxy's, and a
+// strategy that accounts for it must be used instead (for example, with a count of 2, or
+// RightmostTrustedRangeStrategy with the CDN's ranges).
+// It takes no options; to use any, call NewRightmostTrustedCountStrategy directly.
+func NewHerokuStrategy() RightmostTrustedCountStrategy {
+	return RightmostTrustedCountStrategy{headerName: xForwardedForHdr, trustedCount: 1}
+}
+
+// NewGCPExternalLBStrategy creates a RightmostTrustedCountStrategy for servers behind a
+// Google Cloud external Application Load Balancer. The load balancer appends two IPs to
+// the X-Forwarded-For header: the IP of the client that connected to it, and the IP of
+// the load balancer itself (the Google Front End). So the client IP is the second from
+// the right (the same as NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)). Anything
+// to the left of those two came from the client, and can be spoofed.
+// This assumes that the load balancer is the only proxy in front of the server, and that
+// the server can't be reached other than through it. If there is another proxy (like a
+// CDN) in front of the load balancer, the count must be increased accordingly.
+// Alternatively, if other proxies between the load balancer and the server also append
+// to the header, use RightmostTrustedRangeStrategy with ranges.GCPLoadBalancerIPRanges
+// (and the ranges of those proxies).
+// It takes no options; to use any, call NewRightmostTrustedCountStrategy directly.
+func NewGCPExternalLBStrategy() RightmostTrustedCountStrategy {
+	return RightmostTrustedCountStrategy{headerName: xForwardedForHdr, trustedCount: 2}
+}
+
+// RightmostTrustedCountStrategy derives the client IP from the valid IP address added by
+// the first trusted reverse proxy to the X-Forwarded-For or Forwarded header. This
+// Strategy should be used when there is a fixed number of trusted reverse proxies that
+// are appending IP addresses to the header.
+type RightmostTrustedCountStrategy struct {
+	headerName   string
+	trustedCount int
+	listOptions
+}
+
+// NewRightmostTrustedCountStrategy creates a RightmostTrustedCountStrategy. headerName
+// must be "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded". trustedCount is
+// the  number of trusted reverse proxies. The IP returned will be the (trustedCount-1)th
+// from the right. For example, if there's only one trusted proxy, this strategy will
+// return the last (rightmost) IP address.
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewRightmostTrustedCountStrategy(headerName string, trustedCount int, opts ...Option) (RightmostTrustedCountStrategy, error) {
+	if headerName == "" {
+		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostTrustedCountStrategy %w", ErrEmptyHeaderName)
+	}
+
+	if trustedCount <= 0 {
+		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostTrustedCountStrategy %w", ErrNonPositiveCount)
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	o := applyOptions(opts)
+	lo := newListOptions(o)
+	if err := lo.validate("RightmostTrustedCountStrategy", headerName); err != nil {
+		return RightmostTrustedCountStrategy{}, err
+	}
+
+	return RightmostTrustedCountStrategy{
+		headerName:   headerName,
+		trustedCount: trustedCount,
+		listOptions:  lo,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat RightmostTrustedCountStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat RightmostTrustedCountStrategy) Validate() error {
+	if strat.trustedCount <= 0 {
+		return fmt.Errorf("RightmostTrustedCountStrategy %w", ErrNonPositiveCount)
+	}
+	return strat.listOptions.validate("RightmostTrustedCountStrategy", strat.headerName)
+}
+
+func (strat RightmostTrustedCountStrategy) String() string {
+	return fmt.Sprintf("{headerName:%v trustedCount:%v%s%s%s%s%s%s}",
+		strat.headerName, strat.trustedCount, zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped), rejectReservedString(strat.rejectReserved),
+		strictForwardedString(strat.strictForwarded), lenientSeparatorsString(strat.lenientSeparators), syntaxString(strat.syntax))
+}
+
+func (strat RightmostTrustedCountStrategy) derive(headers HeaderGetter, _ string) result {
+	// Only the target item needs to be parsed, so we get the raw items and parse that
+	// one. This saves a lot of work for long headers.
+	res := withRawListItems(headers, strat.headerName, strat.syntax, strat.lenientSeparators, func(items []listItem) result {
+		// We want the (N-1)th from the rightmost. For example, if there's only one
+		// trusted proxy, we want the last.
+		rightmostIndex := len(items) - 1
+		targetIndex := rightmostIndex - (strat.trustedCount - 1)
+
+		if len(items) == 0 {
+			return result{reason: ReasonHeaderMissing}
+		}
+
+		if targetIndex < 0 {
+			// This is a misconfiguration error. There were fewer IPs than we expected.
+			return result{reason: ReasonCountTooLarge}
+		}
+
+		resultItem := items[targetIndex].parsed(strat.syntax.isForwarded(strat.headerName), strat.strictForwarded).
+			withoutReserved(strat.rejectReserved)
+
+		if resultItem.ipAddr == nil {
+			// This is a misconfiguration error. Our first trusted proxy didn't add a
+			// valid IP address to the header.
+			return result{reason: ReasonNoValidIP}
+		}
+
+		return resultItem.result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+	})
+	return strat.observer.observe(res, headers, strat.headerName)
+}
+
+// LeftmostTrustedCountStrategy derives the client IP from the valid IP address at a
+// fixed position from the left of the X-Forwarded-For or Forwarded header. This Strategy
+// should be used when there is a fixed chain of trusted ingress proxies that always
+// _prepend_ to the header, so that the number of trusted hops from the left is known.
+// Note that the usual behaviour of reverse proxies is to append to the header, in which
+// case RightmostTrustedCountStrategy should be used instead. If anything other than
+// trusted proxies can place values at the left of the header, this strategy MUST NOT BE
+// USED, as the result can be trivially spoofed.
+type LeftmostTrustedCountStrategy struct {
+	headerName   string
+	trustedCount int
+	listOptions
+}
+
+// NewLeftmostTrustedCountStrategy creates a LeftmostTrustedCountStrategy. headerName
+// must be "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded". trustedCount is
+// the number of trusted hops from the left. The IP returned will be the
+// (trustedCount-1)th from the left. For example, if trustedCount is 1, this strategy will
+// return the first (leftmost) IP address.
+// The supported options are WithZone, WithMappedIPv6, WithRejectReserved,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewLeftmostTrustedCountStrategy(headerName string, trustedCount int, opts ...Option) (LeftmostTrustedCountStrategy, error) {
+	if headerName == "" {
+		return LeftmostTrustedCountStrategy{}, fmt.Errorf("LeftmostTrustedCountStrategy %w", ErrEmptyHeaderName)
+	}
+
+	if trustedCount <= 0 {
+		return LeftmostTrustedCountStrategy{}, fmt.Errorf("LeftmostTrustedCountStrategy %w", ErrNonPositiveCount)
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	o := applyOptions(opts)
+	lo := newListOptions(o)
+	if err := lo.validate("LeftmostTrustedCountStrategy", headerName); err != nil {
+		return LeftmostTrustedCountStrategy{}, err
+	}
+
+	return LeftmostTrustedCountStrategy{
+		headerName:   headerName,
+		trustedCount: trustedCount,
+		listOptions:  lo,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat LeftmostTrustedCountStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat LeftmostTrustedCountStrategy) Validate() error {
+	if strat.trustedCount <= 0 {
+		return fmt.Errorf("LeftmostTrustedCountStrategy %w", ErrNonPositiveCount)
+	}
+	return strat.listOptions.validate("LeftmostTrustedCountStrategy", strat.headerName)
+}
+
+func (strat LeftmostTrustedCountStrategy) String() string {
+	return fmt.Sprintf("{headerName:%v trustedCount:%v%s%s%s%s%s%s}",
+		strat.headerName, strat.trustedCount, zoneString(strat.stripZone), mappedIPv6String(strat.keepMapped), rejectReservedString(strat.rejectReserved),
+		strictForwardedString(strat.strictForwarded), lenientSeparatorsString(strat.lenientSeparators), syntaxString(strat.syntax))
+}
+
+func (strat LeftmostTrustedCountStrategy) derive(headers HeaderGetter, _ string) result {
+	res := withListItems(headers, strat.headerName, strat.syntax, strat.strictForwarded, strat.lenientSeparators, func(items []listItem) result {
+		rejectReservedItems(items, strat.rejectReserved)
+		// We want the (N-1)th from the leftmost. For example, if trustedCount is one, we
+		// want the first.
+		targetIndex := strat.trustedCount - 1
+
+		if len(items) == 0 {
+			return result{reason: ReasonHeaderMissing}
+		}
+
+		if targetIndex >= len(items) {
+			// This is a misconfiguration error. There were fewer IPs than we expected.
+			return result{reason: ReasonCountTooLarge}
+		}
+
+		resultItem := items[targetIndex]
+
+		if resultItem.ipAddr == nil {
+			// This is a misconfiguration error. The trusted proxy at this position didn't
+			// add a valid IP address to the header.
+			return result{reason: ReasonNoValidIP}
+		}
+
+		return resultItem.result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+	})
+	return strat.observer.observe(res, headers, strat.headerName)
+}
+
+// AddressesAndRangesToIPNets converts a slice of strings with IPv4 and IPv6 addresses and
+// CIDR ranges (prefixes) to net.IPNet instances.
+// If net.ParseCIDR or net.ParseIP fail, an error will be returned.
+// Zones in addresses or ranges are not allowed and will result in an error. This is because:
+// a) net.ParseCIDR will fail to parse a range with a zone, and
+// b) netip.ParsePrefix will succeed but silently throw away the zone; then
+// netip.Prefix.Contains will return false for any IP with a zone, causing confusion and bugs.
+// Note that IPv4-mapped IPv6 ranges and addresses are collapsed to IPv4: the range
+// "::ffff:188.0.2.128/112" is equivalent to (and stringifies as) "188.0.0.0/16", and so
+// contains the plain IPv4 address "188.0.2.1". This is how net.IPNet treats such ranges,
+// and is consistent with how the strategies treat IPv4-mapped addresses. Use
+// AddressesAndRangesToPrefixes if you need to keep them in IPv6 form.
+func AddressesAndRangesToIPNets(ranges ...string) ([]net.IPNet, error) {
+	var result []net.IPNet
+	for _, r := range ranges {
+		if strings.Contains(r, "%") {
+			return nil, fmt.Errorf("%w: %q", ErrZoneNotAllowed, r)
+		}
+
+		if strings.Contains(r, "/") {
+			// This is a CIDR/prefix
+			_, ipNet, err := net.ParseCIDR(r)
+			if err != nil {
+				return nil, fmt.Errorf("net.ParseCIDR failed for %q: %w", r, err)
+			}
+			result = append(result, *ipNet)
+		} else {
+			// This is a single IP; convert it to a range including only itself
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, fmt.Errorf("net.ParseIP failed for %q", r)
+			}
+
+			// To use the right size IP and  mask, we need to know if the address is IPv4 or v6.
+			// Attempt to convert it to IPv4 to find out.
+			if ipv4 := ip.To4(); ipv4 != nil {
+				ip = ipv4
+			}
+
+			// Mask all the bits
+			mask := len(ip) * 8
+			result = append(result, net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(mask, mask),
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// AddressesAndRangesToPrefixes is like AddressesAndRangesToIPNets, but converts to
+// netip.Prefix, and does not collapse IPv4-mapped IPv6 ranges and addresses to IPv4. For
+// example, "::ffff:188.0.2.128/112" becomes "::ffff:188.0.0.0/112" (rather than
+// "188.0.0.0/16"), which does not contain the plain IPv4 address "188.0.2.1".
+// As with AddressesAndRangesToIPNets, ranges are masked, and zones are not allowed.
+func AddressesAndRangesToPrefixes(ranges ...string) ([]netip.Prefix, error) {
+	var result []netip.Prefix
+	for _, r := range ranges {
+		if strings.Contains(r, "%") {
+			return nil, fmt.Errorf("%w: %q", ErrZoneNotAllowed, r)
+		}
+
+		if strings.Contains(r, "/") {
+			// This is a CIDR/prefix
+			prefix, err := netip.ParsePrefix(r)
+			if err != nil {
+				return nil, fmt.Errorf("netip.ParsePrefix failed for %q: %w", r, err)
+			}
+			result = append(result, prefix.Masked())
+		} else {
+			// This is a single IP; convert it to a range including only itself
+			addr, err := netip.ParseAddr(r)
+			if err != nil {
+				return nil, fmt.Errorf("netip.ParseAddr failed for %q: %w", r, err)
+			}
+			result = append(result, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return result, nil
+}
+
+// ParseIPNetsFromReader reads IP addresses and ranges from r, one per line, and converts
+// them to IPNets in the same way as AddressesAndRangesToIPNets. Leading and trailing
+// whitespace is ignored, as are blank lines and anything following a '#' (so both
+// whole-line and end-of-line comments are supported).
+// This is useful for loading trusted ranges from a file. For example:
+//
+//	# Load balancer
+//	10.1.0.0/16
+//	192.0.2.7 # bastion
+//
+// If any entry is invalid, the returned error will indicate its line number.
+func ParseIPNetsFromReader(r io.Reader) ([]net.IPNet, error) {
+	var result []net.IPNet
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		ipNets, err := AddressesAndRangesToIPNets(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		result = append(result, ipNets...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading ranges failed after line %d: %w", lineNum, err)
+	}
+
+	return result, nil
+}
+
+// ParseTorExitList reads the list of Tor exit node addresses from r, and converts them
+// to single-address IPNets (/32 or /128), such as for use with NewBlocklistStrategy.
+// Both of the Tor Project's formats are supported: the bulk exit list
+// (https://check.torproject.org/torbulkexitlist), which has one address per line, and
+// the exit-addresses list (https://check.torproject.org/exit-addresses), where the
+// addresses are on the "ExitAddress" lines and the other lines (like "ExitNode" and
+// "Published") are ignored. Leading and trailing whitespace, blank lines, and '#'
+// comments are also ignored, and addresses that appear more than once are only
+// returned once. For example, to refuse requests from Tor exits:
+//
+//	torRanges, err := realclientip.ParseTorExitList(f)
+//	...
+//	strat, err := realclientip.NewBlocklistStrategy(innerStrat, torRanges)
+//
+// The list changes frequently, so it should be reloaded periodically. If any address is
+// invalid, the returned error will indicate its line number.
+func ParseTorExitList(r io.Reader) ([]net.IPNet, error) {
+	var result []net.IPNet
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// An exit-addresses line looks like:
+		//	ExitAddress 192.0.2.1 2024-01-02 03:04:05
+		// The bulk exit list has only the address.
+		addr := fields[0]
+		switch {
+		case strings.EqualFold(addr, "ExitAddress"):
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: ExitAddress has no address", lineNum)
+			}
+			addr = fields[1]
+		case isTorExitListKeyword(addr):
+			// Another exit-addresses line, like "ExitNode <fingerprint>"
+			continue
+		case len(fields) > 1:
+			return nil, fmt.Errorf("line %d: unexpected line %q", lineNum, line)
+		}
+
+		if strings.Contains(addr, "/") {
+			return nil, fmt.Errorf("line %d: %q is a range, not an address", lineNum, addr)
+		}
+		ipNets, err := AddressesAndRangesToIPNets(addr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		for _, ipNet := range ipNets {
+			if key := ipNet.String(); !seen[key] {
+				seen[key] = true
+				result = append(result, ipNet)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading Tor exit list failed after line %d: %w", lineNum, err)
+	}
+
+	return result, nil
+}
+
+// isTorExitListKeyword returns true if s is one of the keywords (other than ExitAddress)
+// that begin the lines of the Tor exit-addresses list.
+func isTorExitListKeyword(s string) bool {
+	for _, keyword := range []string{"ExitNode", "Published", "LastStatus"} {
+		if strings.EqualFold(s, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrefixesToIPNets converts netip.Prefix values to net.IPNet, for use with the strategies
+// and functions that take []net.IPNet. The prefixes are masked. IPv4-mapped IPv6
+// prefixes (like "::ffff:188.0.0.0/112") keep their IPv6 form, so they can be converted
+// back with IPNetsToPrefixes without change. (Note that net.IPNet treats such ranges as
+// the equivalent IPv4 range, and stringifies them as such.)
+// Invalid prefixes are omitted.
+func PrefixesToIPNets(prefixes ...netip.Prefix) []net.IPNet {
+	result := make([]net.IPNet, 0, len(prefixes))
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			continue
+		}
+
+		p = p.Masked()
+		result = append(result, net.IPNet{
+			IP:   p.Addr().AsSlice(),
+			Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+		})
+	}
+	return result
+}
+
+// IPNetsToPrefixes converts net.IPNet values to netip.Prefix. It is the inverse of
+// PrefixesToIPNets. An IPNet with a 16-byte IP and mask is converted to an IPv6 prefix,
+// even if the IP is IPv4-mapped, so the IPv4-mapped range "::ffff:188.0.0.0/112" is not
+// collapsed to "188.0.0.0/16".
+// IPNets that are not valid CIDR ranges (such as those with a non-contiguous mask) are
+// omitted.
+func IPNetsToPrefixes(ipNets []net.IPNet) []netip.Prefix {
+	result := make([]netip.Prefix, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		ones, bits := ipNet.Mask.Size()
+		if bits == 0 {
+			// The mask is non-canonical
+			continue
+		}
+
+		ip := ipNet.IP
+		if bits == 8*net.IPv4len {
+			// An IPv4 mask may be used with a 16-byte IP
+			ip = ip.To4()
+		}
+
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || addr.BitLen() != bits {
+			continue
+		}
+		result = append(result, netip.PrefixFrom(addr, ones).Masked())
+	}
+	return result
+}
+
+// MergeIPNets returns the smallest set of ranges that covers exactly the same addresses
+// as ranges. Duplicate ranges and ranges contained in others are removed, and adjacent
+// ranges that together form a larger CIDR range (like "10.0.0.0/9" and "10.128.0.0/9")
+// are combined (repeatedly, so four adjacent /26s become a /24). This is useful when
+// combining the ranges of several providers (and perhaps PrivateAndLocalRanges) for
+// RightmostTrustedRangeStrategy, which checks each range in turn.
+// The result is sorted, IPv4 first. As with RangeSet, IPv4-mapped IPv6 ranges are
+// converted to IPv4, and invalid ranges are omitted.
+func MergeIPNets(ranges []net.IPNet) []net.IPNet {
+	// NewRangeSet can only fail for invalid prefixes, which IPNetsToPrefixes omits
+	set, _ := NewRangeSet(IPNetsToPrefixes(ranges)...)
+	prefixes := append(aggregatePrefixes(set.v4), aggregatePrefixes(set.v6)...)
+	return PrefixesToIPNets(prefixes...)
+}
+
+// RightmostTrustedRangeStrategy derives the client IP from the rightmost valid IP address
+// in the X-Forwarded-For or Forwarded header which is not in a set of trusted IP ranges.
+// This strategy should be used when the IP ranges of the reverse proxies between the
+// internet and the server are known.
+// If a third-party WAF, CDN, etc., is used, you SHOULD use a method of verifying its
+// access to your origin that is stronger than checking its IP address (e.g., using
+// authenticated pulls). Failure to do so can result in scenarios like:
+// You use AWS CloudFront in front of a server you host elsewhere. An attacker creates a
+// CF distribution that points at your origin server. The attacker uses Lambda@Edge to
+// spoof the Host and X-Forwarded-For headers. Now your "trusted" reverse proxy is no
+// longer trustworthy.
+type RightmostTrustedRangeStrategy struct {
+	headerName    string
+	trustedRanges []net.IPNet
+	// trustedSet is used instead of trustedRanges if it's set
+	trustedSet      *RangeSet
+	requireHTTPS    bool
+	nonRecursive    bool
+	contiguousTrust bool
+	listOptions
 }
 
-const (
-	// Pre-canonicalized constants to avoid typos later on
-	xForwardedForHdr = "X-Forwarded-For"
-	forwardedHdr     = "Forwarded"
-)
+// NewRightmostTrustedRangeStrategy creates a RightmostTrustedRangeStrategy. headerName
+// must be "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded". trustedRanges
+// must contain all trusted reverse proxies on the path to this server. trustedRanges can
+// be private/internal or external (for example, if a third-party reverse proxy is used).
+// The supported options are WithRequireHTTPS, WithRecursive, WithContiguousTrust,
+// WithPrivateRangesTrusted, WithZone, WithMappedIPv6, WithRejectReserved,
+// WithStrictForwarded, WithLenientSeparators, WithHeaderSyntax (which allows other
+// header names), and WithObserver.
+func NewRightmostTrustedRangeStrategy(headerName string, trustedRanges []net.IPNet, opts ...Option) (RightmostTrustedRangeStrategy, error) {
+	if headerName == "" {
+		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy %w", ErrEmptyHeaderName)
+	}
 
-// Must panics if err is not nil. This can be used to make sure the strategy-making
-// functions do not return an error. It can also facilitate calling NewChainStrategy().
-// It can be called like Must(NewSingleIPHeaderStrategy("X-Real-IP")).
-func Must(strat Strategy, err error) Strategy {
-	if err != nil {
-		panic(fmt.Sprintf("err is not nil: %v", err))
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	o := applyOptions(opts)
+	lo := newListOptions(o)
+	if err := lo.validate("RightmostTrustedRangeStrategy", headerName); err != nil {
+		return RightmostTrustedRangeStrategy{}, err
 	}
-	return strat
+
+	if o.requireHTTPS && !o.syntax.isForwarded(headerName) {
+		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy WithRequireHTTPS requires the %s header syntax", forwardedHdr)
+	}
+
+	if o.contiguousTrust && o.nonRecursive {
+		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy WithContiguousTrust can't be used with WithRecursive(false)")
+	}
+
+	if o.privateRangesTrusted {
+		// Copy, so that the caller's slice isn't modified
+		trustedRanges = append(append([]net.IPNet{}, trustedRanges...), PrivateAndLocalRanges()...)
+	}
+
+	return RightmostTrustedRangeStrategy{
+		headerName:      headerName,
+		trustedRanges:   trustedRanges,
+		requireHTTPS:    o.requireHTTPS,
+		nonRecursive:    o.nonRecursive,
+		contiguousTrust: o.contiguousTrust,
+		listOptions:     lo,
+	}, nil
 }
 
-// ChainStrategy attempts to use the given strategies in order. If the first one returns
-// an empty string, the second one is tried, and so on, until a good IP is found or the
-// strategies are exhausted.
-// A common use for this is if a server is both directly connected to the internet and
-// expecting a header to check. It might be called like:
-//   NewChainStrategy(Must(LeftmostNonPrivateStrategy("X-Forwarded-For")), RemoteAddrStrategy)
-type ChainStrategy struct {
-	strategies []Strategy
+// NewRightmostTrustedRangeStrategyFromSet is like NewRightmostTrustedRangeStrategy, but
+// the trusted ranges are given as a RangeSet. This is faster when there are many ranges.
+// The supported options are the same as for NewRightmostTrustedRangeStrategy.
+func NewRightmostTrustedRangeStrategyFromSet(headerName string, set *RangeSet, opts ...Option) (RightmostTrustedRangeStrategy, error) {
+	strat, err := NewRightmostTrustedRangeStrategy(headerName, nil, opts...)
+	if err != nil {
+		return RightmostTrustedRangeStrategy{}, err
+	}
+
+	if strat.trustedRanges != nil {
+		// WithPrivateRangesTrusted was used, so the private ranges have to be added to
+		// the set
+		set, err = NewRangeSet(append(set.Prefixes(), IPNetsToPrefixes(strat.trustedRanges)...)...)
+		if err != nil {
+			return RightmostTrustedRangeStrategy{}, err
+		}
+		strat.trustedRanges = nil
+	}
+
+	strat.trustedSet = set
+	return strat, nil
 }
 
-// NewChainStrategy creates a ChainStrategy that attempts to use the given strategies to
-// derive the client IP, stopping when the first one succeeds.
-func NewChainStrategy(strategies ...Strategy) ChainStrategy {
-	return ChainStrategy{strategies: strategies}
+// NewRightmostTrustedRangePublicStrategy creates a strategy for setups where the number
+// of proxies varies: starting from remoteAddr (the actual peer) and then walking the
+// X-Forwarded-For or Forwarded header from right to left, it returns the first IP that
+// is neither in trustedRanges (your known proxies) nor private or local (see
+// PrivateAndLocalRanges). If the peer itself is neither, it is the client, and the
+// header is not consulted, so a client that connects directly can't spoof its IP.
+// The result is a TrustedPeerStrategy, with trustedRanges and the private ranges,
+// wrapping a RightmostTrustedRangeStrategy created with WithPrivateRangesTrusted(true).
+// opts are passed to NewRightmostTrustedRangeStrategy; see it for the supported options.
+// As with WithPrivateRangesTrusted, note that this trusts all private and local
+// addresses, not just those of your own network.
+func NewRightmostTrustedRangePublicStrategy(headerName string, trustedRanges []net.IPNet, opts ...Option) (TrustedPeerStrategy, error) {
+	// Copy opts, so that the caller's slice isn't modified
+	opts = append(append([]Option{}, opts...), WithPrivateRangesTrusted(true))
+	inner, err := NewRightmostTrustedRangeStrategy(headerName, trustedRanges, opts...)
+	if err != nil {
+		return TrustedPeerStrategy{}, err
+	}
+	// inner's ranges include the private ranges
+	return NewTrustedPeerStrategy(inner, inner.trustedRanges)
 }
 
 // ClientIP derives the client IP using this strategy.
 // headers is expected to be like http.Request.Header.
-// remoteAddr is expected to be like http.Request.RemoteAddr.
 // The returned IP may contain a zone identifier.
-// If all chained strategies fail to derive a valid IP, an empty string is returned.
-func (strat ChainStrategy) ClientIP(headers http.Header, remoteAddr string) string {
-	for _, subStrat := range strat.strategies {
-		result := subStrat.ClientIP(headers, remoteAddr)
-		if result != "" {
-			return result
-		}
+// If no valid IP can be derived, empty string will be returned.
+func (strat RightmostTrustedRangeStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
+
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat RightmostTrustedRangeStrategy) Validate() error {
+	if err := strat.listOptions.validate("RightmostTrustedRangeStrategy", strat.headerName); err != nil {
+		return err
 	}
-	return ""
+
+	if strat.requireHTTPS && !strat.syntax.isForwarded(strat.headerName) {
+		return fmt.Errorf("RightmostTrustedRangeStrategy WithRequireHTTPS requires the %s header syntax", forwardedHdr)
+	}
+
+	if strat.contiguousTrust && strat.nonRecursive {
+		return fmt.Errorf("RightmostTrustedRangeStrategy WithContiguousTrust can't be used with WithRecursive(false)")
+	}
+	return nil
 }
 
-func (strat ChainStrategy) String() string {
-	var b strings.Builder
-	b.WriteString("{strategies:[")
-	for i, s := range strat.strategies {
-		if i > 0 {
-			b.WriteString(" ")
+func (strat RightmostTrustedRangeStrategy) derive(headers HeaderGetter, _ string) result {
+	res := withListItems(headers, strat.headerName, strat.syntax, strat.strictForwarded, strat.lenientSeparators, func(items []listItem) result {
+		rejectReservedItems(items, strat.rejectReserved)
+		if strat.nonRecursive {
+			// Only the proxy that connected to us is skipped (and it isn't in the header), so
+			// the rightmost IP is the one we want
+			if len(items) == 0 {
+				return result{reason: ReasonHeaderMissing}
+			}
+			if items[len(items)-1].ipAddr == nil {
+				return result{reason: ReasonNoValidIP}
+			}
+			return items[len(items)-1].result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
 		}
-		b.WriteString(fmt.Sprintf("%T%+v", s, s))
-	}
-	b.WriteString("]}")
-	return b.String()
+
+		// Look backwards through the list of IP addresses
+		for i := len(items) - 1; i >= 0; i-- {
+			if items[i].ipAddr != nil && strat.isTrusted(items[i].ipAddr.IP) &&
+				(!strat.requireHTTPS || isHTTPSForwardedListItem(items[i].raw)) {
+				// This IP is trusted
+				continue
+			}
+
+			// At this point we have found the first-from-the-rightmost untrusted IP.
+			// Note that if requireHTTPS is set, this may be a hop within our trusted ranges
+			// that was forwarded over plain HTTP, which we treat as untrusted.
+
+			if items[i].ipAddr == nil {
+				return result{reason: ReasonNoValidIP}
+			}
+
+			if strat.contiguousTrust {
+				// There must be no trusted IPs to the left of the client
+				for _, item := range items[:i] {
+					if item.ipAddr != nil && strat.isTrusted(item.ipAddr.IP) {
+						return result{reason: ReasonTrustGap}
+					}
+				}
+			}
+
+			return items[i].result().withoutZone(strat.stripZone).withMappedIPv6(strat.keepMapped)
+		}
+
+		// Either there are no addresses or they are all in our trusted ranges
+		if len(items) == 0 {
+			return result{reason: ReasonHeaderMissing}
+		}
+		return result{reason: ReasonAllTrusted}
+	})
+	return strat.observer.observe(res, headers, strat.headerName)
 }
 
-// RemoteAddrStrategy returns the client socket IP, stripped of port.
-// This strategy should be used if the server accept direct connections, rather than
-// through a reverse proxy.
-type RemoteAddrStrategy struct{}
+// isTrusted returns true if ip is in the trusted ranges. The candidate's zone is held
+// separately (in net.IPAddr.Zone), so a zoned candidate like "fe80::1%eth0" is checked
+// as "fe80::1", and can match a link-local trusted range like "fe80::/10".
+func (strat RightmostTrustedRangeStrategy) isTrusted(ip net.IP) bool {
+	if strat.trustedSet != nil {
+		return strat.trustedSet.containsIP(ip)
+	}
+	return IPInRanges(ip, strat.trustedRanges)
+}
 
-// ClientIP derives the client IP using this strategy.
-// remoteAddr is expected to be like http.Request.RemoteAddr.
-// The returned IP may contain a zone identifier.
-// If no valid IP can be derived, empty string will be returned. This should only happen
-// if remoteAddr has been modified to something illegal, or if the server is accepting
-// connections on a Unix domain socket (in which case RemoteAddr is "@").
-func (strat RemoteAddrStrategy) ClientIP(_ http.Header, remoteAddr string) string {
-	ipAddr := goodIPAddr(remoteAddr)
-	if ipAddr == nil {
-		return ""
+// ranges returns the trusted ranges, from whichever of trustedRanges and trustedSet is
+// in use.
+func (strat RightmostTrustedRangeStrategy) ranges() []net.IPNet {
+	if strat.trustedSet != nil {
+		return strat.trustedSet.ipNets()
 	}
+	return strat.trustedRanges
+}
 
-	return ipAddr.String()
+func (strat RightmostTrustedRangeStrategy) String() string {
+	str := fmt.Sprintf("{headerName:%v trustedRanges:%v", strat.headerName, ipNetsString(strat.ranges()))
+	if strat.requireHTTPS {
+		str += " requireHTTPS:true"
+	}
+	if strat.nonRecursive {
+		str += " recursive:false"
+	}
+	if strat.contiguousTrust {
+		str += " contiguousTrust:true"
+	}
+	return str + zoneString(strat.stripZone) + mappedIPv6String(strat.keepMapped) + rejectReservedString(strat.rejectReserved) + strictForwardedString(strat.strictForwarded) + lenientSeparatorsString(strat.lenientSeparators) + syntaxString(strat.syntax) + "}"
 }
 
-// SingleIPHeaderStrategy derives an IP address from a single-IP header.
-// A non-exhaustive list of such single-IP headers is:
-// X-Real-IP, CF-Connecting-IP, True-Client-IP, Fastly-Client-IP, X-Azure-ClientIP, X-Azure-SocketIP.
-// This strategy should be used when the given header is added by a trusted reverse proxy.
-// You must ensure that this header is not spoofable (as is possible with Akamai's use of
-// True-Client-IP, Fastly's default use of Fastly-Client-IP, and Azure's X-Azure-ClientIP).
-// See the single-IP wiki page for more info: https://github.com/realclientip/realclientip-go/wiki/Single-IP-Headers
-type SingleIPHeaderStrategy struct {
-	headerName string
+// ReloadableTrustedRangeStrategy is like RightmostTrustedRangeStrategy, except that the
+// trusted ranges can be replaced at any time with Reload. This is useful when the trusted
+// ranges change over time, such as when they are periodically retrieved from a CDN
+// provider's API, as it avoids rebuilding the strategy (and anything that holds it).
+// ClientIP remains threadsafe during reloads: each call uses either the old or the new
+// ranges in their entirety, never a mix.
+// It must be used via a pointer and must not be copied after creation.
+type ReloadableTrustedRangeStrategy struct {
+	// base holds the configuration other than the trusted ranges
+	base          RightmostTrustedRangeStrategy
+	trustedRanges atomic.Pointer[[]net.IPNet]
+	// privateRangesTrusted is set by WithPrivateRangesTrusted, and makes Reload add the
+	// private and local ranges to the given ranges
+	privateRangesTrusted bool
 }
 
-// NewSingleIPHeaderStrategy creates a SingleIPHeaderStrategy that uses the headerName
-// request header to get the client IP.
-func NewSingleIPHeaderStrategy(headerName string) (SingleIPHeaderStrategy, error) {
-	if headerName == "" {
-		return SingleIPHeaderStrategy{}, fmt.Errorf("SingleIPHeaderStrategy header must not be empty")
+// NewReloadableTrustedRangeStrategy creates a ReloadableTrustedRangeStrategy with the
+// given initial trustedRanges. The arguments are the same as for
+// NewRightmostTrustedRangeStrategy.
+func NewReloadableTrustedRangeStrategy(headerName string, trustedRanges []net.IPNet, opts ...Option) (*ReloadableTrustedRangeStrategy, error) {
+	base, err := NewRightmostTrustedRangeStrategy(headerName, nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("ReloadableTrustedRangeStrategy: %w", err)
 	}
 
-	// We will be using the headerName for lookups in the http.Header map, which is keyed
-	// by canonicalized header name. We'll canonicalize here so we only have to do it once.
-	headerName = http.CanonicalHeaderKey(headerName)
+	// base only has trusted ranges if WithPrivateRangesTrusted was used. Those have to be
+	// added on every reload, not just now, or the first reload would drop them.
+	strat := &ReloadableTrustedRangeStrategy{base: base, privateRangesTrusted: base.trustedRanges != nil}
+	strat.base.trustedRanges = nil
+	strat.Reload(trustedRanges)
+	return strat, nil
+}
 
-	if headerName == xForwardedForHdr || headerName == forwardedHdr {
-		return SingleIPHeaderStrategy{}, fmt.Errorf("SingleIPHeaderStrategy header must not be %s or %s", xForwardedForHdr, forwardedHdr)
+// Reload atomically replaces the trusted ranges. It is safe to call concurrently with
+// ClientIP and with other calls to Reload. The caller must not modify the elements of
+// trustedRanges after calling this. If the strategy was created with
+// WithPrivateRangesTrusted, the private and local ranges are added to trustedRanges.
+func (strat *ReloadableTrustedRangeStrategy) Reload(trustedRanges []net.IPNet) {
+	// Copy the slice so that the caller appending to it can't affect us
+	ranges := append([]net.IPNet(nil), trustedRanges...)
+	if strat.privateRangesTrusted {
+		ranges = append(ranges, PrivateAndLocalRanges()...)
 	}
+	strat.trustedRanges.Store(&ranges)
+}
 
-	return SingleIPHeaderStrategy{headerName: headerName}, nil
+// TrustedRanges returns the trusted ranges currently in use. The result must not be
+// modified.
+func (strat *ReloadableTrustedRangeStrategy) TrustedRanges() []net.IPNet {
+	return *strat.trustedRanges.Load()
 }
 
 // ClientIP derives the client IP using this strategy.
 // headers is expected to be like http.Request.Header.
 // The returned IP may contain a zone identifier.
 // If no valid IP can be derived, empty string will be returned.
-func (strat SingleIPHeaderStrategy) ClientIP(headers http.Header, _ string) string {
-	// RFC 2616 does not allow multiple instances of single-IP headers (or any non-list header).
-	// It is debatable whether it is better to treat multiple such headers as an error
-	// (more correct) or simply pick one of them (more flexible). As we've already
-	// told the user tom make sure the header is not spoofable, we're going to use the
-	// last header instance if there are multiple. (Using the last is arbitrary, but
-	// in theory it should be the newest value.)
-	ipStr := lastHeader(headers, strat.headerName)
-	if ipStr == "" {
-		// There is no header
-		return ""
-	}
+func (strat *ReloadableTrustedRangeStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.derive(headers, remoteAddr).String()
+}
 
-	ipAddr := goodIPAddr(ipStr)
-	if ipAddr == nil {
-		// The header value is invalid
-		return ""
+// Validate returns an error if the strategy is misconfigured, such as if it was not
+// created with its constructor.
+func (strat *ReloadableTrustedRangeStrategy) Validate() error {
+	current := strat.base
+	current.trustedRanges = strat.TrustedRanges()
+	if err := current.Validate(); err != nil {
+		return fmt.Errorf("ReloadableTrustedRangeStrategy: %w", err)
 	}
+	return nil
+}
 
-	return ipAddr.String()
+func (strat *ReloadableTrustedRangeStrategy) derive(headers HeaderGetter, remoteAddr string) result {
+	// Load the ranges exactly once, so that a concurrent reload can't affect this call.
+	// We're working on a copy of base, so this doesn't modify shared state.
+	current := strat.base
+	current.trustedRanges = strat.TrustedRanges()
+	return current.derive(headers, remoteAddr)
 }
 
-// LeftmostNonPrivateStrategy derives the client IP from the leftmost valid and
-// non-private IP address in the X-Fowarded-For for Forwarded header. This
-// strategy should be used when a valid, non-private IP closest to the client is desired.
-// Note that this MUST NOT BE USED FOR SECURITY PURPOSES. This IP can be TRIVIALLY
-// SPOOFED.
-type LeftmostNonPrivateStrategy struct {
-	headerName string
+func (strat *ReloadableTrustedRangeStrategy) String() string {
+	current := strat.base
+	current.trustedRanges = strat.TrustedRanges()
+	return current.String()
 }
 
-// NewLeftmostNonPrivateStrategy creates a LeftmostNonPrivateStrategy. headerName must be
-// "X-Forwarded-For" or "Forwarded".
-func NewLeftmostNonPrivateStrategy(headerName string) (LeftmostNonPrivateStrategy, error) {
-	if headerName == "" {
-		return LeftmostNonPrivateStrategy{}, fmt.Errorf("LeftmostNonPrivateStrategy header must not be empty")
-	}
+// ChainSummary produces a compact, single-line summary of the forwarding chain in the
+// X-Forwarded-For or Forwarded header (specified by headerName), suitable for use as a
+// log field. The client is determined the same way as RightmostTrustedRangeStrategy,
+// using trustedRanges. It is shorthand for ChainSummaryNamed with a single set of ranges
+// named "trusted", so the format is the same. For example:
+//
+//	client=203.0.113.5 via [10.0.0.1(trusted),198.51.100.7(trusted)]
+func ChainSummary(headers http.Header, headerName string, trustedRanges []net.IPNet) string {
+	return ChainSummaryNamed(headers, headerName, []NamedRanges{{Name: "trusted", Ranges: trustedRanges}})
+}
 
-	// We will be using the headerName for lookups in the http.Header map, which is keyed
-	// by canonicalized header name. We'll do that here so we only have to do it once.
+// NamedRanges is a set of trusted ranges with a name, such as the provider or network
+// that they belong to (like "cf" for Cloudflare's ranges, or "lb" for the internal load
+// balancers). It is used by ChainSummaryNamed to label the hops.
+type NamedRanges struct {
+	Name   string
+	Ranges []net.IPNet
+}
+
+// ChainSummaryNamed is like ChainSummary, but the trusted ranges are given as named
+// sets, and each hop is labelled with the name of the set that it is in. The trusted
+// ranges are all of the sets' ranges together. The format is stable:
+//
+//	client=<client> via [<hop>(<name>),<hop>(<name>),...]
+//
+// <client> is the client IP, or "invalid" if the client's list item is not a valid IP,
+// or "-" if there is no client (all of the IPs are trusted, the header is absent, or
+// the header has more than MaxListItems entries or MaxHeaderBytes bytes).
+// headerName must be "X-Forwarded-For", "X-Original-Forwarded-For", or "Forwarded";
+// any other header is not read, and the summary is "client=- via []".
+// The "via" list contains the hops to the right of the client, from left to right; each
+// is an IP followed by the name of its set in parentheses. If a hop is in more than one
+// set, the first one's name is used. For example:
+//
+//	client=203.0.113.5 via [10.0.0.1(lb),198.51.100.7(cf)]
+func ChainSummaryNamed(headers http.Header, headerName string, trusted []NamedRanges) string {
 	headerName = http.CanonicalHeaderKey(headerName)
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return LeftmostNonPrivateStrategy{}, fmt.Errorf("LeftmostNonPrivateStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+	// A single-IP header would otherwise be parsed as if it were X-Forwarded-For
+	var items []listItem
+	if validateListHeaderName("ChainSummaryNamed", headerName, HeaderSyntaxAuto) == nil {
+		// If there are too many items or bytes, this is nil and we'll report no client
+		items, _ = getListItems(headers, headerName, headerName == forwardedHdr, false, false)
+	}
+
+	// trustedName returns the name of the first set that contains ip, and whether there
+	// is one
+	trustedName := func(ip net.IP) (string, bool) {
+		for _, nr := range trusted {
+			if IPInRanges(ip, nr.Ranges) {
+				return nr.Name, true
+			}
+		}
+		return "", false
+	}
+
+	// Look backwards through the list for the client, exactly like
+	// RightmostTrustedRangeStrategy does, and keep the hops' names.
+	clientIndex := -1
+	names := make([]string, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		if items[i].ipAddr != nil {
+			if name, ok := trustedName(items[i].ipAddr.IP); ok {
+				names[i] = name
+				continue
+			}
+		}
+		clientIndex = i
+		break
+	}
+
+	var b strings.Builder
+	b.WriteString("client=")
+	switch {
+	case clientIndex < 0:
+		b.WriteString("-")
+	case items[clientIndex].ipAddr == nil:
+		b.WriteString("invalid")
+	default:
+		b.WriteString(items[clientIndex].ipAddr.String())
+	}
+
+	b.WriteString(" via [")
+	for i := clientIndex + 1; i < len(items); i++ {
+		if i > clientIndex+1 {
+			b.WriteString(",")
+		}
+		// Everything to the right of the client is trusted (and therefore valid)
+		b.WriteString(items[i].ipAddr.String())
+		b.WriteString("(")
+		b.WriteString(names[i])
+		b.WriteString(")")
 	}
+	b.WriteString("]")
 
-	return LeftmostNonPrivateStrategy{headerName: headerName}, nil
+	return b.String()
 }
 
-// ClientIP derives the client IP using this strategy.
-// headers is expected to be like http.Request.Header.
-// The returned IP may contain a zone identifier.
-// If no valid IP can be derived, empty string will be returned.
-func (strat LeftmostNonPrivateStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
-	for _, ip := range ipAddrs {
-		if ip != nil && !isPrivateOrLocal(ip.IP) {
-			// This is the leftmost valid, non-private IP
-			return ip.String()
+// privateRangesString formats the privateRanges of a non-private strategy for String.
+// nil is "default", so that it isn't confused with an empty list (nothing is private).
+func privateRangesString(privateRanges []net.IPNet) string {
+	if privateRanges == nil {
+		return "default"
+	}
+	return ipNetsString(privateRanges)
+}
+
+// ipNetsString formats ipNets as a space-separated list in square brackets, like
+// "[10.0.0.0/8 192.0.2.1/32]". (Formatting a []net.IPNet directly with %v prints the
+// underlying byte slices, as net.IPNet's String method has a pointer receiver.)
+func ipNetsString(ipNets []net.IPNet) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i := range ipNets {
+		if i > 0 {
+			b.WriteString(" ")
 		}
+		b.WriteString(ipNets[i].String())
 	}
+	b.WriteString("]")
+	return b.String()
+}
 
-	// We failed to find any valid, non-private IP
-	return ""
+// isListHeader returns true if headerName is one of the list headers the list strategies
+// (like LeftmostNonPrivateStrategy) can use. X-Original-Forwarded-For is set by some load
+// balancers (like AWS ELB and the Kubernetes ingress-nginx controller) to the
+// X-Forwarded-For they received, and has the same syntax.
+func isListHeader(headerName string) bool {
+	return headerName == xForwardedForHdr || headerName == xOriginalForwardedForHdr || headerName == forwardedHdr
 }
 
-// RightmostNonPrivateStrategy derives the client IP from the rightmost valid,
-// non-private/non-internal IP address in the X-Fowarded-For for Forwarded header. This
-// strategy should be used when all reverse proxies between the internet and the
-// server have private-space IP addresses.
-type RightmostNonPrivateStrategy struct {
-	headerName string
+// validateListHeaderName checks that headerName is usable by the list strategies (like
+// LeftmostNonPrivateStrategy) with the given syntax. stratName is used in the error
+// message.
+func validateListHeaderName(stratName, headerName string, syntax HeaderSyntax) error {
+	if headerName == "" {
+		return fmt.Errorf("%s %w", stratName, ErrEmptyHeaderName)
+	}
+
+	switch syntax {
+	case HeaderSyntaxAuto:
+		if !isListHeader(headerName) {
+			return fmt.Errorf("%s %w", stratName, ErrHeaderNotList)
+		}
+	case HeaderSyntaxXFF:
+		if headerName == forwardedHdr {
+			return fmt.Errorf("%s header %s must not use syntax %v", stratName, headerName, syntax)
+		}
+	case HeaderSyntaxForwarded:
+		if isListHeader(headerName) && headerName != forwardedHdr {
+			return fmt.Errorf("%s header %s must not use syntax %v", stratName, headerName, syntax)
+		}
+	default:
+		return fmt.Errorf("%s has unknown header syntax %v", stratName, syntax)
+	}
+
+	return nil
 }
 
-// NewRightmostNonPrivateStrategy creates a RightmostNonPrivateStrategy. headerName must
-// be "X-Forwarded-For" or "Forwarded".
-func NewRightmostNonPrivateStrategy(headerName string) (RightmostNonPrivateStrategy, error) {
+// validateSingleIPHeaderName checks that headerName is usable by the single-IP strategies
+// (like SingleIPHeaderStrategy). stratName is used in the error message.
+func validateSingleIPHeaderName(stratName, headerName string) error {
 	if headerName == "" {
-		return RightmostNonPrivateStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must not be empty")
+		return fmt.Errorf("%s %w", stratName, ErrEmptyHeaderName)
 	}
 
-	// We will be using the headerName for lookups in the http.Header map, which is keyed
-	// by canonicalized header name. We'll do that here so we only have to do it once.
-	headerName = http.CanonicalHeaderKey(headerName)
+	if isListHeader(headerName) {
+		return fmt.Errorf("%s header must not be %s, %s, or %s", stratName, xForwardedForHdr, xOriginalForwardedForHdr, forwardedHdr)
+	}
+
+	return nil
+}
+
+// HopCount returns the number of items in the X-Forwarded-For or Forwarded header
+// (specified by headerName), across all instances of the header. This is the number of
+// hops that the header claims the request has passed through, which is useful for
+// logging and metrics; for example, a sudden increase might indicate spoofing.
+// Items are counted the same way that the strategies tokenize the header (empty items
+// are not counted, but invalid ones, like "unknown", are), but no IPs are parsed and no
+// list is allocated, so this is cheap. MaxListItems does not apply.
+func HopCount(headers http.Header, headerName string) int {
+	return hopCount(headers, http.CanonicalHeaderKey(headerName))
+}
+
+// hopCount is like HopCount, but headerName must already be canonicalized.
+func hopCount(headers HeaderGetter, headerName string) int {
+	count := 0
+	for _, h := range headers.Values(headerName) {
+		n, balanced := countListItems(h, headerName == forwardedHdr)
+		if !balanced {
+			// Match splitQuoted's handling of unbalanced quotes
+			n, _ = countListItems(h, false)
+		}
+		count += n
+	}
+	return count
+}
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return RightmostNonPrivateStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+// countListItems counts the non-empty comma-separated items in s. If quoted is true,
+// commas within double-quoted strings are not treated as separators, and balanced is
+// false if s ends within a quoted string (in which case the count is not meaningful).
+func countListItems(s string, quoted bool) (count int, balanced bool) {
+	inQuotes := false
+	itemEmpty := true
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && inQuotes && s[i] == '\\':
+			// Skip the escaped character (which could be a quote)
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+			itemEmpty = false
+		case !inQuotes && s[i] == ',':
+			if !itemEmpty {
+				count++
+			}
+			itemEmpty = true
+		case s[i] != ' ' && s[i] != '\t':
+			itemEmpty = false
+		}
 	}
 
-	return RightmostNonPrivateStrategy{headerName: headerName}, nil
+	if !itemEmpty {
+		count++
+	}
+	return count, !inQuotes
 }
 
-// ClientIP derives the client IP using this strategy.
-// headers is expected to be like http.Request.Header.
-// The returned IP may contain a zone identifier.
-// If no valid IP can be derived, empty string will be returned.
-func (strat RightmostNonPrivateStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
-	// Look backwards through the list of IP addresses
-	for i := len(ipAddrs) - 1; i >= 0; i-- {
-		if ipAddrs[i] != nil && !isPrivateOrLocal(ipAddrs[i].IP) {
-			// This is the rightmost non-private IP
-			return ipAddrs[i].String()
+// lastHeader returns the last header with the given name. It returns empty string if the
+// header is not found or if the header has an empty value. No validation is done on the
+// IP string. headerName must already be canonicalized.
+// This should be used with single-IP headers, like X-Real-IP. Per RFC 2616, they should
+// not have multiple headers, but if they do we can hope we're getting the newest/best by
+// taking the last instance.
+// This MUST NOT be used with list headers, like X-Forwarded-For and Forwarded.
+func lastHeader(headers HeaderGetter, headerName string) string {
+	// The strategies canonicalize headerName, as Go's Header map uses canonicalized keys
+	matches := headers.Values(headerName)
+	if len(matches) == 0 {
+		// For our uses of this function, returning an empty string in this case is fine
+		return ""
+	}
+
+	return matches[len(matches)-1]
+}
+
+// listItem is a single item from an X-Forwarded-For or Forwarded header list.
+type listItem struct {
+	// raw is the whitespace-trimmed list item, as it appeared in the header
+	raw string
+	// ipAddr is the IP parsed from raw; it is nil if raw is not valid
+	ipAddr *net.IPAddr
+	// index is the item's 0-based index in the list
+	index int
+	// mapped is true if ipAddr is an IPv4 address that was written in IPv4-mapped IPv6
+	// notation
+	mapped bool
+}
+
+// parsed returns the item with its IP parsed from raw (see parseListItem).
+func (item listItem) parsed(forwarded, strictForwarded bool) listItem {
+	parsedItem := parseListItem(item.raw, forwarded, strictForwarded)
+	parsedItem.index = item.index
+	return parsedItem
+}
+
+// result creates a successful derivation result from the list item. The total is set
+// by withListItems.
+func (item listItem) result() result {
+	return result{ipAddr: item.ipAddr, raw: item.raw, reason: ReasonFound, position: item.index + 1, mapped: item.mapped}
+}
+
+// withoutReserved returns the item with a nil ipAddr if reject is true and its IP is
+// reserved (see WithRejectReserved), so that it is treated as invalid.
+func (item listItem) withoutReserved(reject bool) listItem {
+	if reject && item.ipAddr != nil && isReserved(item.ipAddr.IP) {
+		item.ipAddr = nil
+	}
+	return item
+}
+
+// rejectReservedItems applies withoutReserved to each of items, in place.
+func rejectReservedItems(items []listItem, reject bool) {
+	if !reject {
+		return
+	}
+	for i := range items {
+		items[i] = items[i].withoutReserved(true)
+	}
+}
+
+// nonPrivateFailureReason determines why a non-private strategy failed to find a
+// valid, non-private IP of the given family in items.
+func nonPrivateFailureReason(items []listItem, family Family) Reason {
+	if len(items) == 0 {
+		return ReasonHeaderMissing
+	}
+
+	for _, item := range items {
+		if item.ipAddr != nil && family.matches(item.ipAddr.IP) {
+			// There was at least one valid IP, so they must all have been private
+			return ReasonAllPrivate
 		}
 	}
 
-	// We failed to find any valid, non-private IP
-	return ""
+	return ReasonNoValidIP
 }
 
-// RightmostTrustedCountStrategy derives the client IP from the valid IP address added by
-// the first trusted reverse proxy to the X-Forwarded-For or Forwarded header. This
-// Strategy should be used when there is a fixed number of trusted reverse proxies that
-// are appending IP addresses to the header.
-type RightmostTrustedCountStrategy struct {
-	headerName   string
-	trustedCount int
+// ParseXFFString parses a single X-Forwarded-For header value (such as from an access
+// log) into its list of IPs, in order, exactly as the strategies do. Invalid items
+// (including "unknown") result in nil elements; empty items are skipped. If there are no
+// items, or more than MaxListItems, or the value is longer than MaxHeaderBytes, nil is
+// returned.
+func ParseXFFString(value string) []*net.IPAddr {
+	return getIPAddrList(http.Header{xForwardedForHdr: []string{value}}, xForwardedForHdr)
 }
 
-// NewRightmostTrustedCountStrategy creates a RightmostTrustedCountStrategy. headerName
-// must be "X-Forwarded-For" or "Forwarded". trustedCount is the  number of trusted
-// reverse proxies. The IP returned will be the (trustedCount-1)th from the right. For
-// example, if there's only one trusted proxy, this strategy will return the last
-// (rightmost) IP address.
-func NewRightmostTrustedCountStrategy(headerName string, trustedCount int) (RightmostTrustedCountStrategy, error) {
-	if headerName == "" {
-		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostTrustedCountStrategy header must not be empty")
+// ParseForwardedString is like ParseXFFString, but for a Forwarded header value. The
+// returned IPs are those of the "for" directives; items without a valid "for" IP result
+// in nil elements. To get all of the directives, use ParseForwarded.
+func ParseForwardedString(value string) []*net.IPAddr {
+	return getIPAddrList(http.Header{forwardedHdr: []string{value}}, forwardedHdr)
+}
+
+// ParseListHeader is like ParseXFFString, but parses all of the headerName headers in
+// headers, in order, as the strategies do. headerName should be X-Forwarded-For,
+// X-Original-Forwarded-For, or Forwarded; other headers are parsed as X-Forwarded-For.
+// This allows callers to apply their own logic, like UniqueIPs, to the whole list.
+func ParseListHeader(headers http.Header, headerName string) []*net.IPAddr {
+	return getIPAddrList(headers, http.CanonicalHeaderKey(headerName))
+}
+
+// LeftmostRightmost returns the leftmost and rightmost valid IPs in the headerName
+// headers, parsing them only once. This is useful for showing both the claimed origin of
+// a request and the last address added by a proxy, without parsing the list with two
+// strategies. The IPs are as LeftmostStrategy and RightmostStrategy would return (but
+// without the options): normalized, with any zone. If there are no valid IPs, both are
+// empty strings; if there is only one, both are that IP. headerName is as for
+// ParseListHeader.
+// Note that, as with LeftmostStrategy, the leftmost IP is trivially spoofable, so it
+// must not be used for anything security-related.
+func LeftmostRightmost(headers http.Header, headerName string) (leftmost, rightmost string) {
+	addrs := ParseListHeader(headers, headerName)
+
+	for _, addr := range addrs {
+		if addr != nil {
+			leftmost = addr.String()
+			break
+		}
 	}
-
-	if trustedCount <= 0 {
-		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostTrustedCountStrategy count must be greater than zero")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if addrs[i] != nil {
+			rightmost = addrs[i].String()
+			break
+		}
 	}
+	return leftmost, rightmost
+}
 
-	// We will be using the headerName for lookups in the http.Header map, which is keyed
-	// by canonicalized header name. We'll do that here so we only have to do it once.
-	headerName = http.CanonicalHeaderKey(headerName)
+// UniqueIPs returns addrs with the duplicate IPs removed, keeping the first instance of
+// each, in order. IPs are compared by their normalized form and zone, so "192.0.2.1" and
+// "::ffff:192.0.2.1" are duplicates, but "fe80::1%eth0" and "fe80::1%eth1" are not. nil
+// elements (the invalid items from ParseXFFString and the like) are dropped. This is
+// useful when the same proxy chain is described by more than one header, or a proxy
+// duplicates an entry, such as for access control over the set of IPs.
+// The returned slice is new, but its elements are those of addrs.
+func UniqueIPs(addrs []*net.IPAddr) []*net.IPAddr {
+	result := make([]*net.IPAddr, 0, len(addrs))
+	seen := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+		// IPAddr.String normalizes the IP (including IPv4-mapped IPv6) and includes the zone
+		key := addr.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, addr)
 	}
-
-	return RightmostTrustedCountStrategy{headerName: headerName, trustedCount: trustedCount}, nil
+	return result
 }
 
-// ClientIP derives the client IP using this strategy.
-// headers is expected to be like http.Request.Header.
-// The returned IP may contain a zone identifier.
-// If no valid IP can be derived, empty string will be returned.
-func (strat RightmostTrustedCountStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
-
-	// We want the (N-1)th from the rightmost. For example, if there's only one
-	// trusted proxy, we want the last.
-	rightmostIndex := len(ipAddrs) - 1
-	targetIndex := rightmostIndex - (strat.trustedCount - 1)
+// getIPAddrList creates a single list of all of the X-Forwarded-For or Forwarded header
+// values, in order. Any invalid IPs will result in nil elements; empty items are
+// skipped. If there are more than MaxListItems entries, or the headers are longer than
+// MaxHeaderBytes, nil is returned. headerName must already be canonicalized.
+func getIPAddrList(headers HeaderGetter, headerName string) []*net.IPAddr {
+	items, _ := getListItems(headers, headerName, headerName == forwardedHdr, false, false)
+	if items == nil {
+		return nil
+	}
 
-	if targetIndex < 0 {
-		// This is a misconfiguration error. There were fewer IPs than we expected.
-		return ""
+	result := make([]*net.IPAddr, len(items))
+	for i, item := range items {
+		result[i] = item.ipAddr
 	}
+	return result
+}
 
-	resultIP := ipAddrs[targetIndex]
+// parseListItem parses a single, trimmed, non-empty list item of a list header. If
+// forwarded is true, it is a Forwarded list item, otherwise an X-Forwarded-For one; see
+// getListItems.
+func parseListItem(rawListItem string, forwarded, strictForwarded bool) listItem {
+	var ipAddr *net.IPAddr
+	// If this is the XFF header, rawListItem is just an IP;
+	// if it's the Forwarded header, then there's more parsing to do.
+	// Apache's mod_proxy (among others) uses the token "unknown" in XFF when it
+	// can't determine the address of a hop. (RFC 7239 defines "for=unknown" for
+	// the Forwarded header, which parseForwardedListItem treats as invalid.)
+	// Unlike an empty item, this does represent a hop, so it keeps its position
+	// in the list, as an invalid item. This keeps the trusted-count strategies
+	// counting hops correctly.
+	if strings.EqualFold(rawListItem, "unknown") {
+		ipAddr = nil
+	} else if forwarded && strictForwarded {
+		ipAddr = parseStrictForwardedListItem(rawListItem)
+	} else if forwarded {
+		ipAddr = parseForwardedListItem(rawListItem)
+	} else { // == XFF
+		ipAddr = goodIPAddr(rawListItem)
+	}
 
-	if resultIP == nil {
-		// This is a misconfiguration error. Our first trusted proxy didn't add a
-		// valid IP address to the header.
-		return ""
+	// An IPv4-mapped IPv6 address is written with at least two colons (like
+	// "::ffff:192.0.2.1"), so the notation only needs to be checked when an IPv4 address
+	// came from an item with at least two colons. This keeps the common case cheap.
+	mapped := false
+	if ipAddr != nil && ipAddr.IP.To4() != nil && strings.Count(rawListItem, ":") >= 2 {
+		ipText := rawListItem
+		if forwarded {
+			ipText = forwardedDirective(rawListItem, "for")
+		}
+		mapped = isMappedIPv6Notation(ipText)
 	}
 
-	return resultIP.String()
+	// ipAddr is nil if not valid
+	return listItem{raw: rawListItem, ipAddr: ipAddr, mapped: mapped}
 }
 
-// AddressesAndRangesToIPNets converts a slice of strings with IPv4 and IPv6 addresses and
-// CIDR ranges (prefixes) to net.IPNet instances.
-// If net.ParseCIDR or net.ParseIP fail, an error will be returned.
-// Zones in addresses or ranges are not allowed and will result in an error. This is because:
-// a) net.ParseCIDR will fail to parse a range with a zone, and
-// b) netip.ParsePrefix will succeed but silently throw away the zone; then
-// netip.Prefix.Contains will return false for any IP with a zone, causing confusion and bugs.
-func AddressesAndRangesToIPNets(ranges ...string) ([]net.IPNet, error) {
-	var result []net.IPNet
-	for _, r := range ranges {
-		if strings.Contains(r, "%") {
-			return nil, fmt.Errorf("zones are not allowed: %q", r)
-		}
+// isMappedIPv6Notation returns true if ipStr (in any form accepted by ParseIPAddr) is an
+// IPv4-mapped IPv6 address in IPv6 notation, like "::ffff:192.0.2.1" or
+// "[::ffff:c000:201]:4711". net.ParseIP doesn't distinguish these from IPv4 addresses.
+func isMappedIPv6Notation(ipStr string) bool {
+	if host, _, err := net.SplitHostPort(ipStr); err == nil {
+		ipStr = host
+	}
+	ipStr, _ = SplitHostZone(trimMatchedEnds(ipStr, "[]"))
 
-		if strings.Contains(r, "/") {
-			// This is a CIDR/prefix
-			_, ipNet, err := net.ParseCIDR(r)
-			if err != nil {
-				return nil, fmt.Errorf("net.ParseCIDR failed for %q: %w", r, err)
-			}
-			result = append(result, *ipNet)
-		} else {
-			// This is a single IP; convert it to a range including only itself
-			ip := net.ParseIP(r)
-			if ip == nil {
-				return nil, fmt.Errorf("net.ParseIP failed for %q", r)
-			}
+	addr, err := netip.ParseAddr(ipStr)
+	return err == nil && addr.Is4In6()
+}
 
-			// To use the right size IP and  mask, we need to know if the address is IPv4 or v6.
-			// Attempt to convert it to IPv4 to find out.
-			if ipv4 := ip.To4(); ipv4 != nil {
-				ip = ipv4
-			}
+// listHeaderTooLarge returns true if the total length of the headerName headers is more
+// than MaxHeaderBytes.
+func listHeaderTooLarge(headers HeaderGetter, headerName string) bool {
+	if MaxHeaderBytes <= 0 {
+		return false
+	}
 
-			// Mask all the bits
-			mask := len(ip) * 8
-			result = append(result, net.IPNet{
-				IP:   ip,
-				Mask: net.CIDRMask(mask, mask),
-			})
+	n := 0
+	for _, h := range headers.Values(headerName) {
+		n += len(h)
+		if n > MaxHeaderBytes {
+			return true
 		}
 	}
+	return false
+}
 
-	return result, nil
+// maxPooledListItems is the largest capacity of list item slice that withListItems will
+// return to the pool. Larger slices (which can only result from a very long header) are
+// left for the garbage collector, so that they don't stay in memory.
+const maxPooledListItems = 64
+
+// listItemsPool holds the list item slices used by withListItems. Pointers are stored,
+// so that putting a slice back doesn't allocate.
+var listItemsPool = sync.Pool{
+	New: func() any {
+		items := make([]listItem, 0, 8)
+		return &items
+	},
 }
 
-// RightmostTrustedRangeStrategy derives the client IP from the rightmost valid IP address
-// in the X-Forwarded-For or Forwarded header which is not in a set of trusted IP ranges.
-// This strategy should be used when the IP ranges of the reverse proxies between the
-// internet and the server are known.
-// If a third-party WAF, CDN, etc., is used, you SHOULD use a method of verifying its
-// access to your origin that is stronger than checking its IP address (e.g., using
-// authenticated pulls). Failure to do so can result in scenarios like:
-// You use AWS CloudFront in front of a server you host elsewhere. An attacker creates a
-// CF distribution that points at your origin server. The attacker uses Lambda@Edge to
-// spoof the Host and X-Forwarded-For headers. Now your "trusted" reverse proxy is no
-// longer trustworthy.
-type RightmostTrustedRangeStrategy struct {
-	headerName    string
-	trustedRanges []net.IPNet
+// withListItems calls fn with the items of the list header (see getListItems), and
+// returns its result. If there are more than MaxListItems items, fn is not called and
+// the reason is ReasonTooManyItems (or ReasonHeaderTooLarge, if the header is longer than
+// MaxHeaderBytes). The items are only valid during the call: the slice
+// is then returned to a pool, which avoids allocating a new one for each request. fn
+// must not retain items (the listItem values and their fields can be kept).
+func withListItems(headers HeaderGetter, headerName string, syntax HeaderSyntax, strictForwarded, lenientSeparators bool, fn func(items []listItem) result) result {
+	return withPooledListItems(headers, headerName, syntax.isForwarded(headerName), strictForwarded, lenientSeparators, true, fn)
 }
 
-// NewRightmostTrustedRangeStrategy creates a RightmostTrustedRangeStrategy. headerName
-// must be "X-Forwarded-For" or "Forwarded". trustedRanges must contain all trusted
-// reverse proxies on the path to this server. trustedRanges can be private/internal or
-// external (for example, if a third-party reverse proxy is used).
-func NewRightmostTrustedRangeStrategy(headerName string, trustedRanges []net.IPNet) (RightmostTrustedRangeStrategy, error) {
-	if headerName == "" {
-		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy header must not be empty")
+// withRawListItems is like withListItems, but the items are not parsed: only their raw
+// and index fields are set. This is for strategies that only need to parse some of the
+// items, which they can do with listItem.parsed.
+func withRawListItems(headers HeaderGetter, headerName string, syntax HeaderSyntax, lenientSeparators bool, fn func(items []listItem) result) result {
+	return withPooledListItems(headers, headerName, syntax.isForwarded(headerName), false, lenientSeparators, false, fn)
+}
+
+// withPooledListItems implements withListItems and withRawListItems.
+func withPooledListItems(headers HeaderGetter, headerName string, forwarded, strictForwarded, lenientSeparators, parse bool, fn func(items []listItem) result) result {
+	p := listItemsPool.Get().(*[]listItem)
+	var items []listItem
+	var ok bool
+	if parse {
+		items, ok = appendListItems((*p)[:0], headers, headerName, forwarded, strictForwarded, lenientSeparators)
+	} else {
+		items, ok = appendRawListItems((*p)[:0], headers, headerName, forwarded, lenientSeparators)
 	}
 
-	// We will be using the headerName for lookups in the http.Header map, which is keyed
-	// by canonicalized header name. We'll do that here so we only have to do it once.
-	headerName = http.CanonicalHeaderKey(headerName)
+	res := result{reason: ReasonTooManyItems}
+	if !ok && listHeaderTooLarge(headers, headerName) {
+		res.reason = ReasonHeaderTooLarge
+	}
+	if ok {
+		res = fn(items)
+		res.total = len(items)
+	}
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+	if cap(items) <= maxPooledListItems {
+		// Clear the items so that the pool doesn't keep their IPs alive
+		for i := range items {
+			items[i] = listItem{}
+		}
+		*p = items[:0]
+		listItemsPool.Put(p)
 	}
+	return res
+}
 
-	return RightmostTrustedRangeStrategy{headerName: headerName, trustedRanges: trustedRanges}, nil
+// getListItems creates a single list of all of the X-Forwarded-For or Forwarded header
+// items, in order. Any invalid IPs will result in items with a nil ipAddr; empty items
+// are skipped. headerName must already be canonicalized. If forwarded is true, the
+// header is parsed with the Forwarded syntax, otherwise with the X-Forwarded-For syntax.
+// If strictForwarded is true, Forwarded items that don't conform to RFC 7239 are treated
+// as invalid. If lenientSeparators is true, X-Forwarded-For items are also separated by
+// whitespace. If there are more than MaxListItems items, or the headers are longer than
+// MaxHeaderBytes, ok is false and nothing is parsed.
+func getListItems(headers HeaderGetter, headerName string, forwarded, strictForwarded, lenientSeparators bool) (items []listItem, ok bool) {
+	return appendListItems(nil, headers, headerName, forwarded, strictForwarded, lenientSeparators)
 }
 
-// ClientIP derives the client IP using this strategy.
-// headers is expected to be like http.Request.Header.
-// The returned IP may contain a zone identifier.
-// If no valid IP can be derived, empty string will be returned.
-func (strat RightmostTrustedRangeStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
-	// Look backwards through the list of IP addresses
-	for i := len(ipAddrs) - 1; i >= 0; i-- {
-		if ipAddrs[i] != nil && isIPContainedInRanges(ipAddrs[i].IP, strat.trustedRanges) {
-			// This IP is trusted
-			continue
-		}
+// appendListItems is like getListItems, but appends the items to dst and returns the
+// extended slice.
+func appendListItems(dst []listItem, headers HeaderGetter, headerName string, forwarded, strictForwarded, lenientSeparators bool) (items []listItem, ok bool) {
+	items, ok = appendRawListItems(dst, headers, headerName, forwarded, lenientSeparators)
+	if !ok {
+		return items, false
+	}
 
-		// At this point we have found the first-from-the-rightmost untrusted IP
+	for i := len(dst); i < len(items); i++ {
+		items[i] = items[i].parsed(forwarded, strictForwarded)
+	}
+	return items, true
+}
 
-		if ipAddrs[i] == nil {
-			return ""
-		}
+// appendRawListItems is like appendListItems, but the items are not parsed: only their
+// raw and index fields are set. Splitting and trimming the items is cheap compared to
+// parsing their IPs, so strategies that only need one item (like the trusted-count
+// strategies) can parse just that one.
+func appendRawListItems(dst []listItem, headers HeaderGetter, headerName string, forwarded, lenientSeparators bool) (items []listItem, ok bool) {
+	lenientSeparators = lenientSeparators && !forwarded
 
-		return ipAddrs[i].String()
+	if listHeaderTooLarge(headers, headerName) {
+		return dst, false
 	}
 
-	// Either there are no addresses or they are all in our trusted ranges
-	return ""
-}
-
-func (strat RightmostTrustedRangeStrategy) String() string {
-	var b strings.Builder
-	b.WriteString(fmt.Sprintf("{headerName:%v trustedRanges:[", strat.headerName))
-	for i, r := range strat.trustedRanges {
-		if i > 0 {
-			b.WriteString(" ")
+	// Before doing any splitting or parsing, make sure that the number of items is within
+	// the limit. Counting commas doesn't allocate, so an attacker sending an enormous
+	// header can't cause us to do a lot of work or allocation.
+	if MaxListItems > 0 {
+		count := 0
+		for _, h := range headers.Values(headerName) {
+			if lenientSeparators {
+				count += countLenientListItems(h)
+			} else {
+				count += strings.Count(h, ",") + 1
+			}
+		}
+		if count > MaxListItems {
+			return dst, false
 		}
-		b.WriteString(r.String())
 	}
-	b.WriteString("]")
-	return b.String()
-}
 
-// lastHeader returns the last header with the given name. It returns empty string if the
-// header is not found or if the header has an empty value. No validation is done on the
-// IP string. headerName must already be canonicalized.
-// This should be used with single-IP headers, like X-Real-IP. Per RFC 2616, they should
-// not have multiple headers, but if they do we can hope we're getting the newest/best by
-// taking the last instance.
-// This MUST NOT be used with list headers, like X-Forwarded-For and Forwarded.
-func lastHeader(headers http.Header, headerName string) string {
-	// Note that Go's Header map uses canonicalized keys
-	matches, ok := headers[headerName]
-	if !ok || len(matches) == 0 {
-		// For our uses of this function, returning an empty string in this case is fine
-		return ""
+	// Fast path for the very common case of a single header with a single item (like an
+	// X-Forwarded-For with only the client IP). There's nothing to split, so we avoid
+	// allocating the split slice and growing the result.
+	if values := headers.Values(headerName); len(values) == 1 && !strings.Contains(values[0], ",") && !lenientSeparators {
+		rawListItem := strings.TrimSpace(unfoldHeader(values[0]))
+		if rawListItem == "" {
+			return dst, true
+		}
+		return append(dst, listItem{raw: rawListItem}), true
 	}
 
-	return matches[len(matches)-1]
-}
-
-// getIPAddrList creates a single list of all of the X-Forwarded-For or Forwarded header
-// values, in order. Any invalid IPs will result in nil elements. headerName must already
-// be canonicalized.
-func getIPAddrList(headers http.Header, headerName string) []*net.IPAddr {
-	var result []*net.IPAddr
+	result := dst
 
 	// There may be multiple XFF headers present. We need to iterate through them all,
 	// in order, and collect all of the IPs.
 	// Note that we're not joining all of the headers into a single string and then
 	// splitting. Doing it that way would use more memory.
 	// Note that Go's Header map uses canonicalized keys.
-	for _, h := range headers[headerName] {
-		// We now have a string with comma-separated list items
-		for _, rawListItem := range strings.Split(h, ",") {
+	for _, h := range headers.Values(headerName) {
+		h = unfoldHeader(h)
+
+		// We now have a string with comma-separated list items. The Forwarded header may
+		// contain quoted strings, which can themselves contain commas, so we need to be
+		// more careful splitting it.
+		var rawListItems []string
+		if forwarded {
+			rawListItems = splitQuoted(h, ',')
+		} else if lenientSeparators {
+			rawListItems = strings.FieldsFunc(h, func(r rune) bool {
+				return r == ',' || unicode.IsSpace(r)
+			})
+		} else {
+			rawListItems = strings.Split(h, ",")
+		}
+
+		for _, rawListItem := range rawListItems {
 			// The IPs are often comma-space separated, so we'll need to trim the string
 			rawListItem = strings.TrimSpace(rawListItem)
 
-			var ipAddr *net.IPAddr
-			// If this is the XFF header, rawListItem is just an IP;
-			// if it's the Forwarded header, then there's more parsing to do.
-			if headerName == forwardedHdr {
-				ipAddr = parseForwardedListItem(rawListItem)
-			} else { // == XFF
-				ipAddr = goodIPAddr(rawListItem)
+			// Empty items (from leading, trailing, or doubled commas, or an empty header)
+			// are not hops; they're just sloppy list formatting. They must be skipped
+			// rather than treated as invalid items, otherwise they would shift the
+			// positions that the trusted-count strategies rely on.
+			if rawListItem == "" {
+				continue
 			}
 
-			// ipAddr is nil if not valid
-			result = append(result, ipAddr)
+			result = append(result, listItem{raw: rawListItem, index: len(result) - len(dst)})
 		}
 	}
 
 	// Possible performance improvements:
-	// Here we are parsing _all_ of the IPs in the XFF headers, but we don't need all of
-	// them. Instead, we could start from the left or the right (depending on strategy),
-	// parse as we go, and stop when we've come to the one we want. But that would make
-	// the various strategies somewhat more complex.
+	// Here we are splitting _all_ of the items in the headers, even if the strategy only
+	// needs one of them. Instead, we could scan from the left or the right (depending on
+	// strategy) and stop when we've come to the one we want. But the Forwarded header's
+	// quoted strings can't be split reliably from the right, and the splitting is cheap
+	// compared to the parsing, which withRawListItems already lets strategies skip.
 
-	return result
+	return result, true
+}
+
+// unfoldHeader replaces the CR and LF characters of any obsolete line folding (obs-fold;
+// see RFC 7230 section 3.2.4) in the header value h with spaces, as RFC 7230 says
+// recipients should. Go's HTTP server already does this when reading a request, but some
+// legacy intermediaries (and other sources of headers) don't, and the CR and LF would
+// otherwise be left in the list items. As with any other whitespace, a fold within an
+// item (rather than next to a comma) only separates items with WithLenientSeparators.
+// h is returned as-is (without allocating) if it has no CR or LF.
+func unfoldHeader(h string) string {
+	if !strings.ContainsAny(h, "\r\n") {
+		return h
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, h)
+}
+
+// countLenientListItems counts the items in s, as split with WithLenientSeparators. It
+// doesn't allocate.
+func countLenientListItems(s string) int {
+	count := 0
+	inItem := false
+	for _, r := range s {
+		isSep := r == ',' || unicode.IsSpace(r)
+		if !isSep && !inItem {
+			count++
+		}
+		inItem = !isSep
+	}
+	return count
 }
 
 // parseForwardedListItem parses a Forwarded header list item, and returns the "for" IP
@@ -494,39 +3702,15 @@ func parseForwardedListItem(fwd string) *net.IPAddr {
 	//	for=192.0.2.60;proto=http; by=203.0.113.43
 	//	for=192.0.2.43
 
-	// First split up "for=", "by=", "host=", etc.
-	fwdParts := strings.Split(fwd, ";")
-
 	// Find the "for=" part, since that has the IP we want (maybe)
-	var forPart string
-	for _, fp := range fwdParts {
-		// Whitespace is allowed around the semicolons
-		fp = strings.TrimSpace(fp)
-
-		fpSplit := strings.Split(fp, "=")
-		if len(fpSplit) != 2 {
-			// There are too many or too few equal signs in this part
-			continue
-		}
+	forPart := forwardedDirective(fwd, "for")
 
-		if strings.EqualFold(fpSplit[0], "for") {
-			// We found the "for=" part
-			forPart = fpSplit[1]
-			break
-		}
-	}
-
-	// There shouldn't (per RFC 7239) be spaces around the semicolon or equal sign. It might
-	// be more correct to consider spaces an error, but we'll tolerate and trim them.
-	forPart = strings.TrimSpace(forPart)
-
-	// Get rid of any quotes, such as surrounding IPv6 addresses.
-	// Note that doing this without checking if the quotes are present means that we are
+	// Note that forwardedDirective gets rid of any quotes, such as surrounding IPv6
+	// addresses. Doing this without checking if the quotes are present means that we are
 	// effectively accepting IPv6 addresses that don't strictly conform to RFC 7239, which
 	// requires quotes. https://www.rfc-editor.org/rfc/rfc7239#section-4
 	// This behaviour is debatable.
 	// It also means that we will accept IPv4 addresses with quotes, which is correct.
-	forPart = trimMatchedEnds(forPart, `"`)
 
 	if forPart == "" {
 		// We failed to find a "for=" part
@@ -542,9 +3726,196 @@ func parseForwardedListItem(fwd string) *net.IPAddr {
 	return ipAddr
 }
 
+// parseStrictForwardedListItem is like parseForwardedListItem, but nil is also returned
+// if the "for" value does not conform to RFC 7239 (see WithStrictForwarded).
+func parseStrictForwardedListItem(fwd string) *net.IPAddr {
+	// From RFC 7239 (section 6) and RFC 7230 (section 3.2.6):
+	//	node     = nodename [ ":" node-port ]
+	//	nodename = IPv4address / "[" IPv6address "]" / "unknown" / obfnode
+	//	node-port     = port / obfport
+	//	port          = 1*5DIGIT
+	//	obfport       = "_" 1*(ALPHA / DIGIT / "." / "_" / "-")
+	//	value         = token / quoted-string
+	// Colons and brackets are not token characters, so a value containing them must be
+	// quoted.
+	value := rawForwardedDirective(fwd, "for")
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	} else if strings.ContainsAny(value, `:[]"`) {
+		return nil
+	}
+
+	var host, port string
+	hasPort := false
+	if strings.HasPrefix(value, "[") {
+		end := strings.IndexByte(value, ']')
+		if end < 0 {
+			return nil
+		}
+		host = value[1:end]
+		if rest := value[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return nil
+			}
+			port, hasPort = rest[1:], true
+		}
+
+		// Only IPv6 addresses are bracketed
+		if !strings.Contains(host, ":") {
+			return nil
+		}
+	} else {
+		// An IPv4 address, which has no colons (except before the port)
+		host, port, hasPort = strings.Cut(value, ":")
+	}
+
+	if hasPort && !isForwardedNodePort(port) {
+		return nil
+	}
+
+	// Zones are not part of the grammar. We check this before parsing, because
+	// ParseIPAddr will accept them.
+	if strings.Contains(host, "%") {
+		return nil
+	}
+
+	return goodIPAddr(host)
+}
+
+// isObfuscatedIdentifier returns true if s is a valid RFC 7239 obfuscated identifier
+// (obfnode or obfport), like "_hidden".
+func isObfuscatedIdentifier(s string) bool {
+	if len(s) < 2 || s[0] != '_' {
+		return false
+	}
+
+	for _, c := range s[1:] {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlphaNum && c != '.' && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isForwardedNodePort returns true if s is a valid RFC 7239 node-port.
+func isForwardedNodePort(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	if s[0] == '_' {
+		// obfport, which has the same syntax as obfnode
+		return isObfuscatedIdentifier(s)
+	}
+
+	if len(s) > 5 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardedDirective returns the value of the directive with the given name (like "for"
+// or "proto") from a Forwarded header list item. Surrounding quotes are removed from the
+// value. Empty string is returned if the directive is not present.
+func forwardedDirective(fwd, name string) string {
+	// Get rid of any quotes. Quotes are optional around values that are tokens.
+	return trimMatchedEnds(rawForwardedDirective(fwd, name), `"`)
+}
+
+// rawForwardedDirective is like forwardedDirective, but surrounding quotes are retained.
+func rawForwardedDirective(fwd, name string) string {
+	// First split up "for=", "by=", "host=", etc. Quoted values may contain semicolons.
+	for _, fp := range splitQuoted(fwd, ';') {
+		fpName, fpValue, ok := splitForwardedDirective(fp)
+		if ok && strings.EqualFold(fpName, name) {
+			// We found the part we're looking for
+			return fpValue
+		}
+	}
+	return ""
+}
+
+// splitForwardedDirective splits one directive (semicolon-separated part) of a Forwarded
+// header element into its name and value. The value retains any surrounding quotes.
+// ok is false if there is no equal sign or the name is not a token.
+// This is used both by the strategies and by ParseForwarded, so that they agree on what
+// the directives are.
+func splitForwardedDirective(fp string) (name, value string, ok bool) {
+	// Whitespace is allowed around the semicolons
+	fp = strings.TrimSpace(fp)
+
+	// The directive name is a token, which can't contain an equal sign, so we split on
+	// the first one. The value can contain more, either within a quoted string or as
+	// the padding of a base64-encoded value (like "_abc=="), which isn't strictly a
+	// token but is used by some proxies.
+	name, value, ok = strings.Cut(fp, "=")
+	if !ok || !isToken(name) {
+		// There is no equal sign in this part, or the name is malformed (including by
+		// having a space before the equal sign)
+		return "", "", false
+	}
+
+	// There shouldn't (per RFC 7239) be spaces after the equal sign either. It might be
+	// more correct to consider them an error, but we'll tolerate and trim them.
+	return name, strings.TrimSpace(value), true
+}
+
+// splitQuoted splits s on sep, except where sep occurs within a double-quoted string
+// (as defined by RFC 7230, section 3.2.6, including backslash-escaped characters).
+// The quotes are retained in the output.
+// If s ends inside a quoted string -- i.e., the quotes are unbalanced -- then s is split
+// on every sep, as if there were no quotes. Otherwise a stray quote (perhaps inserted by
+// an attacker) would swallow the rest of the header, including the parts added by
+// trusted proxies.
+func splitQuoted(s string, sep byte) []string {
+	var result []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case inQuotes && s[i] == '\\':
+			// Skip the escaped character (which could be a quote)
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == sep:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+
+	if inQuotes {
+		return strings.Split(s, string(sep))
+	}
+
+	return append(result, s[start:])
+}
+
+// isHTTPSForwardedListItem returns true if the Forwarded header list item has a
+// "proto=https" directive.
+func isHTTPSForwardedListItem(fwd string) bool {
+	// The scheme is case-insensitive, per RFC 3986 section 3.1
+	return strings.EqualFold(forwardedDirective(fwd, "proto"), "https")
+}
+
 // ParseIPAddr parses the given string into a net.IPAddr, which is a useful type for
 // dealing with IPs have zones. The Go stdlib net package is lacking such a function.
-// This will also discard any port number from the input.
+// This will also discard any port number from the input. The address may be in square
+// brackets, with or without a port (like "[2001:db8::17]:4711" or "[2001:db8::17]");
+// all of the headers are parsed this way, so an address is accepted the same in each.
+// IPv6 addresses with an embedded dotted-quad IPv4 address are accepted. IPv4-mapped
+// addresses (like "::ffff:188.0.2.128") are equivalent to the plain IPv4 address and
+// will stringify as such. Other embeddings, such as the deprecated IPv4-compatible form
+// (like "::188.0.2.128") and NAT64 (like "64:ff9b::188.0.2.128"), are not IPv4
+// addresses and will stringify in IPv6 form (like "::bc00:280").
+// Unspecified addresses (like "::" and "0.0.0.0") are accepted, although the strategies
+// reject them (unless WithUnspecified is used).
 func ParseIPAddr(ipStr string) (net.IPAddr, error) {
 	host, _, err := net.SplitHostPort(ipStr)
 	if err == nil {
@@ -584,7 +3955,8 @@ func MustParseIPAddr(ipStr string) net.IPAddr {
 // goodIPAddr wraps ParseIPAddr and adds a check for unspecified (like "::") and zero-value
 // addresses (like "0.0.0.0"). These are nominally valid IPs (net.ParseIP will accept them),
 // but they are undesirable for the purposes of this library.
-// Note that this function should be the only use of ParseIPAddr in this library.
+// Note that this function (and unspecifiedIPAddr) should be the only use of ParseIPAddr
+// in this library.
 func goodIPAddr(ipStr string) *net.IPAddr {
 	ipAddr, err := ParseIPAddr(ipStr)
 	if err != nil {
@@ -598,6 +3970,17 @@ func goodIPAddr(ipStr string) *net.IPAddr {
 	return &ipAddr
 }
 
+// unspecifiedIPAddr is the complement of goodIPAddr: it returns the parsed IP only if it
+// is an unspecified address, for strategies that use WithUnspecified.
+func unspecifiedIPAddr(ipStr string) *net.IPAddr {
+	ipAddr, err := ParseIPAddr(ipStr)
+	if err != nil || !ipAddr.IP.IsUnspecified() {
+		return nil
+	}
+
+	return &ipAddr
+}
+
 // SplitHostZone splits a "host%zone" string into its components. If there is no zone,
 // host is the original input and zone is empty.
 func SplitHostZone(s string) (host, zone string) {
@@ -613,6 +3996,25 @@ func SplitHostZone(s string) (host, zone string) {
 	return
 }
 
+// JoinHostZone is the inverse of SplitHostZone: it combines host and zone into a
+// "host%zone" string. If zone is empty, host is returned unchanged.
+func JoinHostZone(host, zone string) string {
+	if zone == "" {
+		return host
+	}
+	return host + "%" + zone
+}
+
+// JoinHostPortZone is like JoinHostZone, but also adds port, in the form
+// "[host%zone]:port" for IPv6 and "host:port" for IPv4 (see net.JoinHostPort).
+// If port is empty, the result is the same as JoinHostZone.
+func JoinHostPortZone(host, zone, port string) string {
+	if port == "" {
+		return JoinHostZone(host, zone)
+	}
+	return net.JoinHostPort(JoinHostZone(host, zone), port)
+}
+
 // mustParseCIDR panics if net.ParseCIDR fails
 func mustParseCIDR(s string) net.IPNet {
 	_, ipNet, err := net.ParseCIDR(s)
@@ -637,7 +4039,7 @@ var privateAndLocalRanges = []net.IPNet{
 	mustParseCIDR("198.51.100.0/24"),    // Assigned as TEST-NET-2
 	mustParseCIDR("203.0.113.0/24"),     // Assigned as TEST-NET-3
 	mustParseCIDR("192.88.99.0/24"),     // RFC 3068
-	mustParseCIDR("192.18.0.0/15"),      // RFC 2544
+	mustParseCIDR("198.18.0.0/15"),      // RFC 2544
 	mustParseCIDR("224.0.0.0/4"),        // RFC 3171
 	mustParseCIDR("240.0.0.0/4"),        // RFC 1112
 	mustParseCIDR("255.255.255.255/32"), // RFC 919 Section 7
@@ -655,8 +4057,116 @@ var privateAndLocalRanges = []net.IPNet{
 	mustParseCIDR("2002::/16"),          // RFC 7526: 6to4 anycast prefix deprecated
 }
 
-// isIPContainedInRanges returns true if the given IP is contained in at least one of the given ranges
-func isIPContainedInRanges(ip net.IP, ranges []net.IPNet) bool {
+// reservedRanges are the ranges rejected by WithRejectReserved. See ReservedRanges.
+var reservedRanges = []net.IPNet{
+	mustParseCIDR("192.0.2.0/24"),    // RFC 5737: TEST-NET-1
+	mustParseCIDR("198.51.100.0/24"), // RFC 5737: TEST-NET-2
+	mustParseCIDR("203.0.113.0/24"),  // RFC 5737: TEST-NET-3
+	mustParseCIDR("198.18.0.0/15"),   // RFC 2544: benchmarking
+	mustParseCIDR("224.0.0.0/4"),     // RFC 5771: multicast
+	mustParseCIDR("240.0.0.0/4"),     // RFC 1112: reserved, including broadcast
+	mustParseCIDR("2001:db8::/32"),   // RFC 3849: documentation
+	mustParseCIDR("3fff::/20"),       // RFC 9637: documentation
+	mustParseCIDR("2001:2::/48"),     // RFC 5180: benchmarking
+	mustParseCIDR("ff00::/8"),        // RFC 4291: multicast
+}
+
+// nat64WellKnownPrefix is the NAT64 well-known prefix, per RFC 6052. Addresses in it
+// embed an IPv4 address in their low 32 bits.
+var nat64WellKnownPrefix = mustParseCIDR("64:ff9b::/96")
+
+// PrivateAndLocalRanges returns a copy of the ranges that are considered private, local,
+// or otherwise not suitable for an external client IP. These are the ranges used by the
+// non-private strategies (unless overridden). A copy is returned so that the internal set
+// can't be modified. It can be combined with other ranges to create the trusted ranges for
+// RightmostTrustedRangeStrategy, for example.
+// The ranges are:
+//
+//	10.0.0.0/8          RFC 1918: private
+//	172.16.0.0/12       RFC 1918: private
+//	192.168.0.0/16      RFC 1918: private
+//	127.0.0.0/8         RFC 5735: loopback
+//	0.0.0.0/8           RFC 1122 section 3.2.1.3: "this" network
+//	169.254.0.0/16      RFC 3927: link local
+//	192.0.0.0/24        RFC 5736: IETF protocol assignments
+//	192.0.2.0/24        RFC 5737: TEST-NET-1 documentation
+//	198.51.100.0/24     RFC 5737: TEST-NET-2 documentation
+//	203.0.113.0/24      RFC 5737: TEST-NET-3 documentation
+//	192.88.99.0/24      RFC 3068: 6to4 relay anycast
+//	198.18.0.0/15       RFC 2544: benchmarking
+//	224.0.0.0/4         RFC 3171: multicast
+//	240.0.0.0/4         RFC 1112: reserved
+//	255.255.255.255/32  RFC 919 section 7: limited broadcast
+//	100.64.0.0/10       RFC 6598: carrier-grade NAT shared address space
+//	::/128              RFC 4291: unspecified address
+//	::1/128             RFC 4291: loopback address
+//	100::/64            RFC 6666: discard address block
+//	2001::/23           RFC 2928: IETF protocol assignments
+//	2001:2::/48         RFC 5180: benchmarking
+//	2001:db8::/32       RFC 3849: documentation
+//	2001::/32           RFC 4380: Teredo
+//	fc00::/7            RFC 4193: unique local
+//	fe80::/10           RFC 4291 section 2.5.6: link-scoped unicast
+//	ff00::/8            RFC 4291 section 2.7: multicast
+//	2002::/16           RFC 7526: deprecated 6to4 anycast prefix
+//
+// Note that the non-private strategies and IsPrivateOrLocal also treat NAT64 addresses
+// (64:ff9b::/96) as private when their embedded IPv4 address is, which can't be
+// expressed as a range.
+func PrivateAndLocalRanges() []net.IPNet {
+	result := make([]net.IPNet, len(privateAndLocalRanges))
+	for i, r := range privateAndLocalRanges {
+		// Copy the underlying slices as well, so that the caller can't modify ours
+		result[i] = net.IPNet{
+			IP:   append(net.IP(nil), r.IP...),
+			Mask: append(net.IPMask(nil), r.Mask...),
+		}
+	}
+	return result
+}
+
+// ReservedRanges returns a copy of the ranges that are rejected by strategies created
+// with WithRejectReserved: ranges that can never be the address of a real client. A copy
+// is returned so that the internal set can't be modified.
+// The ranges are:
+//
+//	192.0.2.0/24     RFC 5737: TEST-NET-1 documentation
+//	198.51.100.0/24  RFC 5737: TEST-NET-2 documentation
+//	203.0.113.0/24   RFC 5737: TEST-NET-3 documentation
+//	198.18.0.0/15    RFC 2544: benchmarking
+//	224.0.0.0/4      RFC 5771: multicast
+//	240.0.0.0/4      RFC 1112: reserved (including the limited broadcast address)
+//	2001:db8::/32    RFC 3849: documentation
+//	3fff::/20        RFC 9637: documentation
+//	2001:2::/48      RFC 5180: benchmarking
+//	ff00::/8         RFC 4291 section 2.7: multicast
+//
+// The unspecified addresses are always rejected, and the private and loopback ranges
+// are left to the non-private strategies (see PrivateAndLocalRanges).
+func ReservedRanges() []net.IPNet {
+	result := make([]net.IPNet, len(reservedRanges))
+	for i, r := range reservedRanges {
+		result[i] = net.IPNet{
+			IP:   append(net.IP(nil), r.IP...),
+			Mask: append(net.IPMask(nil), r.Mask...),
+		}
+	}
+	return result
+}
+
+// isReserved returns true if ip is in one of the reserved ranges. IPv4-mapped IPv6
+// addresses are checked as IPv4.
+func isReserved(ip net.IP) bool {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	return IPInRanges(ip, reservedRanges)
+}
+
+// IPInRanges returns true if the given IP is contained in at least one of the given
+// ranges. This is the same check that the strategies in this package use, so it can be
+// used to validate or post-filter IPs consistently with them.
+func IPInRanges(ip net.IP, ranges []net.IPNet) bool {
 	for _, r := range ranges {
 		if r.Contains(ip) {
 			return true
@@ -665,10 +4175,61 @@ func isIPContainedInRanges(ip net.IP, ranges []net.IPNet) bool {
 	return false
 }
 
-// isPrivateOrLocal return true if the given IP address is private, local, or otherwise
-// not suitable for an external client IP.
-func isPrivateOrLocal(ip net.IP) bool {
-	return isIPContainedInRanges(ip, privateAndLocalRanges)
+// IsTrustedProxy returns true if remoteAddr (like http.Request.RemoteAddr: an IP or
+// IP:port) is in at least one of trustedRanges. It parses and checks the address the same
+// way as TrustedPeerStrategy and RightmostTrustedRangeStrategy, so it can be used to
+// check that the ranges given to those strategies include a particular proxy. It returns
+// false if remoteAddr is not a valid IP.
+func IsTrustedProxy(remoteAddr string, trustedRanges []net.IPNet) bool {
+	ipAddr := goodIPAddr(remoteAddr)
+	return ipAddr != nil && IPInRanges(ipAddr.IP, trustedRanges)
+}
+
+// IsPrivateOrLocal returns true if the given IP address is private, local, or otherwise
+// not suitable for an external client IP. The ranges checked are those returned by
+// PrivateAndLocalRanges. This is the same check used by the non-private strategies, so
+// it can be used (for example) to validate that a configured IP isn't internal.
+// IPv4-mapped IPv6 addresses (like "::ffff:10.0.0.1") are checked as the IPv4 address
+// they represent. NAT64 addresses with the well-known prefix (like "64:ff9b::10.0.0.1")
+// are private if the embedded IPv4 address is.
+func IsPrivateOrLocal(ip net.IP) bool {
+	return isPrivate(ip, nil)
+}
+
+// copyPrivateRanges copies privateRanges, so that the caller modifying its slice can't
+// affect a strategy. nil (the default ranges) and empty (no private ranges) are kept
+// distinct.
+func copyPrivateRanges(privateRanges []net.IPNet) []net.IPNet {
+	if privateRanges == nil {
+		return nil
+	}
+	return append([]net.IPNet{}, privateRanges...)
+}
+
+// isPrivate returns true if the given IP address is in privateRanges. If privateRanges is
+// nil, the default private and local ranges are used instead.
+func isPrivate(ip net.IP, privateRanges []net.IPNet) bool {
+	if privateRanges == nil {
+		privateRanges = privateAndLocalRanges
+	}
+
+	// An IPv4-mapped IPv6 address (like "::ffff:10.0.0.1", or equivalently
+	// "::ffff:a00:1") is the IPv4 address, and must be checked against the IPv4 ranges.
+	// Otherwise an attacker could get a private address accepted as non-private by
+	// encoding it this way. net.IPNet.Contains does this conversion itself, but we do it
+	// explicitly so that this security-relevant behaviour doesn't depend on that.
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+
+	// Similarly, a NAT64 address using the well-known prefix (like "64:ff9b::10.0.0.1")
+	// is translated to the IPv4 address embedded in its low 32 bits, so if that embedded
+	// address is private then so is the NAT64 address.
+	if len(ip) == net.IPv6len && nat64WellKnownPrefix.Contains(ip) && IPInRanges(ip[12:], privateRanges) {
+		return true
+	}
+
+	return IPInRanges(ip, privateRanges)
 }
 
 // trimMatchedEnds trims s if and only if the first and last bytes in s are in chars.
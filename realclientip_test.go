@@ -3,10 +3,14 @@
 package realclientip
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/realclientip/realclientip-go/ranges"
@@ -304,7 +308,7 @@ func TestSingleIPHeaderStrategy(t *testing.T) {
 			args: args{
 				headerName: "x-real-ip",
 				headers: http.Header{
-					"X-Real-Ip":       []string{"2607:f8b0:4004:83f::19"},
+					"X-Real-Ip":       []string{"[2607:f8b0:4004:83f::19]"},
 					"A-B-C-D":         []string{"[fe80::1111%zone]:4848"},
 					"X-Forwarded-For": []string{"3.3.3.3"}},
 			},
@@ -408,6 +412,15 @@ func TestSingleIPHeaderStrategy(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Error: X-Original-Forwarded-For header",
+			args: args{
+				headerName: "X-Original-Forwarded-For",
+				headers: http.Header{
+					"X-Original-Forwarded-For": []string{"3.3.3.3"}},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -430,265 +443,793 @@ func TestSingleIPHeaderStrategy(t *testing.T) {
 	}
 }
 
-func TestLeftmostNonPrivateStrategy(t *testing.T) {
-	// Ensure the strategy interface is implemented
-	var _ Strategy = LeftmostNonPrivateStrategy{}
+func TestWithRejectMultipleHeaders(t *testing.T) {
+	lenient := Must(NewSingleIPHeaderStrategy("X-Real-IP")).(SingleIPHeaderStrategy)
+	strict := Must(NewSingleIPHeaderStrategy("X-Real-IP", WithRejectMultipleHeaders(true))).(SingleIPHeaderStrategy)
 
-	type args struct {
-		headerName string
-		headers    http.Header
-		remoteAddr string
+	tests := []struct {
+		name             string
+		values           []string
+		wantLenient      string
+		wantStrict       string
+		wantStrictReason Reason
+	}{
+		{
+			name:             "Single header",
+			values:           []string{"1.1.1.1"},
+			wantLenient:      "1.1.1.1",
+			wantStrict:       "1.1.1.1",
+			wantStrictReason: ReasonFound,
+		},
+		{
+			name:             "Multiple headers",
+			values:           []string{"1.1.1.1", "2.2.2.2"},
+			wantLenient:      "2.2.2.2",
+			wantStrict:       "",
+			wantStrictReason: ReasonMultipleHeaders,
+		},
+		{
+			name:             "Multiple identical headers",
+			values:           []string{"1.1.1.1", "1.1.1.1"},
+			wantLenient:      "1.1.1.1",
+			wantStrict:       "",
+			wantStrictReason: ReasonMultipleHeaders,
+		},
+		{
+			name:             "No header",
+			values:           nil,
+			wantLenient:      "",
+			wantStrict:       "",
+			wantStrictReason: ReasonHeaderMissing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Real-Ip": tt.values}
+			if got := lenient.ClientIP(headers, ""); got != tt.wantLenient {
+				t.Fatalf("lenient ClientIP = %q, want %q", got, tt.wantLenient)
+			}
+			if got, reason := ClientIPDetail(strict, headers, ""); got != tt.wantStrict || reason != tt.wantStrictReason {
+				t.Fatalf("strict ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.wantStrict, tt.wantStrictReason)
+			}
+		})
+	}
+}
+
+func TestWithStrictForwarded(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	headers := http.Header{"Forwarded": []string{`for="[2001:db8::1]:4711", for=2600:1f18::99, for="[2600:1f18::98]", for=10.0.0.1`}}
+
+	tests := []struct {
+		strat      Strategy
+		wantStrict string
+	}{
+		{Must(NewLeftmostNonPrivateStrategy("Forwarded", WithStrictForwarded(true))), "2600:1f18::98"},
+		{Must(NewRightmostNonPrivateStrategy("Forwarded", WithStrictForwarded(true))), "2600:1f18::98"},
+		{Must(NewLeftmostStrategy("Forwarded", WithStrictForwarded(true))), "2001:db8::1"},
+		{Must(NewRightmostStrategy("Forwarded", WithStrictForwarded(true))), "10.0.0.1"},
+		{Must(NewLeftmostTrustedCountStrategy("Forwarded", 2, WithStrictForwarded(true))), ""},
+		{Must(NewRightmostTrustedCountStrategy("Forwarded", 3, WithStrictForwarded(true))), ""},
+		{Must(NewRightmostTrustedRangeStrategy("Forwarded", trustedRanges, WithStrictForwarded(true))), "2600:1f18::98"},
+	}
+	for _, tt := range tests {
+		if got := tt.strat.ClientIP(headers, ""); got != tt.wantStrict {
+			t.Fatalf("%T ClientIP = %q, want %q", tt.strat, got, tt.wantStrict)
+		}
+	}
+
+	// The non-conforming item is accepted by default
+	if got := Must(NewLeftmostTrustedCountStrategy("Forwarded", 2)).ClientIP(headers, ""); got != "2600:1f18::99" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2600:1f18::99")
+	}
+
+	// Forwarded only
+	if _, err := NewRightmostStrategy("X-Forwarded-For", WithStrictForwarded(true)); err == nil {
+		t.Fatalf("NewRightmostStrategy did not return error for X-Forwarded-For with WithStrictForwarded")
+	}
+	if _, err := NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithStrictForwarded(true)); err == nil {
+		t.Fatalf("NewRightmostTrustedRangeStrategy did not return error for X-Forwarded-For with WithStrictForwarded")
 	}
+}
+
+func TestWithLenientSeparators(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("3.3.3.3")
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2 3.3.3.3", "\t4.4.4.4\t 5.5.5.5 ,, "}}
+
 	tests := []struct {
-		name    string
-		args    args
-		want    string
-		wantErr bool
+		name        string
+		newStrat    func(opts ...Option) (Strategy, error)
+		wantLenient string
+		wantDefault string
 	}{
 		{
-			name: "IPv4 with port",
-			args: args{
-				headerName: "X-Forwarded-For",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-				},
+			name: "LeftmostNonPrivate",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostNonPrivateStrategy("X-Forwarded-For", opts...)
 			},
-			want: "2.2.2.2",
+			wantLenient: "1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "IPv4 with no port",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`For=5.5.5.5`, `For=6.6.6.6`},
-				},
+			name: "RightmostNonPrivate",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostNonPrivateStrategy("X-Forwarded-For", opts...)
 			},
-			want: "5.5.5.5",
+			wantLenient: "5.5.5.5",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "IPv6 with port",
-			args: args{
-				headerName: "X-Forwarded-For",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`[2607:f8b0:4004:83f::18]:3838, 3.3.3.3`, `4.4.4.4`},
-				},
+			name: "Leftmost",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostStrategy("X-Forwarded-For", opts...)
 			},
-			want: "2607:f8b0:4004:83f::18",
+			wantLenient: "1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "IPv6 with no port",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`Host=blah;For="2607:f8b0:4004:83f::18";Proto=https`},
-				},
+			name: "Rightmost",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostStrategy("X-Forwarded-For", opts...)
 			},
-			want: "2607:f8b0:4004:83f::18",
+			wantLenient: "5.5.5.5",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "IPv6 with port and zone",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`For=[fe80::1111%zone], Host=blah;For="[2607:f8b0:4004:83f::18%zone]:9943";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name: "LeftmostTrustedCount",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostTrustedCountStrategy("X-Forwarded-For", 2, opts...)
 			},
-			want: "2607:f8b0:4004:83f::18%zone",
+			wantLenient: "2.2.2.2",
+			wantDefault: "",
 		},
 		{
-			name: "IPv6 with port and zone, no quotes",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`For=[fe80::1111%zone], Host=blah;For=[2607:f8b0:4004:83f::18%zone]:9943;Proto=https`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name: "RightmostTrustedCount",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedCountStrategy("X-Forwarded-For", 3, opts...)
 			},
-			want: "2607:f8b0:4004:83f::18%zone",
+			wantLenient: "3.3.3.3",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "IPv4-mapped IPv6",
-			args: args{
-				headerName: "x-forwarded-for",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::ffff:188.0.2.128, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name: "RightmostTrustedRange",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, opts...)
 			},
-			want: "188.0.2.128",
+			wantLenient: "5.5.5.5",
+			wantDefault: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Must(tt.newStrat(WithLenientSeparators(true))).ClientIP(headers, ""); got != tt.wantLenient {
+				t.Fatalf("lenient ClientIP = %q, want %q", got, tt.wantLenient)
+			}
+			// By default, the space-separated values are single invalid items
+			if got := Must(tt.newStrat()).ClientIP(headers, ""); got != tt.wantDefault {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantDefault)
+			}
+		})
+	}
+
+	// X-Forwarded-For syntax only
+	if _, err := NewRightmostStrategy("Forwarded", WithLenientSeparators(true)); err == nil {
+		t.Fatalf("NewRightmostStrategy did not return error for Forwarded with WithLenientSeparators")
+	}
+	if _, err := NewRightmostStrategy("X-Cdn-Chain", WithLenientSeparators(true), WithHeaderSyntax(HeaderSyntaxForwarded)); err == nil {
+		t.Fatalf("NewRightmostStrategy did not return error for Forwarded syntax with WithLenientSeparators")
+	}
+}
+
+func TestWithMappedIPv6(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For": []string{`[::ffff:1.1.1.1]:4711, 2.2.2.2, ::FFFF:10.0.0.1`},
+		"Forwarded":       []string{`for="[::ffff:1.1.1.1]:4711";proto=https, for=2.2.2.2;by="[2001:db8::1]", For="::ffff:c0a8:1"`},
+		"X-Real-Ip":       []string{`::ffff:1.1.1.1%eth0`},
+		"X-Proxy-Line":    []string{`PROXY TCP6 ::ffff:1.1.1.1 2001:db8::1 1234 443`},
+	}
+	trustedRanges, _ := AddressesAndRangesToIPNets("2.2.2.2", "10.0.0.0/8", "192.168.0.0/16")
+
+	tests := []struct {
+		name        string
+		newStrat    func(opts ...Option) (Strategy, error)
+		wantKeep    string
+		wantDefault string
+	}{
+		{
+			name: "LeftmostNonPrivate",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostNonPrivateStrategy("X-Forwarded-For", opts...)
+			},
+			wantKeep:    "::ffff:1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "IPv4-mapped IPv6 with port",
-			args: args{
-				headerName: "x-forwarded-for",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`[::ffff:188.0.2.128]:48483, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name: "RightmostNonPrivate, IPv4 notation",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostNonPrivateStrategy("X-Forwarded-For", opts...)
 			},
-			want: "188.0.2.128",
+			wantKeep:    "2.2.2.2",
+			wantDefault: "2.2.2.2",
 		},
 		{
-			name: "IPv4-mapped IPv6 in IPv6 (hex) form",
-			args: args{
-				headerName: "forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`[::ffff:188.0.2.128]:48483, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name: "Leftmost Forwarded",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostStrategy("Forwarded", opts...)
 			},
-			want: "188.21.0.6",
+			wantKeep:    "::ffff:1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "NAT64 IPv4-mapped IPv6",
-			args: args{
-				headerName: "x-forwarded-for",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`64:ff9b::188.0.2.128, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name: "Rightmost Forwarded, hex notation",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostStrategy("Forwarded", opts...)
 			},
-			want: "64:ff9b::bc00:280",
+			wantKeep:    "::ffff:192.168.0.1",
+			wantDefault: "192.168.0.1",
 		},
 		{
-			name: "XFF: leftmost not desirable",
-			args: args{
-				headerName: "x-forwarded-for",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope`, `4.4.4.4, 5.5.5.5`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name: "Forwarded, IPv4 notation with IPv6 by",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedCountStrategy("Forwarded", 2, opts...)
 			},
-			want: "4.4.4.4",
+			wantKeep:    "2.2.2.2",
+			wantDefault: "2.2.2.2",
 		},
 		{
-			name: "Forwarded: leftmost not desirable",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope`, `4.4.4.4, 5.5.5.5`},
-					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="2607:f8b0:4004:83f::18"`},
-				},
+			name: "RightmostTrustedCount",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, opts...)
 			},
-			want: "2607:f8b0:4004:83f::18",
+			wantKeep:    "::ffff:10.0.0.1",
+			wantDefault: "10.0.0.1",
 		},
 		{
-			name: "Fail: XFF: none acceptable",
-			args: args{
-				headerName: "X-Forwarded-For",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope, ::, 0.0.0.0`, `192.168.1.1, !?!`},
-					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="fe80::abcd%zone"`},
-				},
+			name: "LeftmostTrustedCount",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1, opts...)
 			},
-			want: "",
+			wantKeep:    "::ffff:1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "Fail: Forwarded: none acceptable",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, 2.2.2.2`},
-					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone",For="::",For=0.0.0.0`},
-				},
+			name: "RightmostTrustedRange",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, opts...)
 			},
-			want: "",
+			wantKeep:    "::ffff:1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "Fail: XFF: no header",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip": []string{`1.1.1.1`},
-					"Forwarded": []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone"`},
-				},
+			name: "SingleIPHeader, with zone",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewSingleIPHeaderStrategy("X-Real-IP", opts...)
 			},
-			want: "",
+			wantKeep:    "::ffff:1.1.1.1%eth0",
+			wantDefault: "1.1.1.1%eth0",
 		},
 		{
-			name: "Fail: Forwarded: no header",
-			args: args{
-				headerName: "forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`64:ff9b::188.0.2.128, 3.3.3.3`, `4.4.4.4`},
-				},
+			name: "SingleIPHeader, zone stripped",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewSingleIPHeaderStrategy("X-Real-IP", append(opts, WithZone(false))...)
 			},
-			want: "",
+			wantKeep:    "::ffff:1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "Error: empty header name",
-			args: args{
-				headerName: "",
-				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
+			name: "ProxyProtocol",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewProxyProtocolStrategy("X-Proxy-Line", opts...)
 			},
-			wantErr: true,
+			wantKeep:    "::ffff:1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 		{
-			name: "Error: invalid header",
-			args: args{
-				headerName: "X-Real-IP",
-				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
+			name: "Chain",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewChainStrategy(Must(NewSingleIPHeaderStrategy("X-Client-IP", opts...)), Must(NewLeftmostStrategy("X-Forwarded-For", opts...))), nil
 			},
-			wantErr: true,
+			wantKeep:    "::ffff:1.1.1.1",
+			wantDefault: "1.1.1.1",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			strat, err := NewLeftmostNonPrivateStrategy(tt.args.headerName)
-			if (err != nil) != tt.wantErr {
-				t.Fatalf("NewLeftmostNonPrivateStrategy error = %v, wantErr %v", err, tt.wantErr)
-				return
+			strat := Must(tt.newStrat(WithMappedIPv6(true)))
+			if got := strat.ClientIP(headers, ""); got != tt.wantKeep {
+				t.Fatalf("mapped ClientIP = %q, want %q", got, tt.wantKeep)
 			}
-
-			if err != nil {
-				// We can't continue
-				return
+			// The IPAddr is unaffected
+			if got := ClientNetIPAddr(strat, headers, ""); got.String() != tt.wantDefault {
+				t.Fatalf("mapped ClientNetIPAddr = %q, want %q", got, tt.wantDefault)
 			}
 
-			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			if got := Must(tt.newStrat()).ClientIP(headers, ""); got != tt.wantDefault {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantDefault)
+			}
+			if got := Must(tt.newStrat(WithMappedIPv6(false))).ClientIP(headers, ""); got != tt.wantDefault {
+				t.Fatalf("WithMappedIPv6(false) ClientIP = %q, want %q", got, tt.wantDefault)
 			}
 		})
 	}
 }
 
-func TestRightmostNonPrivateStrategy(t *testing.T) {
-	// Ensure the strategy interface is implemented
-	var _ Strategy = RightmostNonPrivateStrategy{}
+func Test_isMappedIPv6Notation(t *testing.T) {
+	tests := []struct {
+		ipStr string
+		want  bool
+	}{
+		{"::ffff:192.0.2.1", true},
+		{"::FFFF:192.0.2.1", true},
+		{"::ffff:c000:201", true},
+		{"0:0:0:0:0:ffff:192.0.2.1", true},
+		{"[::ffff:192.0.2.1]:4711", true},
+		{"[::ffff:192.0.2.1]", true},
+		{"::ffff:192.0.2.1%eth0", true},
+		{"192.0.2.1", false},
+		{"192.0.2.1:4711", false},
+		{"[192.0.2.1]", false},
+		{"::192.0.2.1", false},
+		{"64:ff9b::192.0.2.1", false},
+		{"2001:db8::1", false},
+		{"nope", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isMappedIPv6Notation(tt.ipStr); got != tt.want {
+			t.Fatalf("isMappedIPv6Notation(%q) = %v, want %v", tt.ipStr, got, tt.want)
+		}
+	}
+}
 
-	type args struct {
-		headerName string
-		headers    http.Header
-		remoteAddr string
+func TestWithRejectReserved(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For": []string{`2.2.2.2, 198.18.0.1, 3.3.3.3, 224.0.0.1, [ff02::1]:80, 2001:db8::1, ::ffff:203.0.113.9`},
+		"Forwarded":       []string{`for=2.2.2.2, for="[2001:db8::1]:80", for=255.255.255.255`},
+		"X-Real-Ip":       []string{`239.1.2.3`},
 	}
+	trustedRanges, _ := AddressesAndRangesToIPNets("203.0.113.0/24")
+
 	tests := []struct {
-		name    string
-		args    args
+		name       string
+		newStrat   func(opts ...Option) (Strategy, error)
+		wantAccept string
+		wantReject string
+	}{
+		{
+			name: "SingleIPHeader",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewSingleIPHeaderStrategy("X-Real-IP", opts...)
+			},
+			wantAccept: "239.1.2.3",
+			wantReject: "",
+		},
+		{
+			name: "Rightmost",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostStrategy("X-Forwarded-For", opts...)
+			},
+			wantAccept: "203.0.113.9",
+			wantReject: "3.3.3.3",
+		},
+		{
+			name: "Rightmost Forwarded",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostStrategy("Forwarded", opts...)
+			},
+			wantAccept: "255.255.255.255",
+			wantReject: "2.2.2.2",
+		},
+		{
+			name: "Leftmost",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostStrategy("X-Forwarded-For", append(opts, WithFamily(FamilyIPv6))...)
+			},
+			wantAccept: "ff02::1",
+			wantReject: "",
+		},
+		{
+			// The non-private strategies already skip most reserved ranges, but not the
+			// benchmarking range
+			name: "LeftmostNonPrivate",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostNonPrivateStrategyWithRanges("X-Forwarded-For", mustAddressesAndRangesToIPNets("2.2.2.2"), opts...)
+			},
+			wantAccept: "198.18.0.1",
+			wantReject: "3.3.3.3",
+		},
+		{
+			name: "RightmostNonPrivate",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostNonPrivateStrategyWithRanges("X-Forwarded-For", mustAddressesAndRangesToIPNets("3.3.3.0/24"), opts...)
+			},
+			wantAccept: "203.0.113.9",
+			wantReject: "2.2.2.2",
+		},
+		{
+			name: "RightmostTrustedCount",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedCountStrategy("X-Forwarded-For", 3, opts...)
+			},
+			wantAccept: "ff02::1",
+			wantReject: "",
+		},
+		{
+			name: "LeftmostTrustedCount",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostTrustedCountStrategy("X-Forwarded-For", 2, opts...)
+			},
+			wantAccept: "198.18.0.1",
+			wantReject: "",
+		},
+		{
+			name: "RightmostTrustedRange",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, opts...)
+			},
+			wantAccept: "2001:db8::1",
+			wantReject: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Must(tt.newStrat()).ClientIP(headers, ""); got != tt.wantAccept {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantAccept)
+			}
+			if got := Must(tt.newStrat(WithRejectReserved(false))).ClientIP(headers, ""); got != tt.wantAccept {
+				t.Fatalf("WithRejectReserved(false) ClientIP = %q, want %q", got, tt.wantAccept)
+			}
+			if got := Must(tt.newStrat(WithRejectReserved(true))).ClientIP(headers, ""); got != tt.wantReject {
+				t.Fatalf("WithRejectReserved(true) ClientIP = %q, want %q", got, tt.wantReject)
+			}
+		})
+	}
+
+	// A rejected item is invalid, not skipped
+	strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, WithRejectReserved(true))).(RightmostTrustedCountStrategy)
+	if ip, reason := ClientIPDetail(strat, headers, ""); ip != "" || reason != ReasonNoValidIP {
+		t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", ip, reason, "", ReasonNoValidIP)
+	}
+}
+
+func Test_isReserved(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"198.51.100.1", true},
+		{"203.0.113.255", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"224.0.0.1", true},
+		{"239.255.255.250", true},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::ffff:224.0.0.1", true},
+		{"2001:db8::1", true},
+		{"3fff:fff::1", true},
+		{"2001:2::1", true},
+		{"ff02::1", true},
+		{"1.1.1.1", false},
+		{"10.0.0.1", false},
+		{"127.0.0.1", false},
+		{"198.20.0.1", false},
+		{"223.255.255.255", false},
+		{"2600:1f18::99", false},
+		{"fe80::1", false},
+		{"3fff:1000::1", false},
+	}
+	for _, tt := range tests {
+		if got := isReserved(net.ParseIP(tt.ip)); got != tt.want {
+			t.Fatalf("isReserved(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestWithHeaderSyntax(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	headers := http.Header{
+		"X-Cdn-Client-Chain": []string{`5.5.5.5, 6.6.6.6, 10.0.0.1`},
+		"X-Cdn-Forwarded":    []string{`for=5.5.5.5;proto=https, for="6.6.6.6:4711";proto=http, for=10.0.0.1;proto=https`},
+	}
+
+	tests := []struct {
+		name  string
+		strat Strategy
+		want  string
+	}{
+		{"LeftmostNonPrivate XFF", Must(NewLeftmostNonPrivateStrategy("X-CDN-Client-Chain", WithHeaderSyntax(HeaderSyntaxXFF))), "5.5.5.5"},
+		{"RightmostNonPrivate XFF", Must(NewRightmostNonPrivateStrategy("X-CDN-Client-Chain", WithHeaderSyntax(HeaderSyntaxXFF))), "6.6.6.6"},
+		{"Leftmost Forwarded", Must(NewLeftmostStrategy("X-CDN-Forwarded", WithHeaderSyntax(HeaderSyntaxForwarded))), "5.5.5.5"},
+		{"Rightmost Forwarded", Must(NewRightmostStrategy("X-CDN-Forwarded", WithHeaderSyntax(HeaderSyntaxForwarded))), "10.0.0.1"},
+		{"LeftmostTrustedCount XFF", Must(NewLeftmostTrustedCountStrategy("X-CDN-Client-Chain", 2, WithHeaderSyntax(HeaderSyntaxXFF))), "6.6.6.6"},
+		{"RightmostTrustedCount Forwarded", Must(NewRightmostTrustedCountStrategy("X-CDN-Forwarded", 2, WithHeaderSyntax(HeaderSyntaxForwarded))), "6.6.6.6"},
+		{"RightmostTrustedRange XFF", Must(NewRightmostTrustedRangeStrategy("X-CDN-Client-Chain", trustedRanges, WithHeaderSyntax(HeaderSyntaxXFF))), "6.6.6.6"},
+		{"RightmostTrustedRange requireHTTPS", Must(NewRightmostTrustedRangeStrategy("X-CDN-Forwarded", trustedRanges,
+			WithHeaderSyntax(HeaderSyntaxForwarded), WithRequireHTTPS(true))), "6.6.6.6"},
+		{"Known header with matching syntax", Must(NewRightmostStrategy("Forwarded", WithHeaderSyntax(HeaderSyntaxForwarded))), ""},
+		{"XFF syntax on a Forwarded-syntax header", Must(NewRightmostStrategy("X-CDN-Forwarded", WithHeaderSyntax(HeaderSyntaxXFF))), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.strat.(interface{ Validate() error }).Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if got := tt.strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	errTests := []struct {
+		name string
+		fn   func() (Strategy, error)
+	}{
+		{"Unknown header without syntax", func() (Strategy, error) { return NewRightmostStrategy("X-CDN-Client-Chain") }},
+		{"Forwarded with XFF syntax", func() (Strategy, error) {
+			return NewRightmostStrategy("Forwarded", WithHeaderSyntax(HeaderSyntaxXFF))
+		}},
+		{"X-Forwarded-For with Forwarded syntax", func() (Strategy, error) {
+			return NewLeftmostStrategy("X-Forwarded-For", WithHeaderSyntax(HeaderSyntaxForwarded))
+		}},
+		{"Unknown syntax", func() (Strategy, error) {
+			return NewLeftmostNonPrivateStrategy("X-CDN-Client-Chain", WithHeaderSyntax(HeaderSyntax(99)))
+		}},
+		{"Strict with XFF syntax", func() (Strategy, error) {
+			return NewRightmostStrategy("X-CDN-Client-Chain", WithHeaderSyntax(HeaderSyntaxXFF), WithStrictForwarded(true))
+		}},
+		{"RequireHTTPS with XFF syntax", func() (Strategy, error) {
+			return NewRightmostTrustedRangeStrategy("X-CDN-Client-Chain", trustedRanges, WithHeaderSyntax(HeaderSyntaxXFF), WithRequireHTTPS(true))
+		}},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.fn(); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+
+	if _, err := NewRightmostStrategy("X-CDN-Client-Chain"); !errors.Is(err, ErrHeaderNotList) {
+		t.Fatalf("error = %v, want ErrHeaderNotList", err)
+	}
+}
+
+func TestWithUnspecified(t *testing.T) {
+	strict := Must(NewSingleIPHeaderStrategy("X-Real-IP")).(SingleIPHeaderStrategy)
+	lenient := Must(NewSingleIPHeaderStrategy("X-Real-IP", WithUnspecified(true))).(SingleIPHeaderStrategy)
+
+	tests := []struct {
+		value             string
+		wantStrict        string
+		wantLenient       string
+		wantLenientReason Reason
+	}{
+		{"1.1.1.1", "1.1.1.1", "1.1.1.1", ReasonFound},
+		{"0.0.0.0", "", "0.0.0.0", ReasonFound},
+		{"0.0.0.0:1234", "", "0.0.0.0", ReasonFound},
+		{"::", "", "::", ReasonFound},
+		{"[::]:1234", "", "::", ReasonFound},
+		{"::ffff:0.0.0.0", "", "0.0.0.0", ReasonFound},
+		{"nope", "", "", ReasonNoValidIP},
+		{"", "", "", ReasonHeaderMissing},
+	}
+	for _, tt := range tests {
+		headers := http.Header{}
+		if tt.value != "" {
+			headers.Set("X-Real-IP", tt.value)
+		}
+
+		if got, reason := ClientIPDetail(strict, headers, ""); got != tt.wantStrict {
+			t.Fatalf("%q: default ClientIPDetail = (%q, %v), want %q", tt.value, got, reason, tt.wantStrict)
+		}
+		if got, reason := ClientIPDetail(lenient, headers, ""); got != tt.wantLenient || reason != tt.wantLenientReason {
+			t.Fatalf("%q: WithUnspecified ClientIPDetail = (%q, %v), want (%q, %v)", tt.value, got, reason, tt.wantLenient, tt.wantLenientReason)
+		}
+	}
+}
+
+func TestSingleIPHeadersStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = SingleIPHeadersStrategy{}
+
+	tests := []struct {
+		name        string
+		headerNames []string
+		headers     http.Header
+		want        string
+		wantReason  Reason
+		wantErr     bool
+	}{
+		{
+			name:        "First header present",
+			headerNames: []string{"cf-connecting-ip", "True-Client-IP", "Fastly-Client-IP"},
+			headers: http.Header{
+				"Cf-Connecting-Ip": []string{"1.1.1.1"},
+				"True-Client-Ip":   []string{"2.2.2.2"},
+				"Fastly-Client-Ip": []string{"3.3.3.3"},
+			},
+			want:       "1.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:        "Only last header present",
+			headerNames: []string{"cf-connecting-ip", "True-Client-IP", "Fastly-Client-IP"},
+			headers: http.Header{
+				"Fastly-Client-Ip": []string{"[2607:f8b0:4004:83f::18]:3838"},
+			},
+			want:       "2607:f8b0:4004:83f::18",
+			wantReason: ReasonFound,
+		},
+		{
+			name:        "Earlier header invalid",
+			headerNames: []string{"cf-connecting-ip", "True-Client-IP", "Fastly-Client-IP"},
+			headers: http.Header{
+				"Cf-Connecting-Ip": []string{"nope"},
+				"True-Client-Ip":   []string{"0.0.0.0"},
+				"Fastly-Client-Ip": []string{"3.3.3.3"},
+			},
+			want:       "3.3.3.3",
+			wantReason: ReasonFound,
+		},
+		{
+			name:        "Fail: no headers present",
+			headerNames: []string{"cf-connecting-ip", "True-Client-IP"},
+			headers: http.Header{
+				"X-Real-Ip": []string{"1.1.1.1"},
+			},
+			want:       "",
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:        "Fail: all headers invalid",
+			headerNames: []string{"cf-connecting-ip", "True-Client-IP"},
+			headers: http.Header{
+				"Cf-Connecting-Ip": []string{"nope"},
+			},
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:        "Error: no header names",
+			headerNames: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "Error: empty header name",
+			headerNames: []string{"X-Real-IP", ""},
+			wantErr:     true,
+		},
+		{
+			name:        "Error: Forwarded header",
+			headerNames: []string{"X-Real-IP", "forwarded"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewSingleIPHeadersStrategy(tt.headerNames...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSingleIPHeadersStrategy error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got, reason := ClientIPDetail(strat, tt.headers, "")
+			if got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestSingleIPHeaderStrategy_Warnings(t *testing.T) {
+	tests := []struct {
+		headerName string
+		want       []string
+	}{
+		{"X-Real-IP", nil},
+		{"CF-Connecting-IP", nil},
+		{"X-Azure-SocketIP", nil},
+		{"x-client-ip", []string{"X-Client-Ip"}},
+		{"X-Cluster-Client-IP", []string{"X-Cluster-Client-Ip"}},
+		{"True-Client-IP", []string{"True-Client-Ip"}},
+		{"fastly-client-ip", []string{"Fastly-Client-Ip"}},
+		{"X-Azure-ClientIP", []string{"X-Azure-Clientip"}},
+	}
+	for _, tt := range tests {
+		warnings := Must(NewSingleIPHeaderStrategy(tt.headerName)).(SingleIPHeaderStrategy).Warnings()
+		var got []string
+		for _, w := range warnings {
+			if w.Message == "" || !strings.HasPrefix(w.String(), w.Header+": ") {
+				t.Fatalf("%s: bad warning %+v", tt.headerName, w)
+			}
+			got = append(got, w.Header)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: Warnings() headers = %v, want %v", tt.headerName, got, tt.want)
+		}
+	}
+
+	strat := Must(NewSingleIPHeadersStrategy("X-Real-IP", "X-Client-IP", "True-Client-IP")).(SingleIPHeadersStrategy)
+	var got []string
+	for _, w := range strat.Warnings() {
+		got = append(got, w.Header)
+	}
+	if want := []string{"X-Client-Ip", "True-Client-Ip"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("SingleIPHeadersStrategy.Warnings() headers = %v, want %v", got, want)
+	}
+}
+
+func TestNewGoogleFrontendStrategy(t *testing.T) {
+	strat := NewGoogleFrontendStrategy()
+
+	want := Must(NewSingleIPHeaderStrategy("X-ProxyUser-Ip"))
+	if !reflect.DeepEqual(strat, want) {
+		t.Fatalf("NewGoogleFrontendStrategy() = %+v, want %+v", strat, want)
+	}
+
+	headers := http.Header{
+		"X-Proxyuser-Ip":  []string{"2.2.2.2"},
+		"X-Forwarded-For": []string{"3.3.3.3"},
+	}
+	if got := strat.ClientIP(headers, "4.4.4.4:1234"); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+
+	if got := strat.ClientIP(http.Header{"X-Proxyuser-Ip": []string{"nope"}}, ""); got != "" {
+		t.Fatalf("ClientIP = %q, want %q", got, "")
+	}
+
+	// Options are passed through
+	withOpts := NewGoogleFrontendStrategy(WithZone(false), WithRejectReserved(true))
+	if want := Must(NewSingleIPHeaderStrategy("X-ProxyUser-Ip", WithZone(false), WithRejectReserved(true))); !reflect.DeepEqual(withOpts, want) {
+		t.Fatalf("NewGoogleFrontendStrategy(opts) = %+v, want %+v", withOpts, want)
+	}
+}
+
+func TestNewFlyClientIPStrategy(t *testing.T) {
+	strat := NewFlyClientIPStrategy()
+
+	want := Must(NewSingleIPHeaderStrategy("Fly-Client-IP"))
+	if !reflect.DeepEqual(strat, want) {
+		t.Fatalf("NewFlyClientIPStrategy() = %+v, want %+v", strat, want)
+	}
+
+	headers := http.Header{
+		"Fly-Client-Ip":   []string{"2600:1f18::99"},
+		"X-Forwarded-For": []string{"3.3.3.3, 2600:1f18::99"},
+	}
+	if got := strat.ClientIP(headers, "[fdaa::1]:1234"); got != "2600:1f18::99" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2600:1f18::99")
+	}
+
+	if got := strat.ClientIP(http.Header{"Fly-Client-Ip": []string{"nope"}}, ""); got != "" {
+		t.Fatalf("ClientIP = %q, want %q", got, "")
+	}
+
+	// Options are passed through
+	withOpts := NewFlyClientIPStrategy(WithZone(false), WithRejectMultipleHeaders(true))
+	if want := Must(NewSingleIPHeaderStrategy("Fly-Client-IP", WithZone(false), WithRejectMultipleHeaders(true))); !reflect.DeepEqual(withOpts, want) {
+		t.Fatalf("NewFlyClientIPStrategy(opts) = %+v, want %+v", withOpts, want)
+	}
+}
+
+func TestLeftmostNonPrivateStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = LeftmostNonPrivateStrategy{}
+
+	type args struct {
+		headerName string
+		headers    http.Header
+		remoteAddr string
+	}
+	tests := []struct {
+		name    string
+		args    args
 		want    string
 		wantErr bool
 	}{
@@ -698,10 +1239,10 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
 				},
 			},
-			want: "4.4.4.4",
+			want: "2.2.2.2",
 		},
 		{
 			name: "IPv4 with no port",
@@ -713,7 +1254,27 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 					"Forwarded":       []string{`For=5.5.5.5`, `For=6.6.6.6`},
 				},
 			},
-			want: "6.6.6.6",
+			want: "5.5.5.5",
+		},
+		{
+			name: "IPv4-mapped IPv6 private addresses",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`::ffff:192.168.1.1, ::ffff:127.0.0.1, ::ffff:169.254.1.1, ::ffff:0a00:0001, ::ffff:7.7.7.7`},
+				},
+			},
+			want: "7.7.7.7",
+		},
+		{
+			name: "NAT64 with private embedded IPv4",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`64:ff9b::10.0.0.1, 64:ff9b::8.8.8.8`},
+				},
+			},
+			want: "64:ff9b::808:808",
 		},
 		{
 			name: "IPv6 with port",
@@ -721,7 +1282,7 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`[2607:f8b0:4004:83f::18]:3838`},
+					"X-Forwarded-For": []string{`[2607:f8b0:4004:83f::18]:3838, 3.3.3.3`, `4.4.4.4`},
 				},
 			},
 			want: "2607:f8b0:4004:83f::18",
@@ -733,7 +1294,7 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `Host=blah;For="2607:f8b0:4004:83f::18";Proto=https`},
+					"Forwarded":       []string{`Host=blah;For="2607:f8b0:4004:83f::18";Proto=https`},
 				},
 			},
 			want: "2607:f8b0:4004:83f::18",
@@ -745,10 +1306,10 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For="[fe80::1111%zone]:9943";Proto=https`},
+					"Forwarded":       []string{`For=[fe80::1111%zone], Host=blah;For="[2607:f8b0:4004:83f::18%zone]:9943";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
-			want: "2607:f8b0:4004:83f::18%eth0",
+			want: "2607:f8b0:4004:83f::18%zone",
 		},
 		{
 			name: "IPv6 with port and zone, no quotes",
@@ -757,10 +1318,10 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For=[fe80::1111%zone]:9943;Proto=https`},
+					"Forwarded":       []string{`For=[fe80::1111%zone], Host=blah;For=[2607:f8b0:4004:83f::18%zone]:9943;Proto=https`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
-			want: "2607:f8b0:4004:83f::18%eth0",
+			want: "2607:f8b0:4004:83f::18%zone",
 		},
 		{
 			name: "IPv4-mapped IPv6",
@@ -768,7 +1329,7 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, ::ffff:188.0.2.128`},
+					"X-Forwarded-For": []string{`::ffff:188.0.2.128, 3.3.3.3`, `4.4.4.4`},
 					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
@@ -780,7 +1341,7 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4,[::ffff:188.0.2.128]:48483`},
+					"X-Forwarded-For": []string{`[::ffff:188.0.2.128]:48483, 3.3.3.3`, `4.4.4.4`},
 					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
@@ -793,7 +1354,7 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`[::ffff:188.0.2.128]:48483, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="::ffff:bc15:0006"`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
 			want: "188.21.0.6",
@@ -804,35 +1365,35 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, 64:ff9b::188.0.2.128`},
+					"X-Forwarded-For": []string{`64:ff9b::188.0.2.128, 3.3.3.3`, `4.4.4.4`},
 					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
 			want: "64:ff9b::bc00:280",
 		},
 		{
-			name: "XFF: rightmost not desirable",
+			name: "XFF: leftmost not desirable",
 			args: args{
 				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`},
+					"X-Forwarded-For": []string{`::1, nope`, `4.4.4.4, 5.5.5.5`},
 					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
-			want: "5.5.5.5",
+			want: "4.4.4.4",
 		},
 		{
-			name: "Forwarded: rightmost not desirable",
+			name: "Forwarded: leftmost not desirable",
 			args: args{
 				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`::1, nope`, `4.4.4.4, 5.5.5.5`},
-					"Forwarded":       []string{`host=what;for=:48485;proto=https,For=2.2.2.2`, `For="", For="::ffff:192.168.1.1"`},
+					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="2607:f8b0:4004:83f::18"`},
 				},
 			},
-			want: "2.2.2.2",
+			want: "2607:f8b0:4004:83f::18",
 		},
 		{
 			name: "Fail: XFF: none acceptable",
@@ -840,7 +1401,7 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, !?!, ::, 0.0.0.0`},
+					"X-Forwarded-For": []string{`::1, nope, ::, 0.0.0.0`, `192.168.1.1, !?!`},
 					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="fe80::abcd%zone"`},
 				},
 			},
@@ -853,7 +1414,7 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, 2.2.2.2`},
-					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone", For="::", For=0.0.0.0`},
+					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone",For="::",For=0.0.0.0`},
 				},
 			},
 			want: "",
@@ -866,7 +1427,6 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 					"X-Real-Ip": []string{`1.1.1.1`},
 					"Forwarded": []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone"`},
 				},
-				remoteAddr: "9.9.9.9",
 			},
 			want: "",
 		},
@@ -906,9 +1466,9 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			strat, err := NewRightmostNonPrivateStrategy(tt.args.headerName)
+			strat, err := NewLeftmostNonPrivateStrategy(tt.args.headerName)
 			if (err != nil) != tt.wantErr {
-				t.Fatalf("NewRightmostNonPrivateStrategy error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("NewLeftmostNonPrivateStrategy error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
@@ -925,15 +1485,14 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 	}
 }
 
-func TestRightmostTrustedCountStrategy(t *testing.T) {
+func TestRightmostNonPrivateStrategy(t *testing.T) {
 	// Ensure the strategy interface is implemented
-	var _ Strategy = RightmostTrustedCountStrategy{}
+	var _ Strategy = RightmostNonPrivateStrategy{}
 
 	type args struct {
-		headerName   string
-		trustedCount int
-		headers      http.Header
-		remoteAddr   string
+		headerName string
+		headers    http.Header
+		remoteAddr string
 	}
 	tests := []struct {
 		name    string
@@ -941,140 +1500,223 @@ func TestRightmostTrustedCountStrategy(t *testing.T) {
 		want    string
 		wantErr bool
 	}{
-		// TODO: Is it okay not to test every IP type, since the logic is sufficiently similar to RightmostNonPrivateStrategy?
-
 		{
-			name: "Count one",
+			name: "IPv4 with port",
 			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 1,
+				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
+				},
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "IPv4 with no port",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`For=5.5.5.5`, `For=6.6.6.6`},
 				},
 			},
 			want: "6.6.6.6",
 		},
 		{
-			name: "Count five",
+			name: "IPv6 with port",
 			args: args{
-				headerName:   "X-Forwarded-For",
-				trustedCount: 5,
+				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`[2607:f8b0:4004:83f::18]:3838`},
 				},
 			},
-			want: "8.8.8.8",
+			want: "2607:f8b0:4004:83f::18",
 		},
 		{
-			name: "Fail: header too short/count too large",
+			name: "IPv6 with no port",
 			args: args{
-				headerName:   "X-Forwarded-For",
-				trustedCount: 50,
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `Host=blah;For="2607:f8b0:4004:83f::18";Proto=https`},
 				},
 			},
-			want: "",
+			want: "2607:f8b0:4004:83f::18",
 		},
 		{
-			name: "Fail: bad value at count index",
+			name: "IPv6 with port and zone",
 			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 2,
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=nope`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For="[fe80::1111%zone]:9943";Proto=https`},
 				},
 			},
-			want: "",
+			want: "2607:f8b0:4004:83f::18%eth0",
 		},
 		{
-			name: "Fail: zero value at count index",
+			name: "IPv6 with port and zone, no quotes",
 			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 2,
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=0.0.0.0`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For=[fe80::1111%zone]:9943;Proto=https`},
 				},
 			},
-			want: "",
+			want: "2607:f8b0:4004:83f::18%eth0",
 		},
 		{
-			name: "Fail: header missing",
+			name: "IPv4-mapped IPv6",
 			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 1,
+				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, ::ffff:188.0.2.128`},
+					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
-			want: "",
+			want: "188.0.2.128",
 		},
 		{
-			name: "Error: empty header name",
+			name: "IPv4-mapped IPv6 with port",
 			args: args{
-				headerName:   "",
-				trustedCount: 1,
+				headerName: "x-forwarded-for",
 				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4,[::ffff:188.0.2.128]:48483`},
+					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
+				},
 			},
-			wantErr: true,
+			want: "188.0.2.128",
 		},
 		{
-			name: "Error: invalid header",
+			name: "IPv4-mapped IPv6 in IPv6 (hex) form",
 			args: args{
-				headerName:   "X-Real-IP",
-				trustedCount: 1,
+				headerName: "forwarded",
 				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`[::ffff:188.0.2.128]:48483, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="::ffff:bc15:0006"`},
+				},
 			},
-			wantErr: true,
+			want: "188.21.0.6",
 		},
 		{
-			name: "Error: zero trustedCount",
+			name: "NAT64 IPv4-mapped IPv6",
 			args: args{
-				headerName:   "x-forwarded-for",
-				trustedCount: 0,
+				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`, `fe80::382b:141b:fa4a:2a16%28`},
+					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, 64:ff9b::188.0.2.128`},
 					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
-			wantErr: true,
+			want: "64:ff9b::bc00:280",
 		},
 		{
-			name: "Error: negative trustedCount",
+			name: "XFF: rightmost not desirable",
 			args: args{
-				headerName:   "X-Forwarded-For",
-				trustedCount: -999,
+				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "5.5.5.5",
+		},
+		{
+			name: "Forwarded: rightmost not desirable",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`::1, nope`, `4.4.4.4, 5.5.5.5`},
+					"Forwarded":       []string{`host=what;for=:48485;proto=https,For=2.2.2.2`, `For="", For="::ffff:192.168.1.1"`},
+				},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "Fail: XFF: none acceptable",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, !?!, ::, 0.0.0.0`},
+					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="fe80::abcd%zone"`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: Forwarded: none acceptable",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, 2.2.2.2`},
+					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone", For="::", For=0.0.0.0`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: XFF: no header",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"X-Real-Ip": []string{`1.1.1.1`},
+					"Forwarded": []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone"`},
+				},
+				remoteAddr: "9.9.9.9",
+			},
+			want: "",
+		},
+		{
+			name: "Fail: Forwarded: no header",
+			args: args{
+				headerName: "forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`64:ff9b::188.0.2.128, 3.3.3.3`, `4.4.4.4`},
 				},
 			},
+			want: "",
+		},
+		{
+			name: "Error: empty header name",
+			args: args{
+				headerName: "",
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: invalid header",
+			args: args{
+				headerName: "X-Real-IP",
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			strat, err := NewRightmostTrustedCountStrategy(tt.args.headerName, tt.args.trustedCount)
+			strat, err := NewRightmostNonPrivateStrategy(tt.args.headerName)
 			if (err != nil) != tt.wantErr {
-				t.Fatalf("NewRightmostTrustedCountStrategy error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("NewRightmostNonPrivateStrategy error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
@@ -1091,116 +1733,265 @@ func TestRightmostTrustedCountStrategy(t *testing.T) {
 	}
 }
 
-func TestAddressesAndRangesToIPNets(t *testing.T) {
+func TestNonPrivateStrategiesWithRanges(t *testing.T) {
+	cgnatAndInternal, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "5.5.0.0/16")
+
 	tests := []struct {
-		name    string
-		ranges  []string
-		want    []string
-		wantErr bool
+		name          string
+		leftmost      bool
+		privateRanges []net.IPNet
+		headers       http.Header
+		want          string
+		wantErr       bool
 	}{
 		{
-			name:   "Empty input",
-			ranges: []string{},
-			want:   nil,
-		},
-		{
-			name:   "Single IPv4 address",
-			ranges: []string{"1.1.1.1"},
-			want:   []string{"1.1.1.1/32"},
-		},
-		{
-			name:   "Single IPv6 address",
-			ranges: []string{"2607:f8b0:4004:83f::200e"},
-			want:   []string{"2607:f8b0:4004:83f::200e/128"},
-		},
-		{
-			name:   "Single IPv4 range",
-			ranges: []string{"1.1.1.1/16"},
-			want:   []string{"1.1.0.0/16"},
+			name:     "Leftmost default ranges",
+			leftmost: true,
+			headers:  http.Header{"X-Forwarded-For": []string{"100.64.1.1, 5.5.5.5, 10.0.0.1"}},
+			want:     "5.5.5.5",
 		},
 		{
-			name:   "Single IPv6 range",
-			ranges: []string{"2607:f8b0:4004:83f::200e/48"},
-			want:   []string{"2607:f8b0:4004::/48"},
+			name:          "Leftmost custom ranges",
+			leftmost:      true,
+			privateRanges: cgnatAndInternal,
+			headers:       http.Header{"X-Forwarded-For": []string{"100.64.1.1, 5.5.5.5, 10.0.0.1"}},
+			want:          "100.64.1.1",
 		},
 		{
-			name: "Mixed input",
-			ranges: []string{
-				"1.1.1.1", "2607:f8b0:4004:83f::200e",
-				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
-				"1.1.1.1/16", "2607:f8b0:4004:83f::200e/56",
-				"::ffff:188.0.2.128/112", "::ffff:bc15:0006/104",
-				"64:ff9b::188.0.2.128/112",
-			},
-			want: []string{
-				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
-				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
-				"1.1.0.0/16", "2607:f8b0:4004:800::/56",
-				"188.0.0.0/16", "188.0.0.0/8",
-				"64:ff9b::bc00:0/112",
-			},
+			name:    "Rightmost default ranges",
+			headers: http.Header{"X-Forwarded-For": []string{"1.1.1.1, 100.64.1.1, 5.5.5.5, 10.0.0.1"}},
+			want:    "5.5.5.5",
 		},
 		{
-			name:   "No input",
-			ranges: nil,
-			want:   nil,
+			name:          "Rightmost custom ranges",
+			privateRanges: cgnatAndInternal,
+			headers:       http.Header{"X-Forwarded-For": []string{"1.1.1.1, 100.64.1.1, 5.5.5.5, 10.0.0.1"}},
+			want:          "100.64.1.1",
 		},
 		{
-			name:    "Error: garbage CIDR",
-			ranges:  []string{"2607:f8b0:4004:83f::200e/nope"},
-			wantErr: true,
+			name:          "Rightmost empty non-nil ranges",
+			privateRanges: []net.IPNet{},
+			headers:       http.Header{"X-Forwarded-For": []string{"1.1.1.1, 100.64.1.1, 5.5.5.5, 10.0.0.1"}},
+			want:          "10.0.0.1",
 		},
 		{
-			name:    "Error: CIDR with zone",
-			ranges:  []string{"fe80::abcd%nope/64"},
-			wantErr: true,
+			name:          "Fail: Leftmost all custom private",
+			leftmost:      true,
+			privateRanges: cgnatAndInternal,
+			headers:       http.Header{"X-Forwarded-For": []string{"5.5.5.5, 10.0.0.1"}},
+			want:          "",
 		},
 		{
-			name:    "Error: garbage IP",
-			ranges:  []string{"1.1.1.nope"},
-			wantErr: true,
+			name:     "Error: Leftmost bad header",
+			leftmost: true,
+			headers:  http.Header{},
+			wantErr:  true,
 		},
 		{
-			name:    "Error: empty value",
-			ranges:  []string{""},
+			name:    "Error: Rightmost bad header",
+			headers: http.Header{},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := AddressesAndRangesToIPNets(tt.ranges...)
-			if (err != nil) != tt.wantErr {
-				t.Fatalf("AddressesAndRangesToIPNets() error = %v, wantErr %v", err, tt.wantErr)
+			headerName := "X-Forwarded-For"
+			if tt.wantErr {
+				headerName = "X-Real-IP"
+			}
+
+			var strat Strategy
+			var err error
+			if tt.leftmost {
+				strat, err = NewLeftmostNonPrivateStrategyWithRanges(headerName, tt.privateRanges)
+			} else {
+				strat, err = NewRightmostNonPrivateStrategyWithRanges(headerName, tt.privateRanges)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("constructor error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
 				return
 			}
 
+			if got := strat.ClientIP(tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The strategy must have its own copy of the ranges
+	privateRanges := mustAddressesAndRangesToIPNets("10.0.0.0/8")
+	strat := Must(NewRightmostNonPrivateStrategyWithRanges("X-Forwarded-For", privateRanges))
+	privateRanges[0] = mustParseCIDR("2.2.2.0/24")
+	if got := strat.ClientIP(http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 10.0.0.1"}}, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP after modifying ranges = %q, want %q", got, "2.2.2.2")
+	}
+}
+
+func TestLeftmostAndRightmostStrategies(t *testing.T) {
+	tests := []struct {
+		name       string
+		leftmost   bool
+		headerName string
+		headers    http.Header
+		want       string
+		wantReason Reason
+		wantErr    bool
+	}{
+		{
+			name:       "Leftmost private",
+			leftmost:   true,
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{"X-Forwarded-For": []string{"10.1.1.1, 5.5.5.5, 10.0.0.1"}},
+			want:       "10.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Leftmost skips invalid, zero, and unspecified",
+			leftmost:   true,
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{"X-Forwarded-For": []string{"nope, 0.0.0.0, ::, 192.168.1.1, 5.5.5.5"}},
+			want:       "192.168.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Leftmost Forwarded",
+			leftmost:   true,
+			headerName: "Forwarded",
+			headers:    http.Header{"Forwarded": []string{`For="[fd00::1]:4711", for=10.0.0.1`}},
+			want:       "fd00::1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Rightmost private",
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{"X-Forwarded-For": []string{"5.5.5.5, 10.1.1.1", "10.0.0.1"}},
+			want:       "10.0.0.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Rightmost skips invalid",
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{"X-Forwarded-For": []string{"5.5.5.5, 10.1.1.1, nope, ::"}},
+			want:       "10.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Leftmost X-Original-Forwarded-For",
+			leftmost:   true,
+			headerName: "X-Original-Forwarded-For",
+			headers: http.Header{
+				"X-Original-Forwarded-For": []string{"5.5.5.5, 10.0.0.1"},
+				"X-Forwarded-For":          []string{"6.6.6.6, 10.0.0.2"},
+			},
+			want:       "5.5.5.5",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Rightmost X-Original-Forwarded-For",
+			headerName: "X-Original-Forwarded-For",
+			headers: http.Header{
+				"X-Original-Forwarded-For": []string{`5.5.5.5, [2600:1f18::99]:4711`},
+				"Forwarded":                []string{"for=6.6.6.6"},
+			},
+			want:       "2600:1f18::99",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Fail: Leftmost no valid IP",
+			leftmost:   true,
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{"X-Forwarded-For": []string{"nope, 0.0.0.0"}},
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Fail: Rightmost header missing",
+			headerName: "Forwarded",
+			headers:    http.Header{"X-Forwarded-For": []string{"5.5.5.5"}},
+			want:       "",
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Error: Leftmost bad header",
+			leftmost:   true,
+			headerName: "X-Real-IP",
+			wantErr:    true,
+		},
+		{
+			name:       "Error: Rightmost empty header",
+			headerName: "",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var strat Strategy
+			var err error
+			if tt.leftmost {
+				strat, err = NewLeftmostStrategy(tt.headerName)
+			} else {
+				strat, err = NewRightmostStrategy(tt.headerName)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("constructor error = %v, wantErr %v", err, tt.wantErr)
+			}
+
 			if err != nil {
 				// We can't continue
 				return
 			}
 
-			if len(got) != len(tt.want) {
-				t.Fatalf("len mismatch: %d != %d", len(got), len(tt.want))
+			got, reason := ClientIPDetail(strat, tt.headers, "")
+			if got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
 			}
+		})
+	}
+}
 
-			for i := 0; i < len(got); i++ {
-				if got[i].String() != tt.want[i] {
-					t.Fatalf("got does not equal want; %d: %q != %q", i, got[i].String(), tt.want[i])
-				}
+func TestNewLeftmostPublicOrPrivateStrategy(t *testing.T) {
+	strat, err := NewLeftmostPublicOrPrivateStrategy("X-Forwarded-For", WithZone(false))
+	if err != nil {
+		t.Fatalf("NewLeftmostPublicOrPrivateStrategy error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		xff        string
+		want       string
+		wantReason Reason
+	}{
+		{"Public preferred", "10.0.0.1, 3.3.3.3, 4.4.4.4", "3.3.3.3", ReasonFound},
+		{"Leftmost private fallback", "nope, [fe80::1%eth0]:1234, 10.0.0.1", "fe80::1", ReasonFound},
+		{"Fail: no valid IP", "nope, ::", "", ReasonNoValidIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+			if got, reason := ClientIPDetail(strat, headers, ""); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
 			}
 		})
 	}
+
+	if _, err := NewLeftmostPublicOrPrivateStrategy("X-Real-IP"); err == nil {
+		t.Fatalf("NewLeftmostPublicOrPrivateStrategy did not return error for non-list header")
+	}
 }
 
-func TestRightmostTrustedRangeStrategy(t *testing.T) {
+func TestRightmostTrustedCountStrategy(t *testing.T) {
 	// Ensure the strategy interface is implemented
-	var _ Strategy = RightmostTrustedRangeStrategy{}
+	var _ Strategy = RightmostTrustedCountStrategy{}
 
 	type args struct {
-		headerName    string
-		headers       http.Header
-		remoteAddr    string
-		trustedRanges []string
+		headerName   string
+		trustedCount int
+		headers      http.Header
+		remoteAddr   string
 	}
 	tests := []struct {
 		name    string
@@ -1208,263 +1999,4215 @@ func TestRightmostTrustedRangeStrategy(t *testing.T) {
 		want    string
 		wantErr bool
 	}{
+		// TODO: Is it okay not to test every IP type, since the logic is sufficiently similar to RightmostNonPrivateStrategy?
+
 		{
-			name: "No ranges",
+			name: "Count one",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName:   "Forwarded",
+				trustedCount: 1,
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: nil,
 			},
-			want: "4.4.4.4",
+			want: "6.6.6.6",
 		},
 		{
-			name: "One range",
+			name: "Count five",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName:   "X-Forwarded-For",
+				trustedCount: 5,
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: []string{`4.4.4.0/24`},
 			},
-			want: "3.3.3.3",
+			want: "8.8.8.8",
 		},
 		{
-			name: "One IP",
+			name: "Empty items skipped: leading comma",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName:   "X-Forwarded-For",
+				trustedCount: 2,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`, 1.1.1.1, 2.2.2.2`},
 				},
-				trustedRanges: []string{`4.4.4.4`},
 			},
-			want: "3.3.3.3",
+			want: "1.1.1.1",
 		},
 		{
-			name: "Many kinds of ranges",
+			name: "Empty items skipped: trailing comma",
 			args: args{
-				headerName: "Forwarded",
+				headerName:   "X-Forwarded-For",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, , 2.2.2.2,`},
+				},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "Empty items skipped: doubled commas",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 2,
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, , 2.2.2.2,,3.3.3.3`},
+				},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "Empty items skipped: whitespace-only items and empty header",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 3,
+				headers: http.Header{
+					"Forwarded": []string{`For=1.1.1.1, 	 ,For=2.2.2.2`, ``, `For=3.3.3.3,  `},
+				},
+			},
+			want: "1.1.1.1",
+		},
+		{
+			name: "Fail: count too large after skipping empty items",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 3,
+				headers: http.Header{
+					"X-Forwarded-For": []string{`,1.1.1.1,,2.2.2.2,`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: header too short/count too large",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 50,
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded": []string{
-						`For=99.99.99.99, For=4.4.4.8, For="[2607:f8b0:4004:83f::200e]:4747"`,
-						`For=2.2.2.2:8883, For=64:ff9b::188.0.2.200, For=3.3.5.5, For=2001:db7::abcd`,
-					},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: []string{
-					`2.2.2.2/32`, `2607:f8b0:4004:83f::200e/128`,
-					`3.3.0.0/16`, `2001:db7::/64`,
-					`::ffff:4.4.4.4/124`, `64:ff9b::188.0.2.128/112`,
+			},
+			want: "",
+		},
+		{
+			name: "Fail: bad value at count index",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 2,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=nope`, `host=what;for=6.6.6.6;proto=https`},
 				},
 			},
-			want: "99.99.99.99",
+			want: "",
 		},
 		{
-			name: "Cloudflare ranges",
+			name: "Fail: zero value at count index",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName:   "Forwarded",
+				trustedCount: 2,
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`, `2400:cb00::1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=0.0.0.0`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: ranges.Cloudflare,
 			},
-			want: "4.4.4.4",
+			want: "",
 		},
 		{
-			name: "Fail: no non-trusted IP",
+			name: "Fail: header missing",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName:   "Forwarded",
+				trustedCount: 1,
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
 				},
-				trustedRanges: []string{`2.2.2.0/24`},
 			},
 			want: "",
 		},
 		{
-			name: "Fail: rightmost non-trusted IP invalid",
-			args: args{
-				headerName: "X-Forwarded-For",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`nope, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
-				},
-				trustedRanges: []string{`2.2.2.0/24`},
-			},
-			want: "",
+			name: "Error: empty header name",
+			args: args{
+				headerName:   "",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: invalid header",
+			args: args{
+				headerName:   "X-Real-IP",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: zero trustedCount",
+			args: args{
+				headerName:   "x-forwarded-for",
+				trustedCount: 0,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`, `fe80::382b:141b:fa4a:2a16%28`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: negative trustedCount",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: -999,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewRightmostTrustedCountStrategy(tt.args.headerName, tt.args.trustedCount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRightmostTrustedCountStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewHerokuStrategy(t *testing.T) {
+	strat := NewHerokuStrategy()
+
+	want := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))
+	if !reflect.DeepEqual(strat, want) {
+		t.Fatalf("NewHerokuStrategy() = %+v, want %+v", strat, want)
+	}
+	if err := strat.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	// The client may have sent its own X-Forwarded-For, which the router appends to
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2"}}
+	if got := strat.ClientIP(headers, "10.1.1.1:1234"); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+}
+
+func TestNewGCPExternalLBStrategy(t *testing.T) {
+	strat := NewGCPExternalLBStrategy()
+
+	want := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2))
+	if !reflect.DeepEqual(strat, want) {
+		t.Fatalf("NewGCPExternalLBStrategy() = %+v, want %+v", strat, want)
+	}
+	if err := strat.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	// The client may have sent its own X-Forwarded-For; the load balancer appends the
+	// client IP and its own IP
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 35.191.0.1"}}
+	if got := strat.ClientIP(headers, "35.191.0.1:1234"); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+}
+
+func TestLeftmostTrustedCountStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = LeftmostTrustedCountStrategy{}
+
+	type args struct {
+		headerName   string
+		trustedCount int
+		headers      http.Header
+		remoteAddr   string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Count one",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "188.21.0.6",
+		},
+		{
+			name: "Count four",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 4,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "fe80::382b:141b:fa4a:2a16%28",
+		},
+		{
+			name: "Fail: bad value at count index",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 5,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Count six",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 6,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "8.8.8.8",
+		},
+		{
+			name: "Count equal to list length",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 3,
+				headers: http.Header{
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `6.6.6.6`},
+				},
+			},
+			want: "6.6.6.6",
+		},
+		{
+			name: "Fail: header too short/count too large",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 4,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `6.6.6.6`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: zero value at count index",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 2,
+				headers: http.Header{
+					"Forwarded": []string{`For="::ffff:bc15:0006"`, `For=0.0.0.0`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: header missing",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Error: empty header name",
+			args: args{
+				headerName:   "",
+				trustedCount: 1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: invalid header",
+			args: args{
+				headerName:   "X-Real-IP",
+				trustedCount: 1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: zero trustedCount",
+			args: args{
+				headerName:   "x-forwarded-for",
+				trustedCount: 0,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: negative trustedCount",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: -999,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewLeftmostTrustedCountStrategy(tt.args.headerName, tt.args.trustedCount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLeftmostTrustedCountStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressesAndRangesToIPNets(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "Empty input",
+			ranges: []string{},
+			want:   nil,
+		},
+		{
+			name:   "Single IPv4 address",
+			ranges: []string{"1.1.1.1"},
+			want:   []string{"1.1.1.1/32"},
+		},
+		{
+			name:   "Single IPv6 address",
+			ranges: []string{"2607:f8b0:4004:83f::200e"},
+			want:   []string{"2607:f8b0:4004:83f::200e/128"},
+		},
+		{
+			name:   "Single IPv4 range",
+			ranges: []string{"1.1.1.1/16"},
+			want:   []string{"1.1.0.0/16"},
+		},
+		{
+			name:   "Single IPv6 range",
+			ranges: []string{"2607:f8b0:4004:83f::200e/48"},
+			want:   []string{"2607:f8b0:4004::/48"},
+		},
+		{
+			name: "Mixed input",
+			ranges: []string{
+				"1.1.1.1", "2607:f8b0:4004:83f::200e",
+				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
+				"1.1.1.1/16", "2607:f8b0:4004:83f::200e/56",
+				"::ffff:188.0.2.128/112", "::ffff:bc15:0006/104",
+				"64:ff9b::188.0.2.128/112",
+			},
+			want: []string{
+				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
+				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
+				"1.1.0.0/16", "2607:f8b0:4004:800::/56",
+				"188.0.0.0/16", "188.0.0.0/8",
+				"64:ff9b::bc00:0/112",
+			},
+		},
+		{
+			name:   "IPv4-mapped collapsed to IPv4",
+			ranges: []string{"::ffff:188.0.2.128/112", "::ffff:188.0.2.128"},
+			want:   []string{"188.0.0.0/16", "188.0.2.128/32"},
+		},
+		{
+			name:   "No input",
+			ranges: nil,
+			want:   nil,
+		},
+		{
+			name:    "Error: garbage CIDR",
+			ranges:  []string{"2607:f8b0:4004:83f::200e/nope"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: CIDR with zone",
+			ranges:  []string{"fe80::abcd%nope/64"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: garbage IP",
+			ranges:  []string{"1.1.1.nope"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: empty value",
+			ranges:  []string{""},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddressesAndRangesToIPNets(tt.ranges...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddressesAndRangesToIPNets() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("len mismatch: %d != %d", len(got), len(tt.want))
+			}
+
+			for i := 0; i < len(got); i++ {
+				if got[i].String() != tt.want[i] {
+					t.Fatalf("got does not equal want; %d: %q != %q", i, got[i].String(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAddressesAndRangesToPrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "Empty input",
+			ranges: []string{},
+			want:   nil,
+		},
+		{
+			name: "Mixed input",
+			ranges: []string{
+				"1.1.1.1", "2607:f8b0:4004:83f::200e",
+				"1.1.1.1/16", "2607:f8b0:4004:83f::200e/56",
+				"64:ff9b::188.0.2.128/112",
+			},
+			want: []string{
+				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
+				"1.1.0.0/16", "2607:f8b0:4004:800::/56",
+				"64:ff9b::bc00:0/112",
+			},
+		},
+		{
+			name:   "IPv4-mapped kept in IPv6 form",
+			ranges: []string{"::ffff:188.0.2.128/112", "::ffff:bc15:0006/104", "::ffff:188.0.2.128"},
+			want:   []string{"::ffff:188.0.0.0/112", "::ffff:188.0.0.0/104", "::ffff:188.0.2.128/128"},
+		},
+		{
+			name:    "Error: garbage CIDR",
+			ranges:  []string{"2607:f8b0:4004:83f::200e/nope"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: CIDR with zone",
+			ranges:  []string{"fe80::abcd%nope/64"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: address with zone",
+			ranges:  []string{"fe80::abcd%nope"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: garbage IP",
+			ranges:  []string{"1.1.1.nope"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddressesAndRangesToPrefixes(tt.ranges...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddressesAndRangesToPrefixes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var gotStrs []string
+			for _, p := range got {
+				gotStrs = append(gotStrs, p.String())
+			}
+			if !reflect.DeepEqual(gotStrs, tt.want) {
+				t.Fatalf("AddressesAndRangesToPrefixes() = %v, want %v", gotStrs, tt.want)
+			}
+		})
+	}
+
+	// The two functions differ in whether a mapped range contains a plain IPv4 address
+	ipNets, _ := AddressesAndRangesToIPNets("::ffff:188.0.2.128/112")
+	prefixes, _ := AddressesAndRangesToPrefixes("::ffff:188.0.2.128/112")
+	if !IPInRanges(net.ParseIP("188.0.2.1"), ipNets) {
+		t.Fatalf("AddressesAndRangesToIPNets() range does not contain IPv4 address")
+	}
+	if prefixes[0].Contains(netip.MustParseAddr("188.0.2.1")) {
+		t.Fatalf("AddressesAndRangesToPrefixes() range contains IPv4 address")
+	}
+}
+
+func TestPrefixesToIPNets(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []netip.Prefix
+		want     []string
+	}{
+		{
+			name:     "Empty",
+			prefixes: nil,
+			want:     []string{},
+		},
+		{
+			name: "IPv4 and IPv6",
+			prefixes: []netip.Prefix{
+				netip.MustParsePrefix("10.1.2.3/8"),
+				netip.MustParsePrefix("188.0.2.128/32"),
+				netip.MustParsePrefix("2001:db8::1/32"),
+			},
+			want: []string{"10.0.0.0/8", "188.0.2.128/32", "2001:db8::/32"},
+		},
+		{
+			name: "Invalid omitted",
+			prefixes: []netip.Prefix{
+				{},
+				netip.MustParsePrefix("10.0.0.0/8"),
+			},
+			want: []string{"10.0.0.0/8"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, ipNet := range PrefixesToIPNets(tt.prefixes...) {
+				got = append(got, ipNet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("PrefixesToIPNets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// An IPv4-mapped prefix keeps its IPv6 form, although net.IPNet treats it as IPv4
+	ipNets := PrefixesToIPNets(netip.MustParsePrefix("::ffff:188.0.2.128/112"))
+	if len(ipNets[0].IP) != net.IPv6len || len(ipNets[0].Mask) != net.IPv6len {
+		t.Fatalf("PrefixesToIPNets() = %#v, want IPv6 form", ipNets[0])
+	}
+	if !ipNets[0].Contains(net.ParseIP("188.0.99.99")) {
+		t.Fatalf("PrefixesToIPNets() result does not contain IPv4 address")
+	}
+}
+
+func TestIPNetsToPrefixes(t *testing.T) {
+	tests := []struct {
+		name   string
+		ipNets []net.IPNet
+		want   []string
+	}{
+		{
+			name:   "Empty",
+			ipNets: nil,
+			want:   []string{},
+		},
+		{
+			name: "IPv4 and IPv6",
+			ipNets: []net.IPNet{
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+				{IP: net.ParseIP("188.0.2.128"), Mask: net.CIDRMask(32, 32)},
+				{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)},
+			},
+			want: []string{"10.0.0.0/8", "188.0.2.128/32", "2001:db8::/32"},
+		},
+		{
+			name: "IPv4-mapped not collapsed",
+			ipNets: []net.IPNet{
+				{IP: net.ParseIP("::ffff:188.0.2.128"), Mask: net.CIDRMask(112, 128)},
+			},
+			want: []string{"::ffff:188.0.0.0/112"},
+		},
+		{
+			name: "Invalid omitted",
+			ipNets: []net.IPNet{
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.IPv4Mask(255, 0, 255, 0)},
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(64, 128)},
+				{IP: net.IP{1, 2, 3}, Mask: net.CIDRMask(8, 32)},
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+			},
+			want: []string{"10.0.0.0/8"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, p := range IPNetsToPrefixes(tt.ipNets) {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("IPNetsToPrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Round trip through AddressesAndRangesToIPNets keeps the IPv4-mapped form
+	ipNets, _ := AddressesAndRangesToIPNets("::ffff:188.0.2.128/112", "10.0.0.1", "2001:db8::/32")
+	want := mustParsePrefixes("::ffff:188.0.0.0/112", "10.0.0.1/32", "2001:db8::/32")
+	if got := IPNetsToPrefixes(ipNets); !reflect.DeepEqual(got, want) {
+		t.Fatalf("IPNetsToPrefixes() = %v, want %v", got, want)
+	}
+	if got := IPNetsToPrefixes(PrefixesToIPNets(want...)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("IPNetsToPrefixes(PrefixesToIPNets()) = %v, want %v", got, want)
+	}
+}
+
+func TestMergeIPNets(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []string
+		want   []string
+	}{
+		{
+			name:   "Empty",
+			ranges: nil,
+			want:   []string{},
+		},
+		{
+			name:   "Nothing to merge",
+			ranges: []string{"2001:db8::/32", "10.0.0.0/8", "192.168.0.0/16"},
+			want:   []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"},
+		},
+		{
+			name:   "Duplicates",
+			ranges: []string{"10.0.0.0/8", "10.0.0.0/8", "2001:db8::1", "2001:db8::1"},
+			want:   []string{"10.0.0.0/8", "2001:db8::1/128"},
+		},
+		{
+			name:   "Containment",
+			ranges: []string{"10.1.0.0/16", "10.0.0.0/8", "10.2.3.4", "2001:db8:cafe::/48", "2001:db8::/32"},
+			want:   []string{"10.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			name:   "Adjacent siblings",
+			ranges: []string{"10.128.0.0/9", "10.0.0.0/9", "2001:db8:8000::/33", "2001:db8::/33"},
+			want:   []string{"10.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			name:   "Repeated aggregation",
+			ranges: []string{"192.168.1.0/26", "192.168.1.64/26", "192.168.1.128/26", "192.168.1.192/26"},
+			want:   []string{"192.168.1.0/24"},
+		},
+		{
+			name:   "Aggregation with containment",
+			ranges: []string{"192.168.1.0/25", "192.168.1.128/26", "192.168.1.192/26", "192.168.1.200"},
+			want:   []string{"192.168.1.0/24"},
+		},
+		{
+			name:   "Adjacent but not siblings",
+			ranges: []string{"10.0.1.0/24", "10.0.2.0/24"},
+			want:   []string{"10.0.1.0/24", "10.0.2.0/24"},
+		},
+		{
+			name:   "Different sizes",
+			ranges: []string{"10.0.0.0/24", "10.0.1.0/25"},
+			want:   []string{"10.0.0.0/24", "10.0.1.0/25"},
+		},
+		{
+			name:   "Single addresses",
+			ranges: []string{"1.1.1.1", "1.1.1.0", "1.1.1.2", "1.1.1.3"},
+			want:   []string{"1.1.1.0/30"},
+		},
+		{
+			name:   "Whole address space",
+			ranges: []string{"128.0.0.0/1", "0.0.0.0/1"},
+			want:   []string{"0.0.0.0/0"},
+		},
+		{
+			name:   "IPv4-mapped",
+			ranges: []string{"::ffff:10.0.0.0/104", "10.0.0.0/8"},
+			want:   []string{"10.0.0.0/8"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := AddressesAndRangesToIPNets(tt.ranges...)
+			if err != nil {
+				t.Fatalf("AddressesAndRangesToIPNets() error = %v", err)
+			}
+
+			got := []string{}
+			for _, ipNet := range MergeIPNets(ranges) {
+				got = append(got, ipNet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("MergeIPNets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIPNetsFromReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		want        []string
+		wantErr     bool
+		wantErrLine string
+	}{
+		{
+			name:  "Empty input",
+			input: "",
+			want:  []string{},
+		},
+		{
+			name: "Ranges, addresses, comments, and blank lines",
+			input: "# Trusted proxies\n" +
+				"\n" +
+				"  10.1.0.0/16  \n" +
+				"\t192.0.2.7 # bastion\n" +
+				"2001:db8::/32\r\n" +
+				"   # indented comment\n" +
+				"::1",
+			want: []string{"10.1.0.0/16", "192.0.2.7/32", "2001:db8::/32", "::1/128"},
+		},
+		{
+			name:        "Error: bad entry",
+			input:       "# comment\n10.0.0.0/8\n\nnope\n",
+			wantErr:     true,
+			wantErrLine: "line 4:",
+		},
+		{
+			name:        "Error: zone",
+			input:       "fe80::1%eth0",
+			wantErr:     true,
+			wantErrLine: "line 1:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIPNetsFromReader(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIPNetsFromReader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				if !strings.HasPrefix(err.Error(), tt.wantErrLine) {
+					t.Fatalf("error %q does not start with %q", err, tt.wantErrLine)
+				}
+				return
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("len mismatch: %d != %d", len(got), len(tt.want))
+			}
+
+			for i := 0; i < len(got); i++ {
+				if got[i].String() != tt.want[i] {
+					t.Fatalf("got does not equal want; %d: %q != %q", i, got[i].String(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseTorExitList(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		want        []string
+		wantErr     bool
+		wantErrLine string
+	}{
+		{
+			name:  "Empty input",
+			input: "",
+			want:  []string{},
+		},
+		{
+			name:  "Bulk exit list",
+			input: "192.0.2.1\n198.51.100.7\r\n2001:db8::1\n\n192.0.2.1\n",
+			want:  []string{"192.0.2.1/32", "198.51.100.7/32", "2001:db8::1/128"},
+		},
+		{
+			name: "Exit addresses",
+			input: "# Tor exit list\n" +
+				"ExitNode 0011BD2485AD45D984EC4159C88FC066E5E3300E\n" +
+				"Published 2024-01-01 09:10:11\n" +
+				"LastStatus 2024-01-01 10:00:00\n" +
+				"ExitAddress 192.0.2.1 2024-01-01 10:07:31\n" +
+				"ExitNode 0091174DE56EAD1E6F8A2B1F3C6E1F6A7E4A6C1B\n" +
+				"Published 2024-01-01 08:00:00\n" +
+				"LastStatus 2024-01-01 09:00:00\n" +
+				"ExitAddress 2001:db8::1 2024-01-01 09:30:00\n" +
+				"ExitAddress 192.0.2.1 2024-01-01 09:30:00\n",
+			want: []string{"192.0.2.1/32", "2001:db8::1/128"},
+		},
+		{
+			name:        "Error: bad address",
+			input:       "192.0.2.1\nnope\n",
+			wantErr:     true,
+			wantErrLine: "line 2:",
+		},
+		{
+			name:        "Error: range",
+			input:       "192.0.2.0/24",
+			wantErr:     true,
+			wantErrLine: "line 1:",
+		},
+		{
+			name:        "Error: missing ExitAddress address",
+			input:       "ExitNode 0011BD2485AD45D984EC4159C88FC066E5E3300E\nExitAddress\n",
+			wantErr:     true,
+			wantErrLine: "line 2:",
+		},
+		{
+			name:        "Error: bad ExitAddress address",
+			input:       "ExitAddress 192.0.2 2024-01-01 10:07:31\n",
+			wantErr:     true,
+			wantErrLine: "line 1:",
+		},
+		{
+			name:        "Error: unexpected line",
+			input:       "192.0.2.1 192.0.2.2\n",
+			wantErr:     true,
+			wantErrLine: "line 1:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTorExitList(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTorExitList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				if !strings.HasPrefix(err.Error(), tt.wantErrLine) {
+					t.Fatalf("error %q does not start with %q", err, tt.wantErrLine)
+				}
+				return
+			}
+
+			gotStrs := []string{}
+			for _, ipNet := range got {
+				gotStrs = append(gotStrs, ipNet.String())
+			}
+			if !reflect.DeepEqual(gotStrs, tt.want) {
+				t.Fatalf("ParseTorExitList() = %v, want %v", gotStrs, tt.want)
+			}
+		})
+	}
+
+	// The result can be used to block Tor exits
+	torRanges, _ := ParseTorExitList(strings.NewReader("192.0.2.1\n"))
+	strat, err := NewBlocklistStrategy(RemoteAddrStrategy{}, torRanges)
+	if err != nil {
+		t.Fatalf("NewBlocklistStrategy() error = %v", err)
+	}
+	if ip, reason := ClientIPDetail(strat, nil, "192.0.2.1:1234"); ip != "" || reason != ReasonBlocked {
+		t.Fatalf("ClientIPDetail = (%q, %v), want blocked", ip, reason)
+	}
+}
+
+func TestRightmostTrustedRangeStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = RightmostTrustedRangeStrategy{}
+
+	type args struct {
+		headerName    string
+		headers       http.Header
+		remoteAddr    string
+		trustedRanges []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "No ranges",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: nil,
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "One range",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: []string{`4.4.4.0/24`},
+			},
+			want: "3.3.3.3",
+		},
+		{
+			name: "One IP",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: []string{`4.4.4.4`},
+			},
+			want: "3.3.3.3",
+		},
+		{
+			name: "Many kinds of ranges",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded": []string{
+						`For=99.99.99.99, For=4.4.4.8, For="[2607:f8b0:4004:83f::200e]:4747"`,
+						`For=2.2.2.2:8883, For=64:ff9b::188.0.2.200, For=3.3.5.5, For=2001:db7::abcd`,
+					},
+				},
+				trustedRanges: []string{
+					`2.2.2.2/32`, `2607:f8b0:4004:83f::200e/128`,
+					`3.3.0.0/16`, `2001:db7::/64`,
+					`::ffff:4.4.4.4/124`, `64:ff9b::188.0.2.128/112`,
+				},
+			},
+			want: "99.99.99.99",
+		},
+		{
+			name: "Cloudflare ranges",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`, `2400:cb00::1`},
+				},
+				trustedRanges: ranges.Cloudflare,
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "CloudFront ranges",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`2.2.2.2, 4.4.4.4, 13.32.0.1`},
+				},
+				trustedRanges: ranges.AWSCloudFrontIPRanges,
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "Fastly ranges",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"Forwarded": []string{`For=2.2.2.2, For=4.4.4.4, For=151.101.1.1, For="[2a04:4e42::1]"`},
+				},
+				trustedRanges: ranges.FastlyIPRanges,
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "GCP load balancer ranges",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`2.2.2.2, 4.4.4.4, 35.191.3.4, 130.211.1.1`},
+				},
+				trustedRanges: ranges.GCPLoadBalancerIPRanges,
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "Fail: no non-trusted IP",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+				},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: rightmost non-trusted IP invalid",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`nope, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+				},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: rightmost non-trusted IP unspecified",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`::, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+				},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: no values in header",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{}},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Error: empty header nanme",
+			args: args{
+				headerName: "",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: nil,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Zoned link-local candidates in trusted range",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`2600:1f18::99, fe80::1%eth0, [fe80::2%3]:4711`},
+				},
+				trustedRanges: []string{`fe80::/10`},
+			},
+			want: "2600:1f18::99",
+		},
+		{
+			name: "Zoned link-local candidates in trusted range, Forwarded",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"Forwarded": []string{`For="[2600:1f18::99]:1234", For="[fe80::1%eth0]:4711"`},
+				},
+				trustedRanges: []string{`fe80::/10`},
+			},
+			want: "2600:1f18::99",
+		},
+		{
+			name: "Zoned link-local candidate not in trusted range",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`2600:1f18::99, fe80::1%eth0, [fe80::2%3]:4711`},
+				},
+				trustedRanges: []string{`fe80::2`},
+			},
+			want: "fe80::1%eth0",
+		},
+		{
+			name: "Error: bad header nanme",
+			args: args{
+				headerName: "Not-XFF-Or-Forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: nil,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := AddressesAndRangesToIPNets(tt.args.trustedRanges...)
+			if err != nil {
+				// We're not testing AddressesAndRangesToIPNets here
+				t.Fatalf("AddressesAndRangesToIPNets failed")
+			}
+
+			strat, err := NewRightmostTrustedRangeStrategy(tt.args.headerName, ranges)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRightmostTrustedRangeStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+
+			// The same ranges in a RangeSet must give the same result
+			set, _ := NewRangeSet(IPNetsToPrefixes(ranges)...)
+			setStrat := Must(NewRightmostTrustedRangeStrategyFromSet(tt.args.headerName, set))
+			if got := setStrat.ClientIP(tt.args.headers, tt.args.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP from set = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_recursive(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+
+	recursive := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges))
+	nonRecursive := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithRecursive(false)))
+
+	tests := []struct {
+		name             string
+		xff              []string
+		wantRecursive    string
+		wantNonRecursive string
+	}{
+		{
+			name:             "Single untrusted",
+			xff:              []string{`1.1.1.1`},
+			wantRecursive:    "1.1.1.1",
+			wantNonRecursive: "1.1.1.1",
+		},
+		{
+			name:             "Multiple trusted proxies",
+			xff:              []string{`1.1.1.1, 2.2.2.2, 10.0.0.2`, `10.0.0.1`},
+			wantRecursive:    "2.2.2.2",
+			wantNonRecursive: "10.0.0.1",
+		},
+		{
+			name:             "All trusted",
+			xff:              []string{`10.0.0.3, 10.0.0.2`},
+			wantRecursive:    "",
+			wantNonRecursive: "10.0.0.2",
+		},
+		{
+			name:             "Rightmost invalid",
+			xff:              []string{`1.1.1.1, nope`},
+			wantRecursive:    "",
+			wantNonRecursive: "",
+		},
+		{
+			name:             "Header missing",
+			xff:              nil,
+			wantRecursive:    "",
+			wantNonRecursive: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.xff != nil {
+				headers["X-Forwarded-For"] = tt.xff
+			}
+
+			if got := recursive.ClientIP(headers, ""); got != tt.wantRecursive {
+				t.Fatalf("recursive ClientIP = %q, want %q", got, tt.wantRecursive)
+			}
+			if got := nonRecursive.ClientIP(headers, ""); got != tt.wantNonRecursive {
+				t.Fatalf("non-recursive ClientIP = %q, want %q", got, tt.wantNonRecursive)
+			}
+		})
+	}
+
+	// Like nginx's real_ip_recursive off, combined with a trusted peer check
+	nginxLike := Must(NewTrustedPeerStrategy(nonRecursive, trustedRanges))
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`}}
+	if got := nginxLike.ClientIP(headers, "10.0.0.1:1234"); got != "2.2.2.2" {
+		t.Fatalf("nginx-like ClientIP from trusted peer = %q, want %q", got, "2.2.2.2")
+	}
+	if got := nginxLike.ClientIP(headers, "3.3.3.3:1234"); got != "3.3.3.3" {
+		t.Fatalf("nginx-like ClientIP from untrusted peer = %q, want %q", got, "3.3.3.3")
+	}
+
+	if got, want := nonRecursive.(RightmostTrustedRangeStrategy).String(), "{headerName:X-Forwarded-For trustedRanges:[10.0.0.0/8] recursive:false}"; got != want {
+		t.Fatalf("String = %q, want %q", got, want)
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_requireHTTPS(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2.2.2.2")
+
+	tests := []struct {
+		name         string
+		headerName   string
+		requireHTTPS bool
+		headers      http.Header
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "All trusted hops are HTTPS",
+			headerName:   "Forwarded",
+			requireHTTPS: true,
+			headers: http.Header{"Forwarded": []string{
+				`for=1.1.1.1;proto=https, for=2.2.2.2;proto=HTTPS, for=10.0.0.1;proto="https"`,
+			}},
+			want: "1.1.1.1",
+		},
+		{
+			name:         "Trusted hop forwarded over HTTP",
+			headerName:   "Forwarded",
+			requireHTTPS: true,
+			headers: http.Header{"Forwarded": []string{
+				`for=1.1.1.1;proto=https, for=2.2.2.2;proto=http, for=10.0.0.1;proto=https`,
+			}},
+			want: "2.2.2.2",
+		},
+		{
+			name:         "Trusted hop with no proto",
+			headerName:   "Forwarded",
+			requireHTTPS: true,
+			headers: http.Header{"Forwarded": []string{
+				`for=1.1.1.1;proto=https`, `for=2.2.2.2;proto=https, for=10.0.0.1`,
+			}},
+			want: "10.0.0.1",
+		},
+		{
+			name:         "Not required",
+			headerName:   "Forwarded",
+			requireHTTPS: false,
+			headers: http.Header{"Forwarded": []string{
+				`for=1.1.1.1;proto=https, for=2.2.2.2;proto=http, for=10.0.0.1`,
+			}},
+			want: "1.1.1.1",
+		},
+		{
+			name:         "Fail: all trusted and HTTPS",
+			headerName:   "Forwarded",
+			requireHTTPS: true,
+			headers: http.Header{"Forwarded": []string{
+				`for=2.2.2.2;proto=https, for=10.0.0.1;proto=https`,
+			}},
+			want: "",
+		},
+		{
+			name:         "Error: X-Forwarded-For",
+			headerName:   "X-Forwarded-For",
+			requireHTTPS: true,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewRightmostTrustedRangeStrategy(tt.headerName, trustedRanges, WithRequireHTTPS(tt.requireHTTPS))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRightmostTrustedRangeStrategy error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if got := strat.ClientIP(tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_contiguousTrust(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2.2.2.2")
+
+	tests := []struct {
+		name        string
+		xff         string
+		want        string
+		wantReason  Reason
+		wantDefault string
+	}{
+		{
+			name:        "Contiguous",
+			xff:         "1.1.1.1, 3.3.3.3, 2.2.2.2, 10.0.0.1",
+			want:        "3.3.3.3",
+			wantReason:  ReasonFound,
+			wantDefault: "3.3.3.3",
+		},
+		{
+			name:        "Trusted IP left of the client",
+			xff:         "10.0.0.5, 3.3.3.3, 2.2.2.2, 10.0.0.1",
+			want:        "",
+			wantReason:  ReasonTrustGap,
+			wantDefault: "3.3.3.3",
+		},
+		{
+			name:        "Untrusted hop between trusted hops",
+			xff:         "3.3.3.3, 2.2.2.2, 4.4.4.4, 10.0.0.1",
+			want:        "",
+			wantReason:  ReasonTrustGap,
+			wantDefault: "4.4.4.4",
+		},
+		{
+			name:        "Invalid items left of the client are ignored",
+			xff:         "nope, 3.3.3.3, 10.0.0.1",
+			want:        "3.3.3.3",
+			wantReason:  ReasonFound,
+			wantDefault: "3.3.3.3",
+		},
+		{
+			name:        "Fail: all trusted",
+			xff:         "2.2.2.2, 10.0.0.1",
+			want:        "",
+			wantReason:  ReasonAllTrusted,
+			wantDefault: "",
+		},
+	}
+	contiguous := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithContiguousTrust(true))).(RightmostTrustedRangeStrategy)
+	def := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+			if got, reason := ClientIPDetail(contiguous, headers, ""); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+			if got := def.ClientIP(headers, ""); got != tt.wantDefault {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantDefault)
+			}
+		})
+	}
+
+	if _, err := NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithContiguousTrust(true), WithRecursive(false)); err == nil {
+		t.Fatalf("NewRightmostTrustedRangeStrategy did not return error for WithContiguousTrust with WithRecursive(false)")
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_privateRangesTrusted(t *testing.T) {
+	cdnRanges, _ := AddressesAndRangesToIPNets("2.2.2.0/24")
+	origRanges := append([]net.IPNet{}, cdnRanges...)
+
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 10.0.0.1, 192.168.1.1"}}
+	set, _ := NewRangeSet(IPNetsToPrefixes(cdnRanges)...)
+
+	tests := []struct {
+		name  string
+		strat Strategy
+		want  string
+	}{
+		{
+			name:  "Default",
+			strat: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", cdnRanges)),
+			want:  "192.168.1.1",
+		},
+		{
+			name:  "Private ranges trusted",
+			strat: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", cdnRanges, WithPrivateRangesTrusted(true))),
+			want:  "1.1.1.1",
+		},
+		{
+			name:  "Private ranges trusted, with no other ranges",
+			strat: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", nil, WithPrivateRangesTrusted(true))),
+			want:  "2.2.2.2",
+		},
+		{
+			name:  "Private ranges not trusted",
+			strat: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", cdnRanges, WithPrivateRangesTrusted(false))),
+			want:  "192.168.1.1",
+		},
+		{
+			name:  "From set, default",
+			strat: Must(NewRightmostTrustedRangeStrategyFromSet("X-Forwarded-For", set)),
+			want:  "192.168.1.1",
+		},
+		{
+			name:  "From set, private ranges trusted",
+			strat: Must(NewRightmostTrustedRangeStrategyFromSet("X-Forwarded-For", set, WithPrivateRangesTrusted(true))),
+			want:  "1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.strat.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if got := tt.strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(cdnRanges, origRanges) {
+		t.Fatalf("WithPrivateRangesTrusted modified the caller's ranges")
+	}
+	if set.Len() != 1 {
+		t.Fatalf("WithPrivateRangesTrusted modified the caller's RangeSet")
+	}
+}
+
+func TestChainSummary(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "198.51.100.7")
+
+	tests := []struct {
+		name       string
+		headers    http.Header
+		headerName string
+		want       string
+	}{
+		{
+			name:       "X-Forwarded-For",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, 203.0.113.5", "10.0.0.1, 198.51.100.7"}},
+			headerName: "x-forwarded-for",
+			want:       "client=203.0.113.5 via [10.0.0.1(trusted),198.51.100.7(trusted)]",
+		},
+		{
+			name:       "Forwarded",
+			headers:    http.Header{"Forwarded": []string{`for="[2001:db8:cafe::17%eth0]:4711", for=10.0.0.1`}},
+			headerName: "Forwarded",
+			want:       "client=2001:db8:cafe::17%eth0 via [10.0.0.1(trusted)]",
+		},
+		{
+			name:       "No trusted hops",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, 203.0.113.5"}},
+			headerName: "X-Forwarded-For",
+			want:       "client=203.0.113.5 via []",
+		},
+		{
+			name:       "Invalid client",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, nope, 10.0.0.1"}},
+			headerName: "X-Forwarded-For",
+			want:       "client=invalid via [10.0.0.1(trusted)]",
+		},
+		{
+			name:       "All trusted",
+			headers:    http.Header{"X-Forwarded-For": []string{"10.0.0.2, 10.0.0.1"}},
+			headerName: "X-Forwarded-For",
+			want:       "client=- via [10.0.0.2(trusted),10.0.0.1(trusted)]",
+		},
+		{
+			name:       "Header missing",
+			headers:    http.Header{},
+			headerName: "X-Forwarded-For",
+			want:       "client=- via []",
+		},
+		{
+			name:       "Not a list header",
+			headers:    http.Header{"X-Real-Ip": []string{"203.0.113.5"}},
+			headerName: "X-Real-IP",
+			want:       "client=- via []",
+		},
+		{
+			name:       "Empty header name",
+			headers:    http.Header{"X-Forwarded-For": []string{"203.0.113.5"}},
+			headerName: "",
+			want:       "client=- via []",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChainSummary(tt.headers, tt.headerName, trustedRanges); got != tt.want {
+				t.Fatalf("ChainSummary = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainSummaryNamed(t *testing.T) {
+	trusted := []NamedRanges{
+		{Name: "lb", Ranges: mustAddressesAndRangesToIPNets("10.0.0.0/8")},
+		{Name: "cf", Ranges: mustAddressesAndRangesToIPNets("198.51.100.0/24")},
+		{Name: "other", Ranges: mustAddressesAndRangesToIPNets("10.0.0.1", "2001:db8::/32")},
+	}
+
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    string
+	}{
+		{
+			name:    "Labelled hops",
+			headers: http.Header{"X-Forwarded-For": []string{"1.1.1.1, 203.0.113.5, 198.51.100.7, 2001:db8::1, 10.0.0.1"}},
+			// 10.0.0.1 is in two sets; the first one's name is used
+			want: "client=203.0.113.5 via [198.51.100.7(cf),2001:db8::1(other),10.0.0.1(lb)]",
+		},
+		{
+			name:    "All trusted",
+			headers: http.Header{"X-Forwarded-For": []string{"198.51.100.7, 10.0.0.1"}},
+			want:    "client=- via [198.51.100.7(cf),10.0.0.1(lb)]",
+		},
+		{
+			name:    "Invalid client",
+			headers: http.Header{"X-Forwarded-For": []string{"nope, 10.0.0.1"}},
+			want:    "client=invalid via [10.0.0.1(lb)]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChainSummaryNamed(tt.headers, "X-Forwarded-For", trusted); got != tt.want {
+				t.Fatalf("ChainSummaryNamed = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := ChainSummaryNamed(http.Header{"X-Forwarded-For": []string{"1.1.1.1, 10.0.0.1"}}, "X-Forwarded-For", nil); got != "client=10.0.0.1 via []" {
+		t.Fatalf("ChainSummaryNamed with no ranges = %q", got)
+	}
+}
+
+func TestReloadableTrustedRangeStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = &ReloadableTrustedRangeStrategy{}
+
+	if _, err := NewReloadableTrustedRangeStrategy("X-Real-IP", nil); err == nil {
+		t.Fatalf("NewReloadableTrustedRangeStrategy did not return error for bad header")
+	}
+
+	initialRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	reloadedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "3.3.3.3")
+
+	strat, err := NewReloadableTrustedRangeStrategy("x-forwarded-for", initialRanges)
+	if err != nil {
+		t.Fatalf("NewReloadableTrustedRangeStrategy error: %v", err)
+	}
+
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 3.3.3.3, 10.0.0.1"}}
+
+	if got := strat.ClientIP(headers, ""); got != "3.3.3.3" {
+		t.Fatalf("ClientIP before reload = %q, want %q", got, "3.3.3.3")
+	}
+
+	strat.Reload(reloadedRanges)
+
+	if got := strat.ClientIP(headers, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP after reload = %q, want %q", got, "2.2.2.2")
+	}
+	if got, reason := ClientIPDetail(strat, headers, ""); got != "2.2.2.2" || reason != ReasonFound {
+		t.Fatalf("ClientIPDetail after reload = (%q, %v)", got, reason)
+	}
+	if got := strat.TrustedRanges(); !reflect.DeepEqual(got, reloadedRanges) {
+		t.Fatalf("TrustedRanges = %v, want %v", got, reloadedRanges)
+	}
+
+	// Appending to the slice passed to Reload must not affect the strategy
+	reloadedRanges = append(reloadedRanges[:1], mustParseCIDR("2.2.2.2/32"))
+	if got := strat.ClientIP(headers, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP after modifying reload slice = %q, want %q", got, "2.2.2.2")
+	}
+
+	// Exercise concurrent reloads and derivations; run with -race to be useful
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			strat.Reload(initialRanges)
+		}()
+		go func() {
+			defer wg.Done()
+			if got := strat.ClientIP(headers, ""); got != "2.2.2.2" && got != "3.3.3.3" {
+				t.Errorf("ClientIP during reload = %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// WithPrivateRangesTrusted must apply to the initial ranges and to reloaded ones
+	externalRanges, _ := AddressesAndRangesToIPNets("203.0.113.0/24")
+	privateStrat, err := NewReloadableTrustedRangeStrategy("X-Forwarded-For", externalRanges, WithPrivateRangesTrusted(true))
+	if err != nil {
+		t.Fatalf("NewReloadableTrustedRangeStrategy error: %v", err)
+	}
+	privateHeaders := http.Header{"X-Forwarded-For": []string{"1.2.3.4, 10.0.0.1, 203.0.113.5"}}
+	if got := privateStrat.ClientIP(privateHeaders, ""); got != "1.2.3.4" {
+		t.Fatalf("ClientIP with private ranges trusted = %q, want %q", got, "1.2.3.4")
+	}
+	privateStrat.Reload(externalRanges)
+	if got := privateStrat.ClientIP(privateHeaders, ""); got != "1.2.3.4" {
+		t.Fatalf("ClientIP with private ranges trusted after reload = %q, want %q", got, "1.2.3.4")
+	}
+	want := fmt.Sprint(Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", externalRanges, WithPrivateRangesTrusted(true))))
+	if got := privateStrat.String(); got != want {
+		t.Fatalf("String with private ranges trusted = %q, want %q", got, want)
+	}
+}
+
+func TestChainStrategy(t *testing.T) {
+	type args struct {
+		strategies []Strategy
+		headers    http.Header
+		remoteAddr string
+	}
+	tests := []struct {
+		name      string
+		args      args
+		want      string
+		wantIndex int
+	}{
+		{
+			name: "Single strategy",
+			args: args{
+				strategies: []Strategy{RemoteAddrStrategy{}},
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: `5.5.5.5`,
+			},
+			want:      "5.5.5.5",
+			wantIndex: 0,
+		},
+		{
+			name: "Multiple strategies",
+			args: args{
+				strategies: []Strategy{
+					Must(NewRightmostNonPrivateStrategy("Forwarded")),
+					Must(NewSingleIPHeaderStrategy("true-client-ip")),
+					Must(NewSingleIPHeaderStrategy("x-real-ip")),
+					RemoteAddrStrategy{},
+				},
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: `5.5.5.5`,
+			},
+			want:      "1.1.1.1",
+			wantIndex: 2,
+		},
+		{
+			name: "Fail: No strategies",
+			args: args{
+				strategies: nil,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: `5.5.5.5`,
+			},
+			want:      "",
+			wantIndex: -1,
+		},
+		{
+			name: "Fail: Multiple strategies, all fail",
+			args: args{
+				strategies: []Strategy{
+					Must(NewRightmostNonPrivateStrategy("Forwarded")),
+					Must(NewSingleIPHeaderStrategy("true-client-ip")),
+					Must(NewSingleIPHeaderStrategy("x-real-ip")),
+					RemoteAddrStrategy{},
+				},
+				headers: http.Header{
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: "",
+			},
+			want:      "",
+			wantIndex: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := NewChainStrategy(tt.args.strategies...)
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+
+			got, gotIndex := strat.ClientIPWithSource(tt.args.headers, tt.args.remoteAddr)
+			if got != tt.want || gotIndex != tt.wantIndex {
+				t.Fatalf("ClientIPWithSource = (%q, %d), want (%q, %d)", got, gotIndex, tt.want, tt.wantIndex)
+			}
+
+			if !reflect.DeepEqual(strat.Strategies(), tt.args.strategies) {
+				t.Fatalf("Strategies = %v, want %v", strat.Strategies(), tt.args.strategies)
+			}
+		})
+	}
+}
+
+func TestConsensusStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = ConsensusStrategy{}
+
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	fwd := Must(NewRightmostTrustedRangeStrategy("Forwarded", trustedRanges))
+	xff := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2))
+
+	tests := []struct {
+		name       string
+		strategies []Strategy
+		headers    http.Header
+		want       string
+		wantReason Reason
+	}{
+		{
+			name:       "Agree",
+			strategies: []Strategy{fwd, xff},
+			headers: http.Header{
+				"Forwarded":       []string{`for=1.1.1.1, for=2.2.2.2, for=10.0.0.1`},
+				"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2, 10.0.0.1`},
+			},
+			want:       "2.2.2.2",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Agree after normalization",
+			strategies: []Strategy{fwd, xff},
+			headers: http.Header{
+				"Forwarded":       []string{`for="[2607:f8b0:4004:83f::200e%eth0]:4711", for=10.0.0.1`},
+				"X-Forwarded-For": []string{`2607:f8b0:4004:83f:0:0:0:200e, 10.0.0.1`},
+			},
+			want:       "2607:f8b0:4004:83f::200e%eth0",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Agree IPv4-mapped",
+			strategies: []Strategy{xff, fwd},
+			headers: http.Header{
+				"Forwarded":       []string{`for=2.2.2.2, for=10.0.0.1`},
+				"X-Forwarded-For": []string{`::ffff:2.2.2.2, 10.0.0.1`},
+			},
+			want:       "2.2.2.2",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Single strategy",
+			strategies: []Strategy{RemoteAddrStrategy{}},
+			want:       "3.3.3.3",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Fail: mismatch",
+			strategies: []Strategy{fwd, xff},
+			headers: http.Header{
+				"Forwarded":       []string{`for=2.2.2.2, for=10.0.0.1`},
+				"X-Forwarded-For": []string{`2.2.2.2, 3.3.3.3, 10.0.0.1`},
+			},
+			want:       "",
+			wantReason: ReasonMismatch,
+		},
+		{
+			name:       "Fail: one header missing",
+			strategies: []Strategy{fwd, xff},
+			headers: http.Header{
+				"X-Forwarded-For": []string{`2.2.2.2, 10.0.0.1`},
+			},
+			want:       "",
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Fail: second strategy fails",
+			strategies: []Strategy{fwd, xff},
+			headers: http.Header{
+				"Forwarded":       []string{`for=2.2.2.2, for=10.0.0.1`},
+				"X-Forwarded-For": []string{`10.0.0.1`},
+			},
+			want:       "",
+			wantReason: ReasonCountTooLarge,
+		},
+		{
+			name:       "Fail: no strategies",
+			strategies: nil,
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := NewConsensusStrategy(tt.strategies...)
+
+			got, reason := ClientIPDetail(strat, tt.headers, "3.3.3.3:1234")
+			if got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+			if got := strat.ClientIP(tt.headers, "3.3.3.3:1234"); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+
+			if !reflect.DeepEqual(strat.Strategies(), tt.strategies) {
+				t.Fatalf("Strategies = %v, want %v", strat.Strategies(), tt.strategies)
+			}
+		})
+	}
+}
+
+func TestRequireAllStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = RequireAllStrategy{}
+
+	xff := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))
+
+	tests := []struct {
+		name       string
+		strategies []Strategy
+		headers    http.Header
+		remoteAddr string
+		want       string
+		wantReason Reason
+	}{
+		{
+			name:       "All succeed, last returned",
+			strategies: []Strategy{RemoteAddrStrategy{}, xff},
+			headers:    http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`}},
+			remoteAddr: "3.3.3.3:1234",
+			want:       "2.2.2.2",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "IPs needn't agree, order matters",
+			strategies: []Strategy{xff, RemoteAddrStrategy{}},
+			headers:    http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`}},
+			remoteAddr: "3.3.3.3:1234",
+			want:       "3.3.3.3",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Single strategy",
+			strategies: []Strategy{RemoteAddrStrategy{}},
+			remoteAddr: "3.3.3.3:1234",
+			want:       "3.3.3.3",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Fail: first strategy fails",
+			strategies: []Strategy{RemoteAddrStrategy{}, xff},
+			headers:    http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`}},
+			remoteAddr: "@",
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Fail: last strategy fails",
+			strategies: []Strategy{RemoteAddrStrategy{}, xff},
+			remoteAddr: "3.3.3.3:1234",
+			want:       "",
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Fail: no strategies",
+			strategies: nil,
+			remoteAddr: "3.3.3.3:1234",
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := NewRequireAllStrategy(tt.strategies...)
+
+			got, reason := ClientIPDetail(strat, tt.headers, tt.remoteAddr)
+			if got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+			if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+
+			if !reflect.DeepEqual(strat.Strategies(), tt.strategies) {
+				t.Fatalf("Strategies = %v, want %v", strat.Strategies(), tt.strategies)
+			}
+		})
+	}
+}
+
+func TestTrustedPeerStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = TrustedPeerStrategy{}
+
+	trustedProxyRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::/32")
+	inner := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	if _, err := NewTrustedPeerStrategy(nil, trustedProxyRanges); err == nil {
+		t.Fatalf("NewTrustedPeerStrategy did not return error for nil inner")
+	}
+	if _, err := NewTrustedPeerStrategy(inner, nil); err == nil {
+		t.Fatalf("NewTrustedPeerStrategy did not return error for no ranges")
+	}
+	if _, err := NewTrustedPeerStrategy(SingleIPHeaderStrategy{}, trustedProxyRanges); err == nil {
+		t.Fatalf("NewTrustedPeerStrategy did not return error for invalid inner")
+	}
+
+	strat, err := NewTrustedPeerStrategy(inner, trustedProxyRanges)
+	if err != nil {
+		t.Fatalf("NewTrustedPeerStrategy error: %v", err)
+	}
+
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`}}
+
+	tests := []struct {
+		name       string
+		headers    http.Header
+		remoteAddr string
+		want       string
+		wantReason Reason
+	}{
+		{
+			name:       "Trusted peer",
+			headers:    headers,
+			remoteAddr: "10.1.1.1:1234",
+			want:       "2.2.2.2",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Trusted IPv6 peer",
+			headers:    headers,
+			remoteAddr: "[2001:db8::1]:1234",
+			want:       "2.2.2.2",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Untrusted peer",
+			headers:    headers,
+			remoteAddr: "3.3.3.3:1234",
+			want:       "3.3.3.3",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Fail: trusted peer, inner fails",
+			headers:    http.Header{},
+			remoteAddr: "10.1.1.1:1234",
+			want:       "",
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Fail: bad remoteAddr",
+			headers:    headers,
+			remoteAddr: "nope",
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+			if got, reason := ClientIPDetail(strat, tt.headers, tt.remoteAddr); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	want := "{inner:realclientip.RightmostNonPrivateStrategy{headerName:X-Forwarded-For privateRanges:default} trustedProxyRanges:[10.0.0.0/8 2001:db8::/32]}"
+	if got := strat.String(); got != want {
+		t.Fatalf("String = %q, want %q", got, want)
+	}
+}
+
+func TestNewCDNOrDirectStrategy(t *testing.T) {
+	cdnRanges, _ := AddressesAndRangesToIPNets(ranges.Cloudflare...)
+	strat, err := NewCDNOrDirectStrategy("CF-Connecting-IP", cdnRanges, WithZone(false))
+	if err != nil {
+		t.Fatalf("NewCDNOrDirectStrategy error: %v", err)
+	}
+
+	headers := http.Header{"Cf-Connecting-Ip": []string{"[fe80::1%eth0]:1234"}}
+	tests := []struct {
+		name       string
+		headers    http.Header
+		remoteAddr string
+		want       string
+		wantReason Reason
+	}{
+		{"From the CDN", headers, "173.245.48.1:443", "fe80::1", ReasonFound},
+		{"Direct, with spoofed header", headers, "3.3.3.3:1234", "3.3.3.3", ReasonFound},
+		{"Direct, without header", http.Header{}, "[2600:1f18::99]:1234", "2600:1f18::99", ReasonFound},
+		{"Fail: from the CDN without header", http.Header{}, "173.245.48.1:443", "", ReasonHeaderMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, reason := ClientIPDetail(strat, tt.headers, tt.remoteAddr); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	if _, err := NewCDNOrDirectStrategy("X-Forwarded-For", cdnRanges); err == nil {
+		t.Fatalf("NewCDNOrDirectStrategy did not return error for list header")
+	}
+	if _, err := NewCDNOrDirectStrategy("CF-Connecting-IP", nil); err == nil {
+		t.Fatalf("NewCDNOrDirectStrategy did not return error for empty ranges")
+	}
+}
+
+func TestNewRightmostTrustedRangePublicStrategy(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("3.3.3.0/24", "2600:1f18:1::/48")
+	strat, err := NewRightmostTrustedRangePublicStrategy("X-Forwarded-For", trustedRanges, WithZone(false))
+	if err != nil {
+		t.Fatalf("NewRightmostTrustedRangePublicStrategy error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		xff        string
+		remoteAddr string
+		want       string
+		wantReason Reason
+	}{
+		{"Direct, with spoofed header", "1.1.1.1", "4.4.4.4:1234", "4.4.4.4", ReasonFound},
+		{"Direct, without header", "", "[2600:1f18::99]:1234", "2600:1f18::99", ReasonFound},
+		{"Via trusted proxy", "1.1.1.1, 2.2.2.2", "3.3.3.3:443", "2.2.2.2", ReasonFound},
+		{"Via private proxy", "1.1.1.1, 2.2.2.2", "10.0.0.1:443", "2.2.2.2", ReasonFound},
+		{"Skips trusted and private", "1.1.1.1, 2.2.2.2, 10.0.0.2, [2600:1f18:1::1]:80, 192.168.1.1, 3.3.3.4", "[fe80::1%eth0]:443", "2.2.2.2", ReasonFound},
+		{"Invalid item", "1.1.1.1, nope, 3.3.3.4", "10.0.0.1:443", "", ReasonNoValidIP},
+		{"Fail: all trusted or private", "10.0.0.2, 3.3.3.4", "3.3.3.3:443", "", ReasonAllTrusted},
+		{"Fail: via proxy without header", "", "10.0.0.1:443", "", ReasonHeaderMissing},
+		{"Fail: bad remoteAddr", "1.1.1.1", "nope", "", ReasonNoValidIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.xff != "" {
+				headers.Set("X-Forwarded-For", tt.xff)
+			}
+			if got, reason := ClientIPDetail(strat, headers, tt.remoteAddr); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	// No trusted ranges means only the private ranges are trusted
+	strat, err = NewRightmostTrustedRangePublicStrategy("Forwarded", nil)
+	if err != nil {
+		t.Fatalf("NewRightmostTrustedRangePublicStrategy error: %v", err)
+	}
+	headers := http.Header{"Forwarded": []string{"for=1.1.1.1, for=2.2.2.2, for=10.0.0.2"}}
+	if got := strat.ClientIP(headers, "10.0.0.1:443"); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+
+	if _, err := NewRightmostTrustedRangePublicStrategy("X-Real-IP", trustedRanges); err == nil {
+		t.Fatalf("NewRightmostTrustedRangePublicStrategy did not return error for single-IP header")
+	}
+}
+
+func TestNewEnvoyExternalAddressStrategy(t *testing.T) {
+	envoyRanges, _ := AddressesAndRangesToIPNets("10.1.0.0/16")
+	strat, err := NewEnvoyExternalAddressStrategy(envoyRanges)
+	if err != nil {
+		t.Fatalf("NewEnvoyExternalAddressStrategy error: %v", err)
+	}
+
+	headers := http.Header{
+		"X-Envoy-External-Address": []string{"2.2.2.2"},
+		"X-Forwarded-For":          []string{"1.1.1.1, 2.2.2.2"},
+	}
+	tests := []struct {
+		name       string
+		headers    http.Header
+		remoteAddr string
+		want       string
+		wantReason Reason
+	}{
+		{"From Envoy", headers, "10.1.2.3:4711", "2.2.2.2", ReasonFound},
+		{"Direct, with spoofed header", headers, "3.3.3.3:1234", "3.3.3.3", ReasonFound},
+		{"Direct, without header", http.Header{}, "[2600:1f18::99]:1234", "2600:1f18::99", ReasonFound},
+		{"Fail: from Envoy without header", http.Header{"X-Forwarded-For": []string{"10.2.0.1"}}, "10.1.2.3:4711", "", ReasonHeaderMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, reason := ClientIPDetail(strat, tt.headers, tt.remoteAddr); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	// Options are passed to the header strategy
+	strat = Must(NewEnvoyExternalAddressStrategy(envoyRanges, WithZone(false))).(TrustedPeerStrategy)
+	zoned := http.Header{"X-Envoy-External-Address": []string{"fe80::1%eth0"}}
+	if got := strat.ClientIP(zoned, "10.1.2.3:4711"); got != "fe80::1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "fe80::1")
+	}
+
+	if _, err := NewEnvoyExternalAddressStrategy(nil); err == nil {
+		t.Fatalf("NewEnvoyExternalAddressStrategy did not return error for empty ranges")
+	}
+}
+
+func TestBlocklistStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = BlocklistStrategy{}
+
+	blockedRanges, _ := AddressesAndRangesToIPNets("3.3.3.0/24", "2600:1f18::/32")
+	inner := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	if _, err := NewBlocklistStrategy(nil, blockedRanges); err == nil {
+		t.Fatalf("NewBlocklistStrategy did not return error for nil inner")
+	}
+	if _, err := NewBlocklistStrategy(SingleIPHeaderStrategy{}, blockedRanges); err == nil {
+		t.Fatalf("NewBlocklistStrategy did not return error for invalid inner")
+	}
+	if _, err := NewBlocklistStrategy(inner, nil); err != nil {
+		t.Fatalf("NewBlocklistStrategy returned error for no ranges: %v", err)
+	}
+
+	strat, err := NewBlocklistStrategy(inner, blockedRanges)
+	if err != nil {
+		t.Fatalf("NewBlocklistStrategy error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		xff        string
+		want       string
+		wantReason Reason
+	}{
+		{
+			name:       "Not blocked",
+			xff:        `1.1.1.1, 2.2.2.2`,
+			want:       "2.2.2.2",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Left of blocked IP is not considered",
+			xff:        `1.1.1.1, 3.3.3.3`,
+			want:       "",
+			wantReason: ReasonBlocked,
+		},
+		{
+			name:       "Blocked IPv6",
+			xff:        `1.1.1.1, [2600:1f18::99%eth0]:4321`,
+			want:       "",
+			wantReason: ReasonBlocked,
+		},
+		{
+			name:       "Blocked IPv4-mapped",
+			xff:        `1.1.1.1, ::ffff:3.3.3.3`,
+			want:       "",
+			wantReason: ReasonBlocked,
+		},
+		{
+			name:       "Fail: inner fails",
+			xff:        `10.0.0.1`,
+			want:       "",
+			wantReason: ReasonAllPrivate,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+			if got := strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+			if got, reason := ClientIPDetail(strat, headers, ""); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	// A blocked result is a failure, so a chain moves on to the next strategy
+	chain := NewChainStrategy(strat, RemoteAddrStrategy{})
+	if got := chain.ClientIP(http.Header{"X-Forwarded-For": []string{`3.3.3.3`}}, "4.4.4.4:1234"); got != "4.4.4.4" {
+		t.Fatalf("chain ClientIP = %q, want %q", got, "4.4.4.4")
+	}
+
+	want := "{inner:realclientip.RightmostNonPrivateStrategy{headerName:X-Forwarded-For privateRanges:default} blockedRanges:[3.3.3.0/24 2600:1f18::/32]}"
+	if got := strat.String(); got != want {
+		t.Fatalf("String = %q, want %q", got, want)
+	}
+}
+
+func TestMaxHopsStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = MaxHopsStrategy{}
+
+	inner := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2))
+
+	if _, err := NewMaxHopsStrategy(nil, "X-Forwarded-For", 2); err == nil {
+		t.Fatalf("NewMaxHopsStrategy did not return error for nil inner")
+	}
+	if _, err := NewMaxHopsStrategy(SingleIPHeaderStrategy{}, "X-Forwarded-For", 2); err == nil {
+		t.Fatalf("NewMaxHopsStrategy did not return error for invalid inner")
+	}
+	if _, err := NewMaxHopsStrategy(inner, "X-Real-IP", 2); err == nil {
+		t.Fatalf("NewMaxHopsStrategy did not return error for non-list header")
+	}
+	if _, err := NewMaxHopsStrategy(inner, "X-Forwarded-For", 0); err == nil {
+		t.Fatalf("NewMaxHopsStrategy did not return error for zero maxHops")
+	}
+
+	strat, err := NewMaxHopsStrategy(inner, "x-forwarded-for", 2)
+	if err != nil {
+		t.Fatalf("NewMaxHopsStrategy error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		xff        []string
+		want       string
+		wantReason Reason
+	}{
+		{
+			name:       "Exactly max hops",
+			xff:        []string{`1.1.1.1, 2.2.2.2`},
+			want:       "1.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Too many hops",
+			xff:        []string{`3.3.3.3, 1.1.1.1, 2.2.2.2`},
+			want:       "",
+			wantReason: ReasonTooManyHops,
+		},
+		{
+			name:       "Too many hops across headers",
+			xff:        []string{`3.3.3.3, 1.1.1.1`, `2.2.2.2`},
+			want:       "",
+			wantReason: ReasonTooManyHops,
+		},
+		{
+			name:       "Invalid items are counted",
+			xff:        []string{`nope, 1.1.1.1, 2.2.2.2`},
+			want:       "",
+			wantReason: ReasonTooManyHops,
+		},
+		{
+			name:       "Empty items are not counted",
+			xff:        []string{`, 1.1.1.1,, 2.2.2.2`},
+			want:       "1.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Fail: inner fails",
+			xff:        []string{`2.2.2.2`},
+			want:       "",
+			wantReason: ReasonCountTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": tt.xff}
+			if got := strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+			if got, reason := ClientIPDetail(strat, headers, ""); got != tt.want || reason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	want := "{inner:realclientip.RightmostTrustedCountStrategy{headerName:X-Forwarded-For trustedCount:2} headerName:X-Forwarded-For maxHops:2}"
+	if got := strat.String(); got != want {
+		t.Fatalf("String = %q, want %q", got, want)
+	}
+}
+
+func TestClientIPWithPosition(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("4.4.4.4", "5.5.5.5")
+	headers := http.Header{"X-Forwarded-For": []string{"10.0.0.1, 2.2.2.2, nope", "3.3.3.3, , 4.4.4.4, 5.5.5.5"}}
+
+	tests := []struct {
+		name      string
+		strat     Strategy
+		headers   http.Header
+		want      string
+		wantIndex int
+		wantTotal int
+	}{
+		{
+			name:      "LeftmostNonPrivate",
+			strat:     Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+			headers:   headers,
+			want:      "2.2.2.2",
+			wantIndex: 1,
+			wantTotal: 6,
+		},
+		{
+			name:      "RightmostNonPrivate",
+			strat:     Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers:   headers,
+			want:      "5.5.5.5",
+			wantIndex: 5,
+			wantTotal: 6,
+		},
+		{
+			name:      "Leftmost",
+			strat:     Must(NewLeftmostStrategy("X-Forwarded-For")),
+			headers:   headers,
+			want:      "10.0.0.1",
+			wantIndex: 0,
+			wantTotal: 6,
+		},
+		{
+			name:      "Rightmost",
+			strat:     Must(NewRightmostStrategy("X-Forwarded-For")),
+			headers:   headers,
+			want:      "5.5.5.5",
+			wantIndex: 5,
+			wantTotal: 6,
+		},
+		{
+			name:      "RightmostTrustedCount",
+			strat:     Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 3)),
+			headers:   headers,
+			want:      "3.3.3.3",
+			wantIndex: 3,
+			wantTotal: 6,
+		},
+		{
+			name:      "LeftmostTrustedCount",
+			strat:     Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 2)),
+			headers:   headers,
+			want:      "2.2.2.2",
+			wantIndex: 1,
+			wantTotal: 6,
+		},
+		{
+			name:      "RightmostTrustedRange",
+			strat:     Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)),
+			headers:   headers,
+			want:      "3.3.3.3",
+			wantIndex: 3,
+			wantTotal: 6,
+		},
+		{
+			name:      "Forwarded",
+			strat:     Must(NewRightmostTrustedCountStrategy("Forwarded", 2)),
+			headers:   http.Header{"Forwarded": []string{`for=1.1.1.1, for="[2600:1f18::99]";proto=https, for=3.3.3.3`}},
+			want:      "2600:1f18::99",
+			wantIndex: 1,
+			wantTotal: 3,
+		},
+		{
+			name:      "Single item",
+			strat:     Must(NewRightmostStrategy("X-Forwarded-For")),
+			headers:   http.Header{"X-Forwarded-For": []string{"1.1.1.1"}},
+			want:      "1.1.1.1",
+			wantIndex: 0,
+			wantTotal: 1,
+		},
+		{
+			name:      "Fail: no IP",
+			strat:     Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 4)),
+			headers:   headers,
+			want:      "",
+			wantIndex: -1,
+			wantTotal: 6,
+		},
+		{
+			name:      "Fail: header missing",
+			strat:     Must(NewRightmostStrategy("X-Forwarded-For")),
+			headers:   http.Header{},
+			want:      "",
+			wantIndex: -1,
+			wantTotal: 0,
+		},
+		{
+			name:      "Wrapped in a chain",
+			strat:     NewChainStrategy(Must(NewSingleIPHeaderStrategy("X-Real-IP")), Must(NewRightmostStrategy("X-Forwarded-For"))),
+			headers:   headers,
+			want:      "5.5.5.5",
+			wantIndex: 5,
+			wantTotal: 6,
+		},
+		{
+			name:      "Not a list header",
+			strat:     Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			headers:   http.Header{"X-Real-Ip": []string{"2.2.2.2"}},
+			want:      "2.2.2.2",
+			wantIndex: -1,
+			wantTotal: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, index, total := ClientIPWithPosition(tt.strat, tt.headers, "")
+			if ip != tt.want || index != tt.wantIndex || total != tt.wantTotal {
+				t.Fatalf("ClientIPWithPosition() = (%q, %d, %d), want (%q, %d, %d)", ip, index, total, tt.want, tt.wantIndex, tt.wantTotal)
+			}
+		})
+	}
+}
+
+// customStrategy is a Strategy that is not implemented by this package.
+type customStrategy struct {
+	ip string
+}
+
+func (strat customStrategy) ClientIP(_ http.Header, _ string) string {
+	return strat.ip
+}
+
+func (strat customStrategy) Validate() error {
+	return nil
+}
+
+func TestWithResultCallback(t *testing.T) {
+	type callbackArgs struct {
+		normalized string
+		raw        string
+		reason     Reason
+	}
+	tests := []struct {
+		name       string
+		strat      Strategy
+		headers    http.Header
+		remoteAddr string
+		want       callbackArgs
+	}{
+		{
+			name:       "RemoteAddr",
+			strat:      RemoteAddrStrategy{},
+			remoteAddr: "[::ffff:188.0.2.128]:4747",
+			want:       callbackArgs{"188.0.2.128", "[::ffff:188.0.2.128]:4747", ReasonFound},
+		},
+		{
+			name:    "Single-IP header",
+			strat:   Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			headers: http.Header{"X-Real-Ip": []string{"[2607:f8b0:4004:83f::18]:3838"}},
+			want:    callbackArgs{"2607:f8b0:4004:83f::18", "[2607:f8b0:4004:83f::18]:3838", ReasonFound},
+		},
+		{
+			name:    "Forwarded list item",
+			strat:   Must(NewRightmostNonPrivateStrategy("Forwarded")),
+			headers: http.Header{"Forwarded": []string{`For="[2607:f8b0:4004:83f::18]:3838";proto=https, for=10.0.0.1`}},
+			want:    callbackArgs{"2607:f8b0:4004:83f::18", `For="[2607:f8b0:4004:83f::18]:3838";proto=https`, ReasonFound},
+		},
+		{
+			name: "Chain",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+				RemoteAddrStrategy{},
+			),
+			remoteAddr: "1.1.1.1:1234",
+			want:       callbackArgs{"1.1.1.1", "1.1.1.1:1234", ReasonFound},
+		},
+		{
+			name:       "Custom strategy",
+			strat:      customStrategy{ip: "fe80::1%eth0"},
+			remoteAddr: "1.1.1.1:1234",
+			want:       callbackArgs{"fe80::1%eth0", "fe80::1%eth0", ReasonFound},
+		},
+		{
+			name:       "Fail: Custom strategy",
+			strat:      customStrategy{ip: ""},
+			remoteAddr: "1.1.1.1:1234",
+			want:       callbackArgs{"", "", ReasonNoValidIP},
+		},
+		{
+			name:    "Fail: no valid IP",
+			strat:   Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{"X-Forwarded-For": []string{"10.0.0.1, nope"}},
+			want:    callbackArgs{"", "", ReasonAllPrivate},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []callbackArgs
+			strat := WithResultCallback(tt.strat, func(normalized, raw string, reason Reason) {
+				calls = append(calls, callbackArgs{normalized, raw, reason})
+			})
+
+			got := strat.ClientIP(tt.headers, tt.remoteAddr)
+			if got != tt.want.normalized {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want.normalized)
+			}
+
+			if len(calls) != 1 {
+				t.Fatalf("callback called %d times, want 1", len(calls))
+			}
+
+			if calls[0] != tt.want {
+				t.Fatalf("callback args = %+v, want %+v", calls[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestWithObserver(t *testing.T) {
+	type observation struct {
+		result string
+		reason Reason
+		header string
+	}
+	var observed []observation
+	obs := func(result string, reason Reason, header string) {
+		observed = append(observed, observation{result, reason, header})
+	}
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		strat      Strategy
+		headers    http.Header
+		remoteAddr string
+		want       []observation
+	}{
+		{
+			name:    "Single-IP header",
+			strat:   Must(NewSingleIPHeaderStrategy("X-Real-IP", WithObserver(obs))),
+			headers: http.Header{"X-Real-Ip": []string{"1.1.1.1", "2.2.2.2:1234"}},
+			want:    []observation{{"2.2.2.2", ReasonFound, "1.1.1.1, 2.2.2.2:1234"}},
+		},
+		{
+			name:    "List header",
+			strat:   Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithObserver(obs))),
+			headers: http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2", "10.0.0.1"}},
+			want:    []observation{{"2.2.2.2", ReasonFound, "1.1.1.1, 2.2.2.2, 10.0.0.1"}},
+		},
+		{
+			name:    "Fail: list header",
+			strat:   Must(NewLeftmostTrustedCountStrategy("Forwarded", 3, WithObserver(obs))),
+			headers: http.Header{"Forwarded": []string{"for=1.1.1.1"}},
+			want:    []observation{{"", ReasonCountTooLarge, "for=1.1.1.1"}},
+		},
+		{
+			name:    "PROXY protocol",
+			strat:   Must(NewProxyProtocolStrategy("X-Proxy-Protocol", WithObserver(obs))),
+			headers: http.Header{"X-Proxy-Protocol": []string{"PROXY TCP4 1.1.1.1 2.2.2.2 1234 443"}},
+			want:    []observation{{"1.1.1.1", ReasonFound, "PROXY TCP4 1.1.1.1 2.2.2.2 1234 443"}},
+		},
+		{
+			name: "Chain",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("X-Real-IP", WithObserver(obs))),
+				Must(NewLeftmostStrategy("X-Forwarded-For", WithObserver(obs))),
+				RemoteAddrStrategy{},
+			),
+			headers:    http.Header{"X-Forwarded-For": []string{"nope"}},
+			remoteAddr: "3.3.3.3:1234",
+			want: []observation{
+				{"", ReasonHeaderMissing, ""},
+				{"", ReasonNoValidIP, "nope"},
+			},
+		},
+		{
+			name:    "Nil observer",
+			strat:   Must(NewRightmostStrategy("X-Forwarded-For", WithObserver(nil))),
+			headers: http.Header{"X-Forwarded-For": []string{"1.1.1.1"}},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed = nil
+			got := tt.strat.ClientIP(tt.headers, tt.remoteAddr)
+			if !reflect.DeepEqual(observed, tt.want) {
+				t.Fatalf("observed %+v, want %+v", observed, tt.want)
+			}
+			if len(tt.want) > 0 && tt.want[len(tt.want)-1].reason == ReasonFound && got != tt.want[len(tt.want)-1].result {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want[len(tt.want)-1].result)
+			}
+		})
+	}
+}
+
+func TestClientIPFromRequest(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2, 10.0.0.1")
+	r.RemoteAddr = "3.3.3.3:1234"
+	if got := ClientIPFromRequest(strat, r); got != "2.2.2.2" {
+		t.Fatalf("ClientIPFromRequest = %q, want %q", got, "2.2.2.2")
+	}
+
+	if got := ClientIPFromRequest(RemoteAddrStrategy{}, r); got != "3.3.3.3" {
+		t.Fatalf("ClientIPFromRequest = %q, want %q", got, "3.3.3.3")
+	}
+
+	if got := ClientIPFromRequest(strat, nil); got != "" {
+		t.Fatalf("ClientIPFromRequest with nil request = %q, want empty", got)
+	}
+}
+
+// lowerCaseHeaders is a HeaderGetter that, like some non-net/http frameworks, stores
+// header names in lowercase.
+type lowerCaseHeaders map[string][]string
+
+func (h lowerCaseHeaders) Values(name string) []string {
+	return h[strings.ToLower(name)]
+}
+
+func TestClientIPFromHeaders(t *testing.T) {
+	getter := lowerCaseHeaders{
+		"x-forwarded-for": []string{"1.1.1.1, 2.2.2.2", "10.0.0.1"},
+		"x-real-ip":       []string{"4.4.4.4"},
+	}
+	httpHeaders := http.Header{
+		"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2", "10.0.0.1"},
+		"X-Real-Ip":       []string{"4.4.4.4"},
+	}
+
+	tests := []struct {
+		name  string
+		strat Strategy
+		want  string
+	}{
+		{"rightmost-non-private", Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")), "2.2.2.2"},
+		{"leftmost", Must(NewLeftmostStrategy("X-Forwarded-For")), "1.1.1.1"},
+		{"rightmost-trusted-count", Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)), "2.2.2.2"},
+		{"single-header", Must(NewSingleIPHeaderStrategy("X-Real-IP")), "4.4.4.4"},
+		{"remote-addr", RemoteAddrStrategy{}, "3.3.3.3"},
+		{"chain", NewChainStrategy(Must(NewSingleIPHeaderStrategy("True-Client-IP")), Must(NewSingleIPHeaderStrategy("X-Real-IP"))), "4.4.4.4"},
+		{"Fail: header missing", Must(NewSingleIPHeaderStrategy("True-Client-IP")), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClientIPFromHeaders(tt.strat, getter, "3.3.3.3:1234"); got != tt.want {
+				t.Fatalf("ClientIPFromHeaders = %q, want %q", got, tt.want)
+			}
+			// The result must be the same as for the equivalent http.Header
+			if got := ClientIPFromHeaders(tt.strat, httpHeaders, "3.3.3.3:1234"); got != tt.want {
+				t.Fatalf("ClientIPFromHeaders with http.Header = %q, want %q", got, tt.want)
+			}
+			if got := tt.strat.ClientIP(httpHeaders, "3.3.3.3:1234"); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// A strategy from outside this package gets the headers only if they're an http.Header
+	headerStrat := headerCustomStrategy{headerName: "X-Real-Ip"}
+	if got := ClientIPFromHeaders(headerStrat, httpHeaders, ""); got != "4.4.4.4" {
+		t.Fatalf("ClientIPFromHeaders with custom strategy = %q, want %q", got, "4.4.4.4")
+	}
+	if got := ClientIPFromHeaders(headerStrat, getter, ""); got != "" {
+		t.Fatalf("ClientIPFromHeaders with custom strategy and getter = %q, want empty", got)
+	}
+}
+
+func TestClientIPFromMetadata(t *testing.T) {
+	md := map[string][]string{
+		"x-forwarded-for": []string{"1.1.1.1, 2.2.2.2", "10.0.0.1"},
+		"forwarded":       []string{"For=5.5.5.5"},
+		"x-real-ip":       []string{"4.4.4.4"},
+		":authority":      []string{"example.com"},
+	}
+
+	tests := []struct {
+		name     string
+		strat    Strategy
+		peerAddr string
+		want     string
+	}{
+		{"rightmost-non-private", Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")), "", "2.2.2.2"},
+		{"Forwarded", Must(NewRightmostNonPrivateStrategy("Forwarded")), "", "5.5.5.5"},
+		{"single-header", Must(NewSingleIPHeaderStrategy("x-real-ip")), "", "4.4.4.4"},
+		{"peer", RemoteAddrStrategy{}, "[2600:1f18::99]:5678", "2600:1f18::99"},
+		{"Fail: header missing", Must(NewSingleIPHeaderStrategy("True-Client-IP")), "3.3.3.3:1234", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClientIPFromMetadata(tt.strat, md, tt.peerAddr); got != tt.want {
+				t.Fatalf("ClientIPFromMetadata = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Converting the metadata to an http.Header directly doesn't work, as the keys aren't
+	// canonicalized
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+	if got := strat.ClientIP(http.Header(md), ""); got != "" {
+		t.Fatalf("ClientIP with converted metadata = %q, want empty", got)
+	}
+
+	if got := ClientIPFromMetadata(strat, nil, ""); got != "" {
+		t.Fatalf("ClientIPFromMetadata with nil metadata = %q, want empty", got)
+	}
+}
+
+// headerCustomStrategy is a Strategy, not implemented by this package, that returns the
+// value of a header.
+type headerCustomStrategy struct {
+	headerName string
+}
+
+func (strat headerCustomStrategy) ClientIP(headers http.Header, _ string) string {
+	return headers.Get(strat.headerName)
+}
+
+func (strat headerCustomStrategy) Validate() error {
+	return nil
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		strat      Strategy
+		headers    http.Header
+		remoteAddr string
+		want       netip.Addr
+		wantOK     bool
+	}{
+		{
+			name:       "IPv4",
+			strat:      RemoteAddrStrategy{},
+			remoteAddr: "1.1.1.1:1234",
+			want:       netip.MustParseAddr("1.1.1.1"),
+			wantOK:     true,
+		},
+		{
+			name:       "IPv4-mapped IPv6 is unmapped",
+			strat:      RemoteAddrStrategy{},
+			remoteAddr: "[::ffff:188.0.2.128]:4747",
+			want:       netip.MustParseAddr("188.0.2.128"),
+			wantOK:     true,
+		},
+		{
+			name:    "IPv6 with zone",
+			strat:   Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{"X-Forwarded-For": []string{"2607:f8b0:4004:83f::18%eth0, 10.0.0.1"}},
+			want:    netip.MustParseAddr("2607:f8b0:4004:83f::18%eth0"),
+			wantOK:  true,
+		},
+		{
+			name:       "Custom strategy",
+			strat:      customStrategy{ip: "fe80::1%eth0"},
+			remoteAddr: "1.1.1.1:1234",
+			want:       netip.MustParseAddr("fe80::1%eth0"),
+			wantOK:     true,
+		},
+		{
+			name:       "Fail: no IP",
+			strat:      RemoteAddrStrategy{},
+			remoteAddr: "@",
+			want:       netip.Addr{},
+			wantOK:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ClientAddr(tt.strat, tt.headers, tt.remoteAddr)
+			if ok != tt.wantOK {
+				t.Fatalf("ClientAddr ok = %v, want %v", ok, tt.wantOK)
+			}
+			if got != tt.want {
+				t.Fatalf("ClientAddr = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPErr(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	ip, err := ClientIPErr(strat, http.Header{"X-Forwarded-For": []string{"1.1.1.1, 10.0.0.1"}}, "")
+	if ip != "1.1.1.1" || err != nil {
+		t.Fatalf("ClientIPErr = (%q, %v), want (%q, nil)", ip, err, "1.1.1.1")
+	}
+
+	tests := []struct {
+		name       string
+		strat      Strategy
+		headers    http.Header
+		wantReason Reason
+	}{
+		{"Header missing", strat, http.Header{}, ReasonHeaderMissing},
+		{"All private", strat, http.Header{"X-Forwarded-For": []string{"10.0.0.1"}}, ReasonAllPrivate},
+		{"Foreign strategy", customStrategy{ip: "nope"}, nil, ReasonNoValidIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := ClientIPErr(tt.strat, tt.headers, "")
+			if ip != "" {
+				t.Fatalf("ClientIPErr ip = %q, want empty", ip)
+			}
+			if !errors.Is(err, ErrNoClientIP) {
+				t.Fatalf("ClientIPErr error = %v, want ErrNoClientIP", err)
+			}
+
+			var noIPErr *NoClientIPError
+			if !errors.As(err, &noIPErr) || noIPErr.Reason != tt.wantReason {
+				t.Fatalf("ClientIPErr error = %v, want reason %v", err, tt.wantReason)
+			}
+			if want := "no client IP could be derived: " + tt.wantReason.String(); err.Error() != want {
+				t.Fatalf("Error() = %q, want %q", err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestClientIPDetail(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		strat      Strategy
+		headers    http.Header
+		remoteAddr string
+		wantIP     string
+		wantReason Reason
+	}{
+		{
+			name:       "RemoteAddr found",
+			strat:      RemoteAddrStrategy{},
+			remoteAddr: "1.1.1.1:1234",
+			wantIP:     "1.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "RemoteAddr invalid",
+			strat:      RemoteAddrStrategy{},
+			remoteAddr: "@",
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Single-IP header missing",
+			strat:      Must(NewSingleIPHeaderStrategy("X-Real-IP")).(SingleIPHeaderStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1"}},
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Single-IP header invalid",
+			strat:      Must(NewSingleIPHeaderStrategy("X-Real-IP")).(SingleIPHeaderStrategy),
+			headers:    http.Header{"X-Real-Ip": []string{"nope"}},
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Leftmost non-private found",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")).(LeftmostNonPrivateStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"10.0.0.1, 1.1.1.1"}},
+			wantIP:     "1.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Leftmost non-private header missing",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")).(LeftmostNonPrivateStrategy),
+			headers:    http.Header{"Forwarded": []string{"for=1.1.1.1"}},
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Leftmost non-private all private",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")).(LeftmostNonPrivateStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"10.0.0.1, nope, 192.168.1.1"}},
+			wantReason: ReasonAllPrivate,
+		},
+		{
+			name:       "Rightmost non-private no valid IP",
+			strat:      Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")).(RightmostNonPrivateStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"nope, 0.0.0.0"}},
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Rightmost trusted count too large",
+			strat:      Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 3)).(RightmostTrustedCountStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2"}},
+			wantReason: ReasonCountTooLarge,
+		},
+		{
+			name:       "Rightmost trusted count header missing",
+			strat:      Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1)).(RightmostTrustedCountStrategy),
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Rightmost trusted count invalid",
+			strat:      Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)).(RightmostTrustedCountStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"nope, 2.2.2.2"}},
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Leftmost trusted count too large",
+			strat:      Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 3)).(LeftmostTrustedCountStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2"}},
+			wantReason: ReasonCountTooLarge,
+		},
+		{
+			name:       "Leftmost trusted count header missing",
+			strat:      Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1)).(LeftmostTrustedCountStrategy),
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name:       "Rightmost trusted range all trusted",
+			strat:      Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"10.0.0.1, 10.0.0.2"}},
+			wantReason: ReasonAllTrusted,
+		},
+		{
+			name:       "Rightmost trusted range invalid",
+			strat:      Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy),
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, nope, 10.0.0.2"}},
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Rightmost trusted range header missing",
+			strat:      Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy),
+			wantReason: ReasonHeaderMissing,
+		},
+		{
+			name: "Chain reports last failure",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+				Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 3)),
+			),
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1"}},
+			wantReason: ReasonCountTooLarge,
+		},
+		{
+			name:       "Chain with no strategies",
+			strat:      NewChainStrategy(),
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Custom strategy found",
+			strat:      customStrategy{ip: "1.1.1.1"},
+			wantIP:     "1.1.1.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Custom strategy failed",
+			strat:      customStrategy{},
+			wantReason: ReasonNoValidIP,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIP, gotReason := ClientIPDetail(tt.strat, tt.headers, tt.remoteAddr)
+			if gotIP != tt.wantIP || gotReason != tt.wantReason {
+				t.Fatalf("ClientIPDetail = (%q, %v), want (%q, %v)", gotIP, gotReason, tt.wantIP, tt.wantReason)
+			}
+
+			// ClientIP must agree
+			if got := tt.strat.ClientIP(tt.headers, tt.remoteAddr); got != gotIP {
+				t.Fatalf("ClientIP = %q, want %q", got, gotIP)
+			}
+		})
+	}
+}
+
+func TestClientNetIPAddr(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	reloadable, _ := NewReloadableTrustedRangeStrategy("X-Forwarded-For", trustedRanges)
+	headers := http.Header{
+		"X-Forwarded-For":  []string{"1.1.1.1, fe80::1%eth0, 2600:1f18::99%eth1, 10.0.0.1"},
+		"Forwarded":        []string{"for=2.2.2.2"},
+		"X-Real-Ip":        []string{"[2600:1f18::98%eth2]:1234"},
+		"X-Proxy-Protocol": []string{"PROXY TCP4 3.3.3.3 4.4.4.4 1234 443"},
+	}
+
+	strategies := []Strategy{
+		RemoteAddrStrategy{},
+		Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+		Must(NewSingleIPHeadersStrategy("True-Client-IP", "X-Real-IP")),
+		Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		Must(NewLeftmostStrategy("X-Forwarded-For")),
+		Must(NewRightmostStrategy("X-Forwarded-For")),
+		Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 2)),
+		Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)),
+		Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)),
+		reloadable,
+		Must(NewProxyProtocolStrategy("X-Proxy-Protocol")),
+		Must(NewTrustedPeerStrategy(Must(NewRightmostStrategy("Forwarded")), trustedRanges)),
+		Must(NewBlocklistStrategy(RemoteAddrStrategy{}, trustedRanges)),
+		Must(NewMaxHopsStrategy(RemoteAddrStrategy{}, "X-Forwarded-For", 2)),
+		NewChainStrategy(Must(NewSingleIPHeaderStrategy("True-Client-IP")), RemoteAddrStrategy{}),
+		NewConsensusStrategy(Must(NewRightmostStrategy("Forwarded")), Must(NewLeftmostStrategy("Forwarded"))),
+		NewRequireAllStrategy(RemoteAddrStrategy{}, Must(NewLeftmostStrategy("Forwarded"))),
+		WithResultCallback(RemoteAddrStrategy{}, func(_, _ string, _ Reason) {}),
+		customStrategy{ip: "2600:1f18::97%eth4"},
+		customStrategy{},
+	}
+	for _, remoteAddr := range []string{"[fe80::2%eth3]:1234", "10.0.0.2:1234", "nope"} {
+		for _, strat := range strategies {
+			want := strat.ClientIP(headers, remoteAddr)
+			got := ClientNetIPAddr(strat, headers, remoteAddr)
+			if want == "" {
+				if got != nil {
+					t.Fatalf("%T ClientNetIPAddr(%q) = %v, want nil", strat, remoteAddr, got)
+				}
+				continue
+			}
+			if got == nil || got.String() != want {
+				t.Fatalf("%T ClientNetIPAddr(%q) = %v, want %v", strat, remoteAddr, got, want)
+			}
+		}
+	}
+
+	// The zone is preserved
+	got := ClientNetIPAddr(Must(NewSingleIPHeaderStrategy("X-Real-IP")), headers, "")
+	if want := MustParseIPAddr("2600:1f18::98%eth2"); !got.IP.Equal(want.IP) || got.Zone != want.Zone {
+		t.Fatalf("ClientNetIPAddr = %v, want %v", got, want)
+	}
+}
+
+func TestReason_String(t *testing.T) {
+	reasons := []Reason{ReasonFound, ReasonHeaderMissing, ReasonNoValidIP, ReasonAllPrivate, ReasonCountTooLarge, ReasonAllTrusted, ReasonTooManyItems, ReasonMismatch, ReasonBlocked, ReasonMultipleHeaders, ReasonTrustGap, ReasonTooManyHops, ReasonHeaderTooLarge}
+	seen := map[string]bool{}
+	for _, r := range reasons {
+		str := r.String()
+		if str == "" || seen[str] || str == fmt.Sprintf("Reason(%d)", int(r)) {
+			t.Fatalf("Reason(%d).String() = %q is not a unique name", int(r), str)
+		}
+		seen[str] = true
+	}
+	if got := Reason(-1).String(); got != "Reason(-1)" {
+		t.Fatalf("Reason(-1).String() = %q", got)
+	}
+}
+
+func TestUnknownListItem(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("1.2.3.4")
+
+	tests := []struct {
+		strat      Strategy
+		want       string
+		wantReason Reason
+	}{
+		{Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")), "1.2.3.4", ReasonFound},
+		{Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")), "1.2.3.4", ReasonFound},
+		{Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1)), "", ReasonNoValidIP},
+		{Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 2)), "1.2.3.4", ReasonFound},
+		{Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1)), "1.2.3.4", ReasonFound},
+		// "unknown" is a hop, so it is counted
+		{Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)), "", ReasonNoValidIP},
+		{Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)), "", ReasonNoValidIP},
+	}
+
+	for _, headerValue := range []string{"unknown, 1.2.3.4", "UNKNOWN, 1.2.3.4", ", unknown,,1.2.3.4,"} {
+		headers := http.Header{"X-Forwarded-For": []string{headerValue}}
+		for _, tt := range tests {
+			res := deriveResult(tt.strat, headers, "")
+			if res.String() != tt.want || res.reason != tt.wantReason {
+				t.Fatalf("%T%v with %q = (%q, %v), want (%q, %v)", tt.strat, tt.strat, headerValue, res.String(), res.reason, tt.want, tt.wantReason)
+			}
+		}
+	}
+
+	// The same applies to the Forwarded header's "for=unknown"
+	headers := http.Header{"Forwarded": []string{"for=unknown, for=1.2.3.4"}}
+	if got := Must(NewRightmostTrustedCountStrategy("Forwarded", 2)).ClientIP(headers, ""); got != "" {
+		t.Fatalf("Forwarded for=unknown: ClientIP = %q, want empty", got)
+	}
+}
+
+func TestHopCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerName string
+		headers    http.Header
+		want       int
+	}{
+		{
+			name:       "Header missing",
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{},
+			want:       0,
+		},
+		{
+			name:       "XFF multiple headers",
+			headerName: "x-forwarded-for",
+			headers: http.Header{
+				"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`, `nope,unknown`},
+			},
+			want: 4,
+		},
+		{
+			name:       "XFF empty items",
+			headerName: "X-Forwarded-For",
+			headers: http.Header{
+				"X-Forwarded-For": []string{`, 1.1.1.1, ,2.2.2.2,`, ``, ` `},
+			},
+			want: 2,
+		},
+		{
+			name:       "XFF quotes are not special",
+			headerName: "X-Forwarded-For",
+			headers: http.Header{
+				"X-Forwarded-For": []string{`"1.1.1.1, 2.2.2.2"`},
+			},
+			want: 2,
+		},
+		{
+			name:       "Forwarded with quoted commas",
+			headerName: "Forwarded",
+			headers: http.Header{
+				"Forwarded": []string{`For="a,b";proto=https, For=2.2.2.2`, `for="\",";by=x,`},
+			},
+			want: 3,
+		},
+		{
+			name:       "Forwarded with unbalanced quotes",
+			headerName: "Forwarded",
+			headers: http.Header{
+				"Forwarded": []string{`For="1.1.1.1, For=2.2.2.2`},
+			},
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := HopCount(tt.headers, tt.headerName)
+			if got != tt.want {
+				t.Fatalf("HopCount() = %d, want %d", got, tt.want)
+			}
+
+			// It should agree with the list that the strategies use
+			headerName := http.CanonicalHeaderKey(tt.headerName)
+			if items, _ := getListItems(tt.headers, headerName, headerName == forwardedHdr, false, false); len(items) != got {
+				t.Fatalf("HopCount() = %d, but getListItems has %d items", got, len(items))
+			}
+		})
+	}
+}
+
+func Test_getListItems_obsFold(t *testing.T) {
+	tests := []struct {
+		name              string
+		headerName        string
+		value             string
+		lenientSeparators bool
+		want              []string
+	}{
+		{
+			name:       "X-Forwarded-For folded after comma",
+			headerName: "X-Forwarded-For",
+			value:      "1.1.1.1,\r\n 2.2.2.2,\r\n\t3.3.3.3",
+			want:       []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+		},
+		{
+			name:       "X-Forwarded-For folded before comma",
+			headerName: "X-Forwarded-For",
+			value:      "1.1.1.1\r\n , 2.2.2.2\r\n",
+			want:       []string{"1.1.1.1", "2.2.2.2"},
+		},
+		{
+			name:       "X-Forwarded-For folded without comma",
+			headerName: "X-Forwarded-For",
+			value:      "1.1.1.1\r\n 2.2.2.2",
+			want:       []string{""},
+		},
+		{
+			name:              "X-Forwarded-For folded without comma, lenient",
+			headerName:        "X-Forwarded-For",
+			value:             "1.1.1.1\r\n 2.2.2.2",
+			lenientSeparators: true,
+			want:              []string{"1.1.1.1", "2.2.2.2"},
+		},
+		{
+			name:       "Forwarded folded",
+			headerName: "Forwarded",
+			value:      "for=1.1.1.1;\r\n proto=https,\r\n\tfor=\"[2600:1f18::99]:4711\"\r\n ;by=3.3.3.3",
+			want:       []string{"1.1.1.1", "2600:1f18::99"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{tt.headerName: []string{tt.value}}
+			items, ok := getListItems(headers, tt.headerName, tt.headerName == forwardedHdr, false, tt.lenientSeparators)
+			if !ok {
+				t.Fatalf("getListItems() not ok")
+			}
+
+			got := []string{}
+			for _, item := range items {
+				if item.ipAddr == nil {
+					got = append(got, "")
+					continue
+				}
+				got = append(got, item.ipAddr.String())
+				if strings.ContainsAny(item.raw, "\r\n") {
+					t.Fatalf("item %q contains CR or LF", item.raw)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("getListItems() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_withListItems(t *testing.T) {
+	strat := Must(NewRightmostStrategy("X-Forwarded-For")).(RightmostStrategy)
+
+	// The pooled slices are reused, so results must not depend on earlier calls, even
+	// when they run concurrently
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				long := http.Header{"X-Forwarded-For": []string{fmt.Sprintf("1.1.1.1, 2.2.2.2, 3.3.3.%d", g)}}
+				if got := strat.ClientIP(long, ""); got != fmt.Sprintf("3.3.3.%d", g) {
+					t.Errorf("ClientIP = %q, want %q", got, fmt.Sprintf("3.3.3.%d", g))
+					return
+				}
+				empty := http.Header{"X-Forwarded-For": []string{""}}
+				if got, reason := ClientIPDetail(strat, empty, ""); got != "" || reason != ReasonHeaderMissing {
+					t.Errorf("ClientIPDetail = (%q, %v), want (\"\", %v)", got, reason, ReasonHeaderMissing)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// fn isn't called if there are too many items
+	headers := http.Header{"X-Forwarded-For": []string{strings.Repeat("1.1.1.1,", MaxListItems)}}
+	res := withListItems(headers, "X-Forwarded-For", HeaderSyntaxAuto, false, false, func(items []listItem) result {
+		t.Fatalf("fn called with %d items", len(items))
+		return result{}
+	})
+	if res.reason != ReasonTooManyItems {
+		t.Fatalf("reason = %v, want %v", res.reason, ReasonTooManyItems)
+	}
+}
+
+func TestMaxListItems(t *testing.T) {
+	// Restore the default when we're done
+	defer func(orig int) { MaxListItems = orig }(MaxListItems)
+	MaxListItems = 10
+
+	// Makes a list of n public IPs, the rightmost of which is 1.1.1.<n>
+	makeList := func(n int) string {
+		ips := make([]string, n)
+		for i := range ips {
+			ips[i] = fmt.Sprintf("1.1.1.%d", i+1)
+		}
+		return strings.Join(ips, ", ")
+	}
+
+	trustedRanges, _ := AddressesAndRangesToIPNets("1.1.1.9/32", "1.1.1.10/32")
+	strategies := []Strategy{
+		Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")).(LeftmostNonPrivateStrategy),
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")).(RightmostNonPrivateStrategy),
+		Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1)).(LeftmostTrustedCountStrategy),
+		Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1)).(RightmostTrustedCountStrategy),
+		Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy),
+	}
+	wants := []string{"1.1.1.1", "1.1.1.10", "1.1.1.1", "1.1.1.10", "1.1.1.8"}
+
+	for i, strat := range strategies {
+		// At the limit, everything works as usual
+		headers := http.Header{"X-Forwarded-For": []string{makeList(10)}}
+		if ip, reason := ClientIPDetail(strat, headers, ""); ip != wants[i] || reason != ReasonFound {
+			t.Fatalf("%T at limit: ClientIPDetail = (%q, %v), want (%q, %v)", strat, ip, reason, wants[i], ReasonFound)
+		}
+
+		// Over the limit, counting across multiple headers
+		headers = http.Header{"X-Forwarded-For": []string{makeList(5), makeList(6)}}
+		if ip, reason := ClientIPDetail(strat, headers, ""); ip != "" || reason != ReasonTooManyItems {
+			t.Fatalf("%T over limit: ClientIPDetail = (%q, %v), want (%q, %v)", strat, ip, reason, "", ReasonTooManyItems)
+		}
+	}
+
+	headers := http.Header{"X-Forwarded-For": []string{makeList(11)}}
+	if got := ChainSummary(headers, "X-Forwarded-For", trustedRanges); got != "client=- via []" {
+		t.Fatalf("ChainSummary over limit = %q", got)
+	}
+
+	// The limit can be disabled
+	MaxListItems = 0
+	strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))
+	headers = http.Header{"X-Forwarded-For": []string{makeList(200)}}
+	if got := strat.ClientIP(headers, ""); got != "1.1.1.200" {
+		t.Fatalf("ClientIP with no limit = %q, want %q", got, "1.1.1.200")
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	// Restore the default when we're done
+	defer func(orig int) { MaxHeaderBytes = orig }(MaxHeaderBytes)
+	MaxHeaderBytes = 32
+
+	strategies := []Strategy{
+		Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")).(LeftmostNonPrivateStrategy),
+		Must(NewRightmostStrategy("X-Forwarded-For")).(RightmostStrategy),
+		Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1)).(RightmostTrustedCountStrategy),
+		Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", nil)).(RightmostTrustedRangeStrategy),
+	}
+	wants := []string{"1.1.1.1", "4.4.4.4", "4.4.4.4", "4.4.4.4"}
+
+	for i, strat := range strategies {
+		// At the limit, everything works as usual (this is 32 bytes)
+		headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1,    2.2.2.2, 4.4.4.4"}}
+		if ip, reason := ClientIPDetail(strat, headers, ""); ip != wants[i] || reason != ReasonFound {
+			t.Fatalf("%T at limit: ClientIPDetail = (%q, %v), want (%q, %v)", strat, ip, reason, wants[i], ReasonFound)
+		}
+
+		// Over the limit, counting across multiple headers
+		headers = http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2", "3.3.3.3,  4.4.4.4"}}
+		if ip, reason := ClientIPDetail(strat, headers, ""); ip != "" || reason != ReasonHeaderTooLarge {
+			t.Fatalf("%T over limit: ClientIPDetail = (%q, %v), want (%q, %v)", strat, ip, reason, "", ReasonHeaderTooLarge)
+		}
+
+		// A single long item, which the item count wouldn't catch
+		headers = http.Header{"X-Forwarded-For": []string{strings.Repeat("1", 33)}}
+		if ip, reason := ClientIPDetail(strat, headers, ""); ip != "" || reason != ReasonHeaderTooLarge {
+			t.Fatalf("%T long item: ClientIPDetail = (%q, %v), want (%q, %v)", strat, ip, reason, "", ReasonHeaderTooLarge)
+		}
+	}
+
+	// The other parsing functions use the limit too
+	value := "1.1.1.1, 2.2.2.2, 3.3.3.3, 4.4.4.4"
+	if got := ParseXFFString(value); got != nil {
+		t.Fatalf("ParseXFFString over limit = %v, want nil", got)
+	}
+	if got := SanitizeXFF(value); got != "" {
+		t.Fatalf("SanitizeXFF over limit = %q, want empty", got)
+	}
+	if errs := ValidateXFF(value); len(errs) != 1 || !strings.Contains(errs[0].Error(), "MaxHeaderBytes") {
+		t.Fatalf("ValidateXFF over limit = %v, want a MaxHeaderBytes error", errs)
+	}
+	headers := http.Header{"X-Forwarded-For": []string{value}}
+	if got := ChainSummary(headers, "X-Forwarded-For", nil); got != "client=- via []" {
+		t.Fatalf("ChainSummary over limit = %q", got)
+	}
+
+	// The limit can be disabled
+	MaxHeaderBytes = 0
+	if got := Must(NewRightmostStrategy("X-Forwarded-For")).ClientIP(headers, ""); got != "4.4.4.4" {
+		t.Fatalf("ClientIP with no limit = %q, want %q", got, "4.4.4.4")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	reloadable, _ := NewReloadableTrustedRangeStrategy("X-Forwarded-For", trustedRanges)
+	emptyReloadable, _ := NewReloadableTrustedRangeStrategy("X-Forwarded-For", nil)
+
+	tests := []struct {
+		name    string
+		strat   Strategy
+		wantErr bool
+	}{
+		{
+			name:  "RemoteAddrStrategy",
+			strat: RemoteAddrStrategy{},
+		},
+		{
+			name:  "SingleIPHeaderStrategy",
+			strat: Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+		},
+		{
+			name:    "Error: zero SingleIPHeaderStrategy",
+			strat:   SingleIPHeaderStrategy{},
+			wantErr: true,
+		},
+		{
+			name:    "Error: SingleIPHeaderStrategy with list header",
+			strat:   SingleIPHeaderStrategy{headerName: xForwardedForHdr},
+			wantErr: true,
+		},
+		{
+			name:  "SingleIPHeadersStrategy",
+			strat: Must(NewSingleIPHeadersStrategy("X-Real-IP", "True-Client-IP")),
+		},
+		{
+			name:    "Error: zero SingleIPHeadersStrategy",
+			strat:   SingleIPHeadersStrategy{},
+			wantErr: true,
+		},
+		{
+			name:    "Error: SingleIPHeadersStrategy with empty header",
+			strat:   SingleIPHeadersStrategy{headerNames: []string{"X-Real-Ip", ""}},
+			wantErr: true,
+		},
+		{
+			name:  "LeftmostNonPrivateStrategy",
+			strat: Must(NewLeftmostNonPrivateStrategy("Forwarded")),
+		},
+		{
+			name:    "Error: zero LeftmostNonPrivateStrategy",
+			strat:   LeftmostNonPrivateStrategy{},
+			wantErr: true,
+		},
+		{
+			name:  "LeftmostStrategy",
+			strat: Must(NewLeftmostStrategy("Forwarded")),
+		},
+		{
+			name:    "Error: zero LeftmostStrategy",
+			strat:   LeftmostStrategy{},
+			wantErr: true,
+		},
+		{
+			name:    "Error: LeftmostStrategy with unknown family",
+			strat:   LeftmostStrategy{headerName: "Forwarded", family: Family(3)},
+			wantErr: true,
+		},
+		{
+			name:  "RightmostStrategy",
+			strat: Must(NewRightmostStrategy("X-Forwarded-For")),
+		},
+		{
+			name:    "Error: RightmostStrategy with single-IP header",
+			strat:   RightmostStrategy{headerName: "X-Real-Ip"},
+			wantErr: true,
+		},
+		{
+			name:  "RightmostNonPrivateStrategy",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		},
+		{
+			name:    "Error: RightmostNonPrivateStrategy with bad header",
+			strat:   RightmostNonPrivateStrategy{headerName: "X-Real-Ip"},
+			wantErr: true,
+		},
+		{
+			name:  "LeftmostTrustedCountStrategy",
+			strat: Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 2)),
+		},
+		{
+			name:    "Error: LeftmostTrustedCountStrategy with zero count",
+			strat:   LeftmostTrustedCountStrategy{headerName: xForwardedForHdr},
+			wantErr: true,
+		},
+		{
+			name:  "RightmostTrustedCountStrategy",
+			strat: Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)),
+		},
+		{
+			name:    "Error: RightmostTrustedCountStrategy with no header",
+			strat:   RightmostTrustedCountStrategy{trustedCount: 2},
+			wantErr: true,
+		},
+		{
+			name:  "RightmostTrustedRangeStrategy",
+			strat: Must(NewRightmostTrustedRangeStrategy("Forwarded", trustedRanges, WithRequireHTTPS(true))),
+		},
+		{
+			// Allowed by the constructor, so valid; the rightmost IP is returned
+			name:  "RightmostTrustedRangeStrategy with no ranges",
+			strat: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", nil)),
+		},
+		{
+			name:    "Error: RightmostTrustedRangeStrategy requireHTTPS with X-Forwarded-For",
+			strat:   RightmostTrustedRangeStrategy{headerName: xForwardedForHdr, trustedRanges: trustedRanges, requireHTTPS: true},
+			wantErr: true,
+		},
+		{
+			name:  "ReloadableTrustedRangeStrategy",
+			strat: reloadable,
+		},
+		{
+			name:  "ReloadableTrustedRangeStrategy with no ranges",
+			strat: emptyReloadable,
+		},
+		{
+			name:  "ProxyProtocolStrategy",
+			strat: Must(NewProxyProtocolStrategy("X-Proxy-Protocol")),
+		},
+		{
+			name:    "Error: zero ProxyProtocolStrategy",
+			strat:   ProxyProtocolStrategy{},
+			wantErr: true,
+		},
+		{
+			name:  "ChainStrategy",
+			strat: NewChainStrategy(Must(NewSingleIPHeaderStrategy("X-Real-IP")), RemoteAddrStrategy{}),
+		},
+		{
+			name:    "Error: empty ChainStrategy",
+			strat:   NewChainStrategy(),
+			wantErr: true,
+		},
+		{
+			name:    "Error: ChainStrategy with invalid strategy",
+			strat:   NewChainStrategy(RemoteAddrStrategy{}, SingleIPHeaderStrategy{}),
+			wantErr: true,
+		},
+		{
+			name:  "ConsensusStrategy",
+			strat: NewConsensusStrategy(Must(NewRightmostTrustedCountStrategy("Forwarded", 1)), Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))),
+		},
+		{
+			name:    "Error: empty ConsensusStrategy",
+			strat:   NewConsensusStrategy(),
+			wantErr: true,
+		},
+		{
+			name:    "Error: ConsensusStrategy with invalid strategy",
+			strat:   NewConsensusStrategy(RemoteAddrStrategy{}, SingleIPHeaderStrategy{}),
+			wantErr: true,
+		},
+		{
+			name:    "Error: ConsensusStrategy with nil strategy",
+			strat:   NewConsensusStrategy(RemoteAddrStrategy{}, nil),
+			wantErr: true,
+		},
+		{
+			name:  "RequireAllStrategy",
+			strat: NewRequireAllStrategy(RemoteAddrStrategy{}, Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))),
+		},
+		{
+			name:    "Error: empty RequireAllStrategy",
+			strat:   NewRequireAllStrategy(),
+			wantErr: true,
+		},
+		{
+			name:    "Error: RequireAllStrategy with invalid strategy",
+			strat:   NewRequireAllStrategy(RemoteAddrStrategy{}, SingleIPHeaderStrategy{}),
+			wantErr: true,
+		},
+		{
+			name:    "Error: RequireAllStrategy with nil strategy",
+			strat:   NewRequireAllStrategy(RemoteAddrStrategy{}, nil),
+			wantErr: true,
+		},
+		{
+			name:    "Error: ChainStrategy with nil strategy",
+			strat:   NewChainStrategy(RemoteAddrStrategy{}, nil),
+			wantErr: true,
+		},
+		{
+			name:  "WithResultCallback",
+			strat: WithResultCallback(RemoteAddrStrategy{}, func(_, _ string, _ Reason) {}),
+		},
+		{
+			name:    "Error: WithResultCallback with invalid strategy",
+			strat:   WithResultCallback(LeftmostNonPrivateStrategy{}, func(_, _ string, _ Reason) {}),
+			wantErr: true,
+		},
+		{
+			name:    "Error: WithResultCallback with nil strategy",
+			strat:   WithResultCallback(nil, func(_, _ string, _ Reason) {}),
+			wantErr: true,
+		},
+		{
+			name:    "Error: WithResultCallback with nil callback",
+			strat:   WithResultCallback(RemoteAddrStrategy{}, nil),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.strat.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithZone(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		strat   Strategy
+		headers http.Header
+		want    string
+	}{
+		{
+			name:    "SingleIPHeaderStrategy",
+			strat:   Must(NewSingleIPHeaderStrategy("X-Real-IP", WithZone(false))),
+			headers: http.Header{"X-Real-Ip": []string{`fe80::1%eth0`}},
+			want:    "fe80::1",
+		},
+		{
+			name:    "LeftmostNonPrivateStrategy",
+			strat:   Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithZone(false))),
+			headers: http.Header{"X-Forwarded-For": []string{`2600:1f18::99%eth0, 10.0.0.1`}},
+			want:    "2600:1f18::99",
+		},
+		{
+			name:    "RightmostNonPrivateStrategy",
+			strat:   Must(NewRightmostNonPrivateStrategyWithRanges("Forwarded", nil, WithZone(false))),
+			headers: http.Header{"Forwarded": []string{`for="[2600:1f18::99%eth0]:4711", for=10.0.0.1`}},
+			want:    "2600:1f18::99",
+		},
+		{
+			name:    "LeftmostTrustedCountStrategy",
+			strat:   Must(NewLeftmostTrustedCountStrategy("X-Forwarded-For", 1, WithZone(false))),
+			headers: http.Header{"X-Forwarded-For": []string{`2001:db8:cafe::99%eth0, 10.0.0.1`}},
+			want:    "2001:db8:cafe::99",
+		},
+		{
+			name:    "RightmostTrustedCountStrategy",
+			strat:   Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, WithZone(false))),
+			headers: http.Header{"X-Forwarded-For": []string{`2001:db8:cafe::99%eth0, 10.0.0.1`}},
+			want:    "2001:db8:cafe::99",
+		},
+		{
+			name:    "RightmostTrustedRangeStrategy",
+			strat:   Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithZone(false))),
+			headers: http.Header{"X-Forwarded-For": []string{`2001:db8:cafe::99%eth0, 10.0.0.1`}},
+			want:    "2001:db8:cafe::99",
+		},
+		{
+			name:    "RightmostTrustedRangeStrategy non-recursive",
+			strat:   Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithRecursive(false), WithZone(false))),
+			headers: http.Header{"X-Forwarded-For": []string{`2001:db8:cafe::99%eth0`}},
+			want:    "2001:db8:cafe::99",
+		},
+		{
+			name:    "ProxyProtocolStrategy",
+			strat:   Must(NewProxyProtocolStrategy("X-Proxy-Protocol", WithZone(false))),
+			headers: http.Header{"X-Proxy-Protocol": []string{`PROXY TCP6 fe80::1%eth0 2001:db8::2 56324 443`}},
+			want:    "fe80::1",
+		},
+		{
+			name:    "Zone kept by default",
+			strat:   Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)),
+			headers: http.Header{"X-Forwarded-For": []string{`2001:db8:cafe::99%eth0, 10.0.0.1`}},
+			want:    "2001:db8:cafe::99%eth0",
+		},
+		{
+			name:    "Zone kept explicitly",
+			strat:   Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithZone(true))),
+			headers: http.Header{"X-Forwarded-For": []string{`2001:db8:cafe::99%eth0, 10.0.0.1`}},
+			want:    "2001:db8:cafe::99%eth0",
+		},
+		{
+			name:    "No zone to strip",
+			strat:   Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithZone(false))),
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1, 10.0.0.1`}},
+			want:    "1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strat.ClientIP(tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithFamily(t *testing.T) {
+	tests := []struct {
+		name       string
+		strat      Strategy
+		xff        string
+		want       string
+		wantReason Reason
+	}{
+		{
+			name:       "Leftmost non-private is IPv6, require IPv4",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyIPv4))),
+			xff:        "10.0.0.1, 2607:f8b0:4004:83f::200e, 188.0.2.128, 3.3.3.3",
+			want:       "188.0.2.128",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "IPv4-mapped is IPv4",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyIPv4))),
+			xff:        "2607:f8b0:4004:83f::200e, ::ffff:188.0.2.128",
+			want:       "188.0.2.128",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Require IPv6",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyIPv6))),
+			xff:        "188.0.2.128, fd00::1, 2607:f8b0:4004:83f::200e",
+			want:       "2607:f8b0:4004:83f::200e",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Any family",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyAny))),
+			xff:        "10.0.0.1, 2607:f8b0:4004:83f::200e, 188.0.2.128",
+			want:       "2607:f8b0:4004:83f::200e",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "LeftmostStrategy require IPv4",
+			strat:      Must(NewLeftmostStrategy("X-Forwarded-For", WithFamily(FamilyIPv4))),
+			xff:        "fd00::1, 10.0.0.1",
+			want:       "10.0.0.1",
+			wantReason: ReasonFound,
+		},
+		{
+			name:       "Fail: no IP of the family",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyIPv4))),
+			xff:        "2607:f8b0:4004:83f::200e, 2001:4860::1",
+			want:       "",
+			wantReason: ReasonNoValidIP,
+		},
+		{
+			name:       "Fail: all IPs of the family are private",
+			strat:      Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(FamilyIPv4))),
+			xff:        "2607:f8b0:4004:83f::200e, 10.0.0.1",
+			want:       "",
+			wantReason: ReasonAllPrivate,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+			res := deriveResult(tt.strat, headers, "")
+			if res.String() != tt.want || res.reason != tt.wantReason {
+				t.Fatalf("derive = (%q, %v), want (%q, %v)", res.String(), res.reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	if _, err := NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithFamily(Family(99))); err == nil {
+		t.Fatalf("NewLeftmostNonPrivateStrategy() expected error for unknown family")
+	}
+	if _, err := NewLeftmostStrategy("X-Forwarded-For", WithFamily(Family(-1))); err == nil {
+		t.Fatalf("NewLeftmostStrategy() expected error for unknown family")
+	}
+	if got := Family(99).String(); got != "Family(99)" {
+		t.Fatalf("Family.String() = %q", got)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{
+			name: "SingleIPHeaderStrategy empty header",
+			err:  second(NewSingleIPHeaderStrategy("")),
+			want: ErrEmptyHeaderName,
+		},
+		{
+			name: "SingleIPHeadersStrategy empty header",
+			err:  second(NewSingleIPHeadersStrategy("X-Real-IP", "")),
+			want: ErrEmptyHeaderName,
+		},
+		{
+			name: "ProxyProtocolStrategy empty header",
+			err:  second(NewProxyProtocolStrategy("")),
+			want: ErrEmptyHeaderName,
+		},
+		{
+			name: "LeftmostNonPrivateStrategy not list",
+			err:  second(NewLeftmostNonPrivateStrategy("X-Real-IP")),
+			want: ErrHeaderNotList,
+		},
+		{
+			name: "RightmostNonPrivateStrategy empty header",
+			err:  second(NewRightmostNonPrivateStrategy("")),
+			want: ErrEmptyHeaderName,
+		},
+		{
+			name: "RightmostTrustedCountStrategy not list",
+			err:  second(NewRightmostTrustedCountStrategy("X-Real-IP", 1)),
+			want: ErrHeaderNotList,
+		},
+		{
+			name: "RightmostTrustedCountStrategy zero count",
+			err:  second(NewRightmostTrustedCountStrategy("X-Forwarded-For", 0)),
+			want: ErrNonPositiveCount,
+		},
+		{
+			name: "LeftmostTrustedCountStrategy negative count",
+			err:  second(NewLeftmostTrustedCountStrategy("X-Forwarded-For", -1)),
+			want: ErrNonPositiveCount,
+		},
+		{
+			name: "RightmostTrustedRangeStrategy not list",
+			err:  second(NewRightmostTrustedRangeStrategy("X-Real-IP", nil)),
+			want: ErrHeaderNotList,
+		},
+		{
+			name: "ReloadableTrustedRangeStrategy empty header",
+			err:  second(NewReloadableTrustedRangeStrategy("", nil)),
+			want: ErrEmptyHeaderName,
+		},
+		{
+			name: "Validate",
+			err:  LeftmostTrustedCountStrategy{headerName: "X-Forwarded-For"}.Validate(),
+			want: ErrNonPositiveCount,
+		},
+		{
+			name: "Validate in chain",
+			err:  NewChainStrategy(RightmostNonPrivateStrategy{}).Validate(),
+			want: ErrEmptyHeaderName,
+		},
+		{
+			name: "AddressesAndRangesToIPNets zone",
+			err:  second(AddressesAndRangesToIPNets("fe80::1%eth0")),
+			want: ErrZoneNotAllowed,
+		},
+		{
+			name: "ParseIPNetsFromReader zone",
+			err:  second(ParseIPNetsFromReader(strings.NewReader("10.0.0.0/8\nfe80::/10%eth0\n"))),
+			want: ErrZoneNotAllowed,
+		},
+		{
+			name: "StrategyFromString not list",
+			err:  second(StrategyFromString("rightmost-non-private:X-Real-IP")),
+			want: ErrHeaderNotList,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, tt.want) {
+				t.Fatalf("error = %v, want %v", tt.err, tt.want)
+			}
+		})
+	}
+}
+
+// second returns its second argument. It is used to get the error from functions that
+// return a value and an error.
+func second[T any](_ T, err error) error {
+	return err
+}
+
+func TestStrategy_String(t *testing.T) {
+	ranges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::1")
+	reloadable, _ := NewReloadableTrustedRangeStrategy("X-Forwarded-For", ranges)
+
+	tests := []struct {
+		strat Strategy
+		want  string
+	}{
+		{RemoteAddrStrategy{}, `{}`},
+		{Must(NewSingleIPHeaderStrategy("x-real-ip")), `{headerName:X-Real-Ip}`},
+		{Must(NewSingleIPHeaderStrategy("x-real-ip", WithRejectMultipleHeaders(true))), `{headerName:X-Real-Ip rejectMultipleHeaders:true}`},
+		{Must(NewSingleIPHeaderStrategy("x-real-ip", WithUnspecified(true), WithRejectMultipleHeaders(true))), `{headerName:X-Real-Ip rejectMultipleHeaders:true unspecified:true}`},
+		{Must(NewSingleIPHeadersStrategy("x-real-ip", "cf-connecting-ip")), `{headerNames:[X-Real-Ip Cf-Connecting-Ip]}`},
+		{Must(NewLeftmostNonPrivateStrategy("Forwarded")), `{headerName:Forwarded privateRanges:default}`},
+		{Must(NewLeftmostNonPrivateStrategyWithRanges("Forwarded", []net.IPNet{})), `{headerName:Forwarded privateRanges:[]}`},
+		{Must(NewRightmostNonPrivateStrategyWithRanges("X-Forwarded-For", ranges)), `{headerName:X-Forwarded-For privateRanges:[10.0.0.0/8 2001:db8::1/128]}`},
+		{Must(NewLeftmostStrategy("Forwarded")), `{headerName:Forwarded}`},
+		{Must(NewLeftmostNonPrivateStrategy("Forwarded", WithFamily(FamilyIPv4), WithZone(false))), `{headerName:Forwarded privateRanges:default family:IPv4 zone:false}`},
+		{Must(NewRightmostStrategy("X-Forwarded-For", WithZone(false))), `{headerName:X-Forwarded-For zone:false}`},
+		{Must(NewRightmostStrategy("X-Forwarded-For", WithZone(false), WithMappedIPv6(true))), `{headerName:X-Forwarded-For zone:false mappedIPv6:true}`},
+		{Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, WithRejectReserved(true))), `{headerName:X-Forwarded-For trustedCount:1 rejectReserved:true}`},
+		{Must(NewRightmostStrategy("Forwarded", WithStrictForwarded(true))), `{headerName:Forwarded strictForwarded:true}`},
+		{Must(NewLeftmostStrategy("X-Forwarded-For", WithLenientSeparators(true))), `{headerName:X-Forwarded-For lenientSeparators:true}`},
+		{Must(NewRightmostTrustedCountStrategy("Forwarded", 2, WithStrictForwarded(true), WithZone(false))), `{headerName:Forwarded trustedCount:2 zone:false strictForwarded:true}`},
+		{Must(NewLeftmostStrategy("X-CDN-Client-Chain", WithHeaderSyntax(HeaderSyntaxXFF))), `{headerName:X-Cdn-Client-Chain syntax:xff}`},
+		{Must(NewRightmostTrustedRangeStrategy("X-CDN-Forwarded", ranges, WithHeaderSyntax(HeaderSyntaxForwarded), WithStrictForwarded(true))),
+			`{headerName:X-Cdn-Forwarded trustedRanges:[10.0.0.0/8 2001:db8::1/128] strictForwarded:true syntax:forwarded}`},
+		{Must(NewRightmostTrustedRangeStrategy("Forwarded", ranges, WithContiguousTrust(true))),
+			`{headerName:Forwarded trustedRanges:[10.0.0.0/8 2001:db8::1/128] contiguousTrust:true}`},
+		{Must(NewLeftmostTrustedCountStrategy("Forwarded", 1)), `{headerName:Forwarded trustedCount:1}`},
+		{Must(NewRightmostTrustedCountStrategy("Forwarded", 2)), `{headerName:Forwarded trustedCount:2}`},
+		{Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges)), `{headerName:X-Forwarded-For trustedRanges:[10.0.0.0/8 2001:db8::1/128]}`},
+		{Must(NewRightmostTrustedRangeStrategy("Forwarded", nil, WithRequireHTTPS(true))), `{headerName:Forwarded trustedRanges:[] requireHTTPS:true}`},
+		{reloadable, `{headerName:X-Forwarded-For trustedRanges:[10.0.0.0/8 2001:db8::1/128]}`},
+		{Must(NewProxyProtocolStrategy("X-Proxy-Protocol")), `{headerName:X-Proxy-Protocol}`},
+		{Must(NewLeftmostTrustedCountStrategy("Forwarded", 1, WithZone(false))), `{headerName:Forwarded trustedCount:1 zone:false}`},
+		{Must(NewRightmostTrustedRangeStrategy("Forwarded", nil, WithRecursive(false), WithZone(false))), `{headerName:Forwarded trustedRanges:[] recursive:false zone:false}`},
+		{
+			NewChainStrategy(Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")), RemoteAddrStrategy{}),
+			`{strategies:[realclientip.SingleIPHeaderStrategy{headerName:Cf-Connecting-Ip} realclientip.RemoteAddrStrategy{}]}`,
+		},
+		{
+			NewConsensusStrategy(RemoteAddrStrategy{}, Must(NewSingleIPHeaderStrategy("X-Real-IP"))),
+			`{strategies:[realclientip.RemoteAddrStrategy{} realclientip.SingleIPHeaderStrategy{headerName:X-Real-Ip}]}`,
+		},
+		{
+			NewRequireAllStrategy(RemoteAddrStrategy{}, Must(NewSingleIPHeaderStrategy("X-Real-IP"))),
+			`{strategies:[realclientip.RemoteAddrStrategy{} realclientip.SingleIPHeaderStrategy{headerName:X-Real-Ip}]}`,
+		},
+		{
+			WithResultCallback(RemoteAddrStrategy{}, func(_, _ string, _ Reason) {}),
+			`{strategy:realclientip.RemoteAddrStrategy{}}`,
+		},
+	}
+	for _, tt := range tests {
+		// Both the String method and %+v formatting should give the same result
+		if got := fmt.Sprint(tt.strat); got != tt.want {
+			t.Fatalf("%T String() = %q, want %q", tt.strat, got, tt.want)
+		}
+		if got := fmt.Sprintf("%+v", tt.strat); got != tt.want {
+			t.Fatalf("%T %%+v = %q, want %q", tt.strat, got, tt.want)
+		}
+	}
+}
+
+func TestMust(t *testing.T) {
+	// We test the non-panic path elsewhere, but we need to specifically check the panic case
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Must() did not panic")
+		}
+	}()
+
+	Must(RemoteAddrStrategy{}, fmt.Errorf("oh no"))
+}
+
+func TestClientIPHash(t *testing.T) {
+	strat := RemoteAddrStrategy{}
+	salt := []byte("secret")
+
+	ip, hash := ClientIPHash(strat, nil, "[::ffff:188.0.2.128]:4747", salt)
+	if ip != "188.0.2.128" {
+		t.Fatalf("ClientIPHash ip = %q, want %q", ip, "188.0.2.128")
+	}
+	if len(hash) != 64 {
+		t.Fatalf("ClientIPHash hash length = %d, want 64", len(hash))
+	}
+
+	// Different representations of the same IP must hash identically
+	_, hash2 := ClientIPHash(strat, nil, "188.0.2.128:1234", salt)
+	if hash2 != hash {
+		t.Fatalf("ClientIPHash hashes differ for the same IP: %q != %q", hash, hash2)
+	}
+
+	// A different salt must produce a different hash
+	_, hash3 := ClientIPHash(strat, nil, "188.0.2.128", []byte("other"))
+	if hash3 == hash {
+		t.Fatalf("ClientIPHash hashes are equal for different salts")
+	}
+
+	// A different IP must produce a different hash
+	_, hash4 := ClientIPHash(strat, nil, "188.0.2.129", salt)
+	if hash4 == hash {
+		t.Fatalf("ClientIPHash hashes are equal for different IPs")
+	}
+
+	// With WithMappedIPv6, the IP keeps its notation, but the hash must not change
+	mappedStrat := Must(NewSingleIPHeaderStrategy("X-Real-IP", WithMappedIPv6(true)))
+	ip, hash5 := ClientIPHash(mappedStrat, http.Header{"X-Real-Ip": []string{"::ffff:188.0.2.128"}}, "", salt)
+	if ip != "::ffff:188.0.2.128" {
+		t.Fatalf("ClientIPHash ip = %q, want %q", ip, "::ffff:188.0.2.128")
+	}
+	if hash5 != hash {
+		t.Fatalf("ClientIPHash hashes differ for mapped notation: %q != %q", hash, hash5)
+	}
+
+	// The zone is not included in the hash
+	_, hash6 := ClientIPHash(strat, nil, "[fe80::1%eth0]:1234", salt)
+	_, hash7 := ClientIPHash(strat, nil, "fe80::1", salt)
+	if hash6 != hash7 {
+		t.Fatalf("ClientIPHash hashes differ for zone: %q != %q", hash6, hash7)
+	}
+
+	ip, hash = ClientIPHash(strat, nil, "nope", salt)
+	if ip != "" || hash != "" {
+		t.Fatalf("ClientIPHash = (%q, %q), want empty", ip, hash)
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	tests := []struct {
+		name       string
+		xff        string
+		v4Bits     int
+		v6Bits     int
+		want       string
+		wantPrefix string
+		badBits    bool
+	}{
+		{"IPv4", "1.1.1.1, [2.2.2.2]:4711", 0, 0, "2.2.2.2", "2.2.2.2/32", false},
+		{"IPv4 network", "2.2.2.2", 24, 0, "2.2.2.2", "2.2.2.0/24", false},
+		{"IPv6 with zone", "2600:1f18::99%eth0", 0, 0, "2600:1f18::99", "2600:1f18::/64", false},
+		{"IPv6 network", "[2600:1f18:1:2:3::99%eth0]:4711", 0, 48, "2600:1f18:1:2:3::99", "2600:1f18:1::/48", false},
+		{"IPv4-mapped IPv6", "::ffff:2.2.2.2", 0, 0, "2.2.2.2", "2.2.2.2/32", false},
+		{"No IP", "10.0.0.1", 0, 0, "", "", false},
+		{"Bad prefix length", "2.2.2.2", 33, 0, "2.2.2.2", "", true},
+		{"Bad prefix length for other family", "2.2.2.2", 0, 129, "2.2.2.2", "", true},
+		{"Bad prefix length and no IP", "10.0.0.1", -1, 0, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+
+			checkPrefix := func(label, key string, err error) {
+				t.Helper()
+				if key != tt.wantPrefix {
+					t.Fatalf("%s = %q, want %q", label, key, tt.wantPrefix)
+				}
+				switch {
+				case tt.badBits:
+					if err == nil || errors.Is(err, ErrNoClientIP) {
+						t.Fatalf("%s error = %v, want a prefix length error", label, err)
+					}
+				case tt.wantPrefix == "":
+					if !errors.Is(err, ErrNoClientIP) {
+						t.Fatalf("%s error = %v, want ErrNoClientIP", label, err)
+					}
+				case err != nil:
+					t.Fatalf("%s error = %v", label, err)
+				}
+			}
+
+			key, ok := LimiterKey(strat, headers, "")
+			if key != tt.want || ok != (tt.want != "") {
+				t.Fatalf("LimiterKey = (%q, %v), want (%q, %v)", key, ok, tt.want, tt.want != "")
+			}
+
+			key, err := LimiterKeyPrefix(strat, headers, "", tt.v4Bits, tt.v6Bits)
+			checkPrefix("LimiterKeyPrefix", key, err)
+
+			// With WithMappedIPv6, the keys must be the same whichever notation is used
+			mappedStrat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithMappedIPv6(true)))
+			key, ok = LimiterKey(mappedStrat, headers, "")
+			if key != tt.want || ok != (tt.want != "") {
+				t.Fatalf("LimiterKey with mapped IPv6 = (%q, %v), want (%q, %v)", key, ok, tt.want, tt.want != "")
+			}
+			key, err = LimiterKeyPrefix(mappedStrat, headers, "", tt.v4Bits, tt.v6Bits)
+			checkPrefix("LimiterKeyPrefix with mapped IPv6", key, err)
+		})
+	}
+}
+
+func TestNetworkPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		v4Bits  int
+		v6Bits  int
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "IPv4 default",
+			ip:   "188.0.2.128",
+			want: "188.0.2.128/32",
+		},
+		{
+			name:   "IPv4 /24",
+			ip:     "188.0.2.128:8080",
+			v4Bits: 24,
+			want:   "188.0.2.0/24",
 		},
 		{
-			name: "Fail: rightmost non-trusted IP unspecified",
-			args: args{
-				headerName: "X-Forwarded-For",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
-				},
-				trustedRanges: []string{`2.2.2.0/24`},
-			},
-			want: "",
+			name:   "IPv4-mapped IPv6",
+			ip:     "::ffff:188.0.2.128",
+			v4Bits: 16,
+			v6Bits: 48,
+			want:   "188.0.0.0/16",
 		},
 		{
-			name: "Fail: no values in header",
-			args: args{
-				headerName: "X-Forwarded-For",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{}},
-				trustedRanges: []string{`2.2.2.0/24`},
-			},
-			want: "",
+			name: "IPv6 default",
+			ip:   "2001:db8:cafe:1234:5678::99",
+			want: "2001:db8:cafe:1234::/64",
 		},
 		{
-			name: "Error: empty header nanme",
-			args: args{
-				headerName: "",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-				},
-				trustedRanges: nil,
-			},
+			name:   "IPv6 /48 with zone and port",
+			ip:     "[2001:db8:cafe:1234::99%eth0]:4711",
+			v4Bits: 24,
+			v6Bits: 48,
+			want:   "2001:db8:cafe::/48",
+		},
+		{
+			name:   "IPv6 /128",
+			ip:     "2001:db8::99",
+			v6Bits: 128,
+			want:   "2001:db8::99/128",
+		},
+		{
+			name:    "Error: bad IP",
+			ip:      "nope",
 			wantErr: true,
 		},
 		{
-			name: "Error: bad header nanme",
-			args: args{
-				headerName: "Not-XFF-Or-Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-				},
-				trustedRanges: nil,
-			},
+			name:    "Error: IPv4 bits too large",
+			ip:      "188.0.2.128",
+			v4Bits:  33,
+			wantErr: true,
+		},
+		{
+			name:    "Error: IPv6 bits negative",
+			ip:      "2001:db8::99",
+			v6Bits:  -1,
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ranges, err := AddressesAndRangesToIPNets(tt.args.trustedRanges...)
-			if err != nil {
-				// We're not testing AddressesAndRangesToIPNets here
-				t.Fatalf("AddressesAndRangesToIPNets failed")
-			}
-
-			strat, err := NewRightmostTrustedRangeStrategy(tt.args.headerName, ranges)
+			got, err := NetworkPrefix(tt.ip, tt.v4Bits, tt.v6Bits)
 			if (err != nil) != tt.wantErr {
-				t.Fatalf("NewRightmostTrustedRangeStrategy error = %v, wantErr %v", err, tt.wantErr)
-				return
+				t.Fatalf("NetworkPrefix() error = %v, wantErr %v", err, tt.wantErr)
 			}
-
-			if err != nil {
-				// We can't continue
-				return
-			}
-
-			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			if got != tt.want {
+				t.Fatalf("NetworkPrefix() = %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestChainStrategy(t *testing.T) {
-	type args struct {
-		strategies []Strategy
-		headers    http.Header
-		remoteAddr string
-	}
+func TestAnonymize(t *testing.T) {
 	tests := []struct {
-		name string
-		args args
-		want string
+		name    string
+		ip      string
+		want    string
+		wantErr bool
 	}{
 		{
-			name: "Single strategy",
-			args: args{
-				strategies: []Strategy{RemoteAddrStrategy{}},
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-				},
-				remoteAddr: `5.5.5.5`,
-			},
-			want: "5.5.5.5",
+			name: "IPv4",
+			ip:   "188.0.2.128",
+			want: "188.0.2.0",
 		},
 		{
-			name: "Multiple strategies",
-			args: args{
-				strategies: []Strategy{
-					Must(NewRightmostNonPrivateStrategy("Forwarded")),
-					Must(NewSingleIPHeaderStrategy("true-client-ip")),
-					Must(NewSingleIPHeaderStrategy("x-real-ip")),
-					RemoteAddrStrategy{},
-				},
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-				},
-				remoteAddr: `5.5.5.5`,
-			},
-			want: "1.1.1.1",
+			name: "IPv4 with port",
+			ip:   "188.0.2.128:8080",
+			want: "188.0.2.0",
 		},
 		{
-			name: "Fail: No strategies",
-			args: args{
-				strategies: nil,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-				},
-				remoteAddr: `5.5.5.5`,
-			},
-			want: "",
+			name: "IPv4-mapped IPv6",
+			ip:   "::ffff:188.0.2.128",
+			want: "188.0.2.0",
 		},
 		{
-			name: "Fail: Multiple strategies, all fail",
-			args: args{
-				strategies: []Strategy{
-					Must(NewRightmostNonPrivateStrategy("Forwarded")),
-					Must(NewSingleIPHeaderStrategy("true-client-ip")),
-					Must(NewSingleIPHeaderStrategy("x-real-ip")),
-					RemoteAddrStrategy{},
-				},
-				headers: http.Header{
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-				},
-				remoteAddr: "",
-			},
-			want: "",
+			name: "IPv6",
+			ip:   "2001:db8:cafe:1234:5678::99",
+			want: "2001:db8:cafe::",
+		},
+		{
+			name: "IPv6 with zone",
+			ip:   "[fe80::1:2:3:4%eth0]:4711",
+			want: "fe80::",
+		},
+		{
+			name:    "Error: bad IP",
+			ip:      "nope",
+			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			strat := NewChainStrategy(tt.args.strategies...)
-
-			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			got, err := Anonymize(tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Anonymize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Anonymize() = %q, want %q", got, tt.want)
 			}
 		})
 	}
-}
-
-func TestMust(t *testing.T) {
-	// We test the non-panic path elsewhere, but we need to specifically check the panic case
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("Must() did not panic")
-		}
-	}()
 
-	Must(RemoteAddrStrategy{}, fmt.Errorf("oh no"))
+	// A different variant
+	if got, _ := AnonymizeWithBits("188.0.2.128", 16, 32); got != "188.0.0.0" {
+		t.Fatalf("AnonymizeWithBits() = %q, want %q", got, "188.0.0.0")
+	}
+	if got, _ := AnonymizeWithBits("2001:db8:cafe::99", 16, 32); got != "2001:db8::" {
+		t.Fatalf("AnonymizeWithBits() = %q, want %q", got, "2001:db8::")
+	}
+	if _, err := AnonymizeWithBits("2001:db8:cafe::99", 24, 129); err == nil {
+		t.Fatalf("AnonymizeWithBits() expected error for too many bits")
+	}
 }
 
 func TestMustParseIPAddr(t *testing.T) {
@@ -1627,7 +6370,7 @@ func Test_goodIPAddr(t *testing.T) {
 	}
 }
 
-func Test_isPrivateOrLocal(t *testing.T) {
+func TestIsPrivateOrLocal(t *testing.T) {
 	tests := []struct {
 		name string
 		ip   string
@@ -1653,11 +6396,67 @@ func Test_isPrivateOrLocal(t *testing.T) {
 			ip:   `192.168.1.1`,
 			want: true,
 		},
+		{
+			name: "IPv4 benchmarking",
+			ip:   `198.19.255.1`,
+			want: true,
+		},
+		{
+			// Not to be confused with the benchmarking range
+			name: "IPv4 192.18.*",
+			ip:   `192.18.0.1`,
+			want: false,
+		},
 		{
 			name: "IPv6 unique local address",
 			ip:   `fd12:3456:789a:1::1`,
 			want: true,
 		},
+		{
+			name: "IPv4-mapped IPv6 192.168.*",
+			ip:   `::ffff:192.168.1.1`,
+			want: true,
+		},
+		{
+			name: "IPv4-mapped IPv6 loopback",
+			ip:   `::ffff:127.0.0.1`,
+			want: true,
+		},
+		{
+			name: "IPv4-mapped IPv6 link-local",
+			ip:   `::ffff:169.254.1.1`,
+			want: true,
+		},
+		{
+			name: "IPv4-mapped IPv6 10.* in hex form",
+			ip:   `::ffff:0a00:0001`,
+			want: true,
+		},
+		{
+			name: "IPv4-mapped IPv6 public",
+			ip:   `::ffff:8.8.8.8`,
+			want: false,
+		},
+		{
+			name: "NAT64 with private embedded IPv4",
+			ip:   `64:ff9b::192.168.0.1`,
+			want: true,
+		},
+		{
+			name: "NAT64 with loopback embedded IPv4",
+			ip:   `64:ff9b::7f00:1`,
+			want: true,
+		},
+		{
+			name: "NAT64 with public embedded IPv4",
+			ip:   `64:ff9b::8.8.8.8`,
+			want: false,
+		},
+		{
+			name: "Outside NAT64 well-known prefix",
+			ip:   `64:ff9b:1::192.168.0.1`,
+			want: false,
+		},
 		{
 			name: "IPv4 link-local",
 			ip:   `169.254.1.1`,
@@ -1678,6 +6477,26 @@ func Test_isPrivateOrLocal(t *testing.T) {
 			ip:   `::ffff:188.0.2.128`,
 			want: false,
 		},
+		{
+			name: "IPv6 6to4",
+			ip:   `2002:c000:204::1`,
+			want: true,
+		},
+		{
+			name: "IPv6 Teredo",
+			ip:   `2001:0:4136:e378:8000:63bf:3fff:fdd2`,
+			want: true,
+		},
+		{
+			name: "IPv4 carrier-grade NAT",
+			ip:   `100.64.0.1`,
+			want: true,
+		},
+		{
+			name: "Non-local IPv6",
+			ip:   `2607:f8b0:4004:83f::200e`,
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1685,10 +6504,141 @@ func Test_isPrivateOrLocal(t *testing.T) {
 			if ip == nil {
 				t.Fatalf("net.ParseIP failed; bad test input")
 			}
-			if got := isPrivateOrLocal(ip); got != tt.want {
-				t.Fatalf("isPrivateOrLocal() = %v, want %v", got, tt.want)
+			if got := IsPrivateOrLocal(ip); got != tt.want {
+				t.Fatalf("IsPrivateOrLocal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPInRanges(t *testing.T) {
+	ranges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::/32", "3.3.3.3")
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"3.3.3.3", true},
+		{"3.3.3.4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := IPInRanges(net.ParseIP(tt.ip), ranges); got != tt.want {
+				t.Fatalf("IPInRanges(%q) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	if IPInRanges(net.ParseIP("10.1.2.3"), nil) {
+		t.Fatalf("IPInRanges with no ranges returned true")
+	}
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	ranges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::/32", "fe80::/10")
+
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{"10.1.2.3", true},
+		{"10.1.2.3:1234", true},
+		{"[::ffff:10.1.2.3]:1234", true},
+		{"11.1.2.3:1234", false},
+		{"[2001:db8::1%eth0]:1234", true},
+		{"[fe80::1%eth0]:1234", true},
+		{"fe80::1%3", true},
+		{"2001:db8::1", true},
+		{"[2001:db9::1]:1234", false},
+		{"nope", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			if got := IsTrustedProxy(tt.remoteAddr, ranges); got != tt.want {
+				t.Fatalf("IsTrustedProxy(%q) = %v, want %v", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+
+	if IsTrustedProxy("10.1.2.3:1234", nil) {
+		t.Fatalf("IsTrustedProxy with no ranges returned true")
+	}
+}
+
+func TestPrivateAndLocalRanges(t *testing.T) {
+	got := PrivateAndLocalRanges()
+	if !reflect.DeepEqual(got, privateAndLocalRanges) {
+		t.Fatalf("PrivateAndLocalRanges() = %v, want %v", got, privateAndLocalRanges)
+	}
+
+	// Modifying the result must not modify the internal ranges
+	got[0].IP[0] = 99
+	got[1] = mustParseCIDR("1.1.1.1/32")
+	if IsPrivateOrLocal(net.ParseIP("1.1.1.1")) || !IsPrivateOrLocal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("PrivateAndLocalRanges() result modification changed internal ranges")
+	}
+
+	// It should be usable as trusted ranges
+	strat, err := NewRightmostTrustedRangeStrategy("X-Forwarded-For", PrivateAndLocalRanges())
+	if err != nil {
+		t.Fatalf("NewRightmostTrustedRangeStrategy error: %v", err)
+	}
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 192.168.1.1, 10.0.0.1"}}
+	if got := strat.ClientIP(headers, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+}
+
+func TestReservedRanges(t *testing.T) {
+	got := ReservedRanges()
+	if !reflect.DeepEqual(got, reservedRanges) {
+		t.Fatalf("ReservedRanges() = %v, want %v", got, reservedRanges)
+	}
+
+	// Modifying the result must not modify the internal ranges
+	got[0].IP[0] = 99
+	got[1] = mustParseCIDR("1.1.1.1/32")
+	if isReserved(net.ParseIP("1.1.1.1")) || !isReserved(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("ReservedRanges() result modification changed internal ranges")
+	}
+}
+
+func TestJoinHostZone(t *testing.T) {
+	tests := []struct {
+		host, zone, port string
+		want             string
+		wantWithPort     string
+	}{
+		{"fe80::1", "eth0", "4711", "fe80::1%eth0", "[fe80::1%eth0]:4711"},
+		{"fe80::1", "", "4711", "fe80::1", "[fe80::1]:4711"},
+		{"1.1.1.1", "", "80", "1.1.1.1", "1.1.1.1:80"},
+		{"1.1.1.1", "eth0", "", "1.1.1.1%eth0", "1.1.1.1%eth0"},
+		{"fe80::1", "eth0", "", "fe80::1%eth0", "fe80::1%eth0"},
+	}
+	for _, tt := range tests {
+		if got := JoinHostZone(tt.host, tt.zone); got != tt.want {
+			t.Fatalf("JoinHostZone(%q, %q) = %q, want %q", tt.host, tt.zone, got, tt.want)
+		}
+		if host, zone := SplitHostZone(tt.want); host != tt.host || zone != tt.zone {
+			t.Fatalf("SplitHostZone(%q) = (%q, %q), want (%q, %q)", tt.want, host, zone, tt.host, tt.zone)
+		}
+
+		got := JoinHostPortZone(tt.host, tt.zone, tt.port)
+		if got != tt.wantWithPort {
+			t.Fatalf("JoinHostPortZone(%q, %q, %q) = %q, want %q", tt.host, tt.zone, tt.port, got, tt.wantWithPort)
+		}
+		if tt.port != "" {
+			// The result must be usable by the strategies
+			if ipAddr, err := ParseIPAddr(got); err != nil || ipAddr.String() != tt.want {
+				t.Fatalf("ParseIPAddr(%q) = (%v, %v), want %q", got, ipAddr, err, tt.want)
 			}
-		})
+		}
 	}
 }
 
@@ -1876,6 +6826,21 @@ func Test_parseForwardedListItem(t *testing.T) {
 			fwd:  "ads\x00jkl&#*(383fdljk",
 			want: nil,
 		},
+		{
+			name: "Other directives with equal signs in values",
+			fwd:  `ext=abc==;host="a=b";for=1.1.1.1;by=_x==`,
+			want: mustParseIPAddrPtr("1.1.1.1"),
+		},
+		{
+			name: "Error: equal sign in quoted for value",
+			fwd:  `for="x=y"`,
+			want: nil,
+		},
+		{
+			name: "Error: padded for value",
+			fwd:  `for=1.1.1.1==`,
+			want: nil,
+		},
 		{
 			// Per RFC 7230 section 3.2.6, this should not be an error, but we don't have
 			// full syntax support yet.
@@ -1909,8 +6874,466 @@ func Test_parseForwardedListItem(t *testing.T) {
 	}
 }
 
+// Ensure that IPv6 addresses with embedded dotted-quad IPv4 addresses are normalized the
+// same way in the X-Forwarded-For and Forwarded paths.
+func Test_parseStrictForwardedListItem(t *testing.T) {
+	tests := []struct {
+		fwd         string
+		wantLenient string
+		wantStrict  string
+	}{
+		// Conforming values are the same in both modes
+		{`for=1.1.1.1`, "1.1.1.1", "1.1.1.1"},
+		{`for="1.1.1.1"`, "1.1.1.1", "1.1.1.1"},
+		{`for="1.1.1.1:4711"`, "1.1.1.1", "1.1.1.1"},
+		{`for="1.1.1.1:_hidden-port.1"`, "1.1.1.1", "1.1.1.1"},
+		{`for="[2001:db8:cafe::17]"`, "2001:db8:cafe::17", "2001:db8:cafe::17"},
+		{`For="[2001:db8:cafe::17]:4711";proto=https`, "2001:db8:cafe::17", "2001:db8:cafe::17"},
+		{`for="[::ffff:1.1.1.1]"`, "1.1.1.1", "1.1.1.1"},
+		{`for=unknown`, "", ""},
+		{`for=_hidden`, "", ""},
+		{`by=1.1.1.1`, "", ""},
+
+		// Divergences: these are only accepted by the lenient parser
+		{`for=1.1.1.1:4711`, "1.1.1.1", ""},                       // port without quotes
+		{`for="2001:db8:cafe::17"`, "2001:db8:cafe::17", ""},      // IPv6 without brackets
+		{`for=2001:db8:cafe::17`, "2001:db8:cafe::17", ""},        // IPv6 without brackets or quotes
+		{`for=[2001:db8:cafe::17]`, "2001:db8:cafe::17", ""},      // IPv6 without quotes
+		{`for=[2001:db8:cafe::17]:4711`, "2001:db8:cafe::17", ""}, // IPv6 and port without quotes
+		{`for="[1.1.1.1]"`, "1.1.1.1", ""},                        // IPv4 in brackets
+		{`for="[1.1.1.1]:4711"`, "1.1.1.1", ""},                   // IPv4 in brackets with port
+		{`for="1.1.1.1:nope"`, "1.1.1.1", ""},                     // non-numeric port
+		{`for="1.1.1.1:123456"`, "1.1.1.1", ""},                   // port too long
+		{`for="1.1.1.1:_"`, "1.1.1.1", ""},                        // empty obfuscated port
+		{`for="[2001:db8:cafe::17]:"`, "2001:db8:cafe::17", ""},   // empty port
+		{`for="[fe80::1%eth0]"`, "fe80::1%eth0", ""},              // zone
+		{`for="1.1.1.1%eth0"`, "1.1.1.1%eth0", ""},                // IPv4 zone
+		{`for="[2001:db8:cafe::17]x"`, "", ""},                    // junk after brackets
+		{`for="[2001:db8:cafe::17"`, "", ""},                      // unmatched bracket
+	}
+	for _, tt := range tests {
+		t.Run(tt.fwd, func(t *testing.T) {
+			lenient, strict := "", ""
+			if ipAddr := parseForwardedListItem(tt.fwd); ipAddr != nil {
+				lenient = ipAddr.String()
+			}
+			if ipAddr := parseStrictForwardedListItem(tt.fwd); ipAddr != nil {
+				strict = ipAddr.String()
+			}
+			if lenient != tt.wantLenient || strict != tt.wantStrict {
+				t.Fatalf("got (lenient %q, strict %q), want (%q, %q)", lenient, strict, tt.wantLenient, tt.wantStrict)
+			}
+		})
+	}
+}
+
+func Test_embeddedIPv4Normalization(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{
+			name: "IPv4-mapped IPv6",
+			ip:   "::ffff:188.0.2.128",
+			want: "188.0.2.128",
+		},
+		{
+			name: "IPv4-mapped IPv6 in expanded form",
+			ip:   "0:0:0:0:0:ffff:188.0.2.128",
+			want: "188.0.2.128",
+		},
+		{
+			// The deprecated IPv4-compatible form (RFC 4291 section 2.5.5.1) is not
+			// unwrapped to IPv4; it is a distinct IPv6 address.
+			name: "Deprecated IPv4-compatible IPv6",
+			ip:   "::188.0.2.128",
+			want: "::bc00:280",
+		},
+		{
+			name: "NAT64 IPv4-mapped IPv6",
+			ip:   "64:ff9b::188.0.2.128",
+			want: "64:ff9b::bc00:280",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{
+				"X-Forwarded-For": []string{"1.1.1.1, " + tt.ip},
+				"Forwarded":       []string{`for=1.1.1.1, for="` + tt.ip + `"`},
+			}
+
+			xffList := getIPAddrList(headers, xForwardedForHdr)
+			fwdList := getIPAddrList(headers, forwardedHdr)
+			if len(xffList) != 2 || len(fwdList) != 2 || xffList[1] == nil || fwdList[1] == nil {
+				t.Fatalf("getIPAddrList failed; xff = %v, fwd = %v", xffList, fwdList)
+			}
+
+			if got := xffList[1].String(); got != tt.want {
+				t.Fatalf("X-Forwarded-For IP = %q, want %q", got, tt.want)
+			}
+			if got := fwdList[1].String(); got != tt.want {
+				t.Fatalf("Forwarded IP = %q, want %q", got, tt.want)
+			}
+
+			// The same must be true when coming through a strategy
+			xffStrat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1))
+			fwdStrat := Must(NewRightmostTrustedCountStrategy("Forwarded", 1))
+			if got := xffStrat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("X-Forwarded-For ClientIP = %q, want %q", got, tt.want)
+			}
+			if got := fwdStrat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("Forwarded ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 // Demonstrate parsing deviations from Forwarded header syntax RFCs, particularly
 // RFC 7239 (Forwarded header) and RFC 7230 (HTTP/1.1 syntax) section 3.2.6.
+func Test_splitQuoted(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		sep  byte
+		want []string
+	}{
+		{
+			name: "No quotes",
+			s:    `a, b,c`,
+			sep:  ',',
+			want: []string{`a`, ` b`, `c`},
+		},
+		{
+			name: "Empty",
+			s:    ``,
+			sep:  ',',
+			want: []string{``},
+		},
+		{
+			name: "Separator in quotes",
+			s:    `For="a,b";proto=https, For=2.2.2.2`,
+			sep:  ',',
+			want: []string{`For="a,b";proto=https`, ` For=2.2.2.2`},
+		},
+		{
+			name: "Semicolon in quotes",
+			s:    `For="a;b";proto=https`,
+			sep:  ';',
+			want: []string{`For="a;b"`, `proto=https`},
+		},
+		{
+			name: "Escaped quote in quotes",
+			s:    `x="a\",b",y`,
+			sep:  ',',
+			want: []string{`x="a\",b"`, `y`},
+		},
+		{
+			name: "Unbalanced quotes fall back to plain split",
+			s:    `For="1.1.1.1, For=2.2.2.2`,
+			sep:  ',',
+			want: []string{`For="1.1.1.1`, ` For=2.2.2.2`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitQuoted(tt.s, tt.sep); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitQuoted() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getIPAddrList_forwardedQuoting(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   []*net.IPAddr
+	}{
+		{
+			name:   "Comma in quoted obfuscated identifier",
+			header: `For="a,b";proto=https, For=2.2.2.2`,
+			want:   []*net.IPAddr{nil, mustParseIPAddrPtr("2.2.2.2")},
+		},
+		{
+			name:   "Comma and semicolon in quoted extension value",
+			header: `For=1.1.1.1;ext="x,y;z=w", For="[2001:db8::1]:4711"`,
+			want:   []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2001:db8::1")},
+		},
+		{
+			name:   "Quoted string spanning would-be items",
+			header: `For="1.1.1.1, For=2.2.2.2, For=3.3.3.3", For="4.4.4.4"`,
+			want:   []*net.IPAddr{nil, mustParseIPAddrPtr("4.4.4.4")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"Forwarded": []string{tt.header}}
+			if got := getIPAddrList(headers, forwardedHdr); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("getIPAddrList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseXFFAndForwardedString(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	tests := []struct {
+		name      string
+		xff       string
+		forwarded string
+		want      []*net.IPAddr
+	}{
+		{
+			name:      "Empty",
+			xff:       ``,
+			forwarded: ``,
+			want:      nil,
+		},
+		{
+			name:      "Valid",
+			xff:       `1.1.1.1, [2001:db8::1%eth0]:4711`,
+			forwarded: `For=1.1.1.1, For="[2001:db8::1%eth0]:4711"`,
+			want:      []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2001:db8::1%eth0")},
+		},
+		{
+			name:      "Invalid and empty items",
+			xff:       `, nope, unknown,, 3.3.3.3,`,
+			forwarded: `, For=nope, For=unknown,, For=3.3.3.3,`,
+			want:      []*net.IPAddr{nil, nil, mustParseIPAddrPtr("3.3.3.3")},
+		},
+		{
+			name:      "Too many items",
+			xff:       strings.Repeat("1.1.1.1,", MaxListItems) + "2.2.2.2",
+			forwarded: strings.Repeat("For=1.1.1.1,", MaxListItems) + "For=2.2.2.2",
+			want:      nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseXFFString(tt.xff); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseXFFString() = %v, want %v", got, tt.want)
+			}
+			if got := ParseForwardedString(tt.forwarded); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseForwardedString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseListHeader(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	headers := http.Header{
+		"X-Forwarded-For": []string{`1.1.1.1, nope`, `2.2.2.2`},
+		"Forwarded":       []string{`for=3.3.3.3`, `For="[2001:db8::1]:4711"`},
+	}
+
+	got := ParseListHeader(headers, "x-forwarded-for")
+	if want := []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), nil, mustParseIPAddrPtr("2.2.2.2")}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseListHeader(X-Forwarded-For) = %v, want %v", got, want)
+	}
+
+	got = ParseListHeader(headers, "Forwarded")
+	if want := []*net.IPAddr{mustParseIPAddrPtr("3.3.3.3"), mustParseIPAddrPtr("2001:db8::1")}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseListHeader(Forwarded) = %v, want %v", got, want)
+	}
+
+	if got := ParseListHeader(headers, "X-Original-Forwarded-For"); got != nil {
+		t.Fatalf("ParseListHeader(missing) = %v, want nil", got)
+	}
+}
+
+func TestLeftmostRightmost(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       http.Header
+		headerName    string
+		wantLeftmost  string
+		wantRightmost string
+	}{
+		{
+			name:          "XFF",
+			headers:       http.Header{"X-Forwarded-For": []string{`nope, [::ffff:1.1.1.1]:4711, 10.0.0.1`, `fe80::1%eth0, unknown`}},
+			headerName:    "x-forwarded-for",
+			wantLeftmost:  "1.1.1.1",
+			wantRightmost: "fe80::1%eth0",
+		},
+		{
+			name:          "Forwarded",
+			headers:       http.Header{"Forwarded": []string{`for=unknown, for="[2600:1f18::99]:80";proto=https, For=2.2.2.2, by=3.3.3.3`}},
+			headerName:    "Forwarded",
+			wantLeftmost:  "2600:1f18::99",
+			wantRightmost: "2.2.2.2",
+		},
+		{
+			name:          "One valid IP",
+			headers:       http.Header{"X-Forwarded-For": []string{`nope, 3.3.3.3, 0.0.0.0`}},
+			headerName:    "X-Forwarded-For",
+			wantLeftmost:  "3.3.3.3",
+			wantRightmost: "3.3.3.3",
+		},
+		{
+			name:          "No valid IPs",
+			headers:       http.Header{"X-Forwarded-For": []string{`nope, unknown`}},
+			headerName:    "X-Forwarded-For",
+			wantLeftmost:  "",
+			wantRightmost: "",
+		},
+		{
+			name:          "No header",
+			headers:       http.Header{},
+			headerName:    "X-Forwarded-For",
+			wantLeftmost:  "",
+			wantRightmost: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leftmost, rightmost := LeftmostRightmost(tt.headers, tt.headerName)
+			if leftmost != tt.wantLeftmost || rightmost != tt.wantRightmost {
+				t.Fatalf("LeftmostRightmost = (%q, %q), want (%q, %q)", leftmost, rightmost, tt.wantLeftmost, tt.wantRightmost)
+			}
+
+			// The results are the same as the strategies'
+			if got := Must(NewLeftmostStrategy(tt.headerName)).ClientIP(tt.headers, ""); got != leftmost {
+				t.Fatalf("LeftmostStrategy = %q, but leftmost = %q", got, leftmost)
+			}
+			if got := Must(NewRightmostStrategy(tt.headerName)).ClientIP(tt.headers, ""); got != rightmost {
+				t.Fatalf("RightmostStrategy = %q, but rightmost = %q", got, rightmost)
+			}
+		})
+	}
+}
+
+func TestUniqueIPs(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []*net.IPAddr
+		want  []string
+	}{
+		{
+			name:  "Empty",
+			addrs: nil,
+			want:  []string{},
+		},
+		{
+			name:  "No duplicates",
+			addrs: ParseXFFString(`1.1.1.1, 2.2.2.2, 2600:1f18::99`),
+			want:  []string{"1.1.1.1", "2.2.2.2", "2600:1f18::99"},
+		},
+		{
+			name:  "Duplicates, first kept",
+			addrs: ParseXFFString(`1.1.1.1, 2.2.2.2, 1.1.1.1, 3.3.3.3, 2.2.2.2`),
+			want:  []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+		},
+		{
+			name:  "Normalized forms",
+			addrs: ParseXFFString(`1.1.1.1, ::ffff:1.1.1.1, 2600:1f18::99, 2600:1f18:0:0:0:0:0:99`),
+			want:  []string{"1.1.1.1", "2600:1f18::99"},
+		},
+		{
+			name:  "Zones differ",
+			addrs: ParseXFFString(`fe80::1%eth0, fe80::1%eth1, fe80::1, fe80::1%eth0`),
+			want:  []string{"fe80::1%eth0", "fe80::1%eth1", "fe80::1"},
+		},
+		{
+			name:  "Invalid items dropped",
+			addrs: ParseXFFString(`nope, 1.1.1.1, unknown, 1.1.1.1`),
+			want:  []string{"1.1.1.1"},
+		},
+		{
+			name: "Across headers",
+			addrs: append(ParseXFFString(`1.1.1.1, 2.2.2.2`),
+				ParseForwardedString(`for=1.1.1.1, for=2.2.2.2, for=3.3.3.3`)...),
+			want: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, addr := range UniqueIPs(tt.addrs) {
+				got = append(got, addr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("UniqueIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_parserConsistency checks that an address is accepted or rejected the same way,
+// regardless of which header (or function) it is parsed from, so that the parsers can't
+// drift apart.
+func Test_parserConsistency(t *testing.T) {
+	tests := []struct {
+		name string
+		// addr is the address as it would appear in a single-IP or XFF header; for the
+		// Forwarded header, it is quoted
+		addr string
+		want string
+	}{
+		{"IPv4", "1.1.1.1", "1.1.1.1"},
+		{"IPv4 with port", "1.1.1.1:4711", "1.1.1.1"},
+		{"IPv4 with brackets and port", "[1.1.1.1]:4711", "1.1.1.1"},
+		{"IPv6", "2607:f8b0:4004:83f::200e", "2607:f8b0:4004:83f::200e"},
+		{"IPv6 with brackets and port", "[2607:f8b0:4004:83f::200e]:4711", "2607:f8b0:4004:83f::200e"},
+		{"IPv6 with brackets and no port", "[2607:f8b0:4004:83f::200e]", "2607:f8b0:4004:83f::200e"},
+		{"IPv6 with zone, brackets and no port", "[fe80::1%eth0]", "fe80::1%eth0"},
+		{"IPv4-mapped with brackets and no port", "[::ffff:1.1.1.1]", "1.1.1.1"},
+		{"Error: unmatched bracket", "[2607:f8b0:4004:83f::200e", ""},
+		{"Error: empty brackets", "[]", ""},
+		{"Error: unspecified with brackets", "[::]", ""},
+		{"Error: garbage", "nope", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+
+			if ipAddr := goodIPAddr(tt.addr); ipAddr != nil {
+				got["goodIPAddr"] = ipAddr.String()
+			} else {
+				got["goodIPAddr"] = ""
+			}
+
+			got["SingleIPHeaderStrategy"] = Must(NewSingleIPHeaderStrategy("X-Real-IP")).ClientIP(
+				http.Header{"X-Real-Ip": []string{tt.addr}}, "")
+			got["RemoteAddrStrategy"] = RemoteAddrStrategy{}.ClientIP(nil, tt.addr)
+			got["ParseXFFString"] = ""
+			if ipAddrs := ParseXFFString("3.3.3.3, " + tt.addr); len(ipAddrs) == 2 && ipAddrs[1] != nil {
+				got["ParseXFFString"] = ipAddrs[1].String()
+			}
+			got["ParseForwardedString"] = ""
+			if ipAddrs := ParseForwardedString(`for=3.3.3.3, for="` + tt.addr + `"`); len(ipAddrs) == 2 && ipAddrs[1] != nil {
+				got["ParseForwardedString"] = ipAddrs[1].String()
+			}
+
+			got["ParseForwarded"] = ""
+			if elems := ParseForwarded(`for="` + tt.addr + `"`); len(elems) == 1 && elems[0].For != nil {
+				got["ParseForwarded"] = elems[0].For.String()
+			}
+
+			for parser, ip := range got {
+				if ip != tt.want {
+					t.Errorf("%s: got %q, want %q", parser, ip, tt.want)
+				}
+			}
+		})
+	}
+}
+
 func Test_forwardedHeaderRFCDeviations(t *testing.T) {
 	mustParseIPAddrPtr := func(s string) *net.IPAddr {
 		res := MustParseIPAddr(s)
@@ -1926,19 +7349,6 @@ func Test_forwardedHeaderRFCDeviations(t *testing.T) {
 		args args
 		want []*net.IPAddr
 	}{
-		{
-			// The value in quotes should be a single value but we split by comma, so it's not.
-			// The first and third "For=" bits have one double-quote in them, so they are
-			// considered invalid by our parser. The second is still in the quoted-string,
-			// but doesn't have any quotes in it, so it parses okay.
-			name: "Comma in quotes",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For="1.1.1.1, For=2.2.2.2, For=3.3.3.3", For="4.4.4.4"`}},
-				headerName: "Forwarded",
-			},
-			// There are really only two values, so we actually want: {nil, "4.4.4.4"}
-			want: []*net.IPAddr{nil, mustParseIPAddrPtr("2.2.2.2"), nil, mustParseIPAddrPtr("4.4.4.4")},
-		},
 		{
 			// Per 7239, the opening unmatched quote makes the whole rest of the header invalid.
 			// But that would mean that an attacker can invalidate the whole header with a
@@ -2040,3 +7450,105 @@ func Test_forwardedHeaderRFCDeviations(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkRightmostNonPrivateStrategy(b *testing.B) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	benchmarks := []struct {
+		name string
+		xff  []string
+	}{
+		// The single-IP case is by far the most common, and takes a fast path
+		{"Single IP", []string{`1.1.1.1`}},
+		{"Multiple IPs", []string{`1.1.1.1, 2.2.2.2, 10.0.0.1`}},
+		{"Multiple headers", []string{`1.1.1.1`, `2.2.2.2`}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			headers := http.Header{"X-Forwarded-For": bm.xff}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				strat.ClientIP(headers, "")
+			}
+		})
+	}
+}
+
+func BenchmarkRightmostTrustedCountStrategy(b *testing.B) {
+	strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)).(RightmostTrustedCountStrategy)
+
+	// The default limit is lower than this, but the header is still plausible for a
+	// server that raises it
+	defer func(orig int) { MaxListItems = orig }(MaxListItems)
+	MaxListItems = 100
+
+	var ips []string
+	for i := 0; i < 100; i++ {
+		ips = append(ips, fmt.Sprintf("2600:1f18::%x", i))
+	}
+	longXFF := strings.Join(ips, ", ")
+
+	benchmarks := []struct {
+		name string
+		xff  []string
+	}{
+		{"Multiple IPs", []string{`1.1.1.1, 2.2.2.2, 10.0.0.1`}},
+		{"100 IPs", []string{longXFF}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			headers := http.Header{"X-Forwarded-For": bm.xff}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				strat.ClientIP(headers, "")
+			}
+		})
+	}
+
+	// For comparison, the same derivation if every item is parsed, as it was before the
+	// strategy only parsed the target item
+	b.Run("100 IPs, parsing all", func(b *testing.B) {
+		headers := http.Header{"X-Forwarded-For": []string{longXFF}}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = withListItems(headers, strat.headerName, strat.syntax, false, false, func(items []listItem) result {
+				return items[len(items)-strat.trustedCount].result()
+			}).String()
+		}
+	})
+}
+
+func BenchmarkListItems(b *testing.B) {
+	// Multiple items are where pooling the slice matters, as it has to grow to hold them
+	benchmarks := []struct {
+		name string
+		xff  []string
+	}{
+		{"Multiple IPs", []string{`1.1.1.1, 2.2.2.2, 10.0.0.1`}},
+		{"Multiple headers", []string{`1.1.1.1, 2.2.2.2`, `3.3.3.3, 10.0.0.1`}},
+	}
+	for _, bm := range benchmarks {
+		headers := http.Header{"X-Forwarded-For": bm.xff}
+
+		b.Run(bm.name+", pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = withListItems(headers, xForwardedForHdr, HeaderSyntaxAuto, false, false, func(items []listItem) result {
+					return items[len(items)-1].result()
+				})
+			}
+		})
+
+		// For comparison, a new slice for every call, as before the slices were pooled
+		b.Run(bm.name+", unpooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				items, _ := getListItems(headers, xForwardedForHdr, false, false, false)
+				_ = items[len(items)-1].result()
+			}
+		})
+	}
+}